@@ -8,11 +8,12 @@ require (
 	github.com/gorilla/mux v1.6.2
 	github.com/lib/pq v1.2.0
 	github.com/majewsky/xyrillian.css v0.0.0-20191113145857-d07f6dae0faa
-	github.com/mattn/go-sqlite3 v1.11.0 // indirect
+	github.com/mattn/go-sqlite3 v1.14.15
 	github.com/onsi/ginkgo v1.10.2 // indirect
 	github.com/onsi/gomega v1.7.0 // indirect
 	github.com/sapcc/go-bits v0.0.0-20190910095551-3863bd6b4943
 	github.com/ziutek/mymysql v1.5.4 // indirect
+	golang.org/x/crypto v0.0.0-20220214200702-86341886e292
 	google.golang.org/appengine v1.6.5 // indirect
 	gopkg.in/asn1-ber.v1 v1.0.0-20181015200546-f715ec2f112d // indirect
 	gopkg.in/gorp.v2 v2.0.0
@@ -0,0 +1,97 @@
+/*******************************************************************************
+*
+* Copyright 2019 Stefan Majewsky <majewsky@gmx.net>
+*
+* This program is free software: you can redistribute it and/or modify it under
+* the terms of the GNU General Public License as published by the Free Software
+* Foundation, either version 3 of the License, or (at your option) any later
+* version.
+*
+* This program is distributed in the hope that it will be useful, but WITHOUT ANY
+* WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+* A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License along with
+* this program. If not, see <http://www.gnu.org/licenses/>.
+*
+*******************************************************************************/
+
+//Package api contains the JSON API that is served alongside the HTML UI.
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/majewsky/alltag/internal/db"
+	"github.com/majewsky/alltag/internal/metrics"
+)
+
+type handler struct {
+	storage db.Storage
+}
+
+//NewHandler returns a http.Handler serving Alltag's JSON API below /api/v1/.
+func NewHandler(storage db.Storage) http.Handler {
+	h := handler{storage}
+	r := mux.NewRouter()
+	r.Use(metrics.InstrumentRoutes)
+
+	r.Methods("GET").Path("/api/v1/locations").
+		HandlerFunc(h.ListLocations)
+	r.Methods("POST").Path("/api/v1/locations").
+		HandlerFunc(h.CreateLocation)
+	r.Methods("GET").Path("/api/v1/locations/{id:[0-9]+}").
+		HandlerFunc(h.GetLocation)
+	r.Methods("PUT").Path("/api/v1/locations/{id:[0-9]+}").
+		HandlerFunc(h.UpdateLocation)
+	r.Methods("DELETE").Path("/api/v1/locations/{id:[0-9]+}").
+		HandlerFunc(h.DeleteLocation)
+
+	r.Methods("GET").Path("/api/v1/tasks").
+		HandlerFunc(h.ListTasks)
+	r.Methods("POST").Path("/api/v1/tasks").
+		HandlerFunc(h.CreateTask)
+	r.Methods("GET").Path("/api/v1/tasks/{id:[0-9]+}").
+		HandlerFunc(h.GetTask)
+	r.Methods("PUT").Path("/api/v1/tasks/{id:[0-9]+}").
+		HandlerFunc(h.UpdateTask)
+	r.Methods("DELETE").Path("/api/v1/tasks/{id:[0-9]+}").
+		HandlerFunc(h.DeleteTask)
+	r.Methods("GET").Path("/api/v1/tasks/{id:[0-9]+}/locations").
+		HandlerFunc(h.GetTaskLocations)
+	r.Methods("PUT").Path("/api/v1/tasks/{id:[0-9]+}/locations").
+		HandlerFunc(h.SetTaskLocations)
+	r.Methods("POST").Path("/api/v1/tasks/{id:[0-9]+}/close").
+		HandlerFunc(h.CloseTask)
+
+	r.Methods("GET").Path("/api/v1/next-task").
+		HandlerFunc(h.GetNextTask)
+
+	return r
+}
+
+func currentUser(r *http.Request) string {
+	//This header was set by the authentication middleware in main.go.
+	return r.Header.Get("X-Alltag-Username")
+}
+
+//maxRequestBodySize is the maximum size of request bodies. A single task or
+//location is much smaller than this.
+const maxRequestBodySize = 1 << 20
+
+//decodeRequestBody parses the JSON request body into the given target. If
+//the request body is malformed or too large, an error response is written and
+//false is returned.
+func decodeRequestBody(w http.ResponseWriter, r *http.Request, target interface{}) bool {
+	decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxRequestBodySize))
+	decoder.DisallowUnknownFields()
+	err := decoder.Decode(target)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("malformed request body: %s", err.Error()), http.StatusBadRequest)
+		return false
+	}
+	return true
+}
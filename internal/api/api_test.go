@@ -0,0 +1,260 @@
+/*******************************************************************************
+*
+* Copyright 2019 Stefan Majewsky <majewsky@gmx.net>
+*
+* This program is free software: you can redistribute it and/or modify it under
+* the terms of the GNU General Public License as published by the Free Software
+* Foundation, either version 3 of the License, or (at your option) any later
+* version.
+*
+* This program is distributed in the hope that it will be useful, but WITHOUT ANY
+* WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+* A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License along with
+* this program. If not, see <http://www.gnu.org/licenses/>.
+*
+*******************************************************************************/
+
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/majewsky/alltag/internal/date"
+	"github.com/majewsky/alltag/internal/db"
+)
+
+//testClient sends requests to the API handler without going through the
+//network.
+type testClient struct {
+	t       *testing.T
+	handler http.Handler
+}
+
+func newTestClient(t *testing.T, storage db.Storage) testClient {
+	return testClient{t, NewHandler(storage)}
+}
+
+//request sends a request as the given user and checks the response status.
+//If target is not nil, the response body is decoded into it.
+func (c testClient) request(userName, method, path, body string, expectedStatus int, target interface{}) {
+	c.t.Helper()
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	//this is usually done by the authentication middleware in main.go
+	req.Header.Set("X-Alltag-Username", userName)
+	rec := httptest.NewRecorder()
+	c.handler.ServeHTTP(rec, req)
+
+	resp := rec.Result()
+	respBody, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != expectedStatus {
+		c.t.Errorf("%s %s: expected status %d, but got %d: %s",
+			method, path, expectedStatus, resp.StatusCode, respBody)
+		return
+	}
+	if target != nil {
+		err := json.Unmarshal(respBody, target)
+		if err != nil {
+			c.t.Errorf("%s %s: cannot decode response body %q: %s", method, path, respBody, err.Error())
+		}
+	}
+}
+
+//setupStorage creates the locations "Home" and "Office" for alice and
+//"Garden" for bob, and returns their IDs in this order.
+func setupStorage(t *testing.T) (db.Storage, []int64) {
+	t.Helper()
+	storage := db.NewMemoryStorage()
+	var ids []int64
+	for _, location := range []db.Location{
+		{Label: "Home", UserName: "alice"},
+		{Label: "Office", UserName: "alice"},
+		{Label: "Garden", UserName: "bob"},
+	} {
+		location := location
+		err := storage.SaveLocation(&location)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		ids = append(ids, location.ID)
+	}
+	return storage, ids
+}
+
+func TestLocations(t *testing.T) {
+	storage, ids := setupStorage(t)
+	c := newTestClient(t, storage)
+	bobPath := fmt.Sprintf("/api/v1/locations/%d", ids[2])
+
+	var list struct {
+		Locations []Location `json:"locations"`
+	}
+	c.request("alice", "GET", "/api/v1/locations", "", http.StatusOK, &list)
+	if len(list.Locations) != 2 || list.Locations[0].Label != "Home" || list.Locations[1].Label != "Office" {
+		t.Errorf("unexpected locations: %#v", list.Locations)
+	}
+
+	var resp struct {
+		Location Location `json:"location"`
+	}
+	c.request("alice", "POST", "/api/v1/locations", `{"label":"Car"}`, http.StatusCreated, &resp)
+	if resp.Location.ID == 0 || resp.Location.Label != "Car" {
+		t.Errorf("unexpected location: %#v", resp.Location)
+	}
+	path := fmt.Sprintf("/api/v1/locations/%d", resp.Location.ID)
+	c.request("alice", "POST", "/api/v1/locations", `{"label":""}`, http.StatusBadRequest, nil)
+	c.request("alice", "POST", "/api/v1/locations", `{"name":"Car"}`, http.StatusBadRequest, nil)
+	//bodies beyond the size limit are not read completely
+	hugeBody := `{"label":"` + strings.Repeat("x", maxRequestBodySize) + `"}`
+	c.request("alice", "POST", "/api/v1/locations", hugeBody, http.StatusBadRequest, nil)
+
+	c.request("alice", "PUT", path, `{"label":"Bike"}`, http.StatusOK, &resp)
+	if resp.Location.Label != "Bike" {
+		t.Errorf("unexpected location: %#v", resp.Location)
+	}
+	c.request("alice", "GET", path, "", http.StatusOK, &resp)
+	if resp.Location.Label != "Bike" {
+		t.Errorf("location was not updated: %#v", resp.Location)
+	}
+
+	//locations of other users are invisible
+	c.request("alice", "GET", bobPath, "", http.StatusNotFound, nil)
+	c.request("alice", "PUT", bobPath, `{"label":"Mine"}`, http.StatusNotFound, nil)
+	c.request("alice", "DELETE", bobPath, "", http.StatusNotFound, nil)
+
+	c.request("alice", "DELETE", path, "", http.StatusNoContent, nil)
+	c.request("alice", "GET", path, "", http.StatusNotFound, nil)
+}
+
+func TestTaskLifecycle(t *testing.T) {
+	storage, ids := setupStorage(t)
+	c := newTestClient(t, storage)
+	type taskResponse struct {
+		Task Task `json:"task"`
+	}
+
+	//create an unclassified task
+	var resp taskResponse
+	c.request("alice", "POST", "/api/v1/tasks", `{"label":"Do the laundry"}`, http.StatusCreated, &resp)
+	task := resp.Task
+	if task.ID == 0 || task.Label != "Do the laundry" || task.Class != nil || task.DueAt != nil || len(task.LocationIDs) != 0 {
+		t.Errorf("unexpected task: %#v", task)
+	}
+	path := fmt.Sprintf("/api/v1/tasks/%d", task.ID)
+	c.request("alice", "POST", "/api/v1/tasks", `{"label":""}`, http.StatusBadRequest, nil)
+
+	//unclassified tasks cannot be closed
+	c.request("alice", "POST", path+"/close", "", http.StatusConflict, nil)
+
+	//classification requires valid locations of the same user
+	due := date.Now().AddDays(3)
+	classify := func(locationIDs ...int64) string {
+		idsJSON, _ := json.Marshal(locationIDs)
+		return fmt.Sprintf(`{"label":"Do the laundry","class":"physical","initial_priority":1,"final_priority":3,"due_at":"%s","location_ids":%s}`,
+			due.String(), idsJSON)
+	}
+	c.request("alice", "PUT", path, classify(), http.StatusBadRequest, nil)
+	c.request("alice", "PUT", path, classify(ids[2]), http.StatusBadRequest, nil)
+	c.request("alice", "PUT", path, classify(ids[1], ids[0]), http.StatusOK, &resp)
+	task = resp.Task
+	if task.Class == nil || *task.Class != db.TaskClassPhysical || task.DueAt == nil || *task.DueAt != due {
+		t.Errorf("task was not classified: %#v", task)
+	}
+	if len(task.LocationIDs) != 2 || task.LocationIDs[0] != ids[0] || task.LocationIDs[1] != ids[1] {
+		t.Errorf("unexpected location IDs: %v", task.LocationIDs)
+	}
+
+	//tasks of other users are invisible
+	c.request("bob", "GET", path, "", http.StatusNotFound, nil)
+	c.request("bob", "POST", path+"/close", "", http.StatusNotFound, nil)
+
+	//list tasks: the classified task is sorted before the unclassified one
+	var other taskResponse
+	c.request("alice", "POST", "/api/v1/tasks", `{"label":"Call mom"}`, http.StatusCreated, &other)
+	var list struct {
+		Tasks []Task `json:"tasks"`
+	}
+	c.request("alice", "GET", "/api/v1/tasks", "", http.StatusOK, &list)
+	if len(list.Tasks) != 2 || list.Tasks[0].ID != task.ID || list.Tasks[1].ID != other.Task.ID {
+		t.Errorf("unexpected task list: %#v", list.Tasks)
+	} else if len(list.Tasks[0].LocationIDs) != 2 || len(list.Tasks[1].LocationIDs) != 0 {
+		t.Errorf("unexpected location IDs in task list: %#v", list.Tasks)
+	}
+	c.request("bob", "GET", "/api/v1/tasks", "", http.StatusOK, &list)
+	if len(list.Tasks) != 0 {
+		t.Errorf("expected bob to see no tasks, but got %#v", list.Tasks)
+	}
+
+	//next task
+	nextPath := fmt.Sprintf("/api/v1/next-task?location_id=%d", ids[1])
+	resp = taskResponse{}
+	c.request("alice", "GET", nextPath+"&class=physical", "", http.StatusOK, &resp)
+	if resp.Task.ID != task.ID {
+		t.Errorf("expected task %d as next task, but got %#v", task.ID, resp.Task)
+	}
+	c.request("alice", "GET", nextPath+"&class=mental", "", http.StatusNotFound, nil)
+	c.request("alice", "GET", nextPath+"&class=other", "", http.StatusBadRequest, nil)
+	c.request("alice", "GET", "/api/v1/next-task?class=physical", "", http.StatusBadRequest, nil)
+	c.request("bob", "GET", nextPath+"&class=physical", "", http.StatusNotFound, nil)
+
+	//task locations
+	var locs struct {
+		LocationIDs []int64 `json:"location_ids"`
+	}
+	c.request("alice", "PUT", path+"/locations", `{"location_ids":[]}`, http.StatusBadRequest, nil)
+	c.request("alice", "PUT", path+"/locations", fmt.Sprintf(`{"location_ids":[%d]}`, ids[2]), http.StatusBadRequest, nil)
+	c.request("alice", "PUT", path+"/locations", fmt.Sprintf(`{"location_ids":[%d]}`, ids[1]), http.StatusOK, &locs)
+	if len(locs.LocationIDs) != 1 || locs.LocationIDs[0] != ids[1] {
+		t.Errorf("unexpected location IDs: %v", locs.LocationIDs)
+	}
+	locs.LocationIDs = nil
+	c.request("alice", "GET", path+"/locations", "", http.StatusOK, &locs)
+	if len(locs.LocationIDs) != 1 || locs.LocationIDs[0] != ids[1] {
+		t.Errorf("unexpected location IDs: %v", locs.LocationIDs)
+	}
+
+	//locations with open tasks cannot be deleted
+	locationPath := fmt.Sprintf("/api/v1/locations/%d", ids[1])
+	c.request("alice", "DELETE", locationPath, "", http.StatusConflict, nil)
+
+	//closing a task with a new recurrence reschedules it
+	c.request("alice", "POST", path+"/close", `{"recurrence_days":-1}`, http.StatusBadRequest, nil)
+	resp = taskResponse{}
+	c.request("alice", "POST", path+"/close", `{"recurrence_days":7}`, http.StatusOK, &resp)
+	task = resp.Task
+	if task.ClosedAt != nil || task.RecurrenceDays != 7 || task.StartsAt == nil || *task.StartsAt != date.Now().AddDays(7) {
+		t.Errorf("task was not rescheduled: %#v", task)
+	}
+
+	//closing it without recurrence closes it for good
+	resp = taskResponse{}
+	c.request("alice", "POST", path+"/close", `{"recurrence_days":0}`, http.StatusOK, &resp)
+	if resp.Task.ClosedAt == nil {
+		t.Errorf("task was not closed: %#v", resp.Task)
+	}
+	completions, err := storage.ListTaskCompletions("alice", time.Now().Add(-time.Hour))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(completions) != 2 {
+		t.Errorf("expected 2 task completions, but got %d", len(completions))
+	}
+	c.request("alice", "POST", path+"/close", "", http.StatusConflict, nil)
+	c.request("alice", "PUT", path, `{"label":"Do it again"}`, http.StatusConflict, nil)
+	c.request("alice", "GET", path, "", http.StatusOK, nil)
+	c.request("alice", "DELETE", locationPath, "", http.StatusNoContent, nil)
+
+	//delete tasks
+	otherPath := fmt.Sprintf("/api/v1/tasks/%d", other.Task.ID)
+	c.request("bob", "DELETE", otherPath, "", http.StatusNotFound, nil)
+	c.request("alice", "DELETE", otherPath, "", http.StatusNoContent, nil)
+	c.request("alice", "GET", otherPath, "", http.StatusNotFound, nil)
+}
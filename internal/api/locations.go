@@ -0,0 +1,164 @@
+/*******************************************************************************
+*
+* Copyright 2019 Stefan Majewsky <majewsky@gmx.net>
+*
+* This program is free software: you can redistribute it and/or modify it under
+* the terms of the GNU General Public License as published by the Free Software
+* Foundation, either version 3 of the License, or (at your option) any later
+* version.
+*
+* This program is distributed in the hope that it will be useful, but WITHOUT ANY
+* WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+* A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License along with
+* this program. If not, see <http://www.gnu.org/licenses/>.
+*
+*******************************************************************************/
+
+package api
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+	"github.com/majewsky/alltag/internal/db"
+	"github.com/sapcc/go-bits/respondwith"
+)
+
+//Location is the JSON representation of db.Location.
+type Location struct {
+	ID    int64  `json:"id"`
+	Label string `json:"label"`
+}
+
+//LocationRequest is the request body for creating or updating a location.
+type LocationRequest struct {
+	Label string `json:"label"`
+}
+
+func renderLocation(location db.Location) Location {
+	return Location{ID: location.ID, Label: location.Label}
+}
+
+//checkLocationIDs returns an error if one of the given location IDs does not
+//refer to a location of the current user.
+func (h *handler) checkLocationIDs(r *http.Request, locationIDs []int64) error {
+	locations, err := h.storage.ListLocations(currentUser(r))
+	if err != nil {
+		return err
+	}
+	isValidLocationID := make(map[int64]bool)
+	for _, loc := range locations {
+		isValidLocationID[loc.ID] = true
+	}
+	for _, id := range locationIDs {
+		if !isValidLocationID[id] {
+			return fmt.Errorf("invalid location ID: %d", id)
+		}
+	}
+	return nil
+}
+
+func (h *handler) findLocationFromRequest(w http.ResponseWriter, r *http.Request) *db.Location {
+	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if respondwith.ErrorText(w, err) {
+		return nil
+	}
+	location, err := h.storage.FindLocation(currentUser(r), id)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return nil
+	}
+	if respondwith.ErrorText(w, err) {
+		return nil
+	}
+	return location
+}
+
+func (h *handler) ListLocations(w http.ResponseWriter, r *http.Request) {
+	locations, err := h.storage.ListLocations(currentUser(r))
+	if respondwith.ErrorText(w, err) {
+		return
+	}
+	result := make([]Location, len(locations))
+	for idx, location := range locations {
+		result[idx] = renderLocation(location)
+	}
+	respondwith.JSON(w, http.StatusOK, map[string]interface{}{"locations": result})
+}
+
+func (h *handler) CreateLocation(w http.ResponseWriter, r *http.Request) {
+	var req LocationRequest
+	if !decodeRequestBody(w, r, &req) {
+		return
+	}
+	if req.Label == "" {
+		http.Error(w, "label may not be empty", http.StatusBadRequest)
+		return
+	}
+
+	location := db.Location{Label: req.Label, UserName: currentUser(r)}
+	err := h.storage.SaveLocation(&location)
+	if respondwith.ErrorText(w, err) {
+		return
+	}
+	respondwith.JSON(w, http.StatusCreated, map[string]interface{}{"location": renderLocation(location)})
+}
+
+func (h *handler) GetLocation(w http.ResponseWriter, r *http.Request) {
+	location := h.findLocationFromRequest(w, r)
+	if location == nil {
+		return
+	}
+	respondwith.JSON(w, http.StatusOK, map[string]interface{}{"location": renderLocation(*location)})
+}
+
+func (h *handler) UpdateLocation(w http.ResponseWriter, r *http.Request) {
+	location := h.findLocationFromRequest(w, r)
+	if location == nil {
+		return
+	}
+	var req LocationRequest
+	if !decodeRequestBody(w, r, &req) {
+		return
+	}
+	if req.Label == "" {
+		http.Error(w, "label may not be empty", http.StatusBadRequest)
+		return
+	}
+
+	location.Label = req.Label
+	err := h.storage.SaveLocation(location)
+	if respondwith.ErrorText(w, err) {
+		return
+	}
+	respondwith.JSON(w, http.StatusOK, map[string]interface{}{"location": renderLocation(*location)})
+}
+
+func (h *handler) DeleteLocation(w http.ResponseWriter, r *http.Request) {
+	location := h.findLocationFromRequest(w, r)
+	if location == nil {
+		return
+	}
+
+	//like in the UI, locations can only be deleted once they do not have any
+	//open tasks anymore
+	tasks, err := h.storage.ListOpenTasksAtLocation(currentUser(r), location.ID)
+	if respondwith.ErrorText(w, err) {
+		return
+	}
+	if len(tasks) > 0 {
+		http.Error(w, "cannot delete location that still has tasks", http.StatusConflict)
+		return
+	}
+
+	err = h.storage.DeleteLocation(location)
+	if respondwith.ErrorText(w, err) {
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
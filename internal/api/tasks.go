@@ -0,0 +1,427 @@
+/*******************************************************************************
+*
+* Copyright 2019 Stefan Majewsky <majewsky@gmx.net>
+*
+* This program is free software: you can redistribute it and/or modify it under
+* the terms of the GNU General Public License as published by the Free Software
+* Foundation, either version 3 of the License, or (at your option) any later
+* version.
+*
+* This program is distributed in the hope that it will be useful, but WITHOUT ANY
+* WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+* A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License along with
+* this program. If not, see <http://www.gnu.org/licenses/>.
+*
+*******************************************************************************/
+
+package api
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/majewsky/alltag/internal/date"
+	"github.com/majewsky/alltag/internal/db"
+	"github.com/majewsky/alltag/internal/rrule"
+	"github.com/sapcc/go-bits/respondwith"
+)
+
+//Task is the JSON representation of db.Task. For unclassified tasks, Class,
+//StartsAt and DueAt are null.
+type Task struct {
+	ID                    int64         `json:"id"`
+	Label                 string        `json:"label"`
+	Notes                 string        `json:"notes"`
+	Class                 *db.TaskClass `json:"class"`
+	InitialPriority       uint16        `json:"initial_priority"`
+	FinalPriority         uint16        `json:"final_priority"`
+	RecurrenceDays        int32         `json:"recurrence_days"`
+	RecurrenceFromDueDate bool          `json:"recurrence_from_due_date"`
+	RecurrenceRule        *rrule.Rule   `json:"recurrence_rule"`
+	StartsAt              *date.Date    `json:"starts_at"`
+	DueAt                 *date.Date    `json:"due_at"`
+	ClosedAt              *date.Date    `json:"closed_at,omitempty"`
+	PredecessorID         *int64        `json:"predecessor_id,omitempty"`
+	LocationIDs           []int64       `json:"location_ids"`
+}
+
+//TaskRequest is the request body for creating or updating a task. When Class
+//is null, only the label (and the notes, if given) is written. Otherwise, all
+//other fields except for the notes and the recurrence fields are required,
+//and the task is classified with them.
+type TaskRequest struct {
+	Label                 string        `json:"label"`
+	Notes                 *string       `json:"notes"`
+	Class                 *db.TaskClass `json:"class"`
+	InitialPriority       uint16        `json:"initial_priority"`
+	FinalPriority         uint16        `json:"final_priority"`
+	RecurrenceDays        int32         `json:"recurrence_days"`
+	RecurrenceFromDueDate bool          `json:"recurrence_from_due_date"`
+	RecurrenceRule        *rrule.Rule   `json:"recurrence_rule"`
+	DueAt                 *date.Date    `json:"due_at"`
+	LocationIDs           []int64       `json:"location_ids"`
+}
+
+//TaskLocationsRequest is the request body for setting the locations of a task.
+type TaskLocationsRequest struct {
+	LocationIDs []int64 `json:"location_ids"`
+}
+
+//CloseTaskRequest is the (optional) request body for closing a task. If
+//RecurrenceDays or RecurrenceRule is given, it replaces the recurrence of the
+//task before closing it, like the respective fields in the UI.
+//RecurrenceFromDueDate is only considered together with RecurrenceDays.
+type CloseTaskRequest struct {
+	RecurrenceDays        *int32      `json:"recurrence_days"`
+	RecurrenceFromDueDate bool        `json:"recurrence_from_due_date"`
+	RecurrenceRule        *rrule.Rule `json:"recurrence_rule"`
+}
+
+//renderTasks converts the given tasks into their JSON representation.
+func (h *handler) renderTasks(r *http.Request, tasks []db.Task) ([]Task, error) {
+	//when rendering a single task, only load the locations of that task
+	var locationIDs map[int64][]int64
+	if len(tasks) == 1 {
+		ids, err := h.storage.FindTaskLocations(tasks[0])
+		if err != nil {
+			return nil, err
+		}
+		locationIDs = map[int64][]int64{tasks[0].ID: ids}
+	} else {
+		var err error
+		locationIDs, err = h.storage.ListTaskLocations(currentUser(r))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	result := make([]Task, len(tasks))
+	for idx, task := range tasks {
+		task := task
+		result[idx] = Task{
+			ID:                    task.ID,
+			Label:                 task.Label,
+			Notes:                 task.Notes,
+			Class:                 task.Class,
+			InitialPriority:       task.InitialPriority,
+			FinalPriority:         task.FinalPriority,
+			RecurrenceDays:        task.RecurrenceDays,
+			RecurrenceFromDueDate: task.RecurrenceFromDueDate,
+			RecurrenceRule:        task.RecurrenceRule,
+			ClosedAt:              task.ClosedAt,
+			PredecessorID:         task.PredecessorID,
+			LocationIDs:           locationIDs[task.ID],
+		}
+		if task.IsClassified() {
+			result[idx].StartsAt = &task.StartsAt
+			result[idx].DueAt = &task.DueAt
+		}
+		if result[idx].LocationIDs == nil {
+			result[idx].LocationIDs = []int64{}
+		}
+	}
+	return result, nil
+}
+
+func (h *handler) respondWithTask(w http.ResponseWriter, r *http.Request, code int, task db.Task) {
+	rendered, err := h.renderTasks(r, []db.Task{task})
+	if respondwith.ErrorText(w, err) {
+		return
+	}
+	respondwith.JSON(w, code, map[string]interface{}{"task": rendered[0]})
+}
+
+func (h *handler) findTaskFromRequest(w http.ResponseWriter, r *http.Request) *db.Task {
+	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if respondwith.ErrorText(w, err) {
+		return nil
+	}
+
+	task, err := h.storage.FindTask(currentUser(r), id)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return nil
+	}
+	if respondwith.ErrorText(w, err) {
+		return nil
+	}
+	return task
+}
+
+//findOpenTaskFromRequest is like findTaskFromRequest, but refuses to work on
+//closed tasks.
+func (h *handler) findOpenTaskFromRequest(w http.ResponseWriter, r *http.Request) *db.Task {
+	task := h.findTaskFromRequest(w, r)
+	if task != nil && task.IsClosed() {
+		http.Error(w, "task is closed", http.StatusConflict)
+		return nil
+	}
+	return task
+}
+
+func (h *handler) ListTasks(w http.ResponseWriter, r *http.Request) {
+	tasks, err := h.storage.ListOpenTasks(currentUser(r))
+	if respondwith.ErrorText(w, err) {
+		return
+	}
+	now := time.Now()
+	sort.Slice(tasks, func(i, j int) bool {
+		//note the sign: this sorts into reverse order (i.e. highest current priority on top)
+		return tasks[i].SortOrder(now) > tasks[j].SortOrder(now)
+	})
+
+	result, err := h.renderTasks(r, tasks)
+	if respondwith.ErrorText(w, err) {
+		return
+	}
+	respondwith.JSON(w, http.StatusOK, map[string]interface{}{"tasks": result})
+}
+
+func (h *handler) GetTask(w http.ResponseWriter, r *http.Request) {
+	task := h.findTaskFromRequest(w, r)
+	if task == nil {
+		return
+	}
+	h.respondWithTask(w, r, http.StatusOK, *task)
+}
+
+func (h *handler) CreateTask(w http.ResponseWriter, r *http.Request) {
+	var req TaskRequest
+	if !decodeRequestBody(w, r, &req) {
+		return
+	}
+	task := db.Task{
+		UserName: currentUser(r),
+		StartsAt: date.Epoch, //zero value
+		DueAt:    date.Epoch, //zero value
+	}
+	h.writeTask(w, r, &task, req, http.StatusCreated)
+}
+
+func (h *handler) UpdateTask(w http.ResponseWriter, r *http.Request) {
+	task := h.findOpenTaskFromRequest(w, r)
+	if task == nil {
+		return
+	}
+	var req TaskRequest
+	if !decodeRequestBody(w, r, &req) {
+		return
+	}
+	h.writeTask(w, r, task, req, http.StatusOK)
+}
+
+//writeTask contains the shared implementation of CreateTask and UpdateTask.
+func (h *handler) writeTask(w http.ResponseWriter, r *http.Request, task *db.Task, req TaskRequest, code int) {
+	task.Label = req.Label
+	if task.Label == "" {
+		http.Error(w, "label may not be empty", http.StatusBadRequest)
+		return
+	}
+	if req.Notes != nil {
+		task.Notes = *req.Notes
+	}
+
+	isNew := task.ID == 0
+	wasClassified := task.IsClassified()
+	isClassification := req.Class != nil
+	if isClassification {
+		task.Class = req.Class
+		task.InitialPriority = req.InitialPriority
+		task.FinalPriority = req.FinalPriority
+		task.RecurrenceDays = req.RecurrenceDays
+		task.RecurrenceFromDueDate = req.RecurrenceFromDueDate
+		task.RecurrenceRule = req.RecurrenceRule
+		if task.StartsAt == date.Epoch {
+			//StartsAt is set during initial classification
+			task.StartsAt = date.Now()
+		}
+		if req.DueAt == nil {
+			http.Error(w, "missing due_at", http.StatusBadRequest)
+			return
+		}
+		task.DueAt = *req.DueAt
+
+		err := task.CheckClassification(date.Now())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if len(req.LocationIDs) == 0 {
+			http.Error(w, "need to specify at least one location", http.StatusBadRequest)
+			return
+		}
+		err = h.checkLocationIDs(r, req.LocationIDs)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	//do everything in a transaction to enable easy rollback
+	err := h.storage.Transaction(func(s db.Storage) error {
+		err := s.SaveTask(task)
+		if err != nil {
+			return err
+		}
+		if isClassification {
+			err = s.SetTaskLocations(*task, req.LocationIDs)
+			if err != nil {
+				return err
+			}
+		}
+		if isNew {
+			err = s.EmitTaskEvent(db.WebhookEventTaskCreated, *task)
+			if err != nil {
+				return err
+			}
+		}
+		if isClassification && !wasClassified {
+			return s.EmitTaskEvent(db.WebhookEventTaskClassified, *task)
+		}
+		return nil
+	})
+	if respondwith.ErrorText(w, err) {
+		return
+	}
+
+	h.respondWithTask(w, r, code, *task)
+}
+
+func (h *handler) DeleteTask(w http.ResponseWriter, r *http.Request) {
+	task := h.findTaskFromRequest(w, r)
+	if task == nil {
+		return
+	}
+	err := h.storage.DeleteTask(task)
+	if respondwith.ErrorText(w, err) {
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *handler) GetTaskLocations(w http.ResponseWriter, r *http.Request) {
+	task := h.findTaskFromRequest(w, r)
+	if task == nil {
+		return
+	}
+	rendered, err := h.renderTasks(r, []db.Task{*task})
+	if respondwith.ErrorText(w, err) {
+		return
+	}
+	respondwith.JSON(w, http.StatusOK, map[string]interface{}{"location_ids": rendered[0].LocationIDs})
+}
+
+func (h *handler) SetTaskLocations(w http.ResponseWriter, r *http.Request) {
+	task := h.findOpenTaskFromRequest(w, r)
+	if task == nil {
+		return
+	}
+	var req TaskLocationsRequest
+	if !decodeRequestBody(w, r, &req) {
+		return
+	}
+	if len(req.LocationIDs) == 0 {
+		http.Error(w, "need to specify at least one location", http.StatusBadRequest)
+		return
+	}
+	err := h.checkLocationIDs(r, req.LocationIDs)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	err = h.storage.SetTaskLocations(*task, req.LocationIDs)
+	if respondwith.ErrorText(w, err) {
+		return
+	}
+
+	h.GetTaskLocations(w, r)
+}
+
+func (h *handler) CloseTask(w http.ResponseWriter, r *http.Request) {
+	task := h.findOpenTaskFromRequest(w, r)
+	if task == nil {
+		return
+	}
+	if !task.IsClassified() {
+		http.Error(w, "cannot close unclassified task", http.StatusConflict)
+		return
+	}
+
+	//the request body is optional
+	var req CloseTaskRequest
+	if r.ContentLength != 0 {
+		if !decodeRequestBody(w, r, &req) {
+			return
+		}
+	}
+	if req.RecurrenceDays != nil && req.RecurrenceRule != nil {
+		http.Error(w, "cannot have both recurrence_days and recurrence_rule", http.StatusBadRequest)
+		return
+	}
+	if req.RecurrenceDays != nil {
+		if *req.RecurrenceDays < 0 {
+			msg := fmt.Sprintf("invalid recurrence_days value: %d", *req.RecurrenceDays)
+			http.Error(w, msg, http.StatusBadRequest)
+			return
+		}
+		task.RecurrenceDays = *req.RecurrenceDays
+		task.RecurrenceFromDueDate = req.RecurrenceFromDueDate && *req.RecurrenceDays != 0
+		task.RecurrenceRule = nil
+	}
+	if req.RecurrenceRule != nil {
+		task.RecurrenceDays = 0
+		task.RecurrenceFromDueDate = false
+		task.RecurrenceRule = req.RecurrenceRule
+		_, ok := task.NextOccurrence(date.Now())
+		if !ok {
+			msg := fmt.Sprintf("recurrence rule %q does not match any date", req.RecurrenceRule.String())
+			http.Error(w, msg, http.StatusBadRequest)
+			return
+		}
+	}
+
+	err := h.storage.CloseTask(task)
+	if respondwith.ErrorText(w, err) {
+		return
+	}
+	h.respondWithTask(w, r, http.StatusOK, *task)
+}
+
+func (h *handler) GetNextTask(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	locationID, err := strconv.ParseInt(query.Get("location_id"), 10, 64)
+	if err != nil {
+		msg := fmt.Sprintf("invalid location_id value: %q", query.Get("location_id"))
+		http.Error(w, msg, http.StatusBadRequest)
+		return
+	}
+	class := db.TaskClass(query.Get("class"))
+	if !db.IsTaskClass[class] {
+		msg := fmt.Sprintf("invalid task class: %q", class)
+		http.Error(w, msg, http.StatusBadRequest)
+		return
+	}
+
+	nextTaskIDs, err := h.storage.NextTasks(currentUser(r))
+	if respondwith.ErrorText(w, err) {
+		return
+	}
+	taskID := nextTaskIDs[class][locationID]
+	if taskID == 0 {
+		http.Error(w, "no matching task", http.StatusNotFound)
+		return
+	}
+
+	task, err := h.storage.FindTask(currentUser(r), taskID)
+	if respondwith.ErrorText(w, err) {
+		return
+	}
+	h.respondWithTask(w, r, http.StatusOK, *task)
+}
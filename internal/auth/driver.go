@@ -18,10 +18,99 @@
 
 package auth
 
+import (
+	"errors"
+	"net/http"
+
+	"github.com/majewsky/alltag/internal/metrics"
+)
+
+//ErrForbidden is returned by Driver.CheckLogin when the credentials are
+//correct, but the user is not allowed to use Alltag.
+var ErrForbidden = errors.New("user is not allowed to use Alltag")
+
 //Driver is a generic interface for auth drivers, to ensure a clean separation
 //between this package and the other packages in this codebase.
 type Driver interface {
 	//CheckLogin returns true when the given user exists and has the given
-	//password.
-	CheckLogin(username, password string) bool
+	//password. When the credentials are wrong, false is returned without an
+	//error. When they are correct, but the user is not allowed to use Alltag,
+	//ErrForbidden is returned. Any other error means that the check could not
+	//be performed (e.g. because the LDAP server is unreachable).
+	CheckLogin(username, password string) (bool, error)
+}
+
+//RequestAuthenticator is an optional interface that a Driver can implement
+//when it can identify the user from the request itself, without the user
+//entering credentials.
+type RequestAuthenticator interface {
+	//AuthenticateRequest returns the name of the user making this request, or
+	//false if the request cannot be authenticated in this way.
+	AuthenticateRequest(r *http.Request) (userName string, ok bool)
+}
+
+//RedirectAuthenticator is an optional interface that a Driver can implement
+//when users log in on an external site (e.g. with OpenID Connect) instead of
+//entering credentials into Alltag's login form.
+type RedirectAuthenticator interface {
+	//LoginURL returns the URL of the external login page.
+	LoginURL(flow LoginFlow) (string, error)
+	//CompleteLogin is called when the user returns from the external login page
+	//with an authorization code. It returns the user's name.
+	CompleteLogin(code string, flow LoginFlow) (userName string, err error)
+}
+
+//UserChecker is an optional interface that a Driver can implement when it
+//can check whether a user may (still) use Alltag without knowing their
+//password. This check is done whenever a session is renewed.
+type UserChecker interface {
+	//CheckUser returns true when the given user exists, and false without an
+	//error when it does not. The meaning of errors is the same as for
+	//CheckLogin.
+	CheckUser(userName string) (bool, error)
+}
+
+//MailAddressFinder is an optional interface that a Driver can implement when
+//it knows the email addresses of its users (e.g. from the "mail" attribute in
+//LDAP).
+type MailAddressFinder interface {
+	//FindMailAddress returns the email address of the given user, or an empty
+	//string if the user does not exist or does not have an email address.
+	FindMailAddress(userName string) (string, error)
+}
+
+//DriverName returns the name of the given driver, as in the
+//ALLTAG_AUTH_DRIVER variable.
+func DriverName(driver Driver) string {
+	switch driver.(type) {
+	case *ldapDriver:
+		return "ldap"
+	case *htpasswdDriver:
+		return "htpasswd"
+	case *proxyDriver:
+		return "proxy"
+	case *oidcDriver:
+		return "oidc"
+	default:
+		return "unknown"
+	}
+}
+
+//RecordAuthAttempt records the outcome of an authentication attempt in the
+//metrics. The arguments are interpreted like the return values of
+//Throttler.CheckLogin.
+func RecordAuthAttempt(driver Driver, ok bool, err error) {
+	var throttledErr ThrottledError
+	result := "failure"
+	switch {
+	case errors.As(err, &throttledErr):
+		result = "throttled"
+	case err == ErrForbidden:
+		result = "forbidden"
+	case err != nil:
+		result = "error"
+	case ok:
+		result = "success"
+	}
+	metrics.AuthAttempts.Inc(DriverName(driver), result)
 }
@@ -0,0 +1,167 @@
+/*******************************************************************************
+*
+* Copyright 2019 Stefan Majewsky <majewsky@gmx.net>
+*
+* This program is free software: you can redistribute it and/or modify it under
+* the terms of the GNU General Public License as published by the Free Software
+* Foundation, either version 3 of the License, or (at your option) any later
+* version.
+*
+* This program is distributed in the hope that it will be useful, but WITHOUT ANY
+* WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+* A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License along with
+* this program. If not, see <http://www.gnu.org/licenses/>.
+*
+*******************************************************************************/
+
+package auth
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sapcc/go-bits/logg"
+	"golang.org/x/crypto/bcrypt"
+)
+
+//HtpasswdConfig contains all the configuration options for the htpasswd auth
+//driver.
+type HtpasswdConfig struct {
+	//Path to a file in the format generated by `htpasswd -B`, i.e. one line
+	//"username:bcrypthash" per user.
+	Path string
+}
+
+type htpasswdDriver struct {
+	cfg   HtpasswdConfig
+	mutex *sync.Mutex
+	//the following fields are protected by the mutex
+	hashes    map[string][]byte
+	dummyHash []byte
+	modTime   time.Time
+}
+
+//NewHtpasswdDriver initializes the htpasswd auth driver.
+func NewHtpasswdDriver(cfg HtpasswdConfig) (Driver, error) {
+	d := &htpasswdDriver{cfg: cfg, mutex: &sync.Mutex{}}
+	_, _, err := d.getHashes()
+	return d, err
+}
+
+//getHashes returns the hashes from the htpasswd file, re-reading the file
+//when it has been changed since the last read. The second return value is a
+//hash that can be used to check passwords for nonexisting users (see below in
+//CheckLogin for why).
+func (d *htpasswdDriver) getHashes() (map[string][]byte, []byte, error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	fi, err := os.Stat(d.cfg.Path)
+	if err != nil {
+		return d.hashes, d.dummyHash, err
+	}
+	if d.hashes != nil && fi.ModTime().Equal(d.modTime) {
+		return d.hashes, d.dummyHash, nil
+	}
+
+	buf, err := ioutil.ReadFile(d.cfg.Path)
+	if err != nil {
+		return d.hashes, d.dummyHash, err
+	}
+	hashes, cost, err := parseHtpasswd(buf)
+	if err != nil {
+		return d.hashes, d.dummyHash, fmt.Errorf("cannot parse %s: %s", d.cfg.Path, err.Error())
+	}
+
+	//the dummy hash needs to have the same cost as the actual hashes, so that
+	//checking against it takes as long as checking against an actual hash
+	dummyCost, err := bcrypt.Cost(d.dummyHash)
+	if err != nil || dummyCost != cost {
+		dummyHash, err := bcrypt.GenerateFromPassword([]byte("not a real password"), cost)
+		if err != nil {
+			return d.hashes, d.dummyHash, err
+		}
+		d.dummyHash = dummyHash
+	}
+
+	d.hashes = hashes
+	d.modTime = fi.ModTime()
+	return d.hashes, d.dummyHash, nil
+}
+
+//parseHtpasswd parses the contents of a htpasswd file. Besides the hashes, it
+//returns the most common bcrypt cost among them.
+func parseHtpasswd(buf []byte) (map[string][]byte, int, error) {
+	result := make(map[string][]byte)
+	costCounts := make(map[int]int)
+	scanner := bufio.NewScanner(bytes.NewReader(buf))
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.SplitN(line, ":", 2)
+		if len(fields) != 2 || fields[0] == "" {
+			return nil, 0, fmt.Errorf("line %d: expected \"username:hash\"", lineNo)
+		}
+		userName, hash := fields[0], []byte(fields[1])
+		//only bcrypt is supported; the other hash methods supported by htpasswd
+		//are not secure enough
+		cost, err := bcrypt.Cost(hash)
+		if err != nil {
+			return nil, 0, fmt.Errorf("line %d: password hash for user %q is not a bcrypt hash (use `htpasswd -B` to generate bcrypt hashes)", lineNo, userName)
+		}
+		result[userName] = hash
+		costCounts[cost]++
+	}
+
+	mostCommonCost := bcrypt.DefaultCost
+	for cost, count := range costCounts {
+		if count > costCounts[mostCommonCost] {
+			mostCommonCost = cost
+		}
+	}
+	return result, mostCommonCost, scanner.Err()
+}
+
+func (d *htpasswdDriver) CheckLogin(userName, password string) (bool, error) {
+	hashes, dummyHash, err := d.getHashes()
+	if err != nil {
+		//keep using the previous version of the file, if any
+		logg.Error("cannot reload htpasswd file: %s", err.Error())
+	}
+
+	//If the user does not exist, check the password against a dummy hash
+	//anyway, but record that we're going to fail regardless of the result of
+	//this check. This avoids a timing side-channel, where an attacker could
+	//infer whether a user exists or not from how long a request to Alltag
+	//takes.
+	hash, userExists := hashes[userName]
+	if !userExists {
+		hash = dummyHash
+	}
+	err = bcrypt.CompareHashAndPassword(hash, []byte(password))
+	return err == nil && userExists, nil
+}
+
+//CheckUser implements the UserChecker interface.
+func (d *htpasswdDriver) CheckUser(userName string) (bool, error) {
+	hashes, _, err := d.getHashes()
+	if err != nil {
+		//see above in CheckLogin
+		logg.Error("cannot reload htpasswd file: %s", err.Error())
+	}
+	_, userExists := hashes[userName]
+	return userExists, nil
+}
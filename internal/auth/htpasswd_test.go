@@ -0,0 +1,78 @@
+/*******************************************************************************
+*
+* Copyright 2019 Stefan Majewsky <majewsky@gmx.net>
+*
+* This program is free software: you can redistribute it and/or modify it under
+* the terms of the GNU General Public License as published by the Free Software
+* Foundation, either version 3 of the License, or (at your option) any later
+* version.
+*
+* This program is distributed in the hope that it will be useful, but WITHOUT ANY
+* WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+* A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License along with
+* this program. If not, see <http://www.gnu.org/licenses/>.
+*
+*******************************************************************************/
+
+package auth
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestHtpasswdCheckUser(t *testing.T) {
+	dir, err := ioutil.TempDir("", "alltag-test")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "htpasswd")
+
+	writeFile := func(contents string, modTime time.Time) {
+		t.Helper()
+		err := ioutil.WriteFile(path, []byte(contents), 0600)
+		if err == nil {
+			err = os.Chtimes(path, modTime, modTime)
+		}
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte("correct"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	writeFile("alice:"+string(hash)+"\nbob:"+string(hash)+"\n", time.Now().Add(-time.Hour))
+
+	d, err := NewHtpasswdDriver(HtpasswdConfig{Path: path})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	checker := d.(UserChecker)
+	expectUser := func(userName string, expected bool) {
+		t.Helper()
+		ok, err := checker.CheckUser(userName)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if ok != expected {
+			t.Errorf("expected CheckUser(%q) = %v, got %v", userName, expected, ok)
+		}
+	}
+	expectUser("alice", true)
+	expectUser("bob", true)
+	expectUser("carol", false)
+
+	//when a user is removed from the file, their sessions cannot be renewed
+	writeFile("bob:"+string(hash)+"\n", time.Now())
+	expectUser("alice", false)
+	expectUser("bob", true)
+}
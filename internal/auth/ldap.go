@@ -20,12 +20,15 @@ package auth
 
 import (
 	"crypto/tls"
+	"errors"
 	"fmt"
 	"net"
 	"net/url"
 	"strings"
 	"sync"
+	"time"
 
+	"github.com/majewsky/alltag/internal/metrics"
 	"github.com/sapcc/go-bits/logg"
 	"gopkg.in/ldap.v3"
 )
@@ -37,60 +40,323 @@ type LDAPConfig struct {
 	BindPassword string
 	SearchBaseDN string
 	SearchFilter string
+	//The maximum number of connections to the LDAP server. This many logins can
+	//be checked concurrently.
+	PoolSize int
+	//If not empty, only members of the group with this DN may log in.
+	RequiredGroupDN string
+	//How group membership is checked. If this is "memberOf", the user's
+	//memberOf attribute must contain the RequiredGroupDN. Otherwise, this is
+	//the attribute of the group that lists its members (e.g. "member" or
+	//"uniqueMember"), and it must contain the user's DN. The attribute
+	//"memberUid" (for posixGroup) is special in that it must contain the
+	//username instead of the DN.
+	GroupMemberAttribute string
 }
 
+const (
+	//how long to wait for a response from the LDAP server
+	ldapRequestTimeout = 10 * time.Second
+	//bounds for the delay between reconnection attempts after the LDAP server
+	//has been unreachable
+	ldapMinBackoff = 1 * time.Second
+	ldapMaxBackoff = 1 * time.Minute
+)
+
 type ldapDriver struct {
-	cfg   LDAPConfig
-	conn  *ldap.Conn
+	cfg             LDAPConfig
+	requiredGroupDN *ldap.DN //parsed from cfg.RequiredGroupDN, or nil
+	//Each slot in this pool holds either a connection or nil (when the
+	//connection has not been established yet, or has been dropped because of
+	//an error). withConn takes a slot out of the pool while it works, so the
+	//capacity of this channel limits the number of concurrent connections.
+	pool chan *ldap.Conn
+
 	mutex *sync.Mutex
+	//the following fields are protected by the mutex
+	backoff       time.Duration
+	nextDialAfter time.Time
 }
 
 //NewLDAPDriver initializes the LDAP auth driver.
 func NewLDAPDriver(cfg LDAPConfig) (Driver, error) {
-	conn, err := ldap.DialURL(cfg.ServerURL.String())
+	if cfg.PoolSize < 1 {
+		cfg.PoolSize = 1
+	}
+	if cfg.GroupMemberAttribute == "" {
+		cfg.GroupMemberAttribute = "memberOf"
+	}
+	d := &ldapDriver{
+		cfg:   cfg,
+		pool:  make(chan *ldap.Conn, cfg.PoolSize),
+		mutex: &sync.Mutex{},
+	}
+	if cfg.RequiredGroupDN != "" {
+		var err error
+		d.requiredGroupDN, err = ldap.ParseDN(cfg.RequiredGroupDN)
+		if err != nil {
+			return nil, fmt.Errorf("cannot parse required group DN %q: %s", cfg.RequiredGroupDN, err.Error())
+		}
+	}
+
+	//establish the first connection right away to validate the configuration;
+	//but if the LDAP server is just not reachable right now, start up anyway
+	//and keep trying to connect in the background of CheckLogin
+	conn, err := d.connectWithBackoff()
+	if err != nil {
+		if !ldap.IsErrorWithCode(errors.Unwrap(err), ldap.ErrorNetwork) {
+			return nil, err
+		}
+		logg.Error(err.Error())
+	}
+	d.pool <- conn
+	for idx := 1; idx < cfg.PoolSize; idx++ {
+		d.pool <- nil
+	}
+	return d, nil
+}
+
+//connect establishes a new connection to the LDAP server, and binds as the
+//service user.
+func (d *ldapDriver) connect() (*ldap.Conn, error) {
+	start := time.Now()
+	conn, err := ldap.DialURL(d.cfg.ServerURL.String())
+	metrics.ObserveDuration(metrics.LDAPRequestDuration, start, "dial")
 	if err != nil {
 		return nil, err
 	}
+	conn.SetTimeout(ldapRequestTimeout)
 
-	if cfg.ServerURL.Scheme == "ldap" {
-		host, _, err := net.SplitHostPort(cfg.ServerURL.Host)
+	if d.cfg.ServerURL.Scheme == "ldap" {
+		host, _, err := net.SplitHostPort(d.cfg.ServerURL.Host)
 		if err != nil {
-			host = cfg.ServerURL.Host
+			host = d.cfg.ServerURL.Host
 		}
+		start := time.Now()
 		err = conn.StartTLS(&tls.Config{ServerName: host})
+		metrics.ObserveDuration(metrics.LDAPRequestDuration, start, "starttls")
 		if err != nil {
+			conn.Close()
 			return nil, err
 		}
 	}
 
-	err = conn.Bind(cfg.BindDN, cfg.BindPassword)
-	return &ldapDriver{cfg, conn, &sync.Mutex{}}, err
+	err = ldapBind(conn, d.cfg.BindDN, d.cfg.BindPassword)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
 }
 
-//this list generated with `perl -E 'print chr for 32..126' | tr -d 0-9A-Za-z`
-const allASCIISymbols = " !\"#$%&'()*+,-./:;<=>?@[\\]^_`{|}~"
+//ldapBind and ldapSearch wrap the methods of the same name on ldap.Conn, and
+//record their round-trip times in the metrics.
+func ldapBind(conn *ldap.Conn, userDN, password string) error {
+	defer metrics.ObserveDuration(metrics.LDAPRequestDuration, time.Now(), "bind")
+	return conn.Bind(userDN, password)
+}
+
+func ldapSearch(conn *ldap.Conn, req *ldap.SearchRequest) (*ldap.SearchResult, error) {
+	defer metrics.ObserveDuration(metrics.LDAPRequestDuration, time.Now(), "search")
+	return conn.Search(req)
+}
+
+//connectWithBackoff is like connect, but when previous connection attempts
+//have failed, it refuses to try again until a backoff period has passed.
+//Otherwise, every incoming request would hammer the LDAP server while it is
+//trying to come back up.
+func (d *ldapDriver) connectWithBackoff() (*ldap.Conn, error) {
+	d.mutex.Lock()
+	waitFor := time.Until(d.nextDialAfter)
+	d.mutex.Unlock()
+	if waitFor > 0 {
+		return nil, fmt.Errorf("LDAP server is unavailable (next connection attempt in %s)", waitFor.Round(time.Second))
+	}
+
+	conn, err := d.connect()
 
-func (d *ldapDriver) CheckLogin(userName, password string) bool {
 	d.mutex.Lock()
 	defer d.mutex.Unlock()
+	if err == nil {
+		if d.backoff > 0 {
+			logg.Info("reconnected to LDAP server")
+		}
+		d.backoff = 0
+		return conn, nil
+	}
+
+	switch {
+	case d.backoff == 0:
+		d.backoff = ldapMinBackoff
+	case d.backoff < ldapMaxBackoff:
+		d.backoff *= 2
+		if d.backoff > ldapMaxBackoff {
+			d.backoff = ldapMaxBackoff
+		}
+	}
+	d.nextDialAfter = time.Now().Add(d.backoff)
+	return nil, fmt.Errorf("cannot connect to LDAP server (next attempt in %s): %w", d.backoff, err)
+}
 
+//this list generated with `perl -E 'print chr for 32..126' | tr -d 0-9A-Za-z`
+const allASCIISymbols = " !\"#$%&'()*+,-./:;<=>?@[\\]^_`{|}~"
+
+func (d *ldapDriver) CheckLogin(userName, password string) (bool, error) {
 	//disallow ASCII symbols in username (i.e. all non-ASCII characters are
 	//allowed, but for ASCII, only letters and numbers) to avoid collision with
 	//special characters used in encodings (e.g. LDAP search filter)
 	if strings.ContainsAny(userName, allASCIISymbols) {
-		return false
+		return false, nil
 	}
 
-	sr, err := d.conn.Search(&ldap.SearchRequest{
-		BaseDN:       d.cfg.SearchBaseDN,
-		Scope:        ldap.ScopeWholeSubtree,
-		DerefAliases: ldap.NeverDerefAliases,
-		SizeLimit:    2, //so that we can detect (and fail) when multiple users match
-		Filter:       fmt.Sprintf(d.cfg.SearchFilter, userName),
-		Attributes:   []string{"dn"},
+	var (
+		authOK      bool
+		isForbidden bool
+	)
+	err := d.withConn(func(conn *ldap.Conn) error {
+		var err error
+		authOK, err = d.checkLoginOn(conn, userName, password)
+		//this is a valid result, not a problem with the connection
+		isForbidden = err == ErrForbidden
+		if isForbidden {
+			return nil
+		}
+		return err
 	})
+
+	switch {
+	case isForbidden:
+		return false, ErrForbidden
+	case err == nil, err == errRebindFailed:
+		return authOK, nil
+	default:
+		return false, err
+	}
+}
+
+//FindMailAddress implements the MailAddressFinder interface.
+func (d *ldapDriver) FindMailAddress(userName string) (string, error) {
+	//see comment in CheckLogin
+	if strings.ContainsAny(userName, allASCIISymbols) {
+		return "", nil
+	}
+
+	var address string
+	err := d.withConn(func(conn *ldap.Conn) error {
+		sr, err := ldapSearch(conn, &ldap.SearchRequest{
+			BaseDN:       d.cfg.SearchBaseDN,
+			Scope:        ldap.ScopeWholeSubtree,
+			DerefAliases: ldap.NeverDerefAliases,
+			SizeLimit:    2,
+			Filter:       fmt.Sprintf(d.cfg.SearchFilter, userName),
+			Attributes:   []string{"mail"},
+			TimeLimit:    int(ldapRequestTimeout / time.Second),
+		})
+		switch {
+		case err == nil:
+			if len(sr.Entries) == 1 {
+				address = sr.Entries[0].GetAttributeValue("mail")
+			}
+			return nil
+		case ldap.IsErrorWithCode(err, ldap.LDAPResultSizeLimitExceeded):
+			//more than one user matches, so we do not know which address to use
+			return nil
+		default:
+			return fmt.Errorf("unexpected error while searching in LDAP: %s", err.Error())
+		}
+	})
+	return address, err
+}
+
+//withConn runs the given action on a connection from the pool. An error from
+//the action is taken to mean that the connection is broken, so it is not
+//returned into the pool. The only exception is errRebindFailed, which means
+//that the action has completed and only the connection is broken.
+func (d *ldapDriver) withConn(action func(conn *ldap.Conn) error) error {
+	conn := <-d.pool
+	//the connection in the slot may be nil, or have been closed in the meantime
+	//(e.g. because the LDAP server was restarted)
+	isFreshConn := false
+	if conn != nil && conn.IsClosing() {
+		conn.Close()
+		conn = nil
+	}
+	if conn == nil {
+		var err error
+		conn, err = d.connectWithBackoff()
+		if err != nil {
+			d.pool <- nil
+			return err
+		}
+		isFreshConn = true
+	}
+
+	err := action(conn)
+	//a connection that was idle in the pool may have gone stale without us
+	//noticing, so retry once on a fresh connection before giving up
+	if err != nil && err != errRebindFailed && !isFreshConn {
+		conn.Close()
+		conn, err = d.connectWithBackoff()
+		if err == nil {
+			err = action(conn)
+		}
+	}
+	//do not return broken connections into the pool
+	if err != nil && conn != nil {
+		conn.Close()
+		conn = nil
+	}
+	d.pool <- conn
+	return err
+}
+
+//CheckUser implements the UserChecker interface. Like CheckLogin, it returns
+//ErrForbidden when the user is not a member of the required group (anymore).
+func (d *ldapDriver) CheckUser(userName string) (bool, error) {
+	//see comment in CheckLogin
+	if strings.ContainsAny(userName, allASCIISymbols) {
+		return false, nil
+	}
+
+	var (
+		userExists  bool
+		isForbidden bool
+	)
+	err := d.withConn(func(conn *ldap.Conn) error {
+		sr, err := d.searchUser(conn, userName)
+		if err != nil {
+			return err
+		}
+		userExists = len(sr.Entries) == 1
+		isForbidden = false
+		if userExists && d.requiredGroupDN != nil {
+			isMember, err := d.isGroupMember(conn, sr.Entries[0], userName)
+			if err != nil {
+				return err
+			}
+			isForbidden = !isMember
+		}
+		return nil
+	})
+
+	switch {
+	case err != nil:
+		return false, err
+	case isForbidden:
+		return false, ErrForbidden
+	default:
+		return userExists, nil
+	}
+}
+
+//errRebindFailed is returned by checkLoginOn when the result of the login
+//check is valid, but the connection cannot be used for further checks.
+var errRebindFailed = errors.New("cannot re-bind LDAP service user")
+
+func (d *ldapDriver) checkLoginOn(conn *ldap.Conn, userName, password string) (bool, error) {
+	sr, err := d.searchUser(conn, userName)
 	if err != nil {
-		logg.Fatal("unexpected error while searching in LDAP: " + err.Error())
+		return false, err
 	}
 
 	//If the user does not exist, attempt to bind anyway, but record that we're
@@ -111,14 +377,97 @@ func (d *ldapDriver) CheckLogin(userName, password string) bool {
 	}
 
 	//validate user password
-	err = d.conn.Bind(userDN, password)
+	err = ldapBind(conn, userDN, password)
 	authOK := err == nil && userExists
+	if err != nil && ldap.IsErrorWithCode(err, ldap.ErrorNetwork) {
+		return false, fmt.Errorf("unexpected error while binding as user in LDAP: %s", err.Error())
+	}
 
 	//re-bind as service user to execute next search request
-	err = d.conn.Bind(d.cfg.BindDN, d.cfg.BindPassword)
+	err = ldapBind(conn, d.cfg.BindDN, d.cfg.BindPassword)
 	if err != nil {
-		logg.Fatal("unexpected error while re-binding LDAP service user: " + err.Error())
+		if !authOK || d.requiredGroupDN == nil {
+			logg.Error("%s: %s", errRebindFailed.Error(), err.Error())
+			return authOK, errRebindFailed
+		}
+		//we need the service user to check the group membership, so this counts
+		//as a failed check
+		return false, fmt.Errorf("%s: %s", errRebindFailed.Error(), err.Error())
+	}
+
+	//only check group membership when the password was correct, so that the
+	//outcome does not reveal anything about the user to an attacker
+	if authOK && d.requiredGroupDN != nil {
+		isMember, err := d.isGroupMember(conn, sr.Entries[0], userName)
+		if err != nil {
+			return false, err
+		}
+		if !isMember {
+			return false, ErrForbidden
+		}
 	}
 
-	return authOK
+	return authOK, nil
+}
+
+//searchUser looks up the given user with all attributes needed for the group
+//membership check. When more than one user matches, an empty result is
+//returned.
+func (d *ldapDriver) searchUser(conn *ldap.Conn, userName string) (*ldap.SearchResult, error) {
+	attributes := []string{"dn"}
+	if d.requiredGroupDN != nil && d.cfg.GroupMemberAttribute == "memberOf" {
+		attributes = append(attributes, "memberOf")
+	}
+	sr, err := ldapSearch(conn, &ldap.SearchRequest{
+		BaseDN:       d.cfg.SearchBaseDN,
+		Scope:        ldap.ScopeWholeSubtree,
+		DerefAliases: ldap.NeverDerefAliases,
+		SizeLimit:    2, //so that we can detect (and fail) when multiple users match
+		Filter:       fmt.Sprintf(d.cfg.SearchFilter, userName),
+		Attributes:   attributes,
+		TimeLimit:    int(ldapRequestTimeout / time.Second),
+	})
+	switch {
+	case err == nil:
+		return sr, nil
+	case ldap.IsErrorWithCode(err, ldap.LDAPResultSizeLimitExceeded):
+		return &ldap.SearchResult{}, nil
+	default:
+		return nil, fmt.Errorf("unexpected error while searching in LDAP: %s", err.Error())
+	}
+}
+
+func (d *ldapDriver) isGroupMember(conn *ldap.Conn, user *ldap.Entry, userName string) (bool, error) {
+	if d.cfg.GroupMemberAttribute == "memberOf" {
+		for _, groupDNStr := range user.GetAttributeValues("memberOf") {
+			groupDN, err := ldap.ParseDN(groupDNStr)
+			if err == nil && groupDN.Equal(d.requiredGroupDN) {
+				return true, nil
+			}
+		}
+		return false, nil
+	}
+
+	memberValue := user.DN
+	if strings.EqualFold(d.cfg.GroupMemberAttribute, "memberUid") {
+		memberValue = userName
+	}
+	sr, err := ldapSearch(conn, &ldap.SearchRequest{
+		BaseDN:       d.cfg.RequiredGroupDN,
+		Scope:        ldap.ScopeBaseObject,
+		DerefAliases: ldap.NeverDerefAliases,
+		SizeLimit:    1,
+		Filter:       fmt.Sprintf("(%s=%s)", d.cfg.GroupMemberAttribute, ldap.EscapeFilter(memberValue)),
+		Attributes:   []string{"dn"},
+		TimeLimit:    int(ldapRequestTimeout / time.Second),
+	})
+	switch {
+	case err == nil:
+		return len(sr.Entries) > 0, nil
+	case ldap.IsErrorWithCode(err, ldap.LDAPResultNoSuchObject):
+		logg.Error("required LDAP group %q does not exist", d.cfg.RequiredGroupDN)
+		return false, nil
+	default:
+		return false, fmt.Errorf("unexpected error while checking group membership in LDAP: %s", err.Error())
+	}
 }
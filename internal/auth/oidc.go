@@ -0,0 +1,540 @@
+/*******************************************************************************
+*
+* Copyright 2019 Stefan Majewsky <majewsky@gmx.net>
+*
+* This program is free software: you can redistribute it and/or modify it under
+* the terms of the GNU General Public License as published by the Free Software
+* Foundation, either version 3 of the License, or (at your option) any later
+* version.
+*
+* This program is distributed in the hope that it will be useful, but WITHOUT ANY
+* WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+* A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License along with
+* this program. If not, see <http://www.gnu.org/licenses/>.
+*
+*******************************************************************************/
+
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	_ "crypto/sha512" //for SHA-384 and SHA-512
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sapcc/go-bits/logg"
+)
+
+//OIDCConfig contains all the configuration options for the OpenID Connect
+//auth driver.
+type OIDCConfig struct {
+	//The issuer URL of the OpenID provider. The discovery document is expected
+	//at IssuerURL + "/.well-known/openid-configuration".
+	IssuerURL    string
+	ClientID     string
+	ClientSecret string //may be empty for public clients
+	//The URL of Alltag's /login/callback endpoint, as registered with the
+	//OpenID provider.
+	RedirectURL string
+	//The ID token claim whose value is used as the Alltag username, e.g.
+	//"preferred_username" or "email".
+	UserNameClaim string
+	//Used for all requests to the OpenID provider. If nil, a client with a
+	//reasonable timeout is used.
+	HTTPClient *http.Client
+}
+
+const (
+	//how much clock skew between us and the OpenID provider is tolerated when
+	//checking the expiry of ID tokens
+	oidcClockSkew = 1 * time.Minute
+	//how often the JWKS may be refetched when an ID token refers to an unknown
+	//key (to not hammer the provider with bogus tokens)
+	oidcJWKSRefetchInterval = 1 * time.Minute
+)
+
+//oidcDiscovery contains the fields that we need from the discovery document.
+type oidcDiscovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+type oidcDriver struct {
+	cfg OIDCConfig
+
+	mutex *sync.Mutex
+	//the following fields are protected by the mutex
+	discovery     *oidcDiscovery
+	keys          map[string]crypto.PublicKey //key: key ID
+	keysFetchedAt time.Time
+}
+
+//NewOIDCDriver initializes the OpenID Connect auth driver. This driver does
+//not check passwords. Instead, the login form redirects users to the OpenID
+//provider, which sends them back to Alltag with proof of their identity.
+func NewOIDCDriver(cfg OIDCConfig) (Driver, error) {
+	if cfg.IssuerURL == "" || cfg.ClientID == "" || cfg.RedirectURL == "" {
+		return nil, errors.New("issuer URL, client ID and redirect URL are required for OpenID Connect")
+	}
+	if cfg.UserNameClaim == "" {
+		cfg.UserNameClaim = "preferred_username"
+	}
+	if cfg.HTTPClient == nil {
+		cfg.HTTPClient = &http.Client{Timeout: 10 * time.Second}
+	}
+	d := &oidcDriver{cfg: cfg, mutex: &sync.Mutex{}}
+
+	//fetch the discovery document right away to validate the configuration;
+	//but if the provider is just not reachable right now, start up anyway and
+	//try again on the first login
+	_, err := d.getDiscovery()
+	if err != nil {
+		logg.Error(err.Error())
+	}
+	return d, nil
+}
+
+func (d *oidcDriver) CheckLogin(userName, password string) (bool, error) {
+	//passwords are never accepted since we don't know any
+	return false, nil
+}
+
+//getJSON retrieves a JSON document from the OpenID provider.
+func (d *oidcDriver) getJSON(url string, target interface{}) error {
+	resp, err := d.cfg.HTTPClient.Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	buf, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s returned %d: %s", url, resp.StatusCode, strings.TrimSpace(string(buf)))
+	}
+	err = json.Unmarshal(buf, target)
+	if err != nil {
+		return fmt.Errorf("cannot parse response from GET %s: %s", url, err.Error())
+	}
+	return nil
+}
+
+func (d *oidcDriver) getDiscovery() (*oidcDiscovery, error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if d.discovery != nil {
+		return d.discovery, nil
+	}
+
+	var discovery oidcDiscovery
+	err := d.getJSON(strings.TrimSuffix(d.cfg.IssuerURL, "/")+"/.well-known/openid-configuration", &discovery)
+	if err != nil {
+		return nil, fmt.Errorf("cannot retrieve OpenID Connect discovery document: %s", err.Error())
+	}
+	if discovery.Issuer != d.cfg.IssuerURL {
+		return nil, fmt.Errorf("OpenID Connect discovery document reports issuer %q, expected %q", discovery.Issuer, d.cfg.IssuerURL)
+	}
+	if discovery.AuthorizationEndpoint == "" || discovery.TokenEndpoint == "" || discovery.JWKSURI == "" {
+		return nil, errors.New("OpenID Connect discovery document is missing required endpoints")
+	}
+
+	d.discovery = &discovery
+	return d.discovery, nil
+}
+
+//LoginURL implements the RedirectAuthenticator interface.
+func (d *oidcDriver) LoginURL(flow LoginFlow) (string, error) {
+	discovery, err := d.getDiscovery()
+	if err != nil {
+		return "", err
+	}
+
+	//PKCE (RFC 7636): the provider will only give out the ID token to whoever
+	//presents the code verifier matching this challenge
+	challenge := sha256.Sum256([]byte(flow.CodeVerifier))
+
+	query := url.Values{}
+	query.Set("response_type", "code")
+	query.Set("client_id", d.cfg.ClientID)
+	query.Set("redirect_uri", d.cfg.RedirectURL)
+	query.Set("scope", "openid profile email")
+	query.Set("state", flow.State)
+	query.Set("nonce", flow.Nonce)
+	query.Set("code_challenge", base64.RawURLEncoding.EncodeToString(challenge[:]))
+	query.Set("code_challenge_method", "S256")
+
+	separator := "?"
+	if strings.Contains(discovery.AuthorizationEndpoint, "?") {
+		separator = "&"
+	}
+	return discovery.AuthorizationEndpoint + separator + query.Encode(), nil
+}
+
+//CompleteLogin implements the RedirectAuthenticator interface.
+func (d *oidcDriver) CompleteLogin(code string, flow LoginFlow) (string, error) {
+	discovery, err := d.getDiscovery()
+	if err != nil {
+		return "", err
+	}
+
+	//exchange the authorization code for an ID token
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", d.cfg.RedirectURL)
+	form.Set("code_verifier", flow.CodeVerifier)
+	if d.cfg.ClientSecret == "" {
+		form.Set("client_id", d.cfg.ClientID)
+	}
+	req, err := http.NewRequest("POST", discovery.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if d.cfg.ClientSecret != "" {
+		//RFC 6749, section 2.3.1 requires the credentials to be URL-encoded
+		req.SetBasicAuth(url.QueryEscape(d.cfg.ClientID), url.QueryEscape(d.cfg.ClientSecret))
+	}
+
+	resp, err := d.cfg.HTTPClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	buf, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	var tokenResponse struct {
+		IDToken          string `json:"id_token"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	err = json.Unmarshal(buf, &tokenResponse)
+	if err != nil {
+		return "", fmt.Errorf("cannot parse response from token endpoint (status %d): %s", resp.StatusCode, err.Error())
+	}
+	if tokenResponse.Error != "" {
+		return "", fmt.Errorf("token endpoint returned error %q: %s", tokenResponse.Error, tokenResponse.ErrorDescription)
+	}
+	if resp.StatusCode != http.StatusOK || tokenResponse.IDToken == "" {
+		return "", fmt.Errorf("token endpoint returned %d without an ID token", resp.StatusCode)
+	}
+
+	claims, err := d.verifyIDToken(tokenResponse.IDToken, discovery)
+	if err != nil {
+		return "", fmt.Errorf("invalid ID token: %s", err.Error())
+	}
+	if claims.Nonce != flow.Nonce {
+		return "", errors.New("invalid ID token: nonce does not match")
+	}
+
+	userName, ok := claims.Extra[d.cfg.UserNameClaim].(string)
+	if !ok || userName == "" {
+		return "", fmt.Errorf("ID token does not contain the %q claim", d.cfg.UserNameClaim)
+	}
+	return userName, nil
+}
+
+//oidcClaims contains the claims from an ID token that are validated by
+//verifyIDToken, plus all claims in a generic map.
+type oidcClaims struct {
+	Issuer          string       `json:"iss"`
+	Audience        oidcAudience `json:"aud"`
+	AuthorizedParty string       `json:"azp"`
+	ExpiresAt       int64        `json:"exp"`
+	Nonce           string       `json:"nonce"`
+	Extra           map[string]interface{}
+}
+
+//oidcAudience is the type of the "aud" claim, which may be a single string or
+//a list of strings.
+type oidcAudience []string
+
+func (a *oidcAudience) UnmarshalJSON(buf []byte) error {
+	var single string
+	if json.Unmarshal(buf, &single) == nil {
+		*a = oidcAudience{single}
+		return nil
+	}
+	var multiple []string
+	err := json.Unmarshal(buf, &multiple)
+	*a = oidcAudience(multiple)
+	return err
+}
+
+func (a oidcAudience) contains(value string) bool {
+	for _, v := range a {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+//verifyIDToken checks the signature and the standard claims of an ID token,
+//as described in OpenID Connect Core 1.0, section 3.1.3.7.
+func (d *oidcDriver) verifyIDToken(rawToken string, discovery *oidcDiscovery) (*oidcClaims, error) {
+	fields := strings.Split(rawToken, ".")
+	if len(fields) != 3 {
+		return nil, errors.New("malformed JWT")
+	}
+	headerJSON, err := base64.RawURLEncoding.DecodeString(fields[0])
+	if err != nil {
+		return nil, fmt.Errorf("malformed JWT header: %s", err.Error())
+	}
+	payloadJSON, err := base64.RawURLEncoding.DecodeString(fields[1])
+	if err != nil {
+		return nil, fmt.Errorf("malformed JWT payload: %s", err.Error())
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(fields[2])
+	if err != nil {
+		return nil, fmt.Errorf("malformed JWT signature: %s", err.Error())
+	}
+
+	var header struct {
+		Algorithm string `json:"alg"`
+		KeyID     string `json:"kid"`
+	}
+	err = json.Unmarshal(headerJSON, &header)
+	if err != nil {
+		return nil, fmt.Errorf("malformed JWT header: %s", err.Error())
+	}
+	key, err := d.getKey(header.KeyID, discovery)
+	if err != nil {
+		return nil, err
+	}
+	err = verifyJWTSignature(header.Algorithm, key, fields[0]+"."+fields[1], signature)
+	if err != nil {
+		return nil, err
+	}
+
+	var claims oidcClaims
+	err = json.Unmarshal(payloadJSON, &claims)
+	if err == nil {
+		err = json.Unmarshal(payloadJSON, &claims.Extra)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("malformed JWT payload: %s", err.Error())
+	}
+
+	if claims.Issuer != discovery.Issuer {
+		return nil, fmt.Errorf("issued by %q, expected %q", claims.Issuer, discovery.Issuer)
+	}
+	if !claims.Audience.contains(d.cfg.ClientID) {
+		return nil, errors.New("not issued for this client")
+	}
+	if len(claims.Audience) > 1 && claims.AuthorizedParty != d.cfg.ClientID {
+		return nil, errors.New("not issued for this client (azp mismatch)")
+	}
+	if time.Unix(claims.ExpiresAt, 0).Add(oidcClockSkew).Before(time.Now()) {
+		return nil, errors.New("expired")
+	}
+	return &claims, nil
+}
+
+//getKey returns the public key with the given key ID from the provider's
+//JWKS. The JWKS is refetched when it does not contain this key, since the
+//provider may have rotated its keys.
+func (d *oidcDriver) getKey(keyID string, discovery *oidcDiscovery) (crypto.PublicKey, error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	key, exists := d.findKey(keyID)
+	if exists {
+		return key, nil
+	}
+	if time.Since(d.keysFetchedAt) < oidcJWKSRefetchInterval {
+		return nil, fmt.Errorf("unknown key ID: %q", keyID)
+	}
+
+	var jwks struct {
+		Keys []json.RawMessage `json:"keys"`
+	}
+	err := d.getJSON(discovery.JWKSURI, &jwks)
+	if err != nil {
+		return nil, fmt.Errorf("cannot retrieve JWKS: %s", err.Error())
+	}
+	d.keys = make(map[string]crypto.PublicKey)
+	d.keysFetchedAt = time.Now()
+	for _, buf := range jwks.Keys {
+		keyID, key, err := parseJWK(buf)
+		if err != nil {
+			//ignore keys that we cannot use, but use the others
+			logg.Debug("ignoring key in JWKS: %s", err.Error())
+			continue
+		}
+		d.keys[keyID] = key
+	}
+
+	key, exists = d.findKey(keyID)
+	if !exists {
+		return nil, fmt.Errorf("unknown key ID: %q", keyID)
+	}
+	return key, nil
+}
+
+func (d *oidcDriver) findKey(keyID string) (crypto.PublicKey, bool) {
+	//if the token does not name a key, it can only be verified when there is
+	//just one key
+	if keyID == "" && len(d.keys) == 1 {
+		for _, key := range d.keys {
+			return key, true
+		}
+	}
+	key, exists := d.keys[keyID]
+	return key, exists
+}
+
+//parseJWK parses a single key from a JWKS (RFC 7517).
+func parseJWK(buf []byte) (string, crypto.PublicKey, error) {
+	var jwk struct {
+		KeyType string `json:"kty"`
+		KeyID   string `json:"kid"`
+		Use     string `json:"use"`
+		//for RSA keys
+		N string `json:"n"`
+		E string `json:"e"`
+		//for EC keys
+		Curve string `json:"crv"`
+		X     string `json:"x"`
+		Y     string `json:"y"`
+	}
+	err := json.Unmarshal(buf, &jwk)
+	if err != nil {
+		return "", nil, err
+	}
+	if jwk.Use != "" && jwk.Use != "sig" {
+		return "", nil, fmt.Errorf("key %q is not for signatures", jwk.KeyID)
+	}
+
+	decodeInt := func(input string) (*big.Int, error) {
+		buf, err := base64.RawURLEncoding.DecodeString(input)
+		if err != nil || len(buf) == 0 {
+			return nil, fmt.Errorf("key %q contains malformed numbers", jwk.KeyID)
+		}
+		return new(big.Int).SetBytes(buf), nil
+	}
+
+	switch jwk.KeyType {
+	case "RSA":
+		n, err := decodeInt(jwk.N)
+		if err != nil {
+			return "", nil, err
+		}
+		e, err := decodeInt(jwk.E)
+		if err != nil {
+			return "", nil, err
+		}
+		if !e.IsInt64() || e.Int64() > 1<<31-1 {
+			return "", nil, fmt.Errorf("key %q has an unsupported RSA exponent", jwk.KeyID)
+		}
+		return jwk.KeyID, &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+
+	case "EC":
+		var curve elliptic.Curve
+		switch jwk.Curve {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return "", nil, fmt.Errorf("key %q uses unsupported curve %q", jwk.KeyID, jwk.Curve)
+		}
+		x, err := decodeInt(jwk.X)
+		if err != nil {
+			return "", nil, err
+		}
+		y, err := decodeInt(jwk.Y)
+		if err != nil {
+			return "", nil, err
+		}
+		if !curve.IsOnCurve(x, y) {
+			return "", nil, fmt.Errorf("key %q is not on its curve", jwk.KeyID)
+		}
+		return jwk.KeyID, &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+
+	default:
+		return "", nil, fmt.Errorf("key %q has unsupported type %q", jwk.KeyID, jwk.KeyType)
+	}
+}
+
+//verifyJWTSignature checks a JWS signature (RFC 7515) with one of the
+//algorithms from RFC 7518 that are commonly used for ID tokens.
+func verifyJWTSignature(algorithm string, key crypto.PublicKey, signedInput string, signature []byte) error {
+	var hash crypto.Hash
+	switch algorithm {
+	case "RS256", "PS256", "ES256":
+		hash = crypto.SHA256
+	case "RS384", "PS384", "ES384":
+		hash = crypto.SHA384
+	case "RS512", "PS512", "ES512":
+		hash = crypto.SHA512
+	default:
+		//this includes "none" and the HMAC algorithms, which we do not accept
+		return fmt.Errorf("unsupported signature algorithm: %q", algorithm)
+	}
+	hasher := hash.New()
+	hasher.Write([]byte(signedInput))
+	digest := hasher.Sum(nil)
+
+	errInvalid := errors.New("invalid signature")
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		var err error
+		switch algorithm[:2] {
+		case "RS":
+			err = rsa.VerifyPKCS1v15(key, hash, digest, signature)
+		case "PS":
+			err = rsa.VerifyPSS(key, hash, digest, signature, &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash})
+		default:
+			return fmt.Errorf("cannot use RSA key for algorithm %q", algorithm)
+		}
+		if err != nil {
+			return errInvalid
+		}
+		return nil
+
+	case *ecdsa.PublicKey:
+		expectedBitSize := map[string]int{"ES256": 256, "ES384": 384, "ES512": 521}[algorithm]
+		if key.Curve.Params().BitSize != expectedBitSize {
+			return fmt.Errorf("cannot use EC key on %s for algorithm %q", key.Curve.Params().Name, algorithm)
+		}
+		//the signature is the concatenation of R and S, each padded to the size
+		//of the curve
+		size := (key.Curve.Params().BitSize + 7) / 8
+		if len(signature) != 2*size {
+			return errInvalid
+		}
+		r := new(big.Int).SetBytes(signature[:size])
+		s := new(big.Int).SetBytes(signature[size:])
+		if !ecdsa.Verify(key, digest, r, s) {
+			return errInvalid
+		}
+		return nil
+
+	default:
+		return errors.New("unsupported key type")
+	}
+}
@@ -0,0 +1,382 @@
+/*******************************************************************************
+*
+* Copyright 2019 Stefan Majewsky <majewsky@gmx.net>
+*
+* This program is free software: you can redistribute it and/or modify it under
+* the terms of the GNU General Public License as published by the Free Software
+* Foundation, either version 3 of the License, or (at your option) any later
+* version.
+*
+* This program is distributed in the hope that it will be useful, but WITHOUT ANY
+* WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+* A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License along with
+* this program. If not, see <http://www.gnu.org/licenses/>.
+*
+*******************************************************************************/
+
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+const (
+	testClientID     = "alltag"
+	testClientSecret = "swordfish"
+	testAuthCode     = "the-code"
+)
+
+//stubIssuer is a minimal OpenID provider. Its token endpoint returns whatever
+//ID token is in the `idToken` field.
+type stubIssuer struct {
+	server   *httptest.Server
+	rsaKey   *rsa.PrivateKey
+	ecKey    *ecdsa.PrivateKey
+	flow     LoginFlow
+	idToken  string
+	jwksHits int
+}
+
+func newStubIssuer(t *testing.T) *stubIssuer {
+	t.Helper()
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	s := &stubIssuer{
+		rsaKey: rsaKey,
+		ecKey:  ecKey,
+		flow:   LoginFlow{State: "state", Nonce: "nonce", CodeVerifier: "verifier"},
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, map[string]string{
+			"issuer":                 s.server.URL,
+			"authorization_endpoint": s.server.URL + "/authorize",
+			"token_endpoint":         s.server.URL + "/token",
+			"jwks_uri":               s.server.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		s.jwksHits++
+		encode := func(i *big.Int) string { return base64.RawURLEncoding.EncodeToString(i.Bytes()) }
+		writeJSON(w, map[string]interface{}{
+			"keys": []map[string]string{
+				{"kty": "RSA", "kid": "rsa", "use": "sig", "n": encode(rsaKey.N), "e": encode(big.NewInt(int64(rsaKey.E)))},
+				{"kty": "EC", "kid": "ec", "crv": "P-256", "x": encode(ecKey.X), "y": encode(ecKey.Y)},
+				{"kty": "RSA", "kid": "enc", "use": "enc", "n": encode(rsaKey.N), "e": encode(big.NewInt(int64(rsaKey.E)))},
+			},
+		})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		clientID, clientSecret, _ := r.BasicAuth()
+		switch {
+		case clientID != testClientID || clientSecret != testClientSecret:
+			w.WriteHeader(http.StatusUnauthorized)
+			writeJSON(w, map[string]string{"error": "invalid_client"})
+		case r.PostFormValue("code") != testAuthCode || r.PostFormValue("code_verifier") != s.flow.CodeVerifier:
+			w.WriteHeader(http.StatusBadRequest)
+			writeJSON(w, map[string]string{"error": "invalid_grant"})
+		default:
+			writeJSON(w, map[string]string{"id_token": s.idToken, "token_type": "Bearer"})
+		}
+	})
+	s.server = httptest.NewServer(mux)
+	return s
+}
+
+func writeJSON(w http.ResponseWriter, data interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(data)
+}
+
+func (s *stubIssuer) driver(t *testing.T) *oidcDriver {
+	t.Helper()
+	driver, err := NewOIDCDriver(OIDCConfig{
+		IssuerURL:     s.server.URL,
+		ClientID:      testClientID,
+		ClientSecret:  testClientSecret,
+		RedirectURL:   "https://alltag.example.com/login/callback",
+		UserNameClaim: "preferred_username",
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	return driver.(*oidcDriver)
+}
+
+//validClaims returns the claims of an ID token that the driver accepts.
+func (s *stubIssuer) validClaims() map[string]interface{} {
+	return map[string]interface{}{
+		"iss":                s.server.URL,
+		"sub":                "1234",
+		"aud":                testClientID,
+		"exp":                time.Now().Add(5 * time.Minute).Unix(),
+		"iat":                time.Now().Unix(),
+		"nonce":              s.flow.Nonce,
+		"preferred_username": "alice",
+	}
+}
+
+//makeJWT assembles a JWT. The signature is computed by the given function
+//from the signed input (i.e. the encoded header and payload).
+func makeJWT(t *testing.T, header, claims map[string]interface{}, sign func(signedInput string) []byte) string {
+	t.Helper()
+	headerJSON, err := json.Marshal(header)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	claimsJSON, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	signedInput := base64.RawURLEncoding.EncodeToString(headerJSON) + "." + base64.RawURLEncoding.EncodeToString(claimsJSON)
+	return signedInput + "." + base64.RawURLEncoding.EncodeToString(sign(signedInput))
+}
+
+func signRS256(t *testing.T, key *rsa.PrivateKey) func(string) []byte {
+	return func(signedInput string) []byte {
+		digest := sha256.Sum256([]byte(signedInput))
+		signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		return signature
+	}
+}
+
+func signES256(t *testing.T, key *ecdsa.PrivateKey) func(string) []byte {
+	return func(signedInput string) []byte {
+		digest := sha256.Sum256([]byte(signedInput))
+		r, s, err := ecdsa.Sign(rand.Reader, key, digest[:])
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		//R and S are each padded to 32 bytes
+		signature := make([]byte, 64)
+		rBytes, sBytes := r.Bytes(), s.Bytes()
+		copy(signature[32-len(rBytes):32], rBytes)
+		copy(signature[64-len(sBytes):], sBytes)
+		return signature
+	}
+}
+
+func TestOIDCCompleteLogin(t *testing.T) {
+	s := newStubIssuer(t)
+	defer s.server.Close()
+
+	otherRSAKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	//for the alg confusion attack, the HMAC secret is the issuer's public key,
+	//which the attacker can get from the JWKS
+	publicKeyBytes, err := x509.MarshalPKIXPublicKey(&s.rsaKey.PublicKey)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	signHS256 := func(signedInput string) []byte {
+		mac := hmac.New(sha256.New, publicKeyBytes)
+		mac.Write([]byte(signedInput))
+		return mac.Sum(nil)
+	}
+	signNone := func(string) []byte { return nil }
+	withClaim := func(key string, value interface{}) map[string]interface{} {
+		claims := s.validClaims()
+		if value == nil {
+			delete(claims, key)
+		} else {
+			claims[key] = value
+		}
+		return claims
+	}
+	rsaHeader := map[string]interface{}{"alg": "RS256", "kid": "rsa", "typ": "JWT"}
+
+	testCases := []struct {
+		Description   string
+		IDToken       string
+		ExpectedError string //if empty, login must succeed as "alice"
+	}{
+		{
+			Description: "valid token signed with RS256",
+			IDToken:     makeJWT(t, rsaHeader, s.validClaims(), signRS256(t, s.rsaKey)),
+		},
+		{
+			Description: "valid token signed with ES256",
+			IDToken:     makeJWT(t, map[string]interface{}{"alg": "ES256", "kid": "ec"}, s.validClaims(), signES256(t, s.ecKey)),
+		},
+		{
+			Description: "valid token with multiple audiences",
+			IDToken: makeJWT(t, rsaHeader, func() map[string]interface{} {
+				claims := withClaim("aud", []string{"other", testClientID})
+				claims["azp"] = testClientID
+				return claims
+			}(), signRS256(t, s.rsaKey)),
+		},
+		{
+			Description:   "signed with a different key",
+			IDToken:       makeJWT(t, rsaHeader, s.validClaims(), signRS256(t, otherRSAKey)),
+			ExpectedError: "invalid signature",
+		},
+		{
+			Description: "payload modified after signing",
+			IDToken: func() string {
+				valid := makeJWT(t, rsaHeader, s.validClaims(), signRS256(t, s.rsaKey))
+				forged := makeJWT(t, rsaHeader, withClaim("preferred_username", "admin"), signNone)
+				return forged + strings.SplitN(valid, ".", 3)[2]
+			}(),
+			ExpectedError: "invalid signature",
+		},
+		{
+			Description:   "unknown key ID",
+			IDToken:       makeJWT(t, map[string]interface{}{"alg": "RS256", "kid": "unknown"}, s.validClaims(), signRS256(t, s.rsaKey)),
+			ExpectedError: "unknown key ID",
+		},
+		{
+			Description:   "key that is not for signatures",
+			IDToken:       makeJWT(t, map[string]interface{}{"alg": "RS256", "kid": "enc"}, s.validClaims(), signRS256(t, s.rsaKey)),
+			ExpectedError: "unknown key ID",
+		},
+		{
+			Description:   "wrong audience",
+			IDToken:       makeJWT(t, rsaHeader, withClaim("aud", "other"), signRS256(t, s.rsaKey)),
+			ExpectedError: "not issued for this client",
+		},
+		{
+			Description:   "multiple audiences without azp",
+			IDToken:       makeJWT(t, rsaHeader, withClaim("aud", []string{"other", testClientID}), signRS256(t, s.rsaKey)),
+			ExpectedError: "azp mismatch",
+		},
+		{
+			Description:   "wrong issuer",
+			IDToken:       makeJWT(t, rsaHeader, withClaim("iss", "https://evil.example.com"), signRS256(t, s.rsaKey)),
+			ExpectedError: "issued by",
+		},
+		{
+			Description:   "expired",
+			IDToken:       makeJWT(t, rsaHeader, withClaim("exp", time.Now().Add(-time.Hour).Unix()), signRS256(t, s.rsaKey)),
+			ExpectedError: "expired",
+		},
+		{
+			Description:   "without expiry",
+			IDToken:       makeJWT(t, rsaHeader, withClaim("exp", nil), signRS256(t, s.rsaKey)),
+			ExpectedError: "expired",
+		},
+		{
+			Description:   "nonce mismatch",
+			IDToken:       makeJWT(t, rsaHeader, withClaim("nonce", "replayed"), signRS256(t, s.rsaKey)),
+			ExpectedError: "nonce does not match",
+		},
+		{
+			Description:   "nonce missing",
+			IDToken:       makeJWT(t, rsaHeader, withClaim("nonce", nil), signRS256(t, s.rsaKey)),
+			ExpectedError: "nonce does not match",
+		},
+		{
+			Description:   "alg none",
+			IDToken:       makeJWT(t, map[string]interface{}{"alg": "none", "kid": "rsa"}, s.validClaims(), signNone),
+			ExpectedError: "unsupported signature algorithm",
+		},
+		{
+			Description:   "alg none without key ID",
+			IDToken:       makeJWT(t, map[string]interface{}{"alg": "none"}, s.validClaims(), signNone),
+			ExpectedError: "unknown key ID",
+		},
+		{
+			Description:   "alg HS256 with the RSA public key as secret",
+			IDToken:       makeJWT(t, map[string]interface{}{"alg": "HS256", "kid": "rsa"}, s.validClaims(), signHS256),
+			ExpectedError: "unsupported signature algorithm",
+		},
+		{
+			Description:   "alg ES256 with an RSA key",
+			IDToken:       makeJWT(t, map[string]interface{}{"alg": "ES256", "kid": "rsa"}, s.validClaims(), signES256(t, s.ecKey)),
+			ExpectedError: "cannot use RSA key",
+		},
+		{
+			Description:   "alg RS256 with an EC key",
+			IDToken:       makeJWT(t, map[string]interface{}{"alg": "RS256", "kid": "ec"}, s.validClaims(), signRS256(t, s.rsaKey)),
+			ExpectedError: "cannot use EC key",
+		},
+		{
+			Description:   "malformed token",
+			IDToken:       "not-a-jwt",
+			ExpectedError: "malformed JWT",
+		},
+		{
+			Description:   "without username claim",
+			IDToken:       makeJWT(t, rsaHeader, withClaim("preferred_username", nil), signRS256(t, s.rsaKey)),
+			ExpectedError: `does not contain the "preferred_username" claim`,
+		},
+	}
+
+	for _, tc := range testCases {
+		//use a new driver every time, so that all cases see the same JWKS
+		driver := s.driver(t)
+		s.idToken = tc.IDToken
+
+		userName, err := driver.CompleteLogin(testAuthCode, s.flow)
+		switch {
+		case tc.ExpectedError == "" && err != nil:
+			t.Errorf("%s: expected login to succeed, but got error: %s", tc.Description, err.Error())
+		case tc.ExpectedError == "" && userName != "alice":
+			t.Errorf(`%s: expected login as "alice", but got %q`, tc.Description, userName)
+		case tc.ExpectedError != "" && err == nil:
+			t.Errorf("%s: expected error containing %q, but login succeeded as %q", tc.Description, tc.ExpectedError, userName)
+		case tc.ExpectedError != "" && !strings.Contains(err.Error(), tc.ExpectedError):
+			t.Errorf("%s: expected error containing %q, but got: %s", tc.Description, tc.ExpectedError, err.Error())
+		}
+	}
+}
+
+func TestOIDCRejectsWrongAuthCode(t *testing.T) {
+	s := newStubIssuer(t)
+	defer s.server.Close()
+	s.idToken = makeJWT(t, map[string]interface{}{"alg": "RS256", "kid": "rsa"}, s.validClaims(), signRS256(t, s.rsaKey))
+
+	flow := s.flow
+	flow.CodeVerifier = "wrong"
+	_, err := s.driver(t).CompleteLogin(testAuthCode, flow)
+	if err == nil || !strings.Contains(err.Error(), "invalid_grant") {
+		t.Errorf("expected invalid_grant error, but got %v", err)
+	}
+}
+
+func TestOIDCJWKSRefetch(t *testing.T) {
+	s := newStubIssuer(t)
+	defer s.server.Close()
+	driver := s.driver(t)
+
+	//tokens with unknown keys must not cause the JWKS to be refetched every time
+	for idx := 0; idx < 3; idx++ {
+		s.idToken = makeJWT(t, map[string]interface{}{"alg": "RS256", "kid": "unknown"}, s.validClaims(), signRS256(t, s.rsaKey))
+		_, err := driver.CompleteLogin(testAuthCode, s.flow)
+		if err == nil {
+			t.Fatal("expected login with unknown key ID to fail")
+		}
+	}
+	if s.jwksHits != 1 {
+		t.Errorf("expected JWKS to be fetched once, but was fetched %d times", s.jwksHits)
+	}
+}
@@ -0,0 +1,147 @@
+/*******************************************************************************
+*
+* Copyright 2019 Stefan Majewsky <majewsky@gmx.net>
+*
+* This program is free software: you can redistribute it and/or modify it under
+* the terms of the GNU General Public License as published by the Free Software
+* Foundation, either version 3 of the License, or (at your option) any later
+* version.
+*
+* This program is distributed in the hope that it will be useful, but WITHOUT ANY
+* WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+* A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License along with
+* this program. If not, see <http://www.gnu.org/licenses/>.
+*
+*******************************************************************************/
+
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+//ProxyConfig contains all the configuration options for the proxy auth
+//driver.
+type ProxyConfig struct {
+	//The request header that contains the username, e.g. "X-Forwarded-User".
+	Header string
+	//The header is only trusted on requests coming from these networks.
+	TrustedNetworks []*net.IPNet
+}
+
+//ParseNetworks parses a comma-separated list of CIDRs (or single IP
+//addresses), e.g. for ProxyConfig.TrustedNetworks.
+func ParseNetworks(input string) ([]*net.IPNet, error) {
+	var result []*net.IPNet
+	for _, field := range strings.Split(input, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		if !strings.Contains(field, "/") {
+			ip := net.ParseIP(field)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid IP address: %q", field)
+			}
+			result = append(result, &net.IPNet{IP: ip, Mask: net.CIDRMask(len(ip)*8, len(ip)*8)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(field)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, network)
+	}
+	return result, nil
+}
+
+type proxyDriver struct {
+	cfg ProxyConfig
+}
+
+//NewProxyDriver initializes the proxy auth driver. This driver does not check
+//passwords at all. Instead, it trusts a reverse proxy (which performs its own
+//authentication, e.g. through single sign-on) to put the username in a
+//request header.
+func NewProxyDriver(cfg ProxyConfig) (Driver, error) {
+	if cfg.Header == "" {
+		return nil, errors.New("no header configured for proxy auth")
+	}
+	if len(cfg.TrustedNetworks) == 0 {
+		return nil, errors.New("no trusted networks configured for proxy auth")
+	}
+	return &proxyDriver{cfg}, nil
+}
+
+func (d *proxyDriver) CheckLogin(userName, password string) (bool, error) {
+	//passwords are never accepted since we don't know any
+	return false, nil
+}
+
+func (d *proxyDriver) AuthenticateRequest(r *http.Request) (string, bool) {
+	//when the request does not come from the proxy, anyone could have set the
+	//header, so we must ignore it
+	if !isInNetworks(remoteIP(r), d.cfg.TrustedNetworks) {
+		return "", false
+	}
+	userName := strings.TrimSpace(r.Header.Get(d.cfg.Header))
+	return userName, userName != ""
+}
+
+//remoteIP returns the IP address that the request came from. This may be the
+//IP address of a reverse proxy, cf. ClientIP.
+func remoteIP(r *http.Request) net.IP {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return net.ParseIP(host)
+}
+
+//ClientIP returns the IP address of the client that made the request. When the
+//request comes through a reverse proxy in one of the trusted networks, the
+//client IP is taken from the X-Forwarded-For header. Returns nil if the IP
+//address cannot be determined.
+func ClientIP(r *http.Request, trustedProxies []*net.IPNet) net.IP {
+	ip := remoteIP(r)
+	if !isInNetworks(ip, trustedProxies) {
+		return ip
+	}
+
+	//each proxy appends the address that it received the request from, so the
+	//rightmost address that is not one of our proxies is the client (any
+	//addresses further to the left could have been forged by the client)
+	var forwardedFor []string
+	for _, value := range r.Header["X-Forwarded-For"] {
+		forwardedFor = append(forwardedFor, strings.Split(value, ",")...)
+	}
+	for idx := len(forwardedFor) - 1; idx >= 0; idx-- {
+		forwardedIP := net.ParseIP(strings.TrimSpace(forwardedFor[idx]))
+		if forwardedIP == nil {
+			return nil
+		}
+		ip = forwardedIP
+		if !isInNetworks(ip, trustedProxies) {
+			break
+		}
+	}
+	return ip
+}
+
+func isInNetworks(ip net.IP, networks []*net.IPNet) bool {
+	if ip == nil {
+		return false
+	}
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
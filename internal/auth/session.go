@@ -0,0 +1,305 @@
+/*******************************************************************************
+*
+* Copyright 2019 Stefan Majewsky <majewsky@gmx.net>
+*
+* This program is free software: you can redistribute it and/or modify it under
+* the terms of the GNU General Public License as published by the Free Software
+* Foundation, either version 3 of the License, or (at your option) any later
+* version.
+*
+* This program is distributed in the hope that it will be useful, but WITHOUT ANY
+* WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+* A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License along with
+* this program. If not, see <http://www.gnu.org/licenses/>.
+*
+*******************************************************************************/
+
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sapcc/go-bits/logg"
+)
+
+//SessionCookieName is the name of the cookie that holds the session.
+const SessionCookieName = "alltag-session"
+
+//Sessions issues and verifies session cookies. A session cookie contains the
+//username, the time when the user logged in, and the expiry time, and is
+//signed with a secret key to prevent forgery. Since sessions are not stored on
+//the server side, no database access is needed to verify them.
+type Sessions struct {
+	driver Driver
+	cfg    SessionConfig
+	mutex  *sync.Mutex
+	//the following fields are protected by the mutex
+	revoked map[string]time.Time //cookie value -> expiry time
+}
+
+//SessionConfig contains the configuration options for Sessions.
+type SessionConfig struct {
+	//Secret is the key for signing session cookies.
+	Secret []byte
+	//Lifetime is how long a session stays valid without activity. Sessions
+	//that are in use are renewed, but never beyond MaxAge.
+	Lifetime time.Duration
+	//MaxAge is how long a session can be used at most, counting from the
+	//login. After that, the user has to log in again.
+	MaxAge time.Duration
+}
+
+//NewSessions initializes a Sessions instance. When sessions are renewed, the
+//given driver is asked whether the user may still use Alltag, if it
+//implements UserChecker.
+func NewSessions(driver Driver, cfg SessionConfig) *Sessions {
+	return &Sessions{
+		driver:  driver,
+		cfg:     cfg,
+		mutex:   &sync.Mutex{},
+		revoked: make(map[string]time.Time),
+	}
+}
+
+//sign computes the signature for a cookie value. The cookie name is included
+//in the signature, so that a value signed for one cookie cannot be used in
+//another cookie.
+func (s *Sessions) sign(cookieName, payload string) string {
+	mac := hmac.New(sha256.New, s.cfg.Secret)
+	mac.Write([]byte(cookieName + "=" + payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+//setSignedCookie stores the given data in a cookie that expires at the given
+//time. The cookie value has the form "data.expiry.signature".
+func (s *Sessions) setSignedCookie(w http.ResponseWriter, r *http.Request, cookieName string, data []byte, expiresAt time.Time) {
+	payload := base64.RawURLEncoding.EncodeToString(data) +
+		"." + strconv.FormatInt(expiresAt.Unix(), 10)
+	setCookie(w, r, cookieName, payload+"."+s.sign(cookieName, payload), expiresAt)
+}
+
+//getSignedCookie returns the data from a cookie set by setSignedCookie, as
+//well as the time until it expires. If the cookie does not exist, has been
+//tampered with, or has expired, false is returned.
+func (s *Sessions) getSignedCookie(r *http.Request, cookieName string) ([]byte, time.Duration, bool) {
+	cookie, err := r.Cookie(cookieName)
+	if err != nil {
+		return nil, 0, false
+	}
+	fields := strings.Split(cookie.Value, ".")
+	if len(fields) != 3 {
+		return nil, 0, false
+	}
+
+	payload := fields[0] + "." + fields[1]
+	if !hmac.Equal([]byte(s.sign(cookieName, payload)), []byte(fields[2])) {
+		return nil, 0, false
+	}
+	data, err := base64.RawURLEncoding.DecodeString(fields[0])
+	if err != nil {
+		return nil, 0, false
+	}
+	expiresAtUnix, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil {
+		return nil, 0, false
+	}
+	remaining := time.Until(time.Unix(expiresAtUnix, 0))
+	if remaining <= 0 {
+		return nil, 0, false
+	}
+	return data, remaining, true
+}
+
+func setCookie(w http.ResponseWriter, r *http.Request, cookieName, value string, expiresAt time.Time) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     cookieName,
+		Value:    value,
+		Path:     "/",
+		Expires:  expiresAt,
+		HttpOnly: true,
+		//only send the cookie over HTTPS when we are (or are behind) HTTPS
+		Secure: r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https",
+		//The cookie is not sent along with cross-site POST requests. This protects
+		//the form submissions in the UI against CSRF.
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+//sessionData is the data that is stored in a session cookie.
+type sessionData struct {
+	UserName string `json:"user"`
+	//IssuedAt is when the user logged in, as a UNIX timestamp. It is retained
+	//when the session is renewed.
+	IssuedAt int64 `json:"iat"`
+}
+
+func (s *Sessions) setSessionCookie(w http.ResponseWriter, r *http.Request, session sessionData) {
+	expiresAt := time.Now().Add(s.cfg.Lifetime)
+	maxExpiresAt := time.Unix(session.IssuedAt, 0).Add(s.cfg.MaxAge)
+	if expiresAt.After(maxExpiresAt) {
+		expiresAt = maxExpiresAt
+	}
+	data, _ := json.Marshal(session) //cannot fail
+	s.setSignedCookie(w, r, SessionCookieName, data, expiresAt)
+}
+
+//Issue adds a cookie to the response that starts a session for the given
+//user.
+func (s *Sessions) Issue(w http.ResponseWriter, r *http.Request, userName string) {
+	s.setSessionCookie(w, r, sessionData{UserName: userName, IssuedAt: time.Now().Unix()})
+}
+
+//Revoke adds a cookie to the response that ends the session. The session
+//cookie from the request is also remembered as revoked until it expires, so
+//that a copy of it cannot be used anymore either. (This list is not
+//persisted, so it is lost when Alltag is restarted.)
+func (s *Sessions) Revoke(w http.ResponseWriter, r *http.Request) {
+	setCookie(w, r, SessionCookieName, "", time.Unix(0, 0))
+
+	cookie, err := r.Cookie(SessionCookieName)
+	if err != nil {
+		return
+	}
+	_, remaining, ok := s.getSignedCookie(r, SessionCookieName)
+	if !ok {
+		return
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	now := time.Now()
+	for value, expiresAt := range s.revoked {
+		if expiresAt.Before(now) {
+			delete(s.revoked, value)
+		}
+	}
+	s.revoked[cookie.Value] = now.Add(remaining)
+}
+
+func (s *Sessions) isRevoked(r *http.Request) bool {
+	cookie, err := r.Cookie(SessionCookieName)
+	if err != nil {
+		return false
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	_, isRevoked := s.revoked[cookie.Value]
+	return isRevoked
+}
+
+//Verify checks whether the request carries a valid session cookie. If so,
+//the username from that session is returned.
+//
+//When the session is more than halfway to its expiry, it is renewed by adding
+//a new cookie to the response, but only up to the maximum age, and only if
+//the auth driver confirms that the user may still use Alltag.
+func (s *Sessions) Verify(w http.ResponseWriter, r *http.Request) (userName string, ok bool) {
+	data, remaining, ok := s.getSignedCookie(r, SessionCookieName)
+	if !ok || s.isRevoked(r) {
+		return "", false
+	}
+	var session sessionData
+	err := json.Unmarshal(data, &session)
+	if err != nil || session.UserName == "" {
+		return "", false
+	}
+	//this check is relevant if the maximum age has been reduced since the
+	//cookie was issued
+	maxExpiresAt := time.Unix(session.IssuedAt, 0).Add(s.cfg.MaxAge)
+	if !time.Now().Before(maxExpiresAt) {
+		return "", false
+	}
+
+	expiresAt := time.Now().Add(remaining)
+	if remaining < s.cfg.Lifetime/2 && expiresAt.Before(maxExpiresAt) {
+		isAllowed, err := s.checkUser(session.UserName)
+		switch {
+		case err != nil:
+			//keep the session for now, and try to renew it on the next request
+			logg.Error("cannot check whether user %q may renew their session: %s", session.UserName, err.Error())
+		case isAllowed:
+			s.setSessionCookie(w, r, session)
+		default:
+			s.Revoke(w, r)
+			return "", false
+		}
+	}
+	return session.UserName, true
+}
+
+//checkUser asks the driver whether the given user may still use Alltag.
+func (s *Sessions) checkUser(userName string) (bool, error) {
+	checker, ok := s.driver.(UserChecker)
+	if !ok {
+		return true, nil
+	}
+	ok, err := checker.CheckUser(userName)
+	if err == ErrForbidden {
+		return false, nil
+	}
+	return ok, err
+}
+
+//loginFlowCookieName is the name of the cookie that holds the LoginFlow while
+//the user is logging in on an external site.
+const loginFlowCookieName = "alltag-login-flow"
+
+//loginFlowLifetime is how long the user has to complete a LoginFlow.
+const loginFlowLifetime = 10 * time.Minute
+
+//LoginFlow contains the state of a login on an external site (e.g. with
+//OpenID Connect). It is stored in a cookie while the user is away.
+type LoginFlow struct {
+	//random values that are checked when the user returns
+	State        string `json:"state"`
+	Nonce        string `json:"nonce"`
+	CodeVerifier string `json:"code_verifier"`
+	//where to redirect the user after the login is complete
+	NextURL string `json:"next"`
+}
+
+//StartLoginFlow generates a new LoginFlow and adds a cookie containing it to
+//the response.
+func (s *Sessions) StartLoginFlow(w http.ResponseWriter, r *http.Request, nextURL string) (LoginFlow, error) {
+	flow := LoginFlow{NextURL: nextURL}
+	for _, field := range []*string{&flow.State, &flow.Nonce, &flow.CodeVerifier} {
+		buf := make([]byte, 32)
+		_, err := rand.Read(buf)
+		if err != nil {
+			return LoginFlow{}, err
+		}
+		*field = base64.RawURLEncoding.EncodeToString(buf)
+	}
+
+	data, err := json.Marshal(flow)
+	if err != nil {
+		return LoginFlow{}, err
+	}
+	s.setSignedCookie(w, r, loginFlowCookieName, data, time.Now().Add(loginFlowLifetime))
+	return flow, nil
+}
+
+//FinishLoginFlow retrieves the LoginFlow from the request, and adds a cookie
+//to the response that removes it, so that it cannot be used twice.
+func (s *Sessions) FinishLoginFlow(w http.ResponseWriter, r *http.Request) (LoginFlow, bool) {
+	setCookie(w, r, loginFlowCookieName, "", time.Unix(0, 0))
+
+	data, _, ok := s.getSignedCookie(r, loginFlowCookieName)
+	if !ok {
+		return LoginFlow{}, false
+	}
+	var flow LoginFlow
+	err := json.Unmarshal(data, &flow)
+	return flow, err == nil
+}
@@ -0,0 +1,243 @@
+/*******************************************************************************
+*
+* Copyright 2019 Stefan Majewsky <majewsky@gmx.net>
+*
+* This program is free software: you can redistribute it and/or modify it under
+* the terms of the GNU General Public License as published by the Free Software
+* Foundation, either version 3 of the License, or (at your option) any later
+* version.
+*
+* This program is distributed in the hope that it will be useful, but WITHOUT ANY
+* WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+* A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License along with
+* this program. If not, see <http://www.gnu.org/licenses/>.
+*
+*******************************************************************************/
+
+package auth
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+//testUserChecker is a Driver that implements UserChecker.
+type testUserChecker struct {
+	allowed bool
+	err     error
+	checks  int
+}
+
+func (d *testUserChecker) CheckLogin(userName, password string) (bool, error) {
+	return false, nil
+}
+
+func (d *testUserChecker) CheckUser(userName string) (bool, error) {
+	d.checks++
+	return d.allowed, d.err
+}
+
+//makeSessionRequest returns a request carrying a session cookie with the
+//given contents.
+func makeSessionRequest(s *Sessions, issuedAt, expiresAt time.Time) *http.Request {
+	data, _ := json.Marshal(sessionData{UserName: "alice", IssuedAt: issuedAt.Unix()})
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/", nil)
+	s.setSignedCookie(rec, req, SessionCookieName, data, expiresAt)
+	for _, cookie := range rec.Result().Cookies() {
+		req.AddCookie(cookie)
+	}
+	return req
+}
+
+//renewedCookie returns the session cookie set in the response, or nil.
+func renewedCookie(rec *httptest.ResponseRecorder) *http.Cookie {
+	for _, cookie := range rec.Result().Cookies() {
+		if cookie.Name == SessionCookieName {
+			return cookie
+		}
+	}
+	return nil
+}
+
+func TestSessions(t *testing.T) {
+	now := time.Now()
+	testCases := []struct {
+		Description    string
+		IssuedAt       time.Time
+		ExpiresAt      time.Time
+		Allowed        bool
+		CheckErr       error
+		ExpectedOK     bool
+		ExpectedChecks int
+		//zero if the cookie is not renewed, time.Unix(0, 0) if it is removed
+		ExpectedExpiry time.Time
+	}{
+		{
+			Description:    "fresh session is not renewed",
+			IssuedAt:       now.Add(-time.Hour),
+			ExpiresAt:      now.Add(9 * time.Hour),
+			Allowed:        true,
+			ExpectedOK:     true,
+			ExpectedChecks: 0,
+		},
+		{
+			Description:    "older session is renewed after checking the user",
+			IssuedAt:       now.Add(-50 * time.Hour),
+			ExpiresAt:      now.Add(4 * time.Hour),
+			Allowed:        true,
+			ExpectedOK:     true,
+			ExpectedChecks: 1,
+			ExpectedExpiry: now.Add(10 * time.Hour),
+		},
+		{
+			Description:    "session is not renewed beyond the maximum age",
+			IssuedAt:       now.Add(-95 * time.Hour),
+			ExpiresAt:      now.Add(4 * time.Hour),
+			Allowed:        true,
+			ExpectedOK:     true,
+			ExpectedChecks: 1,
+			ExpectedExpiry: now.Add(5 * time.Hour),
+		},
+		{
+			Description:    "session that is already at the maximum age is not renewed",
+			IssuedAt:       now.Add(-96 * time.Hour),
+			ExpiresAt:      now.Add(4 * time.Hour),
+			Allowed:        true,
+			ExpectedOK:     true,
+			ExpectedChecks: 0,
+		},
+		{
+			Description: "session beyond the maximum age is rejected",
+			IssuedAt:    now.Add(-101 * time.Hour),
+			ExpiresAt:   now.Add(4 * time.Hour),
+			Allowed:     true,
+			ExpectedOK:  false,
+		},
+		{
+			Description: "expired session is rejected",
+			IssuedAt:    now.Add(-20 * time.Hour),
+			ExpiresAt:   now.Add(-time.Minute),
+			Allowed:     true,
+			ExpectedOK:  false,
+		},
+		{
+			Description:    "session of a user that may not use Alltag anymore is ended on renewal",
+			IssuedAt:       now.Add(-50 * time.Hour),
+			ExpiresAt:      now.Add(4 * time.Hour),
+			Allowed:        false,
+			ExpectedOK:     false,
+			ExpectedChecks: 1,
+			ExpectedExpiry: time.Unix(0, 0),
+		},
+		{
+			Description:    "group membership is checked on renewal",
+			IssuedAt:       now.Add(-50 * time.Hour),
+			ExpiresAt:      now.Add(4 * time.Hour),
+			Allowed:        true,
+			CheckErr:       ErrForbidden,
+			ExpectedOK:     false,
+			ExpectedChecks: 1,
+			ExpectedExpiry: time.Unix(0, 0),
+		},
+		{
+			Description:    "session is kept, but not renewed, when the user cannot be checked",
+			IssuedAt:       now.Add(-50 * time.Hour),
+			ExpiresAt:      now.Add(4 * time.Hour),
+			Allowed:        false,
+			CheckErr:       errors.New("LDAP server is unavailable"),
+			ExpectedOK:     true,
+			ExpectedChecks: 1,
+		},
+	}
+
+	for _, tc := range testCases {
+		//use a fresh instance for each test case, since sessions that are ended
+		//are remembered as revoked
+		driver := &testUserChecker{allowed: tc.Allowed, err: tc.CheckErr}
+		s := NewSessions(driver, SessionConfig{
+			Secret:   []byte("secret"),
+			Lifetime: 10 * time.Hour,
+			MaxAge:   100 * time.Hour,
+		})
+		rec := httptest.NewRecorder()
+		userName, ok := s.Verify(rec, makeSessionRequest(s, tc.IssuedAt, tc.ExpiresAt))
+
+		if ok != tc.ExpectedOK || (ok && userName != "alice") {
+			t.Errorf("%s: expected ok = %v, got ok = %v with username %q", tc.Description, tc.ExpectedOK, ok, userName)
+		}
+		if driver.checks != tc.ExpectedChecks {
+			t.Errorf("%s: expected %d calls to CheckUser, got %d", tc.Description, tc.ExpectedChecks, driver.checks)
+		}
+
+		cookie := renewedCookie(rec)
+		switch {
+		case tc.ExpectedExpiry.IsZero():
+			if cookie != nil {
+				t.Errorf("%s: expected no new cookie, got %#v", tc.Description, cookie)
+			}
+		case cookie == nil:
+			t.Errorf("%s: expected new cookie expiring at %s, got none", tc.Description, tc.ExpectedExpiry)
+		case cookie.Expires.Sub(tc.ExpectedExpiry) > time.Second || tc.ExpectedExpiry.Sub(cookie.Expires) > time.Second:
+			t.Errorf("%s: expected new cookie expiring at %s, got %s", tc.Description, tc.ExpectedExpiry, cookie.Expires)
+		}
+
+		//a renewed session retains its issue time
+		if cookie != nil && tc.ExpectedOK {
+			req := httptest.NewRequest("GET", "/", nil)
+			req.AddCookie(cookie)
+			data, _, ok := s.getSignedCookie(req, SessionCookieName)
+			var session sessionData
+			if !ok || json.Unmarshal(data, &session) != nil || session.IssuedAt != tc.IssuedAt.Unix() {
+				t.Errorf("%s: expected renewed cookie to retain the issue time, got %q", tc.Description, string(data))
+			}
+		}
+	}
+}
+
+func TestSessionsRejectForgedAndRevokedCookies(t *testing.T) {
+	s := NewSessions(&testUserChecker{allowed: true}, SessionConfig{
+		Secret:   []byte("secret"),
+		Lifetime: 10 * time.Hour,
+		MaxAge:   100 * time.Hour,
+	})
+	rec := httptest.NewRecorder()
+	s.Issue(rec, httptest.NewRequest("GET", "/", nil), "alice")
+	cookie := renewedCookie(rec)
+	if cookie == nil {
+		t.Fatal("Issue did not set a cookie")
+	}
+	verify := func(value string) bool {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.AddCookie(&http.Cookie{Name: SessionCookieName, Value: value})
+		_, ok := s.Verify(httptest.NewRecorder(), req)
+		return ok
+	}
+
+	if !verify(cookie.Value) {
+		t.Error("expected freshly issued session to be valid")
+	}
+	other := NewSessions(nil, SessionConfig{Secret: []byte("other secret"), Lifetime: time.Hour, MaxAge: time.Hour})
+	rec = httptest.NewRecorder()
+	other.Issue(rec, httptest.NewRequest("GET", "/", nil), "alice")
+	if verify(renewedCookie(rec).Value) {
+		t.Error("expected session signed with another secret to be rejected")
+	}
+	if verify(cookie.Value + "x") {
+		t.Error("expected session with tampered signature to be rejected")
+	}
+
+	//after logout, a copy of the cookie cannot be used anymore
+	req := httptest.NewRequest("POST", "/logout", nil)
+	req.AddCookie(cookie)
+	s.Revoke(httptest.NewRecorder(), req)
+	if verify(cookie.Value) {
+		t.Error("expected revoked session to be rejected")
+	}
+}
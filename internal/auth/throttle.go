@@ -0,0 +1,280 @@
+/*******************************************************************************
+*
+* Copyright 2019 Stefan Majewsky <majewsky@gmx.net>
+*
+* This program is free software: you can redistribute it and/or modify it under
+* the terms of the GNU General Public License as published by the Free Software
+* Foundation, either version 3 of the License, or (at your option) any later
+* version.
+*
+* This program is distributed in the hope that it will be useful, but WITHOUT ANY
+* WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+* A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License along with
+* this program. If not, see <http://www.gnu.org/licenses/>.
+*
+*******************************************************************************/
+
+package auth
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sapcc/go-bits/logg"
+)
+
+const (
+	//how many failed logins are allowed before the username or client IP is
+	//locked out (client IPs get more leeway since multiple users may share
+	//one, e.g. behind NAT)
+	throttleMaxFailuresPerUser = 5
+	throttleMaxFailuresPerIP   = 20
+	//the duration of the first lockout; every further failed login doubles it
+	throttleBaseDelay = 30 * time.Second
+	throttleMaxDelay  = 1 * time.Hour
+	//failed logins are forgotten after this long without further failures
+	throttleForgetAfter = 24 * time.Hour
+	//the RetryAfter reported while the limit is exhausted by attempts whose
+	//outcome is not known yet
+	throttlePendingDelay = 5 * time.Second
+)
+
+//ThrottleConfig contains all the configuration options for type Throttler.
+type ThrottleConfig struct {
+	//Requests from these networks are never throttled.
+	Allowlist []*net.IPNet
+	//Networks containing reverse proxies, cf. ClientIP().
+	TrustedProxies []*net.IPNet
+}
+
+//ThrottledError is returned by Throttler.CheckLogin when the login was not
+//checked because of too many failed attempts.
+type ThrottledError struct {
+	RetryAfter time.Duration
+}
+
+//Error implements the builtin/error interface.
+func (e ThrottledError) Error() string {
+	return fmt.Sprintf("too many failed login attempts, try again in %s", e.RetryAfter.Round(time.Second))
+}
+
+type throttleEntry struct {
+	failures      int
+	lastFailureAt time.Time
+	lockedUntil   time.Time
+	//number of attempts that are currently being checked by the driver
+	pending int
+}
+
+//Throttler wraps a Driver to protect it against brute-force attacks. After
+//several failed logins for the same username or from the same client IP,
+//further logins are locked out for an exponentially growing time.
+//
+//Lockouts apply to nonexisting usernames in exactly the same way as to
+//existing ones, so they do not reveal which users exist. (The drivers take
+//care of the same thing when checking logins, cf. the comments in CheckLogin
+//of the LDAP and htpasswd drivers.)
+//
+//Client IPs are only throttled when they are known. When the client IP cannot
+//be determined (or when a trusted reverse proxy did not say which client it
+//forwards for), only the username is throttled. Otherwise all those clients
+//would share a single lockout, and one attacker could lock out everyone.
+type Throttler struct {
+	driver Driver
+	cfg    ThrottleConfig
+
+	mutex *sync.Mutex
+	//the following fields are protected by the mutex
+	entries  map[string]*throttleEntry //key: "user:$NAME" or "ip:$ADDRESS"
+	purgedAt time.Time
+}
+
+//NewThrottler initializes a Throttler for the given Driver.
+func NewThrottler(driver Driver, cfg ThrottleConfig) *Throttler {
+	return &Throttler{
+		driver:   driver,
+		cfg:      cfg,
+		mutex:    &sync.Mutex{},
+		entries:  make(map[string]*throttleEntry),
+		purgedAt: time.Now(),
+	}
+}
+
+//Driver returns the Driver wrapped by this Throttler.
+func (t *Throttler) Driver() Driver {
+	return t.driver
+}
+
+//CheckLogin is like Driver.CheckLogin, but returns a ThrottledError without
+//checking the credentials if the username or the client IP is locked out.
+//The outcome is recorded in the metrics.
+func (t *Throttler) CheckLogin(r *http.Request, userName, password string) (bool, error) {
+	ok, err := t.checkLogin(r, userName, password)
+	RecordAuthAttempt(t.driver, ok, err)
+	return ok, err
+}
+
+func (t *Throttler) checkLogin(r *http.Request, userName, password string) (bool, error) {
+	clientIP := ClientIP(r, t.cfg.TrustedProxies)
+	if isInNetworks(clientIP, t.cfg.Allowlist) {
+		return t.driver.CheckLogin(userName, password)
+	}
+
+	//usernames are usually case-insensitive in LDAP, so an attacker could try
+	//different spellings to evade the lockout
+	userKey := "user:" + strings.ToLower(userName)
+	ipKey := ""
+	if clientIP != nil && !isInNetworks(clientIP, t.cfg.TrustedProxies) {
+		//IPv6 users usually have a whole /64 at their disposal
+		if clientIP.To4() == nil {
+			clientIP = clientIP.Mask(net.CIDRMask(64, 128))
+		}
+		ipKey = "ip:" + clientIP.String()
+	}
+
+	//the attempt is counted as pending in the same critical section as the
+	//lockout check, so that parallel attempts cannot all pass the check before
+	//any of their failures is recorded
+	err := t.beginAttempt(userKey, ipKey)
+	if err != nil {
+		return false, err
+	}
+	ok, err := t.driver.CheckLogin(userName, password)
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	now := time.Now()
+	t.endAttempt(userKey)
+	t.endAttempt(ipKey)
+	switch {
+	case err != nil && err != ErrForbidden:
+		//the check could not be performed, so this does not count as a failure
+	case ok || err == ErrForbidden:
+		//the credentials were correct, so the user does not need to be locked out
+		//because of earlier typos (but the client IP might still be guessing
+		//passwords for other users, so we do not reset that)
+		if entry, exists := t.entries[userKey]; exists && entry.pending == 0 {
+			delete(t.entries, userKey)
+		} else if exists {
+			entry.failures = 0
+			entry.lockedUntil = time.Time{}
+		}
+	default:
+		t.recordFailure(userKey, throttleMaxFailuresPerUser, now, fmt.Sprintf("user %q", userName))
+		if ipKey != "" {
+			t.recordFailure(ipKey, throttleMaxFailuresPerIP, now, fmt.Sprintf("client IP %s", clientIP))
+		}
+	}
+	t.purge(now)
+	return ok, err
+}
+
+//beginAttempt checks whether a login attempt may proceed. If so, the attempt
+//is counted as pending for the given keys until endAttempt is called. An
+//empty ipKey is ignored.
+func (t *Throttler) beginAttempt(userKey, ipKey string) error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	now := time.Now()
+
+	retryAfter := t.lockedFor(userKey, throttleMaxFailuresPerUser, now)
+	if ipKey != "" {
+		if d := t.lockedFor(ipKey, throttleMaxFailuresPerIP, now); d > retryAfter {
+			retryAfter = d
+		}
+	}
+	if retryAfter > 0 {
+		return ThrottledError{retryAfter}
+	}
+
+	t.entry(userKey, now).pending++
+	if ipKey != "" {
+		t.entry(ipKey, now).pending++
+	}
+	return nil
+}
+
+//endAttempt removes a pending attempt that was counted by beginAttempt. The
+//caller must hold the mutex.
+func (t *Throttler) endAttempt(key string) {
+	if entry, exists := t.entries[key]; exists && entry.pending > 0 {
+		entry.pending--
+	}
+}
+
+//entry returns the entry for the given key, or creates it if it does not
+//exist. Failures that are old enough are forgotten. The caller must hold the
+//mutex.
+func (t *Throttler) entry(key string, now time.Time) *throttleEntry {
+	entry, exists := t.entries[key]
+	if !exists {
+		entry = &throttleEntry{}
+		t.entries[key] = entry
+	} else if entry.failures > 0 && now.Sub(entry.lastFailureAt) > throttleForgetAfter {
+		entry.failures = 0
+	}
+	return entry
+}
+
+//lockedFor returns how long the given key is still locked out. Pending
+//attempts count like failures here: if they all fail, they will reach the
+//limit, so no further attempts may start until their outcome is known. The
+//caller must hold the mutex.
+func (t *Throttler) lockedFor(key string, maxFailures int, now time.Time) time.Duration {
+	entry, exists := t.entries[key]
+	if !exists {
+		return 0
+	}
+	if entry.lockedUntil.After(now) {
+		return entry.lockedUntil.Sub(now)
+	}
+	failures := entry.failures
+	if now.Sub(entry.lastFailureAt) > throttleForgetAfter {
+		failures = 0
+	}
+	if entry.pending > 0 && failures+entry.pending >= maxFailures {
+		return throttlePendingDelay
+	}
+	return 0
+}
+
+//recordFailure records a failed login for the given key. The caller must hold
+//the mutex.
+func (t *Throttler) recordFailure(key string, maxFailures int, now time.Time, description string) {
+	entry := t.entry(key, now)
+	entry.failures++
+	entry.lastFailureAt = now
+	if entry.failures < maxFailures {
+		return
+	}
+
+	delay := throttleMaxDelay
+	if exponent := entry.failures - maxFailures; exponent < 20 {
+		delay = throttleBaseDelay << uint(exponent)
+		if delay > throttleMaxDelay {
+			delay = throttleMaxDelay
+		}
+	}
+	entry.lockedUntil = now.Add(delay)
+	logg.Info("%d failed login attempts for %s, locking out for %s", entry.failures, description, delay)
+}
+
+//purge removes entries that will not be needed anymore, to bound memory
+//usage. The caller must hold the mutex.
+func (t *Throttler) purge(now time.Time) {
+	if now.Sub(t.purgedAt) < 10*time.Minute {
+		return
+	}
+	for key, entry := range t.entries {
+		if now.Sub(entry.lastFailureAt) > throttleForgetAfter && !entry.lockedUntil.After(now) && entry.pending == 0 {
+			delete(t.entries, key)
+		}
+	}
+	t.purgedAt = now
+}
@@ -0,0 +1,203 @@
+/*******************************************************************************
+*
+* Copyright 2019 Stefan Majewsky <majewsky@gmx.net>
+*
+* This program is free software: you can redistribute it and/or modify it under
+* the terms of the GNU General Public License as published by the Free Software
+* Foundation, either version 3 of the License, or (at your option) any later
+* version.
+*
+* This program is distributed in the hope that it will be useful, but WITHOUT ANY
+* WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+* A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License along with
+* this program. If not, see <http://www.gnu.org/licenses/>.
+*
+*******************************************************************************/
+
+package auth
+
+import (
+	"net"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+//testDriver accepts the password "correct" for every user. If `block` is not
+//nil, each CheckLogin waits until it is closed.
+type testDriver struct {
+	block    chan struct{}
+	mutex    sync.Mutex
+	attempts int
+}
+
+func (d *testDriver) CheckLogin(userName, password string) (bool, error) {
+	d.mutex.Lock()
+	d.attempts++
+	d.mutex.Unlock()
+	if d.block != nil {
+		<-d.block
+	}
+	return password == "correct", nil
+}
+
+func mustParseCIDR(t *testing.T, input string) *net.IPNet {
+	t.Helper()
+	_, network, err := net.ParseCIDR(input)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	return network
+}
+
+func checkLoginFrom(throttler *Throttler, remoteAddr, forwardedFor, userName, password string) (bool, error) {
+	r := httptest.NewRequest("POST", "/login", nil)
+	r.RemoteAddr = remoteAddr
+	if forwardedFor != "" {
+		r.Header.Set("X-Forwarded-For", forwardedFor)
+	}
+	return throttler.checkLogin(r, userName, password)
+}
+
+func TestThrottleUser(t *testing.T) {
+	throttler := NewThrottler(&testDriver{}, ThrottleConfig{})
+
+	for idx := 0; idx < throttleMaxFailuresPerUser; idx++ {
+		ok, err := checkLoginFrom(throttler, "192.0.2.1:1234", "", "alice", "wrong")
+		if ok || err != nil {
+			t.Fatalf("expected attempt %d to fail without error, but got ok = %t, err = %v", idx+1, ok, err)
+		}
+	}
+	//now even the correct password is not checked anymore, also with a
+	//different spelling of the username and from a different client
+	for _, userName := range []string{"alice", "Alice"} {
+		_, err := checkLoginFrom(throttler, "192.0.2.2:1234", "", userName, "correct")
+		if _, ok := err.(ThrottledError); !ok {
+			t.Errorf("expected ThrottledError for %q, but got %v", userName, err)
+		}
+	}
+	//other users are not affected
+	ok, err := checkLoginFrom(throttler, "192.0.2.1:1234", "", "bob", "correct")
+	if !ok || err != nil {
+		t.Errorf("expected login for bob to succeed, but got ok = %t, err = %v", ok, err)
+	}
+}
+
+func TestThrottleClientIP(t *testing.T) {
+	throttler := NewThrottler(&testDriver{}, ThrottleConfig{
+		Allowlist: []*net.IPNet{mustParseCIDR(t, "198.51.100.0/24")},
+	})
+
+	for idx := 0; idx < throttleMaxFailuresPerIP; idx++ {
+		userName := string(rune('a' + idx))
+		_, err := checkLoginFrom(throttler, "192.0.2.1:1234", "", userName, "wrong")
+		if err != nil {
+			t.Fatalf("unexpected error in attempt %d: %s", idx+1, err.Error())
+		}
+	}
+	_, err := checkLoginFrom(throttler, "192.0.2.1:1234", "", "alice", "correct")
+	if _, ok := err.(ThrottledError); !ok {
+		t.Errorf("expected ThrottledError, but got %v", err)
+	}
+	//other clients are not affected
+	ok, err := checkLoginFrom(throttler, "192.0.2.2:1234", "", "alice", "correct")
+	if !ok || err != nil {
+		t.Errorf("expected login from other client to succeed, but got ok = %t, err = %v", ok, err)
+	}
+	//the allowlist is never throttled
+	for idx := 0; idx < throttleMaxFailuresPerUser+1; idx++ {
+		_, err := checkLoginFrom(throttler, "198.51.100.1:1234", "", "carol", "wrong")
+		if err != nil {
+			t.Fatalf("unexpected error for allowlisted client in attempt %d: %s", idx+1, err.Error())
+		}
+	}
+}
+
+func TestThrottleUnknownClientIP(t *testing.T) {
+	throttler := NewThrottler(&testDriver{}, ThrottleConfig{
+		TrustedProxies: []*net.IPNet{mustParseCIDR(t, "10.0.0.0/8")},
+	})
+
+	//neither clients with an unknown IP, nor clients behind a proxy that does
+	//not report their IP, shall share one lockout
+	for _, remoteAddr := range []string{"", "10.0.0.1:1234"} {
+		for idx := 0; idx < throttleMaxFailuresPerIP+1; idx++ {
+			userName := string(rune('a' + idx))
+			_, err := checkLoginFrom(throttler, remoteAddr, "", userName, "wrong")
+			if err != nil {
+				t.Fatalf("unexpected error for RemoteAddr %q in attempt %d: %s", remoteAddr, idx+1, err.Error())
+			}
+		}
+	}
+	//but the username is still throttled
+	for idx := 0; idx < throttleMaxFailuresPerUser; idx++ {
+		_, err := checkLoginFrom(throttler, "", "", "zed", "wrong")
+		if err != nil {
+			t.Fatalf("unexpected error in attempt %d: %s", idx+1, err.Error())
+		}
+	}
+	_, err := checkLoginFrom(throttler, "", "", "zed", "correct")
+	if _, ok := err.(ThrottledError); !ok {
+		t.Errorf("expected ThrottledError, but got %v", err)
+	}
+
+	//when the proxy reports the client IP, that IP is throttled
+	for idx := 0; idx < throttleMaxFailuresPerIP; idx++ {
+		userName := "user" + string(rune('a'+idx))
+		_, err := checkLoginFrom(throttler, "10.0.0.1:1234", "192.0.2.1", userName, "wrong")
+		if err != nil {
+			t.Fatalf("unexpected error in attempt %d: %s", idx+1, err.Error())
+		}
+	}
+	_, err = checkLoginFrom(throttler, "10.0.0.1:1234", "192.0.2.1", "alice", "correct")
+	if _, ok := err.(ThrottledError); !ok {
+		t.Errorf("expected ThrottledError, but got %v", err)
+	}
+}
+
+func TestThrottleParallelAttempts(t *testing.T) {
+	driver := &testDriver{block: make(chan struct{})}
+	throttler := NewThrottler(driver, ThrottleConfig{})
+
+	//start many attempts at once, while the driver has not answered any of them
+	const attemptCount = 3 * throttleMaxFailuresPerUser
+	var wg sync.WaitGroup
+	results := make(chan error, attemptCount)
+	for idx := 0; idx < attemptCount; idx++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := checkLoginFrom(throttler, "192.0.2.1:1234", "", "alice", "wrong")
+			results <- err
+		}()
+	}
+
+	//the attempts that are not throttled are waiting for the driver; once all
+	//others have returned, let them finish
+	throttledCount := 0
+	for throttledCount < attemptCount-throttleMaxFailuresPerUser {
+		err := <-results
+		if _, ok := err.(ThrottledError); !ok {
+			t.Fatalf("expected ThrottledError, but got %v", err)
+		}
+		throttledCount++
+	}
+	close(driver.block)
+	wg.Wait()
+	close(results)
+	for err := range results {
+		if err != nil {
+			t.Errorf("expected checked attempt to fail without error, but got %v", err)
+		}
+	}
+
+	if driver.attempts != throttleMaxFailuresPerUser {
+		t.Errorf("expected %d attempts to reach the driver, but got %d", throttleMaxFailuresPerUser, driver.attempts)
+	}
+	_, err := checkLoginFrom(throttler, "192.0.2.1:1234", "", "alice", "correct")
+	if _, ok := err.(ThrottledError); !ok {
+		t.Errorf("expected ThrottledError after parallel failures, but got %v", err)
+	}
+}
@@ -0,0 +1,477 @@
+/*******************************************************************************
+*
+* Copyright 2019 Stefan Majewsky <majewsky@gmx.net>
+*
+* This program is free software: you can redistribute it and/or modify it under
+* the terms of the GNU General Public License as published by the Free Software
+* Foundation, either version 3 of the License, or (at your option) any later
+* version.
+*
+* This program is distributed in the hope that it will be useful, but WITHOUT ANY
+* WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+* A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License along with
+* this program. If not, see <http://www.gnu.org/licenses/>.
+*
+*******************************************************************************/
+
+//Package caldav exposes each user's open tasks as a CalDAV task collection
+//(RFC 4791), so that they can be synchronized with task apps on phones and
+//desktops. Only the parts of WebDAV and CalDAV that are required by common
+//clients are implemented.
+//
+//The resource tree looks like this:
+//
+//	/dav/                    root collection
+//	/dav/principal/          the principal of the authenticated user
+//	/dav/calendars/          calendar home of the authenticated user
+//	/dav/calendars/tasks/    the task collection
+//	/dav/calendars/tasks/*   one VTODO resource per open task
+//
+//Since the user is identified through authentication, every user sees the
+//same paths.
+package caldav
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/majewsky/alltag/internal/date"
+	"github.com/majewsky/alltag/internal/db"
+	"github.com/majewsky/alltag/internal/ical"
+	"github.com/majewsky/alltag/internal/metrics"
+	"github.com/sapcc/go-bits/respondwith"
+)
+
+const (
+	rootPath       = "/dav/"
+	principalPath  = "/dav/principal/"
+	homePath       = "/dav/calendars/"
+	collectionPath = "/dav/calendars/tasks/"
+)
+
+//maxRequestBodySize is the maximum size of request bodies. A single VTODO or
+//an XML request is much smaller than this.
+const maxRequestBodySize = 1 << 20
+
+type handler struct {
+	storage db.Storage
+}
+
+//NewHandler returns a http.Handler serving the CalDAV endpoint below /dav/.
+func NewHandler(storage db.Storage) http.Handler {
+	h := handler{storage}
+	r := mux.NewRouter()
+	r.Use(metrics.InstrumentRoutes)
+
+	r.Methods("OPTIONS").PathPrefix(rootPath).
+		HandlerFunc(h.Options)
+	r.Methods("PROPFIND").PathPrefix(rootPath).
+		HandlerFunc(h.Propfind)
+	r.Methods("REPORT").Path("/dav/calendars/tasks{slash:/?}").
+		HandlerFunc(h.Report)
+	r.Methods("GET", "HEAD").Path("/dav/calendars/tasks/{name}").
+		HandlerFunc(h.GetTask)
+	r.Methods("PUT").Path("/dav/calendars/tasks/{name}").
+		HandlerFunc(h.PutTask)
+	r.Methods("DELETE").Path("/dav/calendars/tasks/{name}").
+		HandlerFunc(h.DeleteTask)
+
+	return r
+}
+
+func currentUser(r *http.Request) string {
+	//This header was set by the authentication middleware in main.go.
+	return r.Header.Get("X-Alltag-Username")
+}
+
+func (h handler) Options(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("DAV", "1, 3, calendar-access")
+	w.Header().Set("Allow", "OPTIONS, GET, HEAD, PUT, DELETE, PROPFIND, REPORT")
+	w.WriteHeader(http.StatusOK)
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// task resources
+
+//taskResource is a task as it appears in the task collection.
+type taskResource struct {
+	Name string
+	Task db.Task
+	Body []byte
+	ETag string
+}
+
+//Path returns the path of this resource.
+func (t taskResource) Path() string {
+	return collectionPath + t.Name
+}
+
+//resourceName returns the name of the resource containing the given task.
+func resourceName(task db.Task) string {
+	if task.CalDAVName != nil {
+		return *task.CalDAVName
+	}
+	return fmt.Sprintf("task-%d.ics", task.ID)
+}
+
+//renderTaskResource renders a task as a resource in the task collection.
+func renderTaskResource(task db.Task, locationLabels []string) (taskResource, error) {
+	//DTSTAMP needs to be stable across requests, otherwise the ETag would
+	//change on every request
+	cal := ical.NewCalendar()
+	cal.Components = []ical.Component{
+		ical.EncodeTask(task, locationLabels, task.StartsAt.FirstSecondIn(time.UTC)),
+	}
+	var buf bytes.Buffer
+	err := cal.Encode(&buf)
+	if err != nil {
+		return taskResource{}, err
+	}
+	hash := sha256.Sum256(buf.Bytes())
+
+	return taskResource{
+		Name: resourceName(task),
+		Task: task,
+		Body: buf.Bytes(),
+		ETag: `"` + hex.EncodeToString(hash[:16]) + `"`,
+	}, nil
+}
+
+//listTaskResources renders all open tasks of the given user.
+func (h handler) listTaskResources(userName string) ([]taskResource, error) {
+	tasks, err := h.storage.ListOpenTasks(userName)
+	if err != nil {
+		return nil, err
+	}
+	locationIDs, err := h.storage.ListTaskLocations(userName)
+	if err != nil {
+		return nil, err
+	}
+	locations, err := h.storage.ListLocations(userName)
+	if err != nil {
+		return nil, err
+	}
+	locationLabels := db.NewLocationLabels(locations)
+
+	result := make([]taskResource, len(tasks))
+	for idx, task := range tasks {
+		result[idx], err = renderTaskResource(task, locationLabels.Of(locationIDs[task.ID]))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Name < result[j].Name
+	})
+	return result, nil
+}
+
+//findTaskResource renders the open task with the given resource name, or
+//returns nil if there is none.
+func (h handler) findTaskResource(userName, name string) (*taskResource, error) {
+	task, err := h.findTaskByName(userName, name)
+	if err != nil || task == nil {
+		return nil, err
+	}
+	locationIDs, err := h.storage.FindTaskLocations(*task)
+	if err != nil {
+		return nil, err
+	}
+	locations, err := h.storage.ListLocations(userName)
+	if err != nil {
+		return nil, err
+	}
+	res, err := renderTaskResource(*task, db.NewLocationLabels(locations).Of(locationIDs))
+	return &res, err
+}
+
+//findTaskByName returns the open task with the given resource name, or nil if
+//there is none.
+func (h handler) findTaskByName(userName, name string) (*db.Task, error) {
+	task, err := h.storage.FindOpenTaskByCalDAVName(userName, name)
+	if err != sql.ErrNoRows {
+		return task, err
+	}
+	//tasks that were not created via CalDAV have a generated name, cf. resourceName
+	id := strings.TrimSuffix(strings.TrimPrefix(name, "task-"), ".ics")
+	return h.findTaskByGeneratedID(userName, id, func(t db.Task) bool {
+		return resourceName(t) == name
+	})
+}
+
+//findTaskByUID returns the open task whose VTODO has the given UID, or nil if
+//there is none.
+func (h handler) findTaskByUID(userName, uid string) (*db.Task, error) {
+	task, err := h.storage.FindOpenTaskByICalUID(userName, uid)
+	if err != sql.ErrNoRows {
+		return task, err
+	}
+	//tasks that were not created via CalDAV have a generated UID, cf. ical.TaskUID
+	id := strings.TrimSuffix(strings.TrimPrefix(uid, "task-"), "@alltag")
+	return h.findTaskByGeneratedID(userName, id, func(t db.Task) bool {
+		return ical.TaskUID(t) == uid
+	})
+}
+
+//findTaskByGeneratedID is the common part of findTaskByName and
+//findTaskByUID. It returns the open task with the given ID, but only if the
+//name or UID that was looked up is actually the one generated for this task.
+func (h handler) findTaskByGeneratedID(userName, idStr string, isGenerated func(db.Task) bool) (*db.Task, error) {
+	id, err := strconv.ParseInt(idStr, 10, 64)
+	if err != nil {
+		return nil, nil
+	}
+	task, err := h.storage.FindTask(userName, id)
+	switch {
+	case err == sql.ErrNoRows:
+		return nil, nil
+	case err != nil:
+		return nil, err
+	case task.IsClosed() || !isGenerated(*task):
+		return nil, nil
+	default:
+		return task, nil
+	}
+}
+
+//lookupTaskResource returns the task resource with the given name, or nil if
+//there is none.
+func lookupTaskResource(resources []taskResource, name string) *taskResource {
+	for idx := range resources {
+		if resources[idx].Name == name {
+			return &resources[idx]
+		}
+	}
+	return nil
+}
+
+//checkPreconditions evaluates the If-Match and If-None-Match headers against
+//the given resource (nil if the resource does not exist). If a precondition
+//fails, an error response is written and false is returned.
+func checkPreconditions(w http.ResponseWriter, r *http.Request, res *taskResource) bool {
+	ifMatch := r.Header.Get("If-Match")
+	if ifMatch != "" {
+		if res == nil || (ifMatch != "*" && !containsETag(ifMatch, res.ETag)) {
+			http.Error(w, "Precondition failed", http.StatusPreconditionFailed)
+			return false
+		}
+	}
+	ifNoneMatch := r.Header.Get("If-None-Match")
+	if ifNoneMatch != "" && res != nil {
+		if ifNoneMatch == "*" || containsETag(ifNoneMatch, res.ETag) {
+			http.Error(w, "Precondition failed", http.StatusPreconditionFailed)
+			return false
+		}
+	}
+	return true
+}
+
+//containsETag checks whether the value of an If-Match or If-None-Match header
+//contains the given ETag.
+func containsETag(headerValue, etag string) bool {
+	for _, field := range strings.Split(headerValue, ",") {
+		if strings.TrimPrefix(strings.TrimSpace(field), "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
+
+func (h handler) GetTask(w http.ResponseWriter, r *http.Request) {
+	res, err := h.findTaskResource(currentUser(r), mux.Vars(r)["name"])
+	if respondwith.ErrorText(w, err) {
+		return
+	}
+	if res == nil {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/calendar; charset=utf-8")
+	w.Header().Set("ETag", res.ETag)
+	if containsETag(r.Header.Get("If-None-Match"), res.ETag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	if r.Method != "HEAD" {
+		w.Write(res.Body)
+	}
+}
+
+func (h handler) DeleteTask(w http.ResponseWriter, r *http.Request) {
+	res, err := h.findTaskResource(currentUser(r), mux.Vars(r)["name"])
+	if respondwith.ErrorText(w, err) {
+		return
+	}
+	if res == nil {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+	if !checkPreconditions(w, r, res) {
+		return
+	}
+
+	err = h.storage.DeleteTask(&res.Task)
+	if respondwith.ErrorText(w, err) {
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h handler) PutTask(w http.ResponseWriter, r *http.Request) {
+	userName := currentUser(r)
+	name := mux.Vars(r)["name"]
+	res, err := h.findTaskResource(userName, name)
+	if respondwith.ErrorText(w, err) {
+		return
+	}
+	if !checkPreconditions(w, r, res) {
+		return
+	}
+
+	//we only accept a single VTODO (but there may be other components like
+	//VTIMEZONE)
+	cal, err := ical.Parse(http.MaxBytesReader(w, r.Body, maxRequestBodySize))
+	if err != nil {
+		http.Error(w, "cannot parse request body: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	var todos []ical.Component
+	for _, component := range cal.Components {
+		switch component.Name {
+		case "VTODO":
+			todos = append(todos, component)
+		case "VEVENT", "VJOURNAL":
+			http.Error(w, "only VTODO components are supported", http.StatusUnsupportedMediaType)
+			return
+		}
+	}
+	if cal.Name != "VCALENDAR" || len(todos) != 1 {
+		http.Error(w, "expected a VCALENDAR with exactly one VTODO", http.StatusBadRequest)
+		return
+	}
+	todo := todos[0]
+	uidProp, _ := todo.Get("UID")
+	uid := ical.UnescapeText(uidProp.Value)
+	if uid == "" {
+		http.Error(w, "VTODO has no UID", http.StatusBadRequest)
+		return
+	}
+	other, err := h.findTaskByUID(userName, uid)
+	if respondwith.ErrorText(w, err) {
+		return
+	}
+	if other != nil && resourceName(*other) != name {
+		http.Error(w, "UID is already used by "+collectionPath+resourceName(*other), http.StatusConflict)
+		return
+	}
+	decoded, err := ical.DecodeTask(todo, date.Now())
+	if err == nil && decoded.UnsupportedRecurrence != nil {
+		//unlike the import in the UI, this cannot just drop the RRULE: the client
+		//would not notice that the task does not recur anymore
+		err = fmt.Errorf("task %q: %s", decoded.Task.Label, decoded.UnsupportedRecurrence.Error())
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	//unlike the import in the UI, CalDAV does not create locations on the fly
+	//since some clients fill CATEGORIES with arbitrary tags
+	resolver, err := ical.NewLocationResolver(h.storage, userName, false)
+	if respondwith.ErrorText(w, err) {
+		return
+	}
+	newLocationIDs, err := resolver.Resolve(decoded.LocationLabels)
+	if respondwith.ErrorText(w, err) {
+		return
+	}
+
+	task := mergeTask(res, decoded.Task, len(newLocationIDs) > 0)
+	task.UserName = userName
+	if res == nil {
+		task.ICalUID = &uid
+		task.CalDAVName = &name
+	}
+	if task.IsClassified() {
+		err := ical.CheckClassification(task)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	err = h.storage.Transaction(func(s db.Storage) error {
+		err := s.SaveTask(&task)
+		if err == nil && task.IsClassified() && len(newLocationIDs) > 0 {
+			err = s.SetTaskLocations(task, newLocationIDs)
+		}
+		if err == nil && res == nil {
+			err = s.EmitTaskEvent(db.WebhookEventTaskCreated, task)
+		}
+		if err == nil && task.IsClassified() && (res == nil || !res.Task.IsClassified()) {
+			err = s.EmitTaskEvent(db.WebhookEventTaskClassified, task)
+		}
+		if err == nil && ical.IsFinished(todo) {
+			err = s.CloseTask(&task)
+		}
+		return err
+	})
+	if respondwith.ErrorText(w, err) {
+		return
+	}
+
+	//there is no ETag in the response since the stored representation differs
+	//from the request body, so the client needs to fetch it again
+	if res == nil {
+		w.WriteHeader(http.StatusCreated)
+	} else {
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+//mergeTask computes the task that results from a PUT request. The label is
+//always taken from the request. The other attributes are only taken from the
+//request if it contains a complete classification, since some clients drop
+//properties that they do not know. New tasks without a complete
+//classification (including at least one known location) are stored as
+//unclassified tasks.
+func mergeTask(existing *taskResource, decoded db.Task, hasLocations bool) db.Task {
+	if existing == nil {
+		if decoded.IsClassified() && hasLocations {
+			return decoded
+		}
+		return db.Task{
+			Label:    decoded.Label,
+			StartsAt: date.Epoch, //zero value
+			DueAt:    date.Epoch, //zero value
+		}
+	}
+
+	task := existing.Task
+	task.Label = decoded.Label
+	if decoded.IsClassified() && (hasLocations || task.IsClassified()) {
+		task.Class = decoded.Class
+		task.InitialPriority = decoded.InitialPriority
+		task.FinalPriority = decoded.FinalPriority
+		task.RecurrenceDays = decoded.RecurrenceDays
+		task.RecurrenceFromDueDate = decoded.RecurrenceFromDueDate
+		task.RecurrenceRule = decoded.RecurrenceRule
+		task.StartsAt = decoded.StartsAt
+		task.DueAt = decoded.DueAt
+	}
+	return task
+}
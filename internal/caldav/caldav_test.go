@@ -0,0 +1,280 @@
+/*******************************************************************************
+*
+* Copyright 2019 Stefan Majewsky <majewsky@gmx.net>
+*
+* This program is free software: you can redistribute it and/or modify it under
+* the terms of the GNU General Public License as published by the Free Software
+* Foundation, either version 3 of the License, or (at your option) any later
+* version.
+*
+* This program is distributed in the hope that it will be useful, but WITHOUT ANY
+* WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+* A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License along with
+* this program. If not, see <http://www.gnu.org/licenses/>.
+*
+*******************************************************************************/
+
+package caldav
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/majewsky/alltag/internal/date"
+	"github.com/majewsky/alltag/internal/db"
+	"github.com/majewsky/alltag/internal/ical"
+)
+
+//testClient sends requests to the CalDAV handler like a CalDAV client would,
+//but without going through the network.
+type testClient struct {
+	t       *testing.T
+	handler http.Handler
+}
+
+func newTestClient(t *testing.T, storage db.Storage) testClient {
+	return testClient{t, NewHandler(storage)}
+}
+
+func (c testClient) request(method, path string, headers map[string]string, body string) *http.Response {
+	c.t.Helper()
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	//this is usually done by the authentication middleware in main.go
+	req.Header.Set("X-Alltag-Username", "alice")
+	for key, value := range headers {
+		req.Header.Set(key, value)
+	}
+	rec := httptest.NewRecorder()
+	c.handler.ServeHTTP(rec, req)
+	return rec.Result()
+}
+
+func (c testClient) expect(resp *http.Response, expectedStatus int) string {
+	c.t.Helper()
+	body, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != expectedStatus {
+		c.t.Errorf("%s %s: expected status %d, but got %d: %s",
+			resp.Request.Method, resp.Request.URL.Path, expectedStatus, resp.StatusCode, body)
+	}
+	return string(body)
+}
+
+func makeCalendar(lines ...string) string {
+	return "BEGIN:VCALENDAR\r\nVERSION:2.0\r\nPRODID:-//test//EN\r\nBEGIN:VTODO\r\n" +
+		strings.Join(lines, "\r\n") + "\r\nEND:VTODO\r\nEND:VCALENDAR\r\n"
+}
+
+func setupStorage(t *testing.T) db.Storage {
+	t.Helper()
+	storage := db.NewMemoryStorage()
+	for _, label := range []string{"Home", "Office"} {
+		err := storage.SaveLocation(&db.Location{Label: label, UserName: "alice"})
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	return storage
+}
+
+func TestTaskLifecycle(t *testing.T) {
+	storage := setupStorage(t)
+	c := newTestClient(t, storage)
+	path := collectionPath + "laundry.ics"
+	noHeaders := map[string]string{}
+
+	//create a new task
+	body := makeCalendar(
+		"UID:laundry@example.com",
+		"SUMMARY:Do the laundry",
+		"CATEGORIES:physical,home,unknown",
+		"DTSTART;VALUE=DATE:20191104",
+		"DUE;VALUE=DATE:20191106",
+	)
+	c.expect(c.request("PUT", path, map[string]string{"If-None-Match": "*"}, body), http.StatusCreated)
+	//creating it again fails
+	c.expect(c.request("PUT", path, map[string]string{"If-None-Match": "*"}, body), http.StatusPreconditionFailed)
+
+	tasks, err := storage.ListOpenTasks("alice")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(tasks) != 1 {
+		t.Fatalf("expected 1 task, but got %d", len(tasks))
+	}
+	task := tasks[0]
+	if task.Label != "Do the laundry" || !task.IsClassified() || *task.Class != db.TaskClassPhysical || task.DueAt.String() != "2019-11-06" {
+		t.Errorf("task was not stored correctly: %#v", task)
+	}
+	locationIDs, err := storage.FindTaskLocations(task)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(locationIDs) != 1 {
+		t.Errorf("expected task to have exactly one location, but got %v", locationIDs)
+	}
+
+	//read it back
+	resp := c.request("GET", path, noHeaders, "")
+	body = c.expect(resp, http.StatusOK)
+	etag := resp.Header.Get("ETag")
+	for _, expected := range []string{"UID:laundry@example.com", "SUMMARY:Do the laundry", "CATEGORIES:physical,Home", "STATUS:NEEDS-ACTION"} {
+		if !strings.Contains(body, expected) {
+			t.Errorf("expected GET response to contain %q, but got: %s", expected, body)
+		}
+	}
+	c.expect(c.request("GET", path, map[string]string{"If-None-Match": etag}, ""), http.StatusNotModified)
+
+	//updates require the current ETag
+	body = makeCalendar(
+		"UID:laundry@example.com",
+		"SUMMARY:Do the laundry and fold it",
+	)
+	c.expect(c.request("PUT", path, map[string]string{"If-Match": `"wrong"`}, body), http.StatusPreconditionFailed)
+	c.expect(c.request("PUT", path, map[string]string{"If-Match": etag}, body), http.StatusNoContent)
+	updated, err := storage.FindTask("alice", task.ID)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	//the client did not send the classification, so it was retained
+	if updated.Label != "Do the laundry and fold it" || !updated.IsClassified() || updated.DueAt != task.DueAt {
+		t.Errorf("task was not updated correctly: %#v", updated)
+	}
+
+	//completing the task closes it, so it disappears from the collection
+	resp = c.request("GET", path, noHeaders, "")
+	c.expect(resp, http.StatusOK)
+	body = makeCalendar(
+		"UID:laundry@example.com",
+		"SUMMARY:Do the laundry and fold it",
+		"STATUS:COMPLETED",
+	)
+	c.expect(c.request("PUT", path, map[string]string{"If-Match": resp.Header.Get("ETag")}, body), http.StatusNoContent)
+	c.expect(c.request("GET", path, noHeaders, ""), http.StatusNotFound)
+	completions, err := storage.ListTaskCompletions("alice", time.Now().Add(-time.Hour))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(completions) != 1 {
+		t.Errorf("expected 1 task completion, but got %d", len(completions))
+	}
+}
+
+func TestTasksNotCreatedViaCalDAV(t *testing.T) {
+	storage := setupStorage(t)
+	c := newTestClient(t, storage)
+	noHeaders := map[string]string{}
+
+	var tasks []db.Task
+	for _, label := range []string{"Open", "Closed"} {
+		task := db.Task{Label: label, UserName: "alice", StartsAt: date.Epoch, DueAt: date.Epoch}
+		if label == "Closed" {
+			today := date.Now()
+			task.ClosedAt = &today
+		}
+		err := storage.SaveTask(&task)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		tasks = append(tasks, task)
+	}
+	openPath := collectionPath + resourceName(tasks[0])
+	closedPath := collectionPath + resourceName(tasks[1])
+
+	body := c.expect(c.request("GET", openPath, noHeaders, ""), http.StatusOK)
+	if !strings.Contains(body, "UID:"+ical.TaskUID(tasks[0])) {
+		t.Errorf("expected generated UID in GET response, but got: %s", body)
+	}
+	c.expect(c.request("GET", closedPath, noHeaders, ""), http.StatusNotFound)
+	c.expect(c.request("GET", collectionPath+"task-abc.ics", noHeaders, ""), http.StatusNotFound)
+
+	//the generated UID cannot be used for another resource
+	body = makeCalendar("UID:"+ical.TaskUID(tasks[0]), "SUMMARY:Duplicate")
+	c.expect(c.request("PUT", collectionPath+"duplicate.ics", noHeaders, body), http.StatusConflict)
+
+	//but it can be updated under its own name
+	body = makeCalendar("UID:"+ical.TaskUID(tasks[0]), "SUMMARY:Still open")
+	c.expect(c.request("PUT", openPath, noHeaders, body), http.StatusNoContent)
+
+	c.expect(c.request("DELETE", openPath, noHeaders, ""), http.StatusNoContent)
+	c.expect(c.request("DELETE", openPath, noHeaders, ""), http.StatusNotFound)
+}
+
+func TestPropfindAndReport(t *testing.T) {
+	storage := setupStorage(t)
+	c := newTestClient(t, storage)
+	for _, name := range []string{"a", "b"} {
+		body := makeCalendar("UID:"+name+"@example.com", "SUMMARY:Task "+name)
+		c.expect(c.request("PUT", collectionPath+name+".ics", nil, body), http.StatusCreated)
+	}
+
+	body := c.expect(c.request("PROPFIND", collectionPath, map[string]string{"Depth": "1"},
+		`<?xml version="1.0"?><propfind xmlns="DAV:"><prop><getetag/></prop></propfind>`,
+	), http.StatusMultiStatus)
+	for _, expected := range []string{"/dav/calendars/tasks/a.ics", "/dav/calendars/tasks/b.ics"} {
+		if !strings.Contains(body, expected) {
+			t.Errorf("expected PROPFIND response to contain %q, but got: %s", expected, body)
+		}
+	}
+
+	body = c.expect(c.request("PROPFIND", collectionPath+"a.ics", map[string]string{"Depth": "0"},
+		`<?xml version="1.0"?><propfind xmlns="DAV:"><prop><getetag/></prop></propfind>`,
+	), http.StatusMultiStatus)
+	if !strings.Contains(body, "/dav/calendars/tasks/a.ics") || strings.Contains(body, "b.ics") {
+		t.Errorf("unexpected PROPFIND response for single task: %s", body)
+	}
+	c.expect(c.request("PROPFIND", collectionPath+"c.ics", map[string]string{"Depth": "0"}, ""), http.StatusNotFound)
+
+	body = c.expect(c.request("REPORT", collectionPath, map[string]string{"Depth": "1"},
+		`<?xml version="1.0"?>
+		<C:calendar-multiget xmlns:D="DAV:" xmlns:C="urn:ietf:params:xml:ns:caldav">
+			<D:prop><D:getetag/><C:calendar-data/></D:prop>
+			<D:href>/dav/calendars/tasks/b.ics</D:href>
+			<D:href>/dav/calendars/tasks/c.ics</D:href>
+		</C:calendar-multiget>`,
+	), http.StatusMultiStatus)
+	for _, expected := range []string{"SUMMARY:Task b", "HTTP/1.1 404 Not Found"} {
+		if !strings.Contains(body, expected) {
+			t.Errorf("expected REPORT response to contain %q, but got: %s", expected, body)
+		}
+	}
+}
+
+func TestRejectedRequests(t *testing.T) {
+	storage := setupStorage(t)
+	c := newTestClient(t, storage)
+	path := collectionPath + "rejected.ics"
+
+	//bodies beyond the size limit are not read completely
+	hugeBody := makeCalendar("UID:huge@example.com", "SUMMARY:Huge", "DESCRIPTION:"+strings.Repeat("x", maxRequestBodySize))
+	c.expect(c.request("PUT", path, nil, hugeBody), http.StatusBadRequest)
+	hugeXML := `<?xml version="1.0"?><propfind xmlns="DAV:"><prop><getetag/></prop>` + strings.Repeat(" ", maxRequestBodySize) + `</propfind>`
+	c.expect(c.request("PROPFIND", collectionPath, nil, hugeXML), http.StatusBadRequest)
+
+	//recurrence rules that would be dropped silently are rejected
+	body := makeCalendar(
+		"UID:counted@example.com",
+		"SUMMARY:Counted",
+		"CATEGORIES:physical,Home",
+		"DUE;VALUE=DATE:20991106",
+		"RRULE:FREQ=DAILY;COUNT=3",
+	)
+	c.expect(c.request("PUT", path, nil, body), http.StatusBadRequest)
+
+	//events are not tasks
+	body = strings.Replace(makeCalendar("UID:event@example.com", "SUMMARY:Event"), "VTODO", "VEVENT", -1)
+	c.expect(c.request("PUT", path, nil, body), http.StatusUnsupportedMediaType)
+
+	tasks, err := storage.ListOpenTasks("alice")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(tasks) != 0 {
+		t.Errorf("expected no tasks to be created, but got %d", len(tasks))
+	}
+}
@@ -0,0 +1,459 @@
+/*******************************************************************************
+*
+* Copyright 2019 Stefan Majewsky <majewsky@gmx.net>
+*
+* This program is free software: you can redistribute it and/or modify it under
+* the terms of the GNU General Public License as published by the Free Software
+* Foundation, either version 3 of the License, or (at your option) any later
+* version.
+*
+* This program is distributed in the hope that it will be useful, but WITHOUT ANY
+* WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+* A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License along with
+* this program. If not, see <http://www.gnu.org/licenses/>.
+*
+*******************************************************************************/
+
+package caldav
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/sapcc/go-bits/respondwith"
+)
+
+//XML namespaces used in requests and responses.
+const (
+	nsDAV    = "DAV:"
+	nsCalDAV = "urn:ietf:params:xml:ns:caldav"
+	nsCS     = "http://calendarserver.org/ns/"
+)
+
+//namespacePrefixes are the prefixes that are declared on the root element of
+//each response.
+var namespacePrefixes = map[string]string{
+	nsDAV:    "D",
+	nsCalDAV: "C",
+	nsCS:     "CS",
+}
+
+var calendarDataName = xml.Name{Space: nsCalDAV, Local: "calendar-data"}
+
+////////////////////////////////////////////////////////////////////////////////
+// request bodies
+
+type xmlElement struct {
+	XMLName xml.Name
+}
+
+//propRequest is a <DAV:prop> element in a request, which lists the names of
+//the requested properties.
+type propRequest struct {
+	Names []xmlElement `xml:",any"`
+}
+
+type propfindRequest struct {
+	XMLName  xml.Name     `xml:"DAV: propfind"`
+	AllProp  *struct{}    `xml:"DAV: allprop"`
+	PropName *struct{}    `xml:"DAV: propname"`
+	Prop     *propRequest `xml:"DAV: prop"`
+}
+
+type compFilter struct {
+	Name        string       `xml:"name,attr"`
+	CompFilters []compFilter `xml:"urn:ietf:params:xml:ns:caldav comp-filter"`
+}
+
+//reportRequest covers both the calendar-query and calendar-multiget reports.
+type reportRequest struct {
+	XMLName xml.Name
+	AllProp *struct{}    `xml:"DAV: allprop"`
+	Prop    *propRequest `xml:"DAV: prop"`
+	Hrefs   []string     `xml:"DAV: href"`
+	Filter  *struct {
+		CompFilter compFilter `xml:"urn:ietf:params:xml:ns:caldav comp-filter"`
+	} `xml:"urn:ietf:params:xml:ns:caldav filter"`
+}
+
+//decodeXMLBody parses the XML request body into the given target. An empty
+//body is not an error. If the request body is malformed, an error response is
+//written and false is returned.
+func decodeXMLBody(w http.ResponseWriter, r *http.Request, target interface{}) (isEmpty, ok bool) {
+	buf, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxRequestBodySize))
+	if err != nil {
+		http.Error(w, "cannot read request body: "+err.Error(), http.StatusBadRequest)
+		return false, false
+	}
+	if len(bytes.TrimSpace(buf)) == 0 {
+		return true, true
+	}
+	err = xml.Unmarshal(buf, target)
+	if err != nil {
+		http.Error(w, "malformed request body: "+err.Error(), http.StatusBadRequest)
+		return false, false
+	}
+	return false, true
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// properties
+
+//davProp is a property of a resource, with its value given as XML.
+type davProp struct {
+	Name     xml.Name
+	InnerXML string
+}
+
+func prop(space, local, innerXML string) davProp {
+	return davProp{xml.Name{Space: space, Local: local}, innerXML}
+}
+
+func hrefXML(path string) string {
+	return "<D:href>" + escapeXML((&url.URL{Path: path}).EscapedPath()) + "</D:href>"
+}
+
+func escapeXML(text string) string {
+	var buf bytes.Buffer
+	xml.EscapeText(&buf, []byte(text))
+	return buf.String()
+}
+
+//davResource is a resource that can appear in a PROPFIND or REPORT response.
+type davResource struct {
+	Path  string
+	Props []davProp
+}
+
+func (h handler) rootResource() davResource {
+	return davResource{rootPath, []davProp{
+		prop(nsDAV, "resourcetype", "<D:collection/>"),
+		prop(nsDAV, "displayname", "Alltag"),
+		prop(nsDAV, "current-user-principal", hrefXML(principalPath)),
+	}}
+}
+
+func (h handler) principalResource(userName string) davResource {
+	return davResource{principalPath, []davProp{
+		prop(nsDAV, "resourcetype", "<D:principal/>"),
+		prop(nsDAV, "displayname", escapeXML(userName)),
+		prop(nsDAV, "current-user-principal", hrefXML(principalPath)),
+		prop(nsDAV, "principal-URL", hrefXML(principalPath)),
+		prop(nsCalDAV, "calendar-home-set", hrefXML(homePath)),
+	}}
+}
+
+func (h handler) homeResource() davResource {
+	return davResource{homePath, []davProp{
+		prop(nsDAV, "resourcetype", "<D:collection/>"),
+		prop(nsDAV, "displayname", "Calendars"),
+		prop(nsDAV, "current-user-principal", hrefXML(principalPath)),
+		prop(nsDAV, "owner", hrefXML(principalPath)),
+	}}
+}
+
+//privilegesXML is the value of DAV:current-user-privilege-set for the task
+//collection and the tasks in it.
+const privilegesXML = "<D:privilege><D:read/></D:privilege>" +
+	"<D:privilege><D:write-content/></D:privilege>" +
+	"<D:privilege><D:bind/></D:privilege>" +
+	"<D:privilege><D:unbind/></D:privilege>"
+
+func (h handler) collectionResource(tasks []taskResource) davResource {
+	//the CTag changes whenever any of the tasks changes, which is what clients
+	//check to see whether they need to sync
+	hash := sha256.New()
+	for _, task := range tasks {
+		fmt.Fprintf(hash, "%s %s\n", task.Name, task.ETag)
+	}
+	ctag := `"` + hex.EncodeToString(hash.Sum(nil)[:16]) + `"`
+
+	return davResource{collectionPath, []davProp{
+		prop(nsDAV, "resourcetype", "<D:collection/><C:calendar/>"),
+		prop(nsDAV, "displayname", "Alltag"),
+		prop(nsDAV, "current-user-principal", hrefXML(principalPath)),
+		prop(nsDAV, "owner", hrefXML(principalPath)),
+		prop(nsDAV, "current-user-privilege-set", privilegesXML),
+		prop(nsDAV, "supported-report-set",
+			"<D:supported-report><D:report><C:calendar-query/></D:report></D:supported-report>"+
+				"<D:supported-report><D:report><C:calendar-multiget/></D:report></D:supported-report>"),
+		prop(nsDAV, "getetag", escapeXML(ctag)),
+		prop(nsCS, "getctag", escapeXML(ctag)),
+		prop(nsCalDAV, "calendar-description", "Open tasks in Alltag"),
+		prop(nsCalDAV, "supported-calendar-component-set", `<C:comp name="VTODO"/>`),
+	}}
+}
+
+func (t taskResource) davResource() davResource {
+	return davResource{t.Path(), []davProp{
+		prop(nsDAV, "resourcetype", ""),
+		prop(nsDAV, "getetag", escapeXML(t.ETag)),
+		prop(nsDAV, "getcontenttype", "text/calendar; charset=utf-8; component=VTODO"),
+		prop(nsDAV, "getcontentlength", strconv.Itoa(len(t.Body))),
+		prop(nsDAV, "current-user-privilege-set", privilegesXML),
+		prop(nsCalDAV, "calendar-data", escapeXML(string(t.Body))),
+	}}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// multistatus responses
+
+//davResponse is a <DAV:response> element in a multistatus response.
+type davResponse struct {
+	Path     string
+	Status   int //only for responses without properties
+	Found    []davProp
+	NotFound []xml.Name
+}
+
+//selectProps builds the response for a resource. When `names` is nil, all
+//properties are returned (except for calendar-data, which must be requested
+//explicitly). When onlyNames is true, only the names of the properties are
+//returned (as in PROPFIND with <DAV:propname/>).
+func selectProps(res davResource, names []xmlElement, onlyNames bool) davResponse {
+	resp := davResponse{Path: res.Path}
+	if names == nil {
+		for _, p := range res.Props {
+			if p.Name == calendarDataName {
+				continue
+			}
+			if onlyNames {
+				p.InnerXML = ""
+			}
+			resp.Found = append(resp.Found, p)
+		}
+		return resp
+	}
+
+	for _, name := range names {
+		found := false
+		for _, p := range res.Props {
+			if p.Name == name.XMLName {
+				resp.Found = append(resp.Found, p)
+				found = true
+				break
+			}
+		}
+		if !found {
+			resp.NotFound = append(resp.NotFound, name.XMLName)
+		}
+	}
+	return resp
+}
+
+//writeMultistatus writes a 207 Multi-Status response.
+func writeMultistatus(w http.ResponseWriter, responses []davResponse) {
+	var buf bytes.Buffer
+	buf.WriteString(xml.Header)
+	fmt.Fprintf(&buf, `<D:multistatus xmlns:D="%s" xmlns:C="%s" xmlns:CS="%s">`, nsDAV, nsCalDAV, nsCS)
+	for _, resp := range responses {
+		buf.WriteString("<D:response>")
+		buf.WriteString(hrefXML(resp.Path))
+		if resp.Status != 0 {
+			writeStatus(&buf, resp.Status)
+		}
+		if len(resp.Found) > 0 {
+			buf.WriteString("<D:propstat><D:prop>")
+			for _, p := range resp.Found {
+				writeElement(&buf, p.Name, p.InnerXML)
+			}
+			buf.WriteString("</D:prop>")
+			writeStatus(&buf, http.StatusOK)
+			buf.WriteString("</D:propstat>")
+		}
+		if len(resp.NotFound) > 0 {
+			buf.WriteString("<D:propstat><D:prop>")
+			for _, name := range resp.NotFound {
+				writeElement(&buf, name, "")
+			}
+			buf.WriteString("</D:prop>")
+			writeStatus(&buf, http.StatusNotFound)
+			buf.WriteString("</D:propstat>")
+		}
+		buf.WriteString("</D:response>")
+	}
+	buf.WriteString("</D:multistatus>")
+
+	w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+	w.Header().Set("Content-Length", strconv.Itoa(buf.Len()))
+	w.WriteHeader(http.StatusMultiStatus)
+	w.Write(buf.Bytes())
+}
+
+func writeStatus(buf *bytes.Buffer, status int) {
+	fmt.Fprintf(buf, "<D:status>HTTP/1.1 %d %s</D:status>", status, http.StatusText(status))
+}
+
+func writeElement(buf *bytes.Buffer, name xml.Name, innerXML string) {
+	//properties in unknown namespaces (which can only appear in the NotFound
+	//list) get their own default namespace declaration
+	tag := name.Local
+	attrs := ""
+	if prefix, exists := namespacePrefixes[name.Space]; exists {
+		tag = prefix + ":" + name.Local
+	} else {
+		attrs = ` xmlns="` + escapeXML(name.Space) + `"`
+	}
+	if innerXML == "" {
+		fmt.Fprintf(buf, "<%s%s/>", tag, attrs)
+	} else {
+		fmt.Fprintf(buf, "<%s%s>%s</%s>", tag, attrs, innerXML, tag)
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// PROPFIND and REPORT
+
+func (h handler) Propfind(w http.ResponseWriter, r *http.Request) {
+	var req propfindRequest
+	isEmpty, ok := decodeXMLBody(w, r, &req)
+	if !ok {
+		return
+	}
+	var names []xmlElement
+	if !isEmpty && req.AllProp == nil && req.PropName == nil {
+		if req.Prop == nil {
+			http.Error(w, "malformed request body: expected prop, allprop or propname", http.StatusBadRequest)
+			return
+		}
+		names = req.Prop.Names
+		if names == nil {
+			names = []xmlElement{}
+		}
+	}
+
+	//collect the requested resource and, unless Depth is 0, its children
+	userName := currentUser(r)
+	path := r.URL.Path
+	if !strings.HasSuffix(path, "/") && !strings.HasPrefix(path, collectionPath) {
+		path += "/"
+	}
+	var resources []davResource
+	switch path {
+	case rootPath:
+		resources = []davResource{h.rootResource(), h.principalResource(userName), h.homeResource()}
+	case principalPath:
+		resources = []davResource{h.principalResource(userName)}
+	case homePath:
+		tasks, err := h.listTaskResources(userName)
+		if respondwith.ErrorText(w, err) {
+			return
+		}
+		resources = []davResource{h.homeResource(), h.collectionResource(tasks)}
+	case collectionPath:
+		tasks, err := h.listTaskResources(userName)
+		if respondwith.ErrorText(w, err) {
+			return
+		}
+		resources = []davResource{h.collectionResource(tasks)}
+		for _, task := range tasks {
+			resources = append(resources, task.davResource())
+		}
+	default:
+		if !strings.HasPrefix(path, collectionPath) {
+			http.Error(w, "Not found", http.StatusNotFound)
+			return
+		}
+		task, err := h.findTaskResource(userName, strings.TrimPrefix(path, collectionPath))
+		if respondwith.ErrorText(w, err) {
+			return
+		}
+		if task == nil {
+			http.Error(w, "Not found", http.StatusNotFound)
+			return
+		}
+		resources = []davResource{task.davResource()}
+	}
+	if r.Header.Get("Depth") == "0" {
+		resources = resources[:1]
+	}
+
+	responses := make([]davResponse, len(resources))
+	for idx, res := range resources {
+		responses[idx] = selectProps(res, names, req.PropName != nil)
+	}
+	writeMultistatus(w, responses)
+}
+
+func (h handler) Report(w http.ResponseWriter, r *http.Request) {
+	var req reportRequest
+	isEmpty, ok := decodeXMLBody(w, r, &req)
+	if !ok {
+		return
+	}
+	if isEmpty || req.XMLName.Space != nsCalDAV {
+		http.Error(w, "unsupported report", http.StatusForbidden)
+		return
+	}
+	var names []xmlElement
+	if req.AllProp == nil && req.Prop != nil {
+		names = req.Prop.Names
+	}
+
+	tasks, err := h.listTaskResources(currentUser(r))
+	if respondwith.ErrorText(w, err) {
+		return
+	}
+
+	var responses []davResponse
+	switch req.XMLName.Local {
+	case "calendar-query":
+		//only the component type is checked since all our resources contain a
+		//VTODO; more specific filters (e.g. on time ranges) are ignored, which
+		//means that the client may get more results than it asked for
+		if req.Filter != nil && !matchesVTODO(req.Filter.CompFilter) {
+			break
+		}
+		for _, task := range tasks {
+			responses = append(responses, selectProps(task.davResource(), names, false))
+		}
+
+	case "calendar-multiget":
+		for _, href := range req.Hrefs {
+			hrefURL, err := url.Parse(strings.TrimSpace(href))
+			if err != nil {
+				responses = append(responses, davResponse{Path: href, Status: http.StatusBadRequest})
+				continue
+			}
+			task := lookupTaskResource(tasks, strings.TrimPrefix(hrefURL.Path, collectionPath))
+			if task == nil || !strings.HasPrefix(hrefURL.Path, collectionPath) {
+				responses = append(responses, davResponse{Path: hrefURL.Path, Status: http.StatusNotFound})
+				continue
+			}
+			responses = append(responses, selectProps(task.davResource(), names, false))
+		}
+
+	default:
+		http.Error(w, "unsupported report", http.StatusForbidden)
+		return
+	}
+
+	writeMultistatus(w, responses)
+}
+
+//matchesVTODO checks whether a calendar-query filter can match VTODO
+//components.
+func matchesVTODO(filter compFilter) bool {
+	if filter.Name != "VCALENDAR" {
+		return false
+	}
+	if len(filter.CompFilters) == 0 {
+		return true
+	}
+	for _, sub := range filter.CompFilters {
+		if sub.Name == "VTODO" {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,166 @@
+/*******************************************************************************
+*
+* Copyright 2019 Stefan Majewsky <majewsky@gmx.net>
+*
+* This program is free software: you can redistribute it and/or modify it under
+* the terms of the GNU General Public License as published by the Free Software
+* Foundation, either version 3 of the License, or (at your option) any later
+* version.
+*
+* This program is distributed in the hope that it will be useful, but WITHOUT ANY
+* WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+* A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License along with
+* this program. If not, see <http://www.gnu.org/licenses/>.
+*
+*******************************************************************************/
+
+//Package client contains the command-line client that talks to an Alltag
+//server through its JSON API.
+package client
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+//Config contains the contents of the client configuration file. Either Token
+//or Username and Password must be given.
+type Config struct {
+	URL      string `json:"url"`
+	Username string `json:"username"`
+	Password string `json:"password"`
+	Token    string `json:"token"`
+}
+
+//ConfigPath returns the path to the client configuration file.
+func ConfigPath() (string, error) {
+	if path := os.Getenv("ALLTAG_CLIENT_CONFIG"); path != "" {
+		return path, nil
+	}
+	configDir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(configDir, "alltag", "client.json"), nil
+}
+
+//LoadConfig reads the client configuration file.
+func LoadConfig() (Config, error) {
+	var cfg Config
+	path, err := ConfigPath()
+	if err != nil {
+		return cfg, err
+	}
+
+	//since the config file contains credentials, refuse to use it when other
+	//users can read it
+	fi, err := os.Stat(path)
+	if err != nil {
+		return cfg, err
+	}
+	if fi.Mode().Perm()&0077 != 0 {
+		return cfg, fmt.Errorf("%s is accessible by other users; run `chmod 0600 %s` to fix", path, path)
+	}
+
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return cfg, err
+	}
+	err = json.Unmarshal(buf, &cfg)
+	if err != nil {
+		return cfg, fmt.Errorf("cannot parse %s: %s", path, err.Error())
+	}
+	if cfg.URL == "" {
+		return cfg, fmt.Errorf("missing \"url\" in %s", path)
+	}
+	return cfg, nil
+}
+
+//Client talks to the JSON API of an Alltag server.
+type Client struct {
+	cfg Config
+}
+
+//NewClient initializes a Client.
+func NewClient(cfg Config) *Client {
+	return &Client{cfg}
+}
+
+//Do executes a request against the API. If reqBody is not nil, it is sent
+//as the JSON request body. If respBody is not nil, the JSON response body is
+//decoded into it.
+func (c *Client) Do(method, path string, reqBody, respBody interface{}) error {
+	var body io.Reader
+	if reqBody != nil {
+		buf, err := json.Marshal(reqBody)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(buf)
+	}
+
+	req, err := http.NewRequest(method, strings.TrimSuffix(c.cfg.URL, "/")+path, body)
+	if err != nil {
+		return err
+	}
+	if reqBody != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.cfg.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.cfg.Token)
+	} else {
+		req.SetBasicAuth(c.cfg.Username, c.cfg.Password)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	respBytes, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode >= 400 {
+		return &APIError{
+			Method:     method,
+			Path:       path,
+			StatusCode: resp.StatusCode,
+			Message:    strings.TrimSpace(string(respBytes)),
+		}
+	}
+	if respBody == nil || len(respBytes) == 0 {
+		return nil
+	}
+	return json.Unmarshal(respBytes, respBody)
+}
+
+//APIError is returned by Client.Do when the server responds with an error.
+type APIError struct {
+	Method     string
+	Path       string
+	StatusCode int
+	Message    string
+}
+
+//Error implements the builtin/error interface.
+func (e *APIError) Error() string {
+	return fmt.Sprintf("%s %s returned %d: %s", e.Method, e.Path, e.StatusCode, e.Message)
+}
+
+//isNotFound returns whether the given error is an APIError with status 404.
+func isNotFound(err error) bool {
+	var apiErr *APIError
+	return errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusNotFound
+}
@@ -0,0 +1,204 @@
+/*******************************************************************************
+*
+* Copyright 2019 Stefan Majewsky <majewsky@gmx.net>
+*
+* This program is free software: you can redistribute it and/or modify it under
+* the terms of the GNU General Public License as published by the Free Software
+* Foundation, either version 3 of the License, or (at your option) any later
+* version.
+*
+* This program is distributed in the hope that it will be useful, but WITHOUT ANY
+* WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+* A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License along with
+* this program. If not, see <http://www.gnu.org/licenses/>.
+*
+*******************************************************************************/
+
+package client
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/majewsky/alltag/internal/api"
+)
+
+const usage = `Usage:
+  alltag add <label>...                              Add a new (unclassified) task.
+  alltag next --location <location> --class <class>  Show the next task for this location and class.
+  alltag done <task-id>                              Mark a task as done.
+  alltag list                                        List all open tasks.
+
+When called without arguments, alltag runs the server instead.
+The client reads its configuration from $ALLTAG_CLIENT_CONFIG, or from
+$XDG_CONFIG_HOME/alltag/client.json if that variable is not set.
+`
+
+var errUsage = errors.New("wrong usage")
+
+type command func(c *Client, args []string) error
+
+var commands = map[string]command{
+	"add":  addTask,
+	"next": showNextTask,
+	"done": closeTask,
+	"list": listTasks,
+}
+
+//Run executes the command-line client with the given arguments (excluding
+//the program name), and returns the exit code for the program.
+func Run(args []string) int {
+	cmd, exists := commands[args[0]]
+	if !exists {
+		fmt.Fprint(os.Stderr, usage)
+		return 1
+	}
+
+	cfg, err := LoadConfig()
+	if err == nil {
+		err = cmd(NewClient(cfg), args[1:])
+	}
+	switch err {
+	case nil:
+		return 0
+	case errUsage:
+		fmt.Fprint(os.Stderr, usage)
+		return 1
+	default:
+		fmt.Fprintf(os.Stderr, "alltag %s: %s\n", args[0], err.Error())
+		return 1
+	}
+}
+
+func parseFlags(fs *flag.FlagSet, args []string) error {
+	fs.SetOutput(ioutil.Discard)
+	err := fs.Parse(args)
+	if err != nil {
+		return errUsage
+	}
+	return nil
+}
+
+func addTask(c *Client, args []string) error {
+	label := strings.TrimSpace(strings.Join(args, " "))
+	if label == "" {
+		return errUsage
+	}
+
+	var resp struct {
+		Task api.Task `json:"task"`
+	}
+	err := c.Do("POST", "/api/v1/tasks", api.TaskRequest{Label: label}, &resp)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Created task #%d.\n", resp.Task.ID)
+	return nil
+}
+
+func showNextTask(c *Client, args []string) error {
+	fs := flag.NewFlagSet("next", flag.ContinueOnError)
+	locationName := fs.String("location", "", "")
+	className := fs.String("class", "", "")
+	err := parseFlags(fs, args)
+	if err != nil || fs.NArg() > 0 || *locationName == "" || *className == "" {
+		return errUsage
+	}
+
+	location, err := c.findLocation(*locationName)
+	if err != nil {
+		return err
+	}
+
+	query := url.Values{}
+	query.Set("location_id", strconv.FormatInt(location.ID, 10))
+	query.Set("class", *className)
+	var resp struct {
+		Task api.Task `json:"task"`
+	}
+	err = c.Do("GET", "/api/v1/next-task?"+query.Encode(), nil, &resp)
+	if isNotFound(err) {
+		fmt.Printf("Nothing to do at %s right now.\n", location.Label)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Printf("#%d: %s\n", resp.Task.ID, resp.Task.Label)
+	return nil
+}
+
+//findLocation finds a location by label (case-insensitive) or by ID.
+func (c *Client) findLocation(nameOrID string) (api.Location, error) {
+	var resp struct {
+		Locations []api.Location `json:"locations"`
+	}
+	err := c.Do("GET", "/api/v1/locations", nil, &resp)
+	if err != nil {
+		return api.Location{}, err
+	}
+	for _, location := range resp.Locations {
+		if strings.EqualFold(location.Label, nameOrID) || strconv.FormatInt(location.ID, 10) == nameOrID {
+			return location, nil
+		}
+	}
+	return api.Location{}, fmt.Errorf("no such location: %q", nameOrID)
+}
+
+func closeTask(c *Client, args []string) error {
+	if len(args) != 1 {
+		return errUsage
+	}
+	taskID, err := strconv.ParseInt(strings.TrimPrefix(args[0], "#"), 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid task ID: %q", args[0])
+	}
+
+	var resp struct {
+		Task api.Task `json:"task"`
+	}
+	err = c.Do("POST", fmt.Sprintf("/api/v1/tasks/%d/close", taskID), nil, &resp)
+	if err != nil {
+		return err
+	}
+	if resp.Task.ClosedAt != nil {
+		fmt.Printf("Closed task #%d.\n", resp.Task.ID)
+	} else {
+		fmt.Printf("Task #%d will respawn on %s.\n", resp.Task.ID, resp.Task.StartsAt)
+	}
+	return nil
+}
+
+func listTasks(c *Client, args []string) error {
+	if len(args) != 0 {
+		return errUsage
+	}
+
+	var resp struct {
+		Tasks []api.Task `json:"tasks"`
+	}
+	err := c.Do("GET", "/api/v1/tasks", nil, &resp)
+	if err != nil {
+		return err
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tCLASS\tSTARTS\tDUE\tLABEL")
+	for _, task := range resp.Tasks {
+		if task.Class == nil {
+			fmt.Fprintf(tw, "%d\t-\t-\t-\t%s\n", task.ID, task.Label)
+		} else {
+			fmt.Fprintf(tw, "%d\t%s\t%s\t%s\t%s\n", task.ID, *task.Class, task.StartsAt, task.DueAt, task.Label)
+		}
+	}
+	return tw.Flush()
+}
@@ -115,14 +115,58 @@ func (d Date) AddDays(days int) Date {
 	return FromTime(d.FirstSecondIn(time.UTC).AddDate(0, 0, days))
 }
 
+//AddPeriodsUntilAfter shifts this date into the future by the smallest
+//positive multiple of the given number of days that results in a date after
+//`after`. This is used for recurrences on a fixed schedule, where periods that
+//have been missed entirely are skipped. The period length must be positive.
+func (d Date) AddPeriodsUntilAfter(periodDays int, after Date) Date {
+	periods := 1
+	if diff := after.Sub(d); diff >= 0 {
+		periods = diff/periodDays + 1
+	}
+	return d.AddDays(periods * periodDays)
+}
+
+//MarshalText implements the encoding.TextMarshaler interface.
+func (d Date) MarshalText() ([]byte, error) {
+	return []byte(d.String()), nil
+}
+
+//UnmarshalText implements the encoding.TextUnmarshaler interface.
+func (d *Date) UnmarshalText(input []byte) error {
+	parsed, err := Parse(string(input))
+	if err == nil {
+		*d = parsed
+	}
+	return err
+}
+
 //Scan implements the database/sql.Scanner interface.
 func (d *Date) Scan(src interface{}) error {
-	tst, ok := src.(time.Time)
-	if !ok {
+	switch src := src.(type) {
+	case time.Time:
+		d.year, d.month, d.day = src.Date()
+		return nil
+	case string:
+		return d.scanString(src)
+	case []byte:
+		return d.scanString(string(src))
+	default:
 		return fmt.Errorf("cannot scan %T into date.Date", src)
 	}
-	d.year, d.month, d.day = tst.Date()
-	return nil
+}
+
+//scanString is used by Scan for databases like SQLite that may return dates
+//as strings. Only the "YYYY-MM-DD" part at the start is considered.
+func (d *Date) scanString(src string) error {
+	if len(src) > 10 {
+		src = src[:10]
+	}
+	parsed, err := Parse(src)
+	if err == nil {
+		*d = parsed
+	}
+	return err
 }
 
 //Value implements the database/sql/driver.Valuer interface.
@@ -0,0 +1,55 @@
+/*******************************************************************************
+*
+* Copyright 2019 Stefan Majewsky <majewsky@gmx.net>
+*
+* This program is free software: you can redistribute it and/or modify it under
+* the terms of the GNU General Public License as published by the Free Software
+* Foundation, either version 3 of the License, or (at your option) any later
+* version.
+*
+* This program is distributed in the hope that it will be useful, but WITHOUT ANY
+* WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+* A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License along with
+* this program. If not, see <http://www.gnu.org/licenses/>.
+*
+*******************************************************************************/
+
+package date
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAddPeriodsUntilAfter(t *testing.T) {
+	testCases := []struct {
+		Description string
+		Date        Date
+		PeriodDays  int
+		After       Date
+		Expected    Date
+	}{
+		{"due date in the future", Date{2019, time.November, 20}, 7, Date{2019, time.November, 15}, Date{2019, time.November, 27}},
+		{"due today", Date{2019, time.November, 20}, 7, Date{2019, time.November, 20}, Date{2019, time.November, 27}},
+		{"due yesterday", Date{2019, time.November, 19}, 7, Date{2019, time.November, 20}, Date{2019, time.November, 26}},
+		{"several missed periods", Date{2019, time.November, 1}, 7, Date{2019, time.November, 20}, Date{2019, time.November, 22}},
+		{"missed periods ending on the day", Date{2019, time.November, 6}, 7, Date{2019, time.November, 20}, Date{2019, time.November, 27}},
+		{"daily period, due in the future", Date{2019, time.November, 25}, 1, Date{2019, time.November, 20}, Date{2019, time.November, 26}},
+		{"daily period, several missed", Date{2019, time.November, 1}, 1, Date{2019, time.November, 20}, Date{2019, time.November, 21}},
+		{"across the end of the year", Date{2019, time.December, 20}, 14, Date{2020, time.January, 5}, Date{2020, time.January, 17}},
+		{"into a leap day", Date{2020, time.February, 27}, 1, Date{2020, time.February, 28}, Date{2020, time.February, 29}},
+		{"across a leap day", Date{2020, time.February, 22}, 7, Date{2020, time.March, 1}, Date{2020, time.March, 7}},
+		{"across February without leap day", Date{2019, time.February, 22}, 7, Date{2019, time.March, 1}, Date{2019, time.March, 8}},
+		{"long period across a leap year", Date{2019, time.March, 1}, 365, Date{2020, time.March, 1}, Date{2021, time.February, 28}},
+	}
+
+	for _, tc := range testCases {
+		actual := tc.Date.AddPeriodsUntilAfter(tc.PeriodDays, tc.After)
+		if actual != tc.Expected {
+			t.Errorf("%s: expected %s + n*%d days after %s to be %s, but got %s",
+				tc.Description, tc.Date, tc.PeriodDays, tc.After, tc.Expected, actual)
+		}
+	}
+}
@@ -0,0 +1,185 @@
+/*******************************************************************************
+*
+* Copyright 2019 Stefan Majewsky <majewsky@gmx.net>
+*
+* This program is free software: you can redistribute it and/or modify it under
+* the terms of the GNU General Public License as published by the Free Software
+* Foundation, either version 3 of the License, or (at your option) any later
+* version.
+*
+* This program is distributed in the hope that it will be useful, but WITHOUT ANY
+* WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+* A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License along with
+* this program. If not, see <http://www.gnu.org/licenses/>.
+*
+*******************************************************************************/
+
+package db
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/majewsky/alltag/internal/metrics"
+	"github.com/mattn/go-sqlite3"
+	"github.com/sapcc/go-bits/logg"
+	"gopkg.in/gorp.v2"
+)
+
+//The database connections are opened through these wrapped drivers, which
+//record the duration of each statement in the metrics.
+const (
+	postgresDriverName = "alltag-postgres"
+	sqliteDriverName   = "alltag-sqlite3"
+)
+
+func init() {
+	sql.Register(postgresDriverName, instrumentedDriver{&pq.Driver{}})
+	sql.Register(sqliteDriverName, instrumentedDriver{&sqlite3.SQLiteDriver{}})
+}
+
+//contextConn contains the optional driver interfaces that instrumentedConn
+//relies on. Both pq and go-sqlite3 implement them.
+type contextConn interface {
+	driver.Conn
+	driver.ConnBeginTx
+	driver.ExecerContext
+	driver.QueryerContext
+}
+
+type instrumentedDriver struct {
+	driver.Driver
+}
+
+func (d instrumentedDriver) Open(name string) (driver.Conn, error) {
+	conn, err := d.Driver.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	cconn, ok := conn.(contextConn)
+	if !ok {
+		conn.Close()
+		return nil, fmt.Errorf("database driver %T does not support contexts", conn)
+	}
+	return instrumentedConn{cconn}, nil
+}
+
+//instrumentedConn times all statements that are executed directly on the
+//connection. This covers everything that gorp does. Statements prepared with
+//Prepare() are not instrumented.
+type instrumentedConn struct {
+	contextConn
+}
+
+func (c instrumentedConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	started := time.Now()
+	tx, err := c.contextConn.BeginTx(ctx, opts)
+	observeQuery(started, "BEGIN")
+	if err != nil {
+		return nil, err
+	}
+	return instrumentedTx{tx}, nil
+}
+
+func (c instrumentedConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	started := time.Now()
+	result, err := c.contextConn.ExecContext(ctx, query, args)
+	observeQuery(started, query)
+	return result, err
+}
+
+//QueryContext only measures the time until the first result is available,
+//not the time spent reading the result set.
+func (c instrumentedConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	started := time.Now()
+	rows, err := c.contextConn.QueryContext(ctx, query, args)
+	observeQuery(started, query)
+	return rows, err
+}
+
+func (c instrumentedConn) Ping(ctx context.Context) error {
+	if pinger, ok := c.contextConn.(driver.Pinger); ok {
+		return pinger.Ping(ctx)
+	}
+	return nil
+}
+
+type instrumentedTx struct {
+	driver.Tx
+}
+
+func (tx instrumentedTx) Commit() error {
+	started := time.Now()
+	err := tx.Tx.Commit()
+	observeQuery(started, "COMMIT")
+	return err
+}
+
+func (tx instrumentedTx) Rollback() error {
+	started := time.Now()
+	err := tx.Tx.Rollback()
+	observeQuery(started, "ROLLBACK")
+	return err
+}
+
+func observeQuery(started time.Time, query string) {
+	metrics.DBQueryDuration.Observe(time.Since(started).Seconds(), queryOperation(query))
+}
+
+//queryOperation returns the first keyword of the given SQL statement, e.g.
+//"select" or "commit". Only well-known keywords are reported, to keep the
+//number of label values in the metrics bounded.
+func queryOperation(query string) string {
+	fields := strings.Fields(strings.ToLower(query))
+	if len(fields) > 0 {
+		switch keyword := strings.TrimSuffix(fields[0], ";"); keyword {
+		case "select", "insert", "update", "delete", "begin", "commit", "rollback":
+			return keyword
+		}
+	}
+	return "other"
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// query trace
+
+type loggDebug struct{}
+
+func (loggDebug) Printf(format string, values ...interface{}) {
+	logg.Debug(format, values...)
+}
+
+//TraceQueries logs all SQL statements issued through the given DbMap (with
+//their arguments and durations) as debug messages. This is intended for debug
+//mode only, since every query pays for formatting its arguments.
+func TraceQueries(dbMap *gorp.DbMap) {
+	dbMap.TraceOn("SQL: ", loggDebug{})
+	dbMap.TypeConverter = traceTypeConverter{}
+}
+
+//traceTypeConverter replaces nil pointers to types like date.Date and
+//rrule.Rule with an untyped nil when binding them to a query. The database/sql
+//package does this by itself, but gorp's trace would otherwise call the Value
+//method through the nil pointer and panic.
+type traceTypeConverter struct{}
+
+func (traceTypeConverter) ToDb(val interface{}) (interface{}, error) {
+	if _, ok := val.(driver.Valuer); ok {
+		if rv := reflect.ValueOf(val); rv.Kind() == reflect.Ptr && rv.IsNil() {
+			return nil, nil
+		}
+	}
+	return val, nil
+}
+
+func (traceTypeConverter) FromDb(target interface{}) (gorp.CustomScanner, bool) {
+	return gorp.CustomScanner{}, false
+}
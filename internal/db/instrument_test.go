@@ -0,0 +1,130 @@
+/*******************************************************************************
+*
+* Copyright 2019 Stefan Majewsky <majewsky@gmx.net>
+*
+* This program is free software: you can redistribute it and/or modify it under
+* the terms of the GNU General Public License as published by the Free Software
+* Foundation, either version 3 of the License, or (at your option) any later
+* version.
+*
+* This program is distributed in the hope that it will be useful, but WITHOUT ANY
+* WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+* A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License along with
+* this program. If not, see <http://www.gnu.org/licenses/>.
+*
+*******************************************************************************/
+
+package db
+
+import (
+	"bufio"
+	"bytes"
+	"io/ioutil"
+	"log"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/majewsky/alltag/internal/metrics"
+	"github.com/sapcc/go-bits/logg"
+)
+
+func TestQueryOperation(t *testing.T) {
+	testCases := map[string]string{
+		"SELECT * FROM tasks WHERE id = $1":    "select",
+		"  insert into \"tasks\" (...)":        "insert",
+		"UPDATE tasks SET label = ?":           "update",
+		"\tDELETE FROM task_locations":         "delete",
+		"COMMIT;":                              "commit",
+		"CREATE TABLE foo (id INTEGER)":        "other",
+		"PRAGMA foreign_keys":                  "other",
+		"":                                     "other",
+		"selection of arbitrary nonsense":      "other",
+		"WITH t AS (SELECT 1) SELECT * FROM t": "other",
+	}
+	for query, expected := range testCases {
+		actual := queryOperation(query)
+		if actual != expected {
+			t.Errorf("expected queryOperation(%q) = %q, got %q", query, expected, actual)
+		}
+	}
+}
+
+//scrapeQueryCounts returns the values of alltag_db_query_duration_seconds_count
+//by operation.
+func scrapeQueryCounts(t *testing.T) map[string]int {
+	t.Helper()
+	req := httptest.NewRequest("GET", "/metrics", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	rec := httptest.NewRecorder()
+	metrics.NewHandler("secret", nil).ServeHTTP(rec, req)
+
+	result := make(map[string]int)
+	prefix := `alltag_db_query_duration_seconds_count{operation="`
+	scanner := bufio.NewScanner(rec.Body)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !strings.HasPrefix(line, prefix) {
+			continue
+		}
+		fields := strings.Fields(strings.TrimPrefix(line, prefix))
+		count, err := strconv.Atoi(fields[1])
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		result[strings.TrimSuffix(fields[0], `"}`)] = count
+	}
+	return result
+}
+
+func TestInstrumentedDriverAndTrace(t *testing.T) {
+	dir, err := ioutil.TempDir("", "alltag-test")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+	dbi, err := Init("sqlite://" + filepath.Join(dir, "test.db"))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer dbi.Db.Close()
+
+	//in debug mode, all statements are logged with their arguments (this must
+	//not panic on nil pointers to types like rrule.Rule and date.Date)
+	TraceQueries(dbi)
+	var logBuf bytes.Buffer
+	log.SetOutput(&logBuf)
+	logg.ShowDebug = true
+	defer func() {
+		log.SetOutput(os.Stderr)
+		logg.ShowDebug = false
+	}()
+
+	countsBefore := scrapeQueryCounts(t)
+	storage := NewStorage(dbi)
+	task := Task{Label: "water the plants", UserName: "alice"}
+	err = storage.SaveTask(&task)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	_, err = storage.FindTask("alice", task.ID)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	countsAfter := scrapeQueryCounts(t)
+
+	for _, op := range []string{"insert", "select"} {
+		if countsAfter[op] <= countsBefore[op] {
+			t.Errorf("expected %s statements to be counted, but count went from %d to %d",
+				op, countsBefore[op], countsAfter[op])
+		}
+	}
+	if !strings.Contains(logBuf.String(), `"water the plants"`) {
+		t.Errorf("expected INSERT to be logged with its arguments, got log: %s", logBuf.String())
+	}
+}
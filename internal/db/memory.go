@@ -0,0 +1,674 @@
+/*******************************************************************************
+*
+* Copyright 2019 Stefan Majewsky <majewsky@gmx.net>
+*
+* This program is free software: you can redistribute it and/or modify it under
+* the terms of the GNU General Public License as published by the Free Software
+* Foundation, either version 3 of the License, or (at your option) any later
+* version.
+*
+* This program is distributed in the hope that it will be useful, but WITHOUT ANY
+* WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+* A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License along with
+* this program. If not, see <http://www.gnu.org/licenses/>.
+*
+*******************************************************************************/
+
+package db
+
+import (
+	"database/sql"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/majewsky/alltag/internal/date"
+)
+
+type memoryStorage struct {
+	mutex *sync.Mutex
+	//the following fields are protected by the mutex
+	data *memoryData
+}
+
+type memoryData struct {
+	lastID        int64
+	locations     map[int64]Location
+	tasks         map[int64]Task
+	taskLocations map[TaskLocation]bool
+	apiTokens     map[int64]APIToken
+	completions   map[int64]TaskCompletion
+	userSettings  map[string]UserSettings
+	webhooks      map[int64]Webhook
+	deliveries    map[int64]WebhookDelivery
+}
+
+//NewMemoryStorage returns a Storage that keeps all records in memory. This is
+//intended for tests. Transactions are rolled back correctly, but are not
+//isolated from concurrent access.
+func NewMemoryStorage() Storage {
+	return memoryStorage{
+		mutex: &sync.Mutex{},
+		data: &memoryData{
+			locations:     make(map[int64]Location),
+			tasks:         make(map[int64]Task),
+			taskLocations: make(map[TaskLocation]bool),
+			apiTokens:     make(map[int64]APIToken),
+			completions:   make(map[int64]TaskCompletion),
+			userSettings:  make(map[string]UserSettings),
+			webhooks:      make(map[int64]Webhook),
+			deliveries:    make(map[int64]WebhookDelivery),
+		},
+	}
+}
+
+func (d *memoryData) nextID() int64 {
+	d.lastID++
+	return d.lastID
+}
+
+func (d *memoryData) clone() *memoryData {
+	result := &memoryData{
+		lastID:        d.lastID,
+		locations:     make(map[int64]Location, len(d.locations)),
+		tasks:         make(map[int64]Task, len(d.tasks)),
+		taskLocations: make(map[TaskLocation]bool, len(d.taskLocations)),
+		apiTokens:     make(map[int64]APIToken, len(d.apiTokens)),
+		completions:   make(map[int64]TaskCompletion, len(d.completions)),
+		userSettings:  make(map[string]UserSettings, len(d.userSettings)),
+		webhooks:      make(map[int64]Webhook, len(d.webhooks)),
+		deliveries:    make(map[int64]WebhookDelivery, len(d.deliveries)),
+	}
+	for id, location := range d.locations {
+		result.locations[id] = location
+	}
+	for id, task := range d.tasks {
+		result.tasks[id] = task
+	}
+	for tl := range d.taskLocations {
+		result.taskLocations[tl] = true
+	}
+	for id, apiToken := range d.apiTokens {
+		result.apiTokens[id] = apiToken
+	}
+	for id, completion := range d.completions {
+		result.completions[id] = completion
+	}
+	for userName, settings := range d.userSettings {
+		result.userSettings[userName] = settings
+	}
+	for id, webhook := range d.webhooks {
+		result.webhooks[id] = webhook
+	}
+	for id, delivery := range d.deliveries {
+		result.deliveries[id] = delivery
+	}
+	return result
+}
+
+func (s memoryStorage) ListLocations(userName string) ([]Location, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	var result []Location
+	for _, location := range s.data.locations {
+		if location.UserName == userName {
+			result = append(result, location)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Label < result[j].Label
+	})
+	return result, nil
+}
+
+func (s memoryStorage) FindLocation(userName string, id int64) (*Location, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	location, exists := s.data.locations[id]
+	if !exists || location.UserName != userName {
+		return nil, sql.ErrNoRows
+	}
+	return &location, nil
+}
+
+func (s memoryStorage) SaveLocation(location *Location) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if location.ID == 0 {
+		location.ID = s.data.nextID()
+	} else if _, exists := s.data.locations[location.ID]; !exists {
+		return sql.ErrNoRows
+	}
+	s.data.locations[location.ID] = *location
+	return nil
+}
+
+func (s memoryStorage) DeleteLocation(location *Location) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	delete(s.data.locations, location.ID)
+	for tl := range s.data.taskLocations {
+		if tl.LocationID == location.ID {
+			delete(s.data.taskLocations, tl)
+		}
+	}
+	return nil
+}
+
+//listTasks returns all tasks of the given user that match the predicate,
+//sorted by ID. The caller must hold the mutex.
+func (s memoryStorage) listTasks(userName string, predicate func(Task) bool) []Task {
+	var result []Task
+	for _, task := range s.data.tasks {
+		if task.UserName == userName && predicate(task) {
+			result = append(result, task)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].ID < result[j].ID
+	})
+	return result
+}
+
+func (s memoryStorage) ListTasks(userName string) ([]Task, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.listTasks(userName, func(Task) bool { return true }), nil
+}
+
+func (s memoryStorage) ListOpenTasks(userName string) ([]Task, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.listTasks(userName, func(t Task) bool {
+		return !t.IsClosed()
+	}), nil
+}
+
+func (s memoryStorage) ListOpenTasksAtLocation(userName string, locationID int64) ([]Task, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.listTasks(userName, func(t Task) bool {
+		return !t.IsClosed() && s.data.taskLocations[TaskLocation{TaskID: t.ID, LocationID: locationID}]
+	}), nil
+}
+
+func (s memoryStorage) FindTask(userName string, id int64) (*Task, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	task, exists := s.data.tasks[id]
+	if !exists || task.UserName != userName {
+		return nil, sql.ErrNoRows
+	}
+	return &task, nil
+}
+
+//findFirstTask is like listTasks, but only returns the first match.
+func (s memoryStorage) findFirstTask(userName string, predicate func(Task) bool) (*Task, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	tasks := s.listTasks(userName, predicate)
+	if len(tasks) == 0 {
+		return nil, sql.ErrNoRows
+	}
+	return &tasks[0], nil
+}
+
+func (s memoryStorage) FindUnclassifiedTask(userName string) (*Task, error) {
+	return s.findFirstTask(userName, func(t Task) bool {
+		return !t.IsClassified() && !t.IsClosed()
+	})
+}
+
+func (s memoryStorage) FindSuccessor(task Task) (*Task, error) {
+	return s.findFirstTask(task.UserName, func(t Task) bool {
+		return t.PredecessorID != nil && *t.PredecessorID == task.ID
+	})
+}
+
+func (s memoryStorage) FindOpenTaskByCalDAVName(userName, name string) (*Task, error) {
+	return s.findFirstTask(userName, func(t Task) bool {
+		return t.CalDAVName != nil && *t.CalDAVName == name && !t.IsClosed()
+	})
+}
+
+func (s memoryStorage) FindOpenTaskByICalUID(userName, uid string) (*Task, error) {
+	return s.findFirstTask(userName, func(t Task) bool {
+		return t.ICalUID != nil && *t.ICalUID == uid && !t.IsClosed()
+	})
+}
+
+func (s memoryStorage) SaveTask(task *Task) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if task.ID == 0 {
+		task.ID = s.data.nextID()
+	} else if _, exists := s.data.tasks[task.ID]; !exists {
+		return sql.ErrNoRows
+	}
+	s.data.tasks[task.ID] = *task
+	return nil
+}
+
+func (s memoryStorage) DeleteTask(task *Task) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	delete(s.data.tasks, task.ID)
+	for tl := range s.data.taskLocations {
+		if tl.TaskID == task.ID {
+			delete(s.data.taskLocations, tl)
+		}
+	}
+	//like ON DELETE SET NULL in the database schema
+	for id, other := range s.data.tasks {
+		if other.PredecessorID != nil && *other.PredecessorID == task.ID {
+			other.PredecessorID = nil
+			s.data.tasks[id] = other
+		}
+	}
+	for id, completion := range s.data.completions {
+		if completion.TaskID != nil && *completion.TaskID == task.ID {
+			completion.TaskID = nil
+			s.data.completions[id] = completion
+		}
+	}
+	return nil
+}
+
+func (s memoryStorage) CloseTask(task *Task) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if _, exists := s.data.tasks[task.ID]; !exists {
+		return sql.ErrNoRows
+	}
+	var locationLabels []string
+	for _, locationID := range s.taskLocationsFor([]Task{*task})[task.ID] {
+		locationLabels = append(locationLabels, s.data.locations[locationID].Label)
+	}
+	sort.Strings(locationLabels)
+
+	now := time.Now()
+	today := date.FromTime(now)
+	completion := newTaskCompletion(*task, locationLabels, now)
+	completion.ID = s.data.nextID()
+	s.data.completions[completion.ID] = completion
+	closedTask := closedTaskForEvent(*task, today)
+	task.markDone(today)
+	s.data.tasks[task.ID] = *task
+
+	err := s.emitTaskEvent(WebhookEventTaskClosed, closedTask, locationLabels, now)
+	if err != nil || task.IsClosed() {
+		return err
+	}
+	return s.emitTaskEvent(WebhookEventTaskRespawned, *task, locationLabels, now)
+}
+
+func (s memoryStorage) ListTaskCompletions(userName string, since time.Time) ([]TaskCompletion, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	var result []TaskCompletion
+	for _, completion := range s.data.completions {
+		if completion.UserName == userName && !completion.CompletedAt.Before(since) {
+			result = append(result, completion)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].CompletedAt.Equal(result[j].CompletedAt) {
+			return result[i].ID > result[j].ID
+		}
+		return result[i].CompletedAt.After(result[j].CompletedAt)
+	})
+	return result, nil
+}
+
+func (s memoryStorage) NextTasks(userName string) (NextTasks, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	openTasks := s.listTasks(userName, func(t Task) bool {
+		return t.IsClassified() && !t.IsClosed()
+	})
+	return selectNextTasks(openTasks, s.taskLocationsFor(openTasks), time.Now()), nil
+}
+
+//taskLocationsFor returns the location IDs of the given tasks, indexed by task
+//ID. The caller must hold the mutex.
+func (s memoryStorage) taskLocationsFor(tasks []Task) map[int64][]int64 {
+	result := make(map[int64][]int64)
+	for _, task := range tasks {
+		for tl := range s.data.taskLocations {
+			if tl.TaskID == task.ID {
+				result[task.ID] = append(result[task.ID], tl.LocationID)
+			}
+		}
+		ids := result[task.ID]
+		sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	}
+	return result
+}
+
+func (s memoryStorage) ListTaskLocations(userName string) (map[int64][]int64, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	tasks := s.listTasks(userName, func(Task) bool { return true })
+	return s.taskLocationsFor(tasks), nil
+}
+
+func (s memoryStorage) FindTaskLocations(task Task) ([]int64, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.taskLocationsFor([]Task{task})[task.ID], nil
+}
+
+func (s memoryStorage) SetTaskLocations(task Task, locationIDs []int64) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for tl := range s.data.taskLocations {
+		if tl.TaskID == task.ID {
+			delete(s.data.taskLocations, tl)
+		}
+	}
+	for _, locationID := range locationIDs {
+		s.data.taskLocations[TaskLocation{TaskID: task.ID, LocationID: locationID}] = true
+	}
+	return nil
+}
+
+func (s memoryStorage) ListAPITokens(userName string) ([]APIToken, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	var result []APIToken
+	for _, apiToken := range s.data.apiTokens {
+		if apiToken.UserName == userName {
+			result = append(result, apiToken)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].CreatedAt.Before(result[j].CreatedAt)
+	})
+	return result, nil
+}
+
+func (s memoryStorage) FindAPITokenByID(userName string, id int64) (*APIToken, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	apiToken, exists := s.data.apiTokens[id]
+	if !exists || apiToken.UserName != userName {
+		return nil, sql.ErrNoRows
+	}
+	return &apiToken, nil
+}
+
+func (s memoryStorage) FindAPIToken(token string) (*APIToken, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	tokenHash := hashAPIToken(token)
+	for id, apiToken := range s.data.apiTokens {
+		if apiToken.TokenHash == tokenHash {
+			if apiToken.markUsed(time.Now()) {
+				s.data.apiTokens[id] = apiToken
+			}
+			return &apiToken, nil
+		}
+	}
+	return nil, nil
+}
+
+func (s memoryStorage) CreateAPIToken(userName, label string, scope APITokenScope) (*APIToken, string, error) {
+	apiToken, token, err := newAPIToken(userName, label, scope)
+	if err != nil {
+		return nil, "", err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	apiToken.ID = s.data.nextID()
+	s.data.apiTokens[apiToken.ID] = *apiToken
+	return apiToken, token, nil
+}
+
+func (s memoryStorage) DeleteAPIToken(apiToken *APIToken) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	delete(s.data.apiTokens, apiToken.ID)
+	return nil
+}
+
+func (s memoryStorage) GetUserSettings(userName string) (*UserSettings, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	settings, exists := s.data.userSettings[userName]
+	if !exists {
+		settings = DefaultUserSettings(userName)
+	}
+	return &settings, nil
+}
+
+func (s memoryStorage) SaveUserSettings(settings *UserSettings) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.data.userSettings[settings.UserName] = *settings
+	return nil
+}
+
+func (s memoryStorage) ListUserSettings() ([]UserSettings, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	result := make([]UserSettings, 0, len(s.data.userSettings))
+	for _, settings := range s.data.userSettings {
+		result = append(result, settings)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].UserName < result[j].UserName
+	})
+	return result, nil
+}
+
+func (s memoryStorage) ListWebhooks(userName string) ([]Webhook, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.listWebhooks(userName), nil
+}
+
+func (s memoryStorage) listWebhooks(userName string) []Webhook {
+	var result []Webhook
+	for _, webhook := range s.data.webhooks {
+		if webhook.UserName == userName {
+			result = append(result, webhook)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].ID < result[j].ID
+	})
+	return result
+}
+
+func (s memoryStorage) ListWebhookUserNames() ([]string, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	isUserName := make(map[string]bool)
+	for _, webhook := range s.data.webhooks {
+		isUserName[webhook.UserName] = true
+	}
+	result := make([]string, 0, len(isUserName))
+	for userName := range isUserName {
+		result = append(result, userName)
+	}
+	sort.Strings(result)
+	return result, nil
+}
+
+func (s memoryStorage) FindWebhook(userName string, id int64) (*Webhook, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	webhook, exists := s.data.webhooks[id]
+	if !exists || webhook.UserName != userName {
+		return nil, sql.ErrNoRows
+	}
+	return &webhook, nil
+}
+
+func (s memoryStorage) SaveWebhook(webhook *Webhook) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if webhook.ID == 0 {
+		webhook.ID = s.data.nextID()
+	} else if _, exists := s.data.webhooks[webhook.ID]; !exists {
+		return sql.ErrNoRows
+	}
+	s.data.webhooks[webhook.ID] = *webhook
+	return nil
+}
+
+func (s memoryStorage) DeleteWebhook(webhook *Webhook) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	delete(s.data.webhooks, webhook.ID)
+	for id, delivery := range s.data.deliveries {
+		if delivery.WebhookID == webhook.ID {
+			delete(s.data.deliveries, id)
+		}
+	}
+	return nil
+}
+
+func (s memoryStorage) EmitTaskEvent(event WebhookEvent, task Task) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	var locationLabels []string
+	for _, locationID := range s.taskLocationsFor([]Task{task})[task.ID] {
+		locationLabels = append(locationLabels, s.data.locations[locationID].Label)
+	}
+	sort.Strings(locationLabels)
+	return s.emitTaskEvent(event, task, locationLabels, time.Now())
+}
+
+func (s memoryStorage) MarkOverdueEventEmitted(task *Task) (bool, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	stored, exists := s.data.tasks[task.ID]
+	if !exists || stored.IsClosed() || stored.DueAt != task.DueAt {
+		return false, nil
+	}
+	dueAt := task.DueAt
+	stored.OverdueEventFor = &dueAt
+	s.data.tasks[task.ID] = stored
+	task.OverdueEventFor = &dueAt
+	return true, nil
+}
+
+//emitTaskEvent is like the function of the same name. The caller must hold
+//the mutex.
+func (s memoryStorage) emitTaskEvent(event WebhookEvent, task Task, locationLabels []string, now time.Time) error {
+	deliveries, err := newWebhookDeliveries(s.listWebhooks(task.UserName), event, task, locationLabels, now)
+	if err != nil {
+		return err
+	}
+	for _, delivery := range deliveries {
+		delivery.ID = s.data.nextID()
+		s.data.deliveries[delivery.ID] = delivery
+	}
+	return nil
+}
+
+func (s memoryStorage) ListWebhookDeliveries(webhook Webhook, limit int) ([]WebhookDelivery, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	var result []WebhookDelivery
+	for _, delivery := range s.data.deliveries {
+		if delivery.WebhookID == webhook.ID {
+			result = append(result, delivery)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].ID > result[j].ID
+	})
+	if len(result) > limit {
+		result = result[:limit]
+	}
+	return result, nil
+}
+
+func (s memoryStorage) ListPendingWebhookDeliveries(now time.Time) ([]WebhookDelivery, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	var result []WebhookDelivery
+	for _, delivery := range s.data.deliveries {
+		if delivery.Status == WebhookDeliveryPending && delivery.NextAttemptAt != nil && !delivery.NextAttemptAt.After(now) {
+			result = append(result, delivery)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].ID < result[j].ID
+	})
+	return result, nil
+}
+
+func (s memoryStorage) SaveWebhookDelivery(delivery *WebhookDelivery) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if _, exists := s.data.deliveries[delivery.ID]; !exists {
+		return sql.ErrNoRows
+	}
+	s.data.deliveries[delivery.ID] = *delivery
+	return nil
+}
+
+func (s memoryStorage) PruneWebhookDeliveries(before time.Time) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for id, delivery := range s.data.deliveries {
+		if delivery.Status != WebhookDeliveryPending && delivery.CreatedAt.Before(before) {
+			delete(s.data.deliveries, id)
+		}
+	}
+	return nil
+}
+
+func (s memoryStorage) Transaction(action func(Storage) error) error {
+	s.mutex.Lock()
+	snapshot := s.data.clone()
+	s.mutex.Unlock()
+
+	err := action(s)
+	if err != nil {
+		s.mutex.Lock()
+		*s.data = *snapshot
+		s.mutex.Unlock()
+	}
+	return err
+}
@@ -0,0 +1,210 @@
+/*******************************************************************************
+*
+* Copyright 2019 Stefan Majewsky <majewsky@gmx.net>
+*
+* This program is free software: you can redistribute it and/or modify it under
+* the terms of the GNU General Public License as published by the Free Software
+* Foundation, either version 3 of the License, or (at your option) any later
+* version.
+*
+* This program is distributed in the hope that it will be useful, but WITHOUT ANY
+* WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+* A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License along with
+* this program. If not, see <http://www.gnu.org/licenses/>.
+*
+*******************************************************************************/
+
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/majewsky/alltag/internal/date"
+)
+
+func mustSaveTask(t *testing.T, storage Storage, task Task, locationIDs ...int64) Task {
+	t.Helper()
+	err := storage.SaveTask(&task)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	err = storage.SetTaskLocations(task, locationIDs)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	return task
+}
+
+func TestMemoryStorageNextTasks(t *testing.T) {
+	storage := NewMemoryStorage()
+	home := Location{Label: "home", UserName: "alice"}
+	office := Location{Label: "office", UserName: "alice"}
+	for _, location := range []*Location{&home, &office} {
+		err := storage.SaveLocation(location)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+
+	today := date.FromTime(time.Now())
+	mental := TaskClassMental
+	newTask := func(userName string, startOffset, dueOffset int) Task {
+		return Task{
+			Label:         "task",
+			UserName:      userName,
+			Class:         &mental,
+			FinalPriority: 10,
+			StartsAt:      today.AddDays(startOffset),
+			DueAt:         today.AddDays(dueOffset),
+		}
+	}
+	relaxed := mustSaveTask(t, storage, newTask("alice", -1, 30), home.ID, office.ID)
+	urgent := mustSaveTask(t, storage, newTask("alice", -2, 1), home.ID)
+	mustSaveTask(t, storage, newTask("alice", 1, 2), office.ID) //not started yet
+	mustSaveTask(t, storage, newTask("bob", -10, -5), home.ID)  //other user
+	mustSaveTask(t, storage, Task{Label: "unclassified", UserName: "alice"}, office.ID)
+	closed := mustSaveTask(t, storage, newTask("alice", -10, -5), office.ID)
+	err := storage.CloseTask(&closed)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	nextTasks, err := storage.NextTasks("alice")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	expected := NextTasks{
+		TaskClassMental:   {home.ID: urgent.ID, office.ID: relaxed.ID},
+		TaskClassPhysical: {},
+	}
+	if !reflect.DeepEqual(nextTasks, expected) {
+		t.Errorf("expected next tasks %v, got %v", expected, nextTasks)
+	}
+
+	//deleting a location removes it from all tasks
+	err = storage.DeleteLocation(&office)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	nextTasks, err = storage.NextTasks("alice")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	expected = NextTasks{
+		TaskClassMental:   {home.ID: urgent.ID},
+		TaskClassPhysical: {},
+	}
+	if !reflect.DeepEqual(nextTasks, expected) {
+		t.Errorf("after DeleteLocation: expected next tasks %v, got %v", expected, nextTasks)
+	}
+}
+
+func TestMemoryStorageCloseTask(t *testing.T) {
+	storage := NewMemoryStorage()
+	location := Location{Label: "home", UserName: "alice"}
+	err := storage.SaveLocation(&location)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	today := date.FromTime(time.Now())
+	task := mustSaveTask(t, storage, Task{
+		Label:          "water the plants",
+		UserName:       "alice",
+		StartsAt:       today.AddDays(-1),
+		DueAt:          today,
+		RecurrenceDays: 3,
+	}, location.ID)
+	err = storage.CloseTask(&task)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	//the recurring task respawns instead of being closed
+	stored, err := storage.FindTask("alice", task.ID)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if stored.IsClosed() || stored.StartsAt != today.AddDays(3) || stored.DueAt != today.AddDays(4) {
+		t.Errorf("expected task to respawn at %s..%s, got %s..%s (closed = %v)",
+			today.AddDays(3), today.AddDays(4), stored.StartsAt, stored.DueAt, stored.IsClosed())
+	}
+
+	//the completion is recorded with the location labels
+	completions, err := storage.ListTaskCompletions("alice", time.Now().Add(-time.Hour))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(completions) != 1 || completions[0].Label != "water the plants" ||
+		!reflect.DeepEqual(completions[0].Locations(), []string{"home"}) {
+		t.Errorf("unexpected task completions: %#v", completions)
+	}
+
+	//tasks of other users are not visible
+	_, err = storage.FindTask("bob", task.ID)
+	if err != sql.ErrNoRows {
+		t.Errorf("expected sql.ErrNoRows when looking up another user's task, got %v", err)
+	}
+	completions, err = storage.ListTaskCompletions("bob", time.Time{})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(completions) != 0 {
+		t.Errorf("expected no task completions for other user, got %#v", completions)
+	}
+}
+
+func TestMemoryStorageTransaction(t *testing.T) {
+	storage := NewMemoryStorage()
+	task := mustSaveTask(t, storage, Task{Label: "first", UserName: "alice"})
+
+	//a failed transaction is rolled back completely
+	errFailed := errors.New("failed")
+	err := storage.Transaction(func(tx Storage) error {
+		task.Label = "changed"
+		err := tx.SaveTask(&task)
+		if err != nil {
+			return err
+		}
+		mustSaveTask(t, tx, Task{Label: "second", UserName: "alice"})
+		return errFailed
+	})
+	if err != errFailed {
+		t.Errorf("expected Transaction to return the action's error, got %v", err)
+	}
+	tasks, err := storage.ListTasks("alice")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(tasks) != 1 || tasks[0].Label != "first" {
+		t.Errorf("expected rollback to restore the first task only, got %#v", tasks)
+	}
+
+	//a successful transaction is kept
+	err = storage.Transaction(func(tx Storage) error {
+		mustSaveTask(t, tx, Task{Label: "second", UserName: "alice"})
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	tasks, err = storage.ListTasks("alice")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(tasks) != 2 || tasks[1].Label != "second" {
+		t.Errorf("expected two tasks after commit, got %#v", tasks)
+	}
+
+	//updating a task that does not exist fails
+	err = storage.SaveTask(&Task{ID: 42, Label: "missing", UserName: "alice"})
+	if err != sql.ErrNoRows {
+		t.Errorf("expected sql.ErrNoRows when updating a missing task, got %v", err)
+	}
+}
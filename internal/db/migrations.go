@@ -55,4 +55,126 @@ var sqlMigrations = map[string]string{
 			PRIMARY KEY (location_id, task_id)
 		);
 	`,
+	"002_add_task_chains.down.sql": `
+		DELETE FROM tasks WHERE closed_at IS NOT NULL;
+		ALTER TABLE tasks DROP COLUMN predecessor_id;
+		ALTER TABLE tasks DROP COLUMN closed_at;
+	`,
+	"002_add_task_chains.up.sql": `
+		ALTER TABLE tasks ADD COLUMN closed_at DATE DEFAULT NULL;
+		ALTER TABLE tasks ADD COLUMN predecessor_id BIGINT DEFAULT NULL REFERENCES tasks ON DELETE SET NULL;
+	`,
+	"003_add_api_tokens.down.sql": `
+		DROP TABLE api_tokens;
+	`,
+	"003_add_api_tokens.up.sql": `
+		CREATE TABLE api_tokens (
+			id           BIGSERIAL   PRIMARY KEY,
+			label        TEXT        NOT NULL,
+			username     TEXT        NOT NULL,
+			scope        TEXT        NOT NULL,
+			token_hash   TEXT        NOT NULL UNIQUE,
+			created_at   TIMESTAMPTZ NOT NULL,
+			last_used_at TIMESTAMPTZ DEFAULT NULL
+		);
+	`,
+	"004_add_task_completions.down.sql": `
+		DROP TABLE task_completions;
+	`,
+	"004_add_task_completions.up.sql": `
+		CREATE TABLE task_completions (
+			id              BIGSERIAL        PRIMARY KEY,
+			task_id         BIGINT           DEFAULT NULL REFERENCES tasks ON DELETE SET NULL,
+			username        TEXT             NOT NULL,
+			-- snapshot of the task at the time of completion
+			label           TEXT             NOT NULL,
+			class           task_class       DEFAULT NULL,
+			location_labels TEXT             NOT NULL DEFAULT '',
+			priority        DOUBLE PRECISION NOT NULL DEFAULT 0,
+			completed_at    TIMESTAMPTZ      NOT NULL
+		);
+		CREATE INDEX task_completions_username_completed_at_idx ON task_completions (username, completed_at);
+
+		-- closed tasks from before this migration are the best record that we have
+		INSERT INTO task_completions (task_id, username, label, class, location_labels, priority, completed_at)
+			SELECT t.id, t.username, t.label, t.class, COALESCE(STRING_AGG(l.label, E'\n' ORDER BY l.label), ''), t.final_priority, t.closed_at
+			FROM tasks t
+			LEFT OUTER JOIN task_locations tl ON tl.task_id = t.id
+			LEFT OUTER JOIN locations l ON l.id = tl.location_id
+			WHERE t.closed_at IS NOT NULL
+			GROUP BY t.id;
+	`,
+	"005_add_recurrence_rules.down.sql": `
+		ALTER TABLE tasks DROP COLUMN recurrence_rule;
+	`,
+	"005_add_recurrence_rules.up.sql": `
+		ALTER TABLE tasks ADD COLUMN recurrence_rule TEXT DEFAULT NULL;
+	`,
+	"006_add_recurrence_from_due_date.down.sql": `
+		ALTER TABLE tasks DROP COLUMN recurrence_from_due_date;
+	`,
+	"006_add_recurrence_from_due_date.up.sql": `
+		ALTER TABLE tasks ADD COLUMN recurrence_from_due_date BOOLEAN NOT NULL DEFAULT FALSE;
+	`,
+	"007_add_snoozed_until.down.sql": `
+		ALTER TABLE tasks DROP COLUMN snoozed_until;
+	`,
+	"007_add_snoozed_until.up.sql": `
+		ALTER TABLE tasks ADD COLUMN snoozed_until TIMESTAMPTZ DEFAULT NULL;
+	`,
+	"008_add_caldav_names.down.sql": `
+		ALTER TABLE tasks DROP COLUMN ical_uid;
+		ALTER TABLE tasks DROP COLUMN caldav_name;
+	`,
+	"008_add_caldav_names.up.sql": `
+		ALTER TABLE tasks ADD COLUMN ical_uid TEXT DEFAULT NULL;
+		ALTER TABLE tasks ADD COLUMN caldav_name TEXT DEFAULT NULL;
+	`,
+	"009_add_user_settings.down.sql": `
+		DROP TABLE user_settings;
+	`,
+	"009_add_user_settings.up.sql": `
+		CREATE TABLE user_settings (
+			username            TEXT        NOT NULL PRIMARY KEY,
+			digest_enabled      BOOLEAN     NOT NULL DEFAULT FALSE,
+			digest_hour         INTEGER     NOT NULL DEFAULT 7,
+			digest_mail_address TEXT        NOT NULL DEFAULT '',
+			digest_sent_at      TIMESTAMPTZ DEFAULT NULL
+		);
+	`,
+	"010_add_webhooks.down.sql": `
+		DROP TABLE webhook_deliveries;
+		DROP TABLE webhooks;
+		ALTER TABLE tasks DROP COLUMN overdue_event_for;
+	`,
+	"010_add_webhooks.up.sql": `
+		CREATE TABLE webhooks (
+			id         BIGSERIAL   PRIMARY KEY,
+			username   TEXT        NOT NULL,
+			url        TEXT        NOT NULL,
+			secret     TEXT        NOT NULL,
+			created_at TIMESTAMPTZ NOT NULL
+		);
+		CREATE TABLE webhook_deliveries (
+			id                   BIGSERIAL   PRIMARY KEY,
+			webhook_id           BIGINT      NOT NULL REFERENCES webhooks ON DELETE CASCADE,
+			username             TEXT        NOT NULL,
+			event                TEXT        NOT NULL,
+			payload              TEXT        NOT NULL,
+			status               TEXT        NOT NULL,
+			attempts             INTEGER     NOT NULL DEFAULT 0,
+			created_at           TIMESTAMPTZ NOT NULL,
+			next_attempt_at      TIMESTAMPTZ DEFAULT NULL,
+			last_attempt_at      TIMESTAMPTZ DEFAULT NULL,
+			last_response_status INTEGER     DEFAULT NULL,
+			last_error           TEXT        NOT NULL DEFAULT ''
+		);
+		ALTER TABLE tasks ADD COLUMN overdue_event_for DATE DEFAULT NULL;
+	`,
+	"011_add_task_notes.down.sql": `
+		ALTER TABLE tasks DROP COLUMN notes;
+	`,
+	"011_add_task_notes.up.sql": `
+		ALTER TABLE tasks ADD COLUMN notes TEXT NOT NULL DEFAULT '';
+	`,
 }
@@ -0,0 +1,144 @@
+/*******************************************************************************
+*
+* Copyright 2019 Stefan Majewsky <majewsky@gmx.net>
+*
+* This program is free software: you can redistribute it and/or modify it under
+* the terms of the GNU General Public License as published by the Free Software
+* Foundation, either version 3 of the License, or (at your option) any later
+* version.
+*
+* This program is distributed in the hope that it will be useful, but WITHOUT ANY
+* WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+* A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License along with
+* this program. If not, see <http://www.gnu.org/licenses/>.
+*
+*******************************************************************************/
+
+package db
+
+//sqliteMigrations is the SQLite equivalent of sqlMigrations. Each migration in
+//sqlMigrations must have a counterpart with the same version number here.
+//Since migrateSQLite only ever migrates upwards, there are no down migrations.
+var sqliteMigrations = map[string]string{
+	"001_initial.up.sql": `
+		CREATE TABLE locations (
+			id       INTEGER PRIMARY KEY AUTOINCREMENT,
+			label    TEXT    NOT NULL,
+			username TEXT    NOT NULL
+		);
+
+		CREATE TABLE tasks (
+			-- basic data (entered on initial creation)
+			id       INTEGER PRIMARY KEY AUTOINCREMENT,
+			label    TEXT    NOT NULL,
+			username TEXT    NOT NULL,
+			-- extended attributes (entered during classification)
+			class           TEXT     DEFAULT NULL CHECK (class IN ('mental', 'physical')),
+			init_priority   SMALLINT NOT NULL DEFAULT 0,
+			final_priority  SMALLINT NOT NULL DEFAULT 0,
+			recurrence_days INT      NOT NULL DEFAULT 0,
+			-- timestamps
+			starts_at DATE NOT NULL DEFAULT CURRENT_DATE,
+			due_at    DATE NOT NULL DEFAULT CURRENT_DATE
+		);
+
+		CREATE TABLE task_locations (
+			location_id INTEGER NOT NULL REFERENCES locations ON DELETE CASCADE,
+			task_id     INTEGER NOT NULL REFERENCES tasks ON DELETE CASCADE,
+			PRIMARY KEY (location_id, task_id)
+		);
+	`,
+	"002_add_task_chains.up.sql": `
+		ALTER TABLE tasks ADD COLUMN closed_at DATE DEFAULT NULL;
+		ALTER TABLE tasks ADD COLUMN predecessor_id INTEGER DEFAULT NULL REFERENCES tasks ON DELETE SET NULL;
+	`,
+	"003_add_api_tokens.up.sql": `
+		CREATE TABLE api_tokens (
+			id           INTEGER   PRIMARY KEY AUTOINCREMENT,
+			label        TEXT      NOT NULL,
+			username     TEXT      NOT NULL,
+			scope        TEXT      NOT NULL,
+			token_hash   TEXT      NOT NULL UNIQUE,
+			created_at   TIMESTAMP NOT NULL,
+			last_used_at TIMESTAMP DEFAULT NULL
+		);
+	`,
+	"004_add_task_completions.up.sql": `
+		CREATE TABLE task_completions (
+			id              INTEGER PRIMARY KEY AUTOINCREMENT,
+			task_id         INTEGER DEFAULT NULL REFERENCES tasks ON DELETE SET NULL,
+			username        TEXT    NOT NULL,
+			-- snapshot of the task at the time of completion
+			label           TEXT    NOT NULL,
+			class           TEXT    DEFAULT NULL CHECK (class IN ('mental', 'physical')),
+			location_labels TEXT    NOT NULL DEFAULT '',
+			priority        REAL    NOT NULL DEFAULT 0,
+			completed_at    TIMESTAMP NOT NULL
+		);
+		CREATE INDEX task_completions_username_completed_at_idx ON task_completions (username, completed_at);
+
+		-- closed tasks from before this migration are the best record that we have
+		-- (GROUP_CONCAT does not take an ORDER BY clause, so the location labels are
+		-- sorted in a subquery to get the same order as in PostgreSQL)
+		INSERT INTO task_completions (task_id, username, label, class, location_labels, priority, completed_at)
+			SELECT t.id, t.username, t.label, t.class, COALESCE((
+				SELECT GROUP_CONCAT(label, CHAR(10)) FROM (
+					SELECT l.label FROM task_locations tl JOIN locations l ON l.id = tl.location_id
+					WHERE tl.task_id = t.id ORDER BY l.label
+				)
+			), ''), t.final_priority, t.closed_at
+			FROM tasks t
+			WHERE t.closed_at IS NOT NULL;
+	`,
+	"005_add_recurrence_rules.up.sql": `
+		ALTER TABLE tasks ADD COLUMN recurrence_rule TEXT DEFAULT NULL;
+	`,
+	"006_add_recurrence_from_due_date.up.sql": `
+		ALTER TABLE tasks ADD COLUMN recurrence_from_due_date BOOLEAN NOT NULL DEFAULT FALSE;
+	`,
+	"007_add_snoozed_until.up.sql": `
+		ALTER TABLE tasks ADD COLUMN snoozed_until TIMESTAMP DEFAULT NULL;
+	`,
+	"008_add_caldav_names.up.sql": `
+		ALTER TABLE tasks ADD COLUMN ical_uid TEXT DEFAULT NULL;
+		ALTER TABLE tasks ADD COLUMN caldav_name TEXT DEFAULT NULL;
+	`,
+	"009_add_user_settings.up.sql": `
+		CREATE TABLE user_settings (
+			username            TEXT      NOT NULL PRIMARY KEY,
+			digest_enabled      BOOLEAN   NOT NULL DEFAULT FALSE,
+			digest_hour         INTEGER   NOT NULL DEFAULT 7,
+			digest_mail_address TEXT      NOT NULL DEFAULT '',
+			digest_sent_at      TIMESTAMP DEFAULT NULL
+		);
+	`,
+	"010_add_webhooks.up.sql": `
+		CREATE TABLE webhooks (
+			id         INTEGER   PRIMARY KEY AUTOINCREMENT,
+			username   TEXT      NOT NULL,
+			url        TEXT      NOT NULL,
+			secret     TEXT      NOT NULL,
+			created_at TIMESTAMP NOT NULL
+		);
+		CREATE TABLE webhook_deliveries (
+			id                   INTEGER   PRIMARY KEY AUTOINCREMENT,
+			webhook_id           INTEGER   NOT NULL REFERENCES webhooks ON DELETE CASCADE,
+			username             TEXT      NOT NULL,
+			event                TEXT      NOT NULL,
+			payload              TEXT      NOT NULL,
+			status               TEXT      NOT NULL,
+			attempts             INTEGER   NOT NULL DEFAULT 0,
+			created_at           TIMESTAMP NOT NULL,
+			next_attempt_at      TIMESTAMP DEFAULT NULL,
+			last_attempt_at      TIMESTAMP DEFAULT NULL,
+			last_response_status INTEGER   DEFAULT NULL,
+			last_error           TEXT      NOT NULL DEFAULT ''
+		);
+		ALTER TABLE tasks ADD COLUMN overdue_event_for DATE DEFAULT NULL;
+	`,
+	"011_add_task_notes.up.sql": `
+		ALTER TABLE tasks ADD COLUMN notes TEXT NOT NULL DEFAULT '';
+	`,
+}
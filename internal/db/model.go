@@ -23,9 +23,12 @@ import (
 	"fmt"
 	"math"
 	"net/url"
+	"sort"
+	"strings"
 	"time"
 
 	"github.com/majewsky/alltag/internal/date"
+	"github.com/majewsky/alltag/internal/rrule"
 	"github.com/sapcc/go-bits/easypg"
 	"github.com/sapcc/go-bits/logg"
 	"gopkg.in/gorp.v2"
@@ -59,6 +62,9 @@ type Task struct {
 	ID       int64  `db:"id"`
 	Label    string `db:"label"`
 	UserName string `db:"username"`
+	//Notes is free-form text with details that do not fit into the label, e.g.
+	//the body of an email from which the task was captured.
+	Notes string `db:"notes"`
 
 	//The following attributes are entered during classification and are zero
 	//before that. `task.Class == nil` is the canonical test for whether a task
@@ -70,10 +76,44 @@ type Task struct {
 	//but reset its StartsAt to this many days after now (and shift DueAt
 	//accordingly).
 	RecurrenceDays int32 `db:"recurrence_days"`
+	//If RecurrenceFromDueDate is true, RecurrenceDays is counted from the
+	//previous DueAt instead of from now, so that the schedule does not drift
+	//when the task is done late. Missed periods are skipped.
+	RecurrenceFromDueDate bool `db:"recurrence_from_due_date"`
+	//Alternatively, if RecurrenceRule is not nil, marking the task as done
+	//resets its StartsAt to the next occurrence of this rule (and shifts DueAt
+	//accordingly). At most one of RecurrenceDays and RecurrenceRule may be set.
+	RecurrenceRule *rrule.Rule `db:"recurrence_rule"`
 
 	//The StartsAt and DueAt timestamps are set during classification.
 	StartsAt date.Date `db:"starts_at"`
 	DueAt    date.Date `db:"due_at"`
+
+	//Closing a non-recurring task sets ClosedAt instead of deleting the task,
+	//so that task chains can still be viewed afterwards.
+	ClosedAt *date.Date `db:"closed_at"`
+	//When a task was entered as the next step after closing another task,
+	//PredecessorID refers to that other task.
+	PredecessorID *int64 `db:"predecessor_id"`
+	//When the user has snoozed a task ("not now"), it will not be suggested
+	//until SnoozedUntil has passed.
+	SnoozedUntil *time.Time `db:"snoozed_until"`
+
+	//When a task is created through CalDAV, the client chooses the UID of the
+	//VTODO and the name of the resource containing it. Both are remembered, so
+	//that the client can recognize the task later. For all other tasks, they
+	//are nil, and default values are derived from the task ID.
+	ICalUID    *string `db:"ical_uid"`
+	CalDAVName *string `db:"caldav_name"`
+
+	//OverdueEventFor is the due date for which the "task.overdue" webhook event
+	//has been emitted, so that it is only emitted once per due date.
+	OverdueEventFor *date.Date `db:"overdue_event_for"`
+}
+
+//IsRecurring returns whether this task respawns when it is marked as done.
+func (t Task) IsRecurring() bool {
+	return t.RecurrenceDays != 0 || t.RecurrenceRule != nil
 }
 
 //IsClassified returns whether this has undergone classification.
@@ -81,6 +121,16 @@ func (t Task) IsClassified() bool {
 	return t.Class != nil
 }
 
+//IsClosed returns whether this task has been closed.
+func (t Task) IsClosed() bool {
+	return t.ClosedAt != nil
+}
+
+//IsSnoozed returns whether this task is snoozed at the given time.
+func (t Task) IsSnoozed(now time.Time) bool {
+	return t.SnoozedUntil != nil && t.SnoozedUntil.After(now)
+}
+
 //CurrentPriority interpolates the current priority of this task.
 //For unclassified tasks, negative infinity is returned.
 //
@@ -133,6 +183,28 @@ type Location struct {
 	UserName string `db:"username"`
 }
 
+//LocationLabels maps location IDs to the labels of these locations.
+type LocationLabels map[int64]string
+
+//NewLocationLabels builds a LocationLabels map for the given locations.
+func NewLocationLabels(locations []Location) LocationLabels {
+	result := make(LocationLabels, len(locations))
+	for _, loc := range locations {
+		result[loc.ID] = loc.Label
+	}
+	return result
+}
+
+//Of returns the labels of the given locations in alphabetical order.
+func (l LocationLabels) Of(locationIDs []int64) []string {
+	var result []string
+	for _, id := range locationIDs {
+		result = append(result, l[id])
+	}
+	sort.Strings(result)
+	return result
+}
+
 //TaskLocation describes a single entry in the N:M mapping between type Task
 //and type Location.
 type TaskLocation struct {
@@ -140,6 +212,164 @@ type TaskLocation struct {
 	LocationID int64 `db:"location_id"`
 }
 
+//APITokenScope is an enum that appears in type APIToken.
+type APITokenScope string
+
+const (
+	//APITokenScopeReadOnly is an enum value for API tokens that can only be
+	//used for GET requests.
+	APITokenScopeReadOnly APITokenScope = "read-only"
+	//APITokenScopeReadWrite is an enum value for API tokens that can be used
+	//for all requests.
+	APITokenScopeReadWrite APITokenScope = "read-write"
+	//APITokenScopeCalendarFeed is an enum value for API tokens that can only be
+	//used to retrieve the calendar feed. Unlike other API tokens, these are
+	//passed in the URL since calendar apps cannot send custom headers.
+	APITokenScopeCalendarFeed APITokenScope = "calendar-feed"
+	//APITokenScopeMailCapture is an enum value for API tokens that can only be
+	//used to create tasks by email. These tokens are part of the recipient
+	//address (see package mailcapture).
+	APITokenScopeMailCapture APITokenScope = "mail-capture"
+)
+
+//IsAPITokenScope contains all acceptable APITokenScope values.
+var IsAPITokenScope = map[APITokenScope]bool{
+	APITokenScopeReadOnly:     true,
+	APITokenScopeReadWrite:    true,
+	APITokenScopeCalendarFeed: true,
+	APITokenScopeMailCapture:  true,
+}
+
+//APIToken is a token that a user can give to a non-interactive client to
+//access the API in their name without knowing their password. Only a hash of
+//the token is stored; the token itself is shown to the user once on creation.
+type APIToken struct {
+	ID         int64         `db:"id"`
+	Label      string        `db:"label"`
+	UserName   string        `db:"username"`
+	Scope      APITokenScope `db:"scope"`
+	TokenHash  string        `db:"token_hash"`
+	CreatedAt  time.Time     `db:"created_at"`
+	LastUsedAt *time.Time    `db:"last_used_at"`
+}
+
+//UserSettings contains the settings of a single user. Users that have never
+//changed their settings do not have a record in the database; see
+//DefaultUserSettings for what applies to them.
+type UserSettings struct {
+	UserName string `db:"username"`
+	//DigestEnabled is whether the daily digest email is sent to this user.
+	DigestEnabled bool `db:"digest_enabled"`
+	//DigestHour is the hour of the day (0-23, in the server's timezone) after
+	//which the digest is sent.
+	DigestHour int `db:"digest_hour"`
+	//DigestMailAddress is where the digest is sent. If empty, the address is
+	//taken from the auth driver (i.e. from LDAP).
+	DigestMailAddress string `db:"digest_mail_address"`
+	//DigestSentAt is when the last digest was sent (or when it was skipped
+	//because there was nothing to report).
+	DigestSentAt *time.Time `db:"digest_sent_at"`
+}
+
+//DefaultUserSettings returns the settings for a user that does not have a
+//UserSettings record yet.
+func DefaultUserSettings(userName string) UserSettings {
+	return UserSettings{
+		UserName:   userName,
+		DigestHour: 7,
+	}
+}
+
+//Webhook is a URL that receives an HTTP request for each task event of its
+//user (see WebhookEvent). The secret is used to sign the request bodies, so it
+//is stored in plain text.
+type Webhook struct {
+	ID        int64     `db:"id"`
+	UserName  string    `db:"username"`
+	URL       string    `db:"url"`
+	Secret    string    `db:"secret"`
+	CreatedAt time.Time `db:"created_at"`
+}
+
+//WebhookEvent is an enum that appears in type WebhookDelivery.
+type WebhookEvent string
+
+const (
+	//WebhookEventTaskCreated is emitted when a task is created.
+	WebhookEventTaskCreated WebhookEvent = "task.created"
+	//WebhookEventTaskClassified is emitted when a task becomes classified
+	//(either on creation or when an unclassified task is classified).
+	WebhookEventTaskClassified WebhookEvent = "task.classified"
+	//WebhookEventTaskClosed is emitted when a task is marked as done. For
+	//recurring tasks, this is followed by WebhookEventTaskRespawned.
+	WebhookEventTaskClosed WebhookEvent = "task.closed"
+	//WebhookEventTaskRespawned is emitted when a recurring task has been
+	//marked as done and respawns with new dates.
+	WebhookEventTaskRespawned WebhookEvent = "task.respawned"
+	//WebhookEventTaskOverdue is emitted once the due date of a task has passed.
+	WebhookEventTaskOverdue WebhookEvent = "task.overdue"
+)
+
+//WebhookDeliveryStatus is an enum that appears in type WebhookDelivery.
+type WebhookDeliveryStatus string
+
+const (
+	//WebhookDeliveryPending is an enum value for deliveries that have not been
+	//successful yet, but will be attempted again at NextAttemptAt.
+	WebhookDeliveryPending WebhookDeliveryStatus = "pending"
+	//WebhookDeliverySucceeded is an enum value for deliveries where the
+	//receiver responded with a 2xx status.
+	WebhookDeliverySucceeded WebhookDeliveryStatus = "succeeded"
+	//WebhookDeliveryFailed is an enum value for deliveries that have failed
+	//too often to be attempted again.
+	WebhookDeliveryFailed WebhookDeliveryStatus = "failed"
+)
+
+//WebhookDelivery is a single request to a Webhook. These records serve both
+//as a queue for pending deliveries and as a delivery log.
+type WebhookDelivery struct {
+	ID        int64        `db:"id"`
+	WebhookID int64        `db:"webhook_id"`
+	UserName  string       `db:"username"`
+	Event     WebhookEvent `db:"event"`
+	//Payload is the JSON request body. It is rendered when the event occurs, so
+	//that retries send the same payload.
+	Payload            string                `db:"payload"`
+	Status             WebhookDeliveryStatus `db:"status"`
+	Attempts           int                   `db:"attempts"`
+	CreatedAt          time.Time             `db:"created_at"`
+	NextAttemptAt      *time.Time            `db:"next_attempt_at"`
+	LastAttemptAt      *time.Time            `db:"last_attempt_at"`
+	LastResponseStatus *int                  `db:"last_response_status"`
+	LastError          string                `db:"last_error"`
+}
+
+//TaskCompletion records that a task was marked as done. Since tasks can be
+//changed or deleted afterwards (and recurring tasks are reused for their next
+//occurrence), the relevant attributes of the task are copied into this record
+//at the time of completion.
+type TaskCompletion struct {
+	ID int64 `db:"id"`
+	//TaskID is nil if the task has been deleted in the meantime.
+	TaskID   *int64     `db:"task_id"`
+	UserName string     `db:"username"`
+	Label    string     `db:"label"`
+	Class    *TaskClass `db:"class"`
+	//LocationLabels contains the labels of the task's locations, separated by
+	//newlines. Use Locations() to get them as a list.
+	LocationLabels string    `db:"location_labels"`
+	Priority       float64   `db:"priority"`
+	CompletedAt    time.Time `db:"completed_at"`
+}
+
+//Locations returns the labels of the locations of the completed task.
+func (c TaskCompletion) Locations() []string {
+	if c.LocationLabels == "" {
+		return nil
+	}
+	return strings.Split(c.LocationLabels, "\n")
+}
+
 //Init connects to the database and initializes the schema and model types.
 func Init(urlStr string) (*gorp.DbMap, error) {
 	dbURL, err := url.Parse(urlStr)
@@ -147,18 +377,39 @@ func Init(urlStr string) (*gorp.DbMap, error) {
 		return nil, fmt.Errorf("malformed ALLTAG_DB_URI: %s", err.Error())
 	}
 
-	dbConn, err := easypg.Connect(easypg.Configuration{
-		PostgresURL: dbURL,
-		Migrations:  sqlMigrations,
-	})
+	//the URL scheme selects the database backend
+	var (
+		dbConn  *sql.DB
+		dialect gorp.Dialect
+	)
+	switch dbURL.Scheme {
+	case "postgres", "postgresql":
+		dbConn, err = easypg.Connect(easypg.Configuration{
+			PostgresURL: dbURL,
+			Migrations:  sqlMigrations,
+			//see instrument.go
+			OverrideDriverName: postgresDriverName,
+		})
+		dialect = gorp.PostgresDialect{}
+	case "sqlite":
+		dbConn, err = connectToSQLite(dbURL)
+		dialect = gorp.SqliteDialect{}
+	default:
+		return nil, fmt.Errorf("unsupported database type in ALLTAG_DB_URI: %q (expected \"postgres\" or \"sqlite\")", dbURL.Scheme)
+	}
 	if err != nil {
 		return nil, fmt.Errorf("cannot connect to database: %s", err.Error())
 	}
 
-	gorpDB := &gorp.DbMap{Db: dbConn, Dialect: gorp.PostgresDialect{}}
+	gorpDB := &gorp.DbMap{Db: dbConn, Dialect: dialect}
 	gorpDB.AddTableWithName(Location{}, "locations").SetKeys(true, "id")
 	gorpDB.AddTableWithName(Task{}, "tasks").SetKeys(true, "id")
 	gorpDB.AddTableWithName(TaskLocation{}, "task_locations").SetKeys(false, "task_id", "location_id")
+	gorpDB.AddTableWithName(APIToken{}, "api_tokens").SetKeys(true, "id")
+	gorpDB.AddTableWithName(TaskCompletion{}, "task_completions").SetKeys(true, "id")
+	gorpDB.AddTableWithName(UserSettings{}, "user_settings").SetKeys(false, "username")
+	gorpDB.AddTableWithName(Webhook{}, "webhooks").SetKeys(true, "id")
+	gorpDB.AddTableWithName(WebhookDelivery{}, "webhook_deliveries").SetKeys(true, "id")
 	return gorpDB, nil
 }
 
@@ -0,0 +1,120 @@
+/*******************************************************************************
+*
+* Copyright 2019 Stefan Majewsky <majewsky@gmx.net>
+*
+* This program is free software: you can redistribute it and/or modify it under
+* the terms of the GNU General Public License as published by the Free Software
+* Foundation, either version 3 of the License, or (at your option) any later
+* version.
+*
+* This program is distributed in the hope that it will be useful, but WITHOUT ANY
+* WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+* A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License along with
+* this program. If not, see <http://www.gnu.org/licenses/>.
+*
+*******************************************************************************/
+
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+//connectToSQLite opens the SQLite database file referenced by the given URL
+//(either "sqlite:relative/path.db" or "sqlite:///absolute/path.db"), creating
+//it if necessary, and brings its schema up to date.
+func connectToSQLite(dbURL *url.URL) (*sql.DB, error) {
+	path := dbURL.Opaque
+	if path == "" {
+		path = dbURL.Path
+	}
+	if path == "" {
+		return nil, errors.New("no database file path given")
+	}
+
+	//foreign keys are not enforced by SQLite unless explicitly requested, and
+	//the busy timeout avoids spurious errors when two requests write at the
+	//same time
+	options := url.Values{}
+	options.Set("_foreign_keys", "1")
+	options.Set("_busy_timeout", "5000")
+	options.Set("_journal_mode", "WAL")
+	dbConn, err := sql.Open(sqliteDriverName, "file:"+path+"?"+options.Encode())
+	if err != nil {
+		return nil, err
+	}
+
+	err = migrateSQLite(dbConn, sqliteMigrations)
+	if err != nil {
+		dbConn.Close()
+		return nil, fmt.Errorf("cannot apply database schema: %s", err.Error())
+	}
+	return dbConn, nil
+}
+
+//migrateSQLite applies all up migrations that have not been applied yet.
+//This is a small replacement for the golang-migrate library that easypg uses
+//for Postgres. The versions of applied migrations are recorded in the
+//schema_migrations table.
+func migrateSQLite(dbConn *sql.DB, migrations map[string]string) error {
+	_, err := dbConn.Exec(`CREATE TABLE IF NOT EXISTS schema_migrations (version INTEGER PRIMARY KEY)`)
+	if err != nil {
+		return err
+	}
+	var currentVersion int64
+	err = dbConn.QueryRow(`SELECT COALESCE(MAX(version), 0) FROM schema_migrations`).Scan(&currentVersion)
+	if err != nil {
+		return err
+	}
+
+	//collect pending migrations, sorted by version
+	versions := make([]int64, 0, len(migrations))
+	queriesForVersion := make(map[int64]string, len(migrations))
+	for fileName, query := range migrations {
+		if !strings.HasSuffix(fileName, ".up.sql") {
+			continue
+		}
+		version, err := strconv.ParseInt(strings.SplitN(fileName, "_", 2)[0], 10, 64)
+		if err != nil {
+			return fmt.Errorf("malformed migration file name: %q", fileName)
+		}
+		if version > currentVersion {
+			versions = append(versions, version)
+			queriesForVersion[version] = query
+		}
+	}
+	sort.Slice(versions, func(i, j int) bool { return versions[i] < versions[j] })
+
+	for _, version := range versions {
+		err := applySQLiteMigration(dbConn, version, queriesForVersion[version])
+		if err != nil {
+			return fmt.Errorf("migration %d failed: %s", version, err.Error())
+		}
+	}
+	return nil
+}
+
+func applySQLiteMigration(dbConn *sql.DB, version int64, query string) error {
+	tx, err := dbConn.Begin()
+	if err != nil {
+		return err
+	}
+	//the sqlite3 driver executes all statements in a multi-statement string
+	_, err = tx.Exec(query)
+	if err == nil {
+		_, err = tx.Exec(`INSERT INTO schema_migrations (version) VALUES ($1)`, version)
+	}
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,489 @@
+/*******************************************************************************
+*
+* Copyright 2019 Stefan Majewsky <majewsky@gmx.net>
+*
+* This program is free software: you can redistribute it and/or modify it under
+* the terms of the GNU General Public License as published by the Free Software
+* Foundation, either version 3 of the License, or (at your option) any later
+* version.
+*
+* This program is distributed in the hope that it will be useful, but WITHOUT ANY
+* WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+* A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License along with
+* this program. If not, see <http://www.gnu.org/licenses/>.
+*
+*******************************************************************************/
+
+package db
+
+import (
+	"database/sql"
+	"time"
+
+	"gopkg.in/gorp.v2"
+)
+
+//Storage is the interface through which the UI accesses the database. Besides
+//the implementation returned by NewStorage, there is an in-memory
+//implementation returned by NewMemoryStorage, which is useful for testing.
+//
+//All methods that look up a single record return sql.ErrNoRows when there is
+//no such record. All methods that take a user name only consider records
+//owned by that user.
+type Storage interface {
+	ListLocations(userName string) ([]Location, error)
+	FindLocation(userName string, id int64) (*Location, error)
+	//SaveLocation inserts the location if its ID is 0, or updates it otherwise.
+	SaveLocation(location *Location) error
+	//DeleteLocation also removes the location from all tasks.
+	DeleteLocation(location *Location) error
+
+	//ListTasks returns all tasks, including closed ones.
+	ListTasks(userName string) ([]Task, error)
+	//ListOpenTasks returns all tasks (classified or not) that are not closed.
+	ListOpenTasks(userName string) ([]Task, error)
+	//ListOpenTasksAtLocation is like ListOpenTasks, but only returns tasks at
+	//the given location.
+	ListOpenTasksAtLocation(userName string, locationID int64) ([]Task, error)
+	FindTask(userName string, id int64) (*Task, error)
+	//FindUnclassifiedTask returns the oldest open task that has not been
+	//classified yet.
+	FindUnclassifiedTask(userName string) (*Task, error)
+	//FindSuccessor returns the task that was entered as the next step after
+	//the given task.
+	FindSuccessor(task Task) (*Task, error)
+	//FindOpenTaskByCalDAVName returns the open task that was created via
+	//CalDAV with the given resource name.
+	FindOpenTaskByCalDAVName(userName, name string) (*Task, error)
+	//FindOpenTaskByICalUID returns the open task that was created via CalDAV
+	//with the given UID.
+	FindOpenTaskByICalUID(userName, uid string) (*Task, error)
+	//SaveTask inserts the task if its ID is 0, or updates it otherwise.
+	SaveTask(task *Task) error
+	DeleteTask(task *Task) error
+	//CloseTask works like the function of the same name.
+	CloseTask(task *Task) error
+	//NextTasks works like FindNextTasks.
+	NextTasks(userName string) (NextTasks, error)
+	//ListTaskCompletions returns all task completions since the given time,
+	//most recent first.
+	ListTaskCompletions(userName string, since time.Time) ([]TaskCompletion, error)
+
+	//ListTaskLocations returns the location IDs of all tasks (including closed
+	//ones), indexed by task ID.
+	ListTaskLocations(userName string) (map[int64][]int64, error)
+	FindTaskLocations(task Task) ([]int64, error)
+	//SetTaskLocations works like the function of the same name.
+	SetTaskLocations(task Task, locationIDs []int64) error
+
+	ListAPITokens(userName string) ([]APIToken, error)
+	FindAPITokenByID(userName string, id int64) (*APIToken, error)
+	//FindAPIToken works like the function of the same name.
+	FindAPIToken(token string) (*APIToken, error)
+	//CreateAPIToken works like the function of the same name.
+	CreateAPIToken(userName, label string, scope APITokenScope) (*APIToken, string, error)
+	DeleteAPIToken(apiToken *APIToken) error
+
+	//GetUserSettings returns DefaultUserSettings if the user does not have
+	//any settings stored yet, so it never returns sql.ErrNoRows.
+	GetUserSettings(userName string) (*UserSettings, error)
+	//SaveUserSettings inserts or updates the given settings.
+	SaveUserSettings(settings *UserSettings) error
+	//ListUserSettings returns the stored settings of all users (not just of
+	//one user like all other methods).
+	ListUserSettings() ([]UserSettings, error)
+
+	ListWebhooks(userName string) ([]Webhook, error)
+	//ListWebhookUserNames returns the names of all users that have webhooks.
+	ListWebhookUserNames() ([]string, error)
+	FindWebhook(userName string, id int64) (*Webhook, error)
+	//SaveWebhook inserts the webhook if its ID is 0, or updates it otherwise.
+	SaveWebhook(webhook *Webhook) error
+	//DeleteWebhook also deletes all deliveries of the webhook.
+	DeleteWebhook(webhook *Webhook) error
+	//EmitTaskEvent works like the function of the same name.
+	EmitTaskEvent(event WebhookEvent, task Task) error
+	//MarkOverdueEventEmitted sets OverdueEventFor to the task's DueAt in the
+	//database, but only if the task is still open and still has that due date.
+	//It returns false if the task was changed in the meantime, in which case no
+	//overdue event shall be emitted for it.
+	MarkOverdueEventEmitted(task *Task) (bool, error)
+	//ListWebhookDeliveries returns the most recent deliveries of the given
+	//webhook, most recent first.
+	ListWebhookDeliveries(webhook Webhook, limit int) ([]WebhookDelivery, error)
+	//ListPendingWebhookDeliveries returns the pending deliveries (of all users)
+	//that shall be attempted at the given time, oldest first.
+	ListPendingWebhookDeliveries(now time.Time) ([]WebhookDelivery, error)
+	//SaveWebhookDelivery updates an existing delivery.
+	SaveWebhookDelivery(delivery *WebhookDelivery) error
+	//PruneWebhookDeliveries deletes all deliveries (of all users) that were
+	//created before the given time and are not pending anymore.
+	PruneWebhookDeliveries(before time.Time) error
+
+	//Transaction calls the given function with a Storage whose changes are
+	//only persisted if the function does not return an error.
+	Transaction(action func(Storage) error) error
+}
+
+type gorpStorage struct {
+	dbi gorp.SqlExecutor
+	//only set outside of transactions
+	dbMap *gorp.DbMap
+}
+
+//NewStorage returns a Storage that is backed by the given database.
+func NewStorage(dbMap *gorp.DbMap) Storage {
+	return gorpStorage{dbMap, dbMap}
+}
+
+func (s gorpStorage) ListLocations(userName string) ([]Location, error) {
+	var locations []Location
+	_, err := s.dbi.Select(&locations,
+		`SELECT * FROM locations WHERE username = $1 ORDER BY label`,
+		userName,
+	)
+	return locations, err
+}
+
+func (s gorpStorage) FindLocation(userName string, id int64) (*Location, error) {
+	var location Location
+	err := s.dbi.SelectOne(&location,
+		`SELECT * FROM locations WHERE id = $1 AND username = $2`,
+		id, userName,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &location, nil
+}
+
+func (s gorpStorage) SaveLocation(location *Location) error {
+	if location.ID == 0 {
+		return s.dbi.Insert(location)
+	}
+	_, err := s.dbi.Update(location)
+	return err
+}
+
+func (s gorpStorage) DeleteLocation(location *Location) error {
+	_, err := s.dbi.Delete(location)
+	return err
+}
+
+func (s gorpStorage) ListTasks(userName string) ([]Task, error) {
+	var tasks []Task
+	_, err := s.dbi.Select(&tasks,
+		`SELECT * FROM tasks WHERE username = $1 ORDER BY id`,
+		userName,
+	)
+	return tasks, err
+}
+
+func (s gorpStorage) ListOpenTasks(userName string) ([]Task, error) {
+	var tasks []Task
+	_, err := s.dbi.Select(&tasks,
+		`SELECT * FROM tasks WHERE username = $1 AND closed_at IS NULL`,
+		userName,
+	)
+	return tasks, err
+}
+
+func (s gorpStorage) ListOpenTasksAtLocation(userName string, locationID int64) ([]Task, error) {
+	var tasks []Task
+	_, err := s.dbi.Select(&tasks,
+		`SELECT t.* FROM tasks t JOIN task_locations l ON t.id = l.task_id WHERE l.location_id = $1 AND t.username = $2 AND t.closed_at IS NULL`,
+		locationID, userName,
+	)
+	return tasks, err
+}
+
+func (s gorpStorage) findOneTask(query string, args ...interface{}) (*Task, error) {
+	var task Task
+	err := s.dbi.SelectOne(&task, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	return &task, nil
+}
+
+func (s gorpStorage) FindTask(userName string, id int64) (*Task, error) {
+	return s.findOneTask(
+		`SELECT * FROM tasks WHERE id = $1 AND username = $2`,
+		id, userName,
+	)
+}
+
+func (s gorpStorage) FindUnclassifiedTask(userName string) (*Task, error) {
+	return s.findOneTask(
+		`SELECT * FROM tasks WHERE class IS NULL AND closed_at IS NULL AND username = $1 ORDER BY id ASC LIMIT 1`,
+		userName,
+	)
+}
+
+func (s gorpStorage) FindSuccessor(task Task) (*Task, error) {
+	return s.findOneTask(
+		`SELECT * FROM tasks WHERE predecessor_id = $1 AND username = $2 ORDER BY id ASC LIMIT 1`,
+		task.ID, task.UserName,
+	)
+}
+
+func (s gorpStorage) FindOpenTaskByCalDAVName(userName, name string) (*Task, error) {
+	return s.findOneTask(
+		`SELECT * FROM tasks WHERE caldav_name = $1 AND username = $2 AND closed_at IS NULL ORDER BY id ASC LIMIT 1`,
+		name, userName,
+	)
+}
+
+func (s gorpStorage) FindOpenTaskByICalUID(userName, uid string) (*Task, error) {
+	return s.findOneTask(
+		`SELECT * FROM tasks WHERE ical_uid = $1 AND username = $2 AND closed_at IS NULL ORDER BY id ASC LIMIT 1`,
+		uid, userName,
+	)
+}
+
+func (s gorpStorage) SaveTask(task *Task) error {
+	if task.ID == 0 {
+		return s.dbi.Insert(task)
+	}
+	_, err := s.dbi.Update(task)
+	return err
+}
+
+func (s gorpStorage) DeleteTask(task *Task) error {
+	_, err := s.dbi.Delete(task)
+	return err
+}
+
+func (s gorpStorage) CloseTask(task *Task) error {
+	return s.Transaction(func(tx Storage) error {
+		return CloseTask(tx.(gorpStorage).dbi, task)
+	})
+}
+
+func (s gorpStorage) NextTasks(userName string) (NextTasks, error) {
+	return FindNextTasks(s.dbi, userName)
+}
+
+func (s gorpStorage) ListTaskCompletions(userName string, since time.Time) ([]TaskCompletion, error) {
+	var completions []TaskCompletion
+	_, err := s.dbi.Select(&completions,
+		`SELECT * FROM task_completions WHERE username = $1 AND completed_at >= $2 ORDER BY completed_at DESC, id DESC`,
+		//SQLite compares timestamps as strings, so they must all be in the same
+		//timezone (newTaskCompletion uses UTC as well)
+		userName, since.UTC(),
+	)
+	return completions, err
+}
+
+func (s gorpStorage) ListTaskLocations(userName string) (map[int64][]int64, error) {
+	rows, err := s.dbi.Query(`
+		SELECT l.task_id, l.location_id
+		FROM task_locations l JOIN tasks t ON t.id = l.task_id
+		WHERE t.username = $1
+		ORDER BY l.location_id
+	`, userName)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make(map[int64][]int64)
+	for rows.Next() {
+		var taskID, locationID int64
+		err := rows.Scan(&taskID, &locationID)
+		if err != nil {
+			return nil, err
+		}
+		result[taskID] = append(result[taskID], locationID)
+	}
+	return result, rows.Close()
+}
+
+func (s gorpStorage) FindTaskLocations(task Task) ([]int64, error) {
+	var result []int64
+	_, err := s.dbi.Select(&result,
+		`SELECT location_id FROM task_locations WHERE task_id = $1 ORDER BY location_id`,
+		task.ID,
+	)
+	return result, err
+}
+
+func (s gorpStorage) SetTaskLocations(task Task, locationIDs []int64) error {
+	return SetTaskLocations(s.dbi, task.ID, locationIDs)
+}
+
+func (s gorpStorage) ListAPITokens(userName string) ([]APIToken, error) {
+	var tokens []APIToken
+	_, err := s.dbi.Select(&tokens,
+		`SELECT * FROM api_tokens WHERE username = $1 ORDER BY created_at`,
+		userName,
+	)
+	return tokens, err
+}
+
+func (s gorpStorage) FindAPITokenByID(userName string, id int64) (*APIToken, error) {
+	var apiToken APIToken
+	err := s.dbi.SelectOne(&apiToken,
+		`SELECT * FROM api_tokens WHERE id = $1 AND username = $2`,
+		id, userName,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &apiToken, nil
+}
+
+func (s gorpStorage) FindAPIToken(token string) (*APIToken, error) {
+	return FindAPIToken(s.dbi, token)
+}
+
+func (s gorpStorage) CreateAPIToken(userName, label string, scope APITokenScope) (*APIToken, string, error) {
+	return CreateAPIToken(s.dbi, userName, label, scope)
+}
+
+func (s gorpStorage) DeleteAPIToken(apiToken *APIToken) error {
+	_, err := s.dbi.Delete(apiToken)
+	return err
+}
+
+func (s gorpStorage) GetUserSettings(userName string) (*UserSettings, error) {
+	var settings UserSettings
+	err := s.dbi.SelectOne(&settings,
+		`SELECT * FROM user_settings WHERE username = $1`,
+		userName,
+	)
+	if err == sql.ErrNoRows {
+		settings = DefaultUserSettings(userName)
+		return &settings, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &settings, nil
+}
+
+func (s gorpStorage) SaveUserSettings(settings *UserSettings) error {
+	count, err := s.dbi.Update(settings)
+	if err != nil || count > 0 {
+		return err
+	}
+	return s.dbi.Insert(settings)
+}
+
+func (s gorpStorage) ListUserSettings() ([]UserSettings, error) {
+	var result []UserSettings
+	_, err := s.dbi.Select(&result, `SELECT * FROM user_settings ORDER BY username`)
+	return result, err
+}
+
+func (s gorpStorage) ListWebhooks(userName string) ([]Webhook, error) {
+	var webhooks []Webhook
+	_, err := s.dbi.Select(&webhooks,
+		`SELECT * FROM webhooks WHERE username = $1 ORDER BY id`,
+		userName,
+	)
+	return webhooks, err
+}
+
+func (s gorpStorage) ListWebhookUserNames() ([]string, error) {
+	var userNames []string
+	_, err := s.dbi.Select(&userNames, `SELECT DISTINCT username FROM webhooks ORDER BY username`)
+	return userNames, err
+}
+
+func (s gorpStorage) FindWebhook(userName string, id int64) (*Webhook, error) {
+	var webhook Webhook
+	err := s.dbi.SelectOne(&webhook,
+		`SELECT * FROM webhooks WHERE id = $1 AND username = $2`,
+		id, userName,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &webhook, nil
+}
+
+func (s gorpStorage) SaveWebhook(webhook *Webhook) error {
+	if webhook.ID == 0 {
+		return s.dbi.Insert(webhook)
+	}
+	_, err := s.dbi.Update(webhook)
+	return err
+}
+
+func (s gorpStorage) DeleteWebhook(webhook *Webhook) error {
+	//the deliveries are deleted by ON DELETE CASCADE
+	_, err := s.dbi.Delete(webhook)
+	return err
+}
+
+func (s gorpStorage) EmitTaskEvent(event WebhookEvent, task Task) error {
+	return EmitTaskEvent(s.dbi, event, task)
+}
+
+func (s gorpStorage) MarkOverdueEventEmitted(task *Task) (bool, error) {
+	result, err := s.dbi.Exec(
+		`UPDATE tasks SET overdue_event_for = $1 WHERE id = $2 AND due_at = $1 AND closed_at IS NULL`,
+		task.DueAt, task.ID)
+	if err != nil {
+		return false, err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil || rowsAffected == 0 {
+		return false, err
+	}
+	dueAt := task.DueAt
+	task.OverdueEventFor = &dueAt
+	return true, nil
+}
+
+func (s gorpStorage) ListWebhookDeliveries(webhook Webhook, limit int) ([]WebhookDelivery, error) {
+	var deliveries []WebhookDelivery
+	_, err := s.dbi.Select(&deliveries,
+		`SELECT * FROM webhook_deliveries WHERE webhook_id = $1 ORDER BY id DESC LIMIT $2`,
+		webhook.ID, limit,
+	)
+	return deliveries, err
+}
+
+func (s gorpStorage) ListPendingWebhookDeliveries(now time.Time) ([]WebhookDelivery, error) {
+	var deliveries []WebhookDelivery
+	_, err := s.dbi.Select(&deliveries,
+		`SELECT * FROM webhook_deliveries WHERE status = $1 AND next_attempt_at <= $2 ORDER BY id`,
+		//UTC for SQLite (see comment in ListTaskCompletions)
+		WebhookDeliveryPending, now.UTC(),
+	)
+	return deliveries, err
+}
+
+func (s gorpStorage) SaveWebhookDelivery(delivery *WebhookDelivery) error {
+	_, err := s.dbi.Update(delivery)
+	return err
+}
+
+func (s gorpStorage) PruneWebhookDeliveries(before time.Time) error {
+	_, err := s.dbi.Exec(
+		`DELETE FROM webhook_deliveries WHERE status <> $1 AND created_at < $2`,
+		WebhookDeliveryPending, before.UTC(),
+	)
+	return err
+}
+
+func (s gorpStorage) Transaction(action func(Storage) error) error {
+	//when already inside a transaction, just extend it
+	if s.dbMap == nil {
+		return action(s)
+	}
+
+	tx, err := s.dbMap.Begin()
+	if err != nil {
+		return err
+	}
+	defer RollbackUnlessCommitted(tx)
+	err = action(gorpStorage{dbi: tx})
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
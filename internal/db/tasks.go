@@ -0,0 +1,308 @@
+/*******************************************************************************
+*
+* Copyright 2019 Stefan Majewsky <majewsky@gmx.net>
+*
+* This program is free software: you can redistribute it and/or modify it under
+* the terms of the GNU General Public License as published by the Free Software
+* Foundation, either version 3 of the License, or (at your option) any later
+* version.
+*
+* This program is distributed in the hope that it will be useful, but WITHOUT ANY
+* WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+* A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License along with
+* this program. If not, see <http://www.gnu.org/licenses/>.
+*
+*******************************************************************************/
+
+package db
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/majewsky/alltag/internal/date"
+	"gopkg.in/gorp.v2"
+)
+
+//CheckClassification returns an error if the attributes that are entered
+//during classification are not valid.
+func (t Task) CheckClassification(today date.Date) error {
+	if t.Label == "" {
+		return errors.New("label may not be empty")
+	}
+	if t.Class == nil || !IsTaskClass[*t.Class] {
+		var class TaskClass
+		if t.Class != nil {
+			class = *t.Class
+		}
+		return fmt.Errorf("invalid task class: %q", class)
+	}
+	if t.FinalPriority > 3 {
+		return fmt.Errorf("invalid priority value: %d", t.FinalPriority)
+	}
+	if t.InitialPriority >= t.FinalPriority {
+		return errors.New("final priority must be higher than initial priority")
+	}
+	if t.RecurrenceDays < 0 {
+		return fmt.Errorf("invalid recurrence_days value: %d", t.RecurrenceDays)
+	}
+	if t.RecurrenceFromDueDate && t.RecurrenceDays == 0 {
+		return errors.New("recurrence from due date requires a recurrence interval")
+	}
+	if t.RecurrenceRule != nil {
+		if t.RecurrenceDays != 0 {
+			return errors.New("cannot have both a recurrence interval and a recurrence rule")
+		}
+		_, ok := t.NextOccurrence(today)
+		if !ok {
+			return fmt.Errorf("recurrence rule %q does not match any date", t.RecurrenceRule.String())
+		}
+	}
+	if t.DueAt.Before(today) {
+		return errors.New("due date cannot be in the past")
+	}
+	if !t.DueAt.After(t.StartsAt) {
+		return errors.New("due date must occur after start date")
+	}
+	return nil
+}
+
+//SetTaskLocations replaces the set of locations for the given task. The caller
+//must ensure that the location IDs refer to locations owned by the task's user.
+func SetTaskLocations(dbi gorp.SqlExecutor, taskID int64, locationIDs []int64) error {
+	_, err := dbi.Exec(`DELETE FROM task_locations WHERE task_id = $1`, taskID)
+	if err != nil {
+		return err
+	}
+	for _, locationID := range locationIDs {
+		err := dbi.Insert(&TaskLocation{TaskID: taskID, LocationID: locationID})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+const sqlGetTaskLocationLabels = `
+	SELECT l.label
+	FROM locations l JOIN task_locations tl ON tl.location_id = l.id
+	WHERE tl.task_id = $1
+	ORDER BY l.label
+`
+
+//CloseTask marks the given task as done. Recurring tasks respawn by shifting
+//their start and due date into the future. All other tasks are marked as
+//closed. In both cases, a TaskCompletion is recorded, and the respective
+//webhook events are emitted. Since this takes several writes, the given
+//executor should be a transaction.
+func CloseTask(dbi gorp.SqlExecutor, task *Task) error {
+	var locationLabels []string
+	_, err := dbi.Select(&locationLabels, sqlGetTaskLocationLabels, task.ID)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	today := date.FromTime(now)
+	completion := newTaskCompletion(*task, locationLabels, now)
+	closedTask := closedTaskForEvent(*task, today)
+	task.markDone(today)
+	_, err = dbi.Update(task)
+	if err != nil {
+		return err
+	}
+	err = dbi.Insert(&completion)
+	if err != nil {
+		return err
+	}
+
+	err = emitTaskEvent(dbi, WebhookEventTaskClosed, closedTask, locationLabels, now)
+	if err != nil || task.IsClosed() {
+		return err
+	}
+	return emitTaskEvent(dbi, WebhookEventTaskRespawned, *task, locationLabels, now)
+}
+
+//newTaskCompletion is the part of CloseTask that records the completion. It
+//must be called before markDone, since markDone changes the dates that go
+//into the priority computation.
+func newTaskCompletion(task Task, locationLabels []string, now time.Time) TaskCompletion {
+	taskID := task.ID
+	priority := 0.0
+	if task.IsClassified() {
+		priority = task.CurrentPriority(now)
+	}
+	return TaskCompletion{
+		TaskID:         &taskID,
+		UserName:       task.UserName,
+		Label:          task.Label,
+		Class:          task.Class,
+		LocationLabels: strings.Join(locationLabels, "\n"),
+		Priority:       priority,
+		CompletedAt:    now.UTC(),
+	}
+}
+
+//NextOccurrence returns the start date that a task with a RecurrenceRule gets
+//when it is closed today, or false if the rule does not match any later date.
+//The series of occurrences is anchored at the current StartsAt, which is
+//usually the previous occurrence. The next occurrence must come after both
+//today and StartsAt: otherwise a task that is closed before it has started
+//would respawn with the same dates.
+func (t Task) NextOccurrence(today date.Date) (date.Date, bool) {
+	after := today
+	if t.StartsAt.After(after) {
+		after = t.StartsAt
+	}
+	return t.RecurrenceRule.Next(t.StartsAt, after)
+}
+
+//markDone is the part of CloseTask that does not touch the database.
+func (t *Task) markDone(today date.Date) {
+	//a respawned task should not inherit the snooze of its previous occurrence
+	t.SnoozedUntil = nil
+	durationInDays := t.DueAt.Sub(t.StartsAt)
+	switch {
+	case t.RecurrenceRule != nil:
+		next, ok := t.NextOccurrence(today)
+		if ok {
+			t.StartsAt = next
+			t.DueAt = t.StartsAt.AddDays(durationInDays)
+			return
+		}
+	case t.RecurrenceDays != 0 && t.RecurrenceFromDueDate:
+		t.DueAt = t.DueAt.AddPeriodsUntilAfter(int(t.RecurrenceDays), today)
+		t.StartsAt = t.DueAt.AddDays(-durationInDays)
+		return
+	case t.RecurrenceDays != 0:
+		t.StartsAt = today.AddDays(int(t.RecurrenceDays))
+		t.DueAt = t.StartsAt.AddDays(durationInDays)
+		return
+	}
+
+	//closed tasks are not deleted, so that they can still be shown in their
+	//task chain
+	t.ClosedAt = &today
+}
+
+const sqlGetOpenTasks = `
+	SELECT t.*
+	FROM tasks t
+	WHERE class IS NOT NULL AND closed_at IS NULL AND username = $1
+`
+
+const sqlGetOpenTaskLocations = `
+	SELECT t.id, l.location_id
+	FROM tasks t JOIN task_locations l ON l.task_id = t.id
+	WHERE class IS NOT NULL AND closed_at IS NULL AND username = $1
+`
+
+//NextTasks is the return type of FindNextTasks. For each task class and
+//location ID, it contains the ID of the task that shall be done next.
+type NextTasks map[TaskClass]map[int64]int64
+
+//FindNextTasks selects the next task for all pairs of (task class, location)
+//for the given user. This is the most urgent task (i.e. the one with the
+//highest current priority) out of all tasks that have already started.
+func FindNextTasks(dbi gorp.SqlExecutor, userName string) (NextTasks, error) {
+	//retrieve all open tasks
+	var openTasks []Task
+	_, err := dbi.Select(&openTasks, sqlGetOpenTasks, userName)
+	if err != nil {
+		return nil, err
+	}
+
+	//retrieve location associations for those tasks
+	rows, err := dbi.Query(sqlGetOpenTaskLocations, userName)
+	if err != nil {
+		return nil, err
+	}
+	locationIDsForTask := make(map[int64][]int64)
+	for rows.Next() {
+		var taskID, locationID int64
+		err := rows.Scan(&taskID, &locationID)
+		if err != nil {
+			return nil, err
+		}
+		locationIDsForTask[taskID] = append(locationIDsForTask[taskID], locationID)
+	}
+	err = rows.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	return selectNextTasks(openTasks, locationIDsForTask, time.Now()), nil
+}
+
+//selectNextTasks is the part of FindNextTasks that does not touch the
+//database. The given tasks must be open and classified.
+func selectNextTasks(openTasks []Task, locationIDsForTask map[int64][]int64, now time.Time) NextTasks {
+	sort.Slice(openTasks, func(i, j int) bool {
+		return openTasks[i].CurrentPriority(now) < openTasks[j].CurrentPriority(now)
+	})
+
+	result := make(NextTasks, len(IsTaskClass))
+	for class := range IsTaskClass {
+		result[class] = make(map[int64]int64)
+	}
+	today := date.FromTime(now)
+	for _, task := range openTasks {
+		if task.StartsAt.After(today) || task.IsSnoozed(now) {
+			continue
+		}
+		for _, locationID := range locationIDsForTask[task.ID] {
+			//because `openTasks` is sorted by current priority, the last task to
+			//write into this particular `result[][]` slot is the one with the
+			//highest current priority
+			result[*task.Class][locationID] = task.ID
+		}
+	}
+	return result
+}
+
+const sqlCountOpenTasks = `
+	SELECT username,
+		COUNT(*),
+		SUM(CASE WHEN class IS NULL THEN 1 ELSE 0 END),
+		SUM(CASE WHEN class IS NOT NULL AND due_at < $1 THEN 1 ELSE 0 END)
+	FROM tasks
+	WHERE closed_at IS NULL
+	GROUP BY username
+`
+
+//TaskCounts is the return type of CountOpenTasks.
+type TaskCounts struct {
+	UserName     string
+	Open         int64
+	Unclassified int64
+	Overdue      int64 //classified tasks that were due before today
+}
+
+//CountOpenTasks counts the open tasks of each user that has any.
+func CountOpenTasks(dbi gorp.SqlExecutor, today date.Date) ([]TaskCounts, error) {
+	rows, err := dbi.Query(sqlCountOpenTasks, today)
+	if err != nil {
+		return nil, err
+	}
+	var result []TaskCounts
+	for rows.Next() {
+		var c TaskCounts
+		err := rows.Scan(&c.UserName, &c.Open, &c.Unclassified, &c.Overdue)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		result = append(result, c)
+	}
+	err = rows.Err()
+	if err != nil {
+		rows.Close()
+		return nil, err
+	}
+	return result, rows.Close()
+}
@@ -0,0 +1,196 @@
+/*******************************************************************************
+*
+* Copyright 2019 Stefan Majewsky <majewsky@gmx.net>
+*
+* This program is free software: you can redistribute it and/or modify it under
+* the terms of the GNU General Public License as published by the Free Software
+* Foundation, either version 3 of the License, or (at your option) any later
+* version.
+*
+* This program is distributed in the hope that it will be useful, but WITHOUT ANY
+* WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+* A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License along with
+* this program. If not, see <http://www.gnu.org/licenses/>.
+*
+*******************************************************************************/
+
+package db
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/majewsky/alltag/internal/date"
+	"github.com/majewsky/alltag/internal/rrule"
+)
+
+func mustParseDate(t *testing.T, input string) date.Date {
+	t.Helper()
+	d, err := date.Parse(input)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	return d
+}
+
+func mustParseRule(t *testing.T, input string) *rrule.Rule {
+	t.Helper()
+	rule, err := rrule.Parse(input)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	return &rule
+}
+
+func TestMarkDone(t *testing.T) {
+	testCases := []struct {
+		Description      string
+		Task             Task
+		Today            string
+		ExpectedStartsAt string
+		ExpectedDueAt    string
+		ExpectedClosed   bool
+	}{
+		{
+			Description:    "non-recurring task",
+			Task:           Task{StartsAt: mustParseDate(t, "2019-11-01"), DueAt: mustParseDate(t, "2019-11-08")},
+			Today:          "2019-11-05",
+			ExpectedClosed: true,
+		},
+		{
+			Description:      "recurring task",
+			Task:             Task{StartsAt: mustParseDate(t, "2019-11-01"), DueAt: mustParseDate(t, "2019-11-08"), RecurrenceDays: 10},
+			Today:            "2019-11-05",
+			ExpectedStartsAt: "2019-11-15",
+			ExpectedDueAt:    "2019-11-22",
+		},
+		{
+			Description:      "recurring task counted from due date",
+			Task:             Task{StartsAt: mustParseDate(t, "2019-11-01"), DueAt: mustParseDate(t, "2019-11-08"), RecurrenceDays: 7, RecurrenceFromDueDate: true},
+			Today:            "2019-11-20",
+			ExpectedStartsAt: "2019-11-15",
+			ExpectedDueAt:    "2019-11-22",
+		},
+		{
+			Description:      "rule-based task closed after its start date",
+			Task:             Task{StartsAt: mustParseDate(t, "2019-11-04"), DueAt: mustParseDate(t, "2019-11-06"), RecurrenceRule: mustParseRule(t, "FREQ=WEEKLY")},
+			Today:            "2019-11-05",
+			ExpectedStartsAt: "2019-11-11",
+			ExpectedDueAt:    "2019-11-13",
+		},
+		{
+			Description:      "rule-based task closed several periods late",
+			Task:             Task{StartsAt: mustParseDate(t, "2019-11-04"), DueAt: mustParseDate(t, "2019-11-06"), RecurrenceRule: mustParseRule(t, "FREQ=WEEKLY")},
+			Today:            "2019-11-20",
+			ExpectedStartsAt: "2019-11-25",
+			ExpectedDueAt:    "2019-11-27",
+		},
+		{
+			Description:      "rule-based task closed before its start date",
+			Task:             Task{StartsAt: mustParseDate(t, "2019-11-04"), DueAt: mustParseDate(t, "2019-11-06"), RecurrenceRule: mustParseRule(t, "FREQ=WEEKLY")},
+			Today:            "2019-11-01",
+			ExpectedStartsAt: "2019-11-11",
+			ExpectedDueAt:    "2019-11-13",
+		},
+		{
+			Description:      "rule-based task closed on its start date",
+			Task:             Task{StartsAt: mustParseDate(t, "2019-11-29"), DueAt: mustParseDate(t, "2019-11-29"), RecurrenceRule: mustParseRule(t, "FREQ=MONTHLY;BYDAY=-1FR")},
+			Today:            "2019-11-29",
+			ExpectedStartsAt: "2019-12-27",
+			ExpectedDueAt:    "2019-12-27",
+		},
+		{
+			Description:    "rule-based task without further occurrences",
+			Task:           Task{StartsAt: mustParseDate(t, "2019-11-04"), DueAt: mustParseDate(t, "2019-11-06"), RecurrenceRule: mustParseRule(t, "FREQ=YEARLY;BYMONTH=4;BYMONTHDAY=31")},
+			Today:          "2019-11-05",
+			ExpectedClosed: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		task := tc.Task
+		today := mustParseDate(t, tc.Today)
+		task.markDone(today)
+
+		if tc.ExpectedClosed {
+			if task.ClosedAt == nil || *task.ClosedAt != today {
+				t.Errorf("%s: expected task to be closed on %s, but got ClosedAt = %v", tc.Description, tc.Today, task.ClosedAt)
+			}
+			continue
+		}
+		if task.ClosedAt != nil {
+			t.Errorf("%s: expected task to respawn, but it was closed", tc.Description)
+		}
+		if task.StartsAt.String() != tc.ExpectedStartsAt || task.DueAt.String() != tc.ExpectedDueAt {
+			t.Errorf("%s: expected task to respawn at %s..%s, but got %s..%s", tc.Description,
+				tc.ExpectedStartsAt, tc.ExpectedDueAt, task.StartsAt, task.DueAt)
+		}
+	}
+}
+
+func TestSelectNextTasks(t *testing.T) {
+	mental, physical := TaskClassMental, TaskClassPhysical
+	newTask := func(id int64, class *TaskClass, startsAt, dueAt string) Task {
+		return Task{
+			ID:            id,
+			Class:         class,
+			FinalPriority: 10,
+			StartsAt:      mustParseDate(t, startsAt),
+			DueAt:         mustParseDate(t, dueAt),
+		}
+	}
+	now := time.Date(2019, 11, 10, 12, 0, 0, 0, time.UTC)
+	snoozedUntil := now.Add(time.Hour)
+	snoozeExpiredAt := now.Add(-time.Hour)
+
+	//location 1 and 2 are shared by tasks 1-3, location 3 only has tasks that
+	//cannot be selected
+	task1 := newTask(1, &mental, "2019-11-01", "2019-11-20")
+	task2 := newTask(2, &mental, "2019-11-05", "2019-11-07") //overdue, so most urgent
+	task3 := newTask(3, &physical, "2019-11-01", "2019-11-20")
+	task4 := newTask(4, &mental, "2019-11-11", "2019-11-12") //not started yet
+	task5 := newTask(5, &mental, "2019-11-01", "2019-11-02") //snoozed
+	task5.SnoozedUntil = &snoozedUntil
+	task6 := newTask(6, &physical, "2019-11-09", "2019-11-10") //snooze expired
+	task6.SnoozedUntil = &snoozeExpiredAt
+	task7 := newTask(7, &mental, "2019-11-01", "2019-11-02") //no locations
+
+	openTasks := []Task{task1, task2, task3, task4, task5, task6, task7}
+	locationIDsForTask := map[int64][]int64{
+		1: {1, 2},
+		2: {2},
+		3: {1},
+		4: {1, 3},
+		5: {1, 3},
+		6: {2},
+	}
+	expected := NextTasks{
+		TaskClassMental:   {1: 1, 2: 2},
+		TaskClassPhysical: {1: 3, 2: 6},
+	}
+
+	actual := selectNextTasks(openTasks, locationIDsForTask, now)
+	if !reflect.DeepEqual(actual, expected) {
+		t.Errorf("expected next tasks %v, got %v", expected, actual)
+	}
+
+	//the result does not depend on the order of the input
+	reversedTasks := make([]Task, len(openTasks))
+	for idx, task := range openTasks {
+		reversedTasks[len(openTasks)-1-idx] = task
+	}
+	actual = selectNextTasks(reversedTasks, locationIDsForTask, now)
+	if !reflect.DeepEqual(actual, expected) {
+		t.Errorf("with reversed input: expected next tasks %v, got %v", expected, actual)
+	}
+
+	//without any tasks, there is still an entry for each class
+	actual = selectNextTasks(nil, nil, now)
+	expected = NextTasks{TaskClassMental: {}, TaskClassPhysical: {}}
+	if !reflect.DeepEqual(actual, expected) {
+		t.Errorf("without tasks: expected next tasks %v, got %v", expected, actual)
+	}
+}
@@ -0,0 +1,139 @@
+/*******************************************************************************
+*
+* Copyright 2019 Stefan Majewsky <majewsky@gmx.net>
+*
+* This program is free software: you can redistribute it and/or modify it under
+* the terms of the GNU General Public License as published by the Free Software
+* Foundation, either version 3 of the License, or (at your option) any later
+* version.
+*
+* This program is distributed in the hope that it will be useful, but WITHOUT ANY
+* WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+* A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License along with
+* this program. If not, see <http://www.gnu.org/licenses/>.
+*
+*******************************************************************************/
+
+package db
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/hex"
+	"strings"
+	"time"
+
+	"gopkg.in/gorp.v2"
+)
+
+//apiTokenPrefix is prepended to all API tokens, so that they can be
+//recognized easily (e.g. by secret scanners).
+const apiTokenPrefix = "alltag_"
+
+//Permits returns whether a token with this scope may be used for a request
+//with the given HTTP method. Calendar feed and mail capture tokens are not
+//accepted by the API at all, so this always returns false for them.
+func (s APITokenScope) Permits(method string) bool {
+	switch s {
+	case APITokenScopeReadWrite:
+		return true
+	case APITokenScopeReadOnly:
+		//PROPFIND and REPORT are the read-only methods of CalDAV
+		return method == "GET" || method == "HEAD" || method == "OPTIONS" || method == "PROPFIND" || method == "REPORT"
+	default:
+		return false
+	}
+}
+
+//IsAPIToken returns whether the given string looks like an API token. This
+//does not check whether the token exists.
+func IsAPIToken(token string) bool {
+	return strings.HasPrefix(token, apiTokenPrefix)
+}
+
+func hashAPIToken(token string) string {
+	hash := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(hash[:])
+}
+
+//CreateAPIToken generates a new API token and stores it in the database.
+//Besides the database record, the token itself is returned. It cannot be
+//recovered later since only its hash is stored.
+//
+//Since the tokens are long random strings, a fast unsalted hash is enough to
+//protect them. Slow hashes like bcrypt are only required for passwords, which
+//may be guessable.
+func CreateAPIToken(dbi gorp.SqlExecutor, userName, label string, scope APITokenScope) (*APIToken, string, error) {
+	apiToken, token, err := newAPIToken(userName, label, scope)
+	if err != nil {
+		return nil, "", err
+	}
+	return apiToken, token, dbi.Insert(apiToken)
+}
+
+//newAPIToken is the part of CreateAPIToken that does not touch the database.
+func newAPIToken(userName, label string, scope APITokenScope) (*APIToken, string, error) {
+	buf := make([]byte, 32)
+	_, err := rand.Read(buf)
+	if err != nil {
+		return nil, "", err
+	}
+	token := apiTokenPrefix + base64.RawURLEncoding.EncodeToString(buf)
+	if scope == APITokenScopeMailCapture {
+		//these tokens are part of an email address, where case is not reliably
+		//preserved and the local part is limited to 64 characters; 160 bits of
+		//randomness are still plenty
+		token = apiTokenPrefix + strings.ToLower(base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(buf[:20]))
+	}
+
+	apiToken := &APIToken{
+		Label:     label,
+		UserName:  userName,
+		Scope:     scope,
+		TokenHash: hashAPIToken(token),
+		CreatedAt: time.Now(),
+	}
+	return apiToken, token, nil
+}
+
+//lastUsedAtPrecision is how precisely FindAPIToken records when a token was
+//last used. API tokens are looked up on every API request, and updating the
+//token on each lookup would turn every read request into a database write.
+const lastUsedAtPrecision = 5 * time.Minute
+
+//markUsed updates LastUsedAt unless it is less than lastUsedAtPrecision old.
+//Returns whether it was updated.
+func (t *APIToken) markUsed(now time.Time) bool {
+	if t.LastUsedAt != nil && now.Sub(*t.LastUsedAt) < lastUsedAtPrecision {
+		return false
+	}
+	t.LastUsedAt = &now
+	return true
+}
+
+//FindAPIToken finds the database record for the given API token, and records
+//that the token has been used (with a precision of lastUsedAtPrecision). If
+//the token does not exist, nil is returned.
+func FindAPIToken(dbi gorp.SqlExecutor, token string) (*APIToken, error) {
+	var apiToken APIToken
+	err := dbi.SelectOne(&apiToken,
+		`SELECT * FROM api_tokens WHERE token_hash = $1`,
+		hashAPIToken(token),
+	)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if apiToken.markUsed(time.Now()) {
+		_, err = dbi.Exec(`UPDATE api_tokens SET last_used_at = $1 WHERE id = $2`, apiToken.LastUsedAt, apiToken.ID)
+	}
+	return &apiToken, err
+}
@@ -0,0 +1,99 @@
+/*******************************************************************************
+*
+* Copyright 2019 Stefan Majewsky <majewsky@gmx.net>
+*
+* This program is free software: you can redistribute it and/or modify it under
+* the terms of the GNU General Public License as published by the Free Software
+* Foundation, either version 3 of the License, or (at your option) any later
+* version.
+*
+* This program is distributed in the hope that it will be useful, but WITHOUT ANY
+* WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+* A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License along with
+* this program. If not, see <http://www.gnu.org/licenses/>.
+*
+*******************************************************************************/
+
+package db
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFindAPITokenRecordsLastUse(t *testing.T) {
+	dir, err := ioutil.TempDir("", "alltag-test")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+	dbi, err := Init("sqlite://" + filepath.Join(dir, "test.db"))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer dbi.Db.Close()
+
+	memory := NewMemoryStorage().(memoryStorage)
+	testCases := []struct {
+		Name    string
+		Storage Storage
+		//SetLastUsedAt overwrites the LastUsedAt of the given token.
+		SetLastUsedAt func(id int64, lastUsedAt time.Time)
+	}{
+		{"gorp", NewStorage(dbi), func(id int64, lastUsedAt time.Time) {
+			_, err := dbi.Exec(`UPDATE api_tokens SET last_used_at = $1 WHERE id = $2`, lastUsedAt, id)
+			if err != nil {
+				t.Fatal(err.Error())
+			}
+		}},
+		{"memory", memory, func(id int64, lastUsedAt time.Time) {
+			apiToken := memory.data.apiTokens[id]
+			apiToken.LastUsedAt = &lastUsedAt
+			memory.data.apiTokens[id] = apiToken
+		}},
+	}
+
+	for _, tc := range testCases {
+		apiToken, token, err := tc.Storage.CreateAPIToken("alice", "test", APITokenScopeReadOnly)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		//findLastUsedAt looks up the token, and returns the LastUsedAt that was
+		//stored by the lookup
+		findLastUsedAt := func() time.Time {
+			t.Helper()
+			_, err := tc.Storage.FindAPIToken(token)
+			if err != nil {
+				t.Fatal(err.Error())
+			}
+			stored, err := tc.Storage.FindAPITokenByID("alice", apiToken.ID)
+			if err != nil {
+				t.Fatal(err.Error())
+			}
+			if stored.LastUsedAt == nil {
+				t.Fatalf("%s: expected LastUsedAt to be set", tc.Name)
+			}
+			return *stored.LastUsedAt
+		}
+
+		//the first use is always recorded, but repeated uses in quick
+		//succession do not update the token again
+		first := findLastUsedAt()
+		time.Sleep(10 * time.Millisecond)
+		if second := findLastUsedAt(); !second.Equal(first) {
+			t.Errorf("%s: expected LastUsedAt to stay at %s, but got %s", tc.Name, first, second)
+		}
+
+		//once the recorded use is old enough, it is updated again
+		old := time.Now().Add(-2 * lastUsedAtPrecision)
+		tc.SetLastUsedAt(apiToken.ID, old)
+		if third := findLastUsedAt(); !third.After(first) {
+			t.Errorf("%s: expected LastUsedAt to be updated after %s, but got %s", tc.Name, first, third)
+		}
+	}
+}
@@ -0,0 +1,159 @@
+/*******************************************************************************
+*
+* Copyright 2019 Stefan Majewsky <majewsky@gmx.net>
+*
+* This program is free software: you can redistribute it and/or modify it under
+* the terms of the GNU General Public License as published by the Free Software
+* Foundation, either version 3 of the License, or (at your option) any later
+* version.
+*
+* This program is distributed in the hope that it will be useful, but WITHOUT ANY
+* WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+* A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License along with
+* this program. If not, see <http://www.gnu.org/licenses/>.
+*
+*******************************************************************************/
+
+package db
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"time"
+
+	"github.com/majewsky/alltag/internal/date"
+	"gopkg.in/gorp.v2"
+)
+
+//WebhookPayload is the JSON request body of a webhook delivery.
+type WebhookPayload struct {
+	Event      WebhookEvent `json:"event"`
+	OccurredAt time.Time    `json:"occurred_at"`
+	UserName   string       `json:"username"`
+	Task       WebhookTask  `json:"task"`
+}
+
+//WebhookTask is the representation of a task in type WebhookPayload. For
+//unclassified tasks, Class, StartsAt and DueAt are null.
+type WebhookTask struct {
+	ID              int64      `json:"id"`
+	Label           string     `json:"label"`
+	Notes           string     `json:"notes"`
+	Class           *TaskClass `json:"class"`
+	InitialPriority uint16     `json:"initial_priority"`
+	FinalPriority   uint16     `json:"final_priority"`
+	IsRecurring     bool       `json:"is_recurring"`
+	StartsAt        *date.Date `json:"starts_at"`
+	DueAt           *date.Date `json:"due_at"`
+	ClosedAt        *date.Date `json:"closed_at,omitempty"`
+	Locations       []string   `json:"locations"`
+}
+
+//NewWebhookSecret generates a random secret for signing webhook payloads.
+func NewWebhookSecret() (string, error) {
+	buf := make([]byte, 32)
+	_, err := rand.Read(buf)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
+
+//EmitTaskEvent queues a delivery of the given event to each webhook of the
+//owner of the given task. The deliveries are performed in the background by
+//package webhooks.
+func EmitTaskEvent(dbi gorp.SqlExecutor, event WebhookEvent, task Task) error {
+	var locationLabels []string
+	_, err := dbi.Select(&locationLabels, sqlGetTaskLocationLabels, task.ID)
+	if err != nil {
+		return err
+	}
+	return emitTaskEvent(dbi, event, task, locationLabels, time.Now())
+}
+
+//emitTaskEvent is like EmitTaskEvent, but does not need to look up the
+//locations of the task.
+func emitTaskEvent(dbi gorp.SqlExecutor, event WebhookEvent, task Task, locationLabels []string, now time.Time) error {
+	var webhooks []Webhook
+	_, err := dbi.Select(&webhooks,
+		`SELECT * FROM webhooks WHERE username = $1 ORDER BY id`,
+		task.UserName,
+	)
+	if err != nil {
+		return err
+	}
+	deliveries, err := newWebhookDeliveries(webhooks, event, task, locationLabels, now)
+	if err != nil {
+		return err
+	}
+	for idx := range deliveries {
+		err := dbi.Insert(&deliveries[idx])
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//newWebhookDeliveries is the part of EmitTaskEvent that does not touch the
+//database.
+func newWebhookDeliveries(webhooks []Webhook, event WebhookEvent, task Task, locationLabels []string, now time.Time) ([]WebhookDelivery, error) {
+	if len(webhooks) == 0 {
+		return nil, nil
+	}
+
+	payload := WebhookPayload{
+		Event:      event,
+		OccurredAt: now.UTC(),
+		UserName:   task.UserName,
+		Task: WebhookTask{
+			ID:              task.ID,
+			Label:           task.Label,
+			Notes:           task.Notes,
+			Class:           task.Class,
+			InitialPriority: task.InitialPriority,
+			FinalPriority:   task.FinalPriority,
+			IsRecurring:     task.IsRecurring(),
+			ClosedAt:        task.ClosedAt,
+			Locations:       locationLabels,
+		},
+	}
+	if task.IsClassified() {
+		payload.Task.StartsAt = &task.StartsAt
+		payload.Task.DueAt = &task.DueAt
+	}
+	if payload.Task.Locations == nil {
+		payload.Task.Locations = []string{}
+	}
+	payloadBytes, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	nextAttemptAt := now.UTC()
+	result := make([]WebhookDelivery, len(webhooks))
+	for idx, webhook := range webhooks {
+		result[idx] = WebhookDelivery{
+			WebhookID:     webhook.ID,
+			UserName:      webhook.UserName,
+			Event:         event,
+			Payload:       string(payloadBytes),
+			Status:        WebhookDeliveryPending,
+			CreatedAt:     now.UTC(),
+			NextAttemptAt: &nextAttemptAt,
+		}
+	}
+	return result, nil
+}
+
+//closedTaskForEvent returns the task as it appears in the "task.closed"
+//event, given its state before markDone. For recurring tasks, the task itself
+//is not closed since it respawns, but the event shall still show when it was
+//closed.
+func closedTaskForEvent(task Task, today date.Date) Task {
+	task.ClosedAt = &today
+	return task
+}
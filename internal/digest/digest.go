@@ -0,0 +1,115 @@
+/*******************************************************************************
+*
+* Copyright 2019 Stefan Majewsky <majewsky@gmx.net>
+*
+* This program is free software: you can redistribute it and/or modify it under
+* the terms of the GNU General Public License as published by the Free Software
+* Foundation, either version 3 of the License, or (at your option) any later
+* version.
+*
+* This program is distributed in the hope that it will be useful, but WITHOUT ANY
+* WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+* A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License along with
+* this program. If not, see <http://www.gnu.org/licenses/>.
+*
+*******************************************************************************/
+
+//Package digest sends a daily email to each user who has enabled it in their
+//settings, listing the tasks that need attention. This way, overdue tasks are
+//noticed even when the user does not open Alltag for a while.
+package digest
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"text/template"
+
+	"github.com/majewsky/alltag/internal/date"
+	"github.com/majewsky/alltag/internal/db"
+)
+
+//Digest contains everything that is reported in a single digest email.
+type Digest struct {
+	Today date.Date
+	//Overdue contains the tasks that were due before today, most overdue first.
+	Overdue []db.Task
+	//DueSoon contains the tasks that are due today or tomorrow.
+	DueSoon []db.Task
+	//UnclassifiedCount is the number of tasks that still need to be classified.
+	UnclassifiedCount int
+}
+
+//Build collects the digest from the given list of open tasks.
+func Build(tasks []db.Task, today date.Date) Digest {
+	d := Digest{Today: today}
+	tomorrow := today.AddDays(1)
+	for _, task := range tasks {
+		switch {
+		case !task.IsClassified():
+			d.UnclassifiedCount++
+		case task.DueAt.Before(today):
+			d.Overdue = append(d.Overdue, task)
+		case !task.DueAt.After(tomorrow):
+			d.DueSoon = append(d.DueSoon, task)
+		}
+	}
+
+	for _, list := range [][]db.Task{d.Overdue, d.DueSoon} {
+		sort.SliceStable(list, func(i, j int) bool {
+			return list[i].DueAt.Before(list[j].DueAt)
+		})
+	}
+	return d
+}
+
+//IsEmpty returns whether there is nothing to report. Empty digests are not
+//sent.
+func (d Digest) IsEmpty() bool {
+	return len(d.Overdue) == 0 && len(d.DueSoon) == 0 && d.UnclassifiedCount == 0
+}
+
+//Subject returns the subject line for the digest email.
+func (d Digest) Subject() string {
+	switch {
+	case len(d.Overdue) > 0:
+		return fmt.Sprintf("Alltag: %d overdue, %d due soon", len(d.Overdue), len(d.DueSoon))
+	case len(d.DueSoon) > 0:
+		return fmt.Sprintf("Alltag: %d due soon", len(d.DueSoon))
+	default:
+		return "Alltag: tasks need to be classified"
+	}
+}
+
+var tBody = template.Must(template.New("digest.txt").Parse(`Your tasks in Alltag on {{.Today}}:
+{{- if .Overdue }}
+
+Overdue:
+{{- range .Overdue }}
+- {{.Label}} (due {{.DueAt}})
+{{- end }}
+{{- end }}
+{{- if .DueSoon }}
+
+Due today or tomorrow:
+{{- range .DueSoon }}
+- {{.Label}} (due {{.DueAt}})
+{{- end }}
+{{- end }}
+{{- if .UnclassifiedCount }}
+
+{{ if eq .UnclassifiedCount 1 }}1 task needs{{ else }}{{.UnclassifiedCount}} tasks need{{ end }} to be classified.
+{{- end }}
+
+You are receiving this email because you enabled the daily digest in Alltag.
+It can be disabled in the settings at /settings/digest.
+`))
+
+//Body returns the plain-text body of the digest email.
+func (d Digest) Body() (string, error) {
+	var buf bytes.Buffer
+	err := tBody.Execute(&buf, d)
+	return buf.String(), err
+}
@@ -0,0 +1,258 @@
+/*******************************************************************************
+*
+* Copyright 2019 Stefan Majewsky <majewsky@gmx.net>
+*
+* This program is free software: you can redistribute it and/or modify it under
+* the terms of the GNU General Public License as published by the Free Software
+* Foundation, either version 3 of the License, or (at your option) any later
+* version.
+*
+* This program is distributed in the hope that it will be useful, but WITHOUT ANY
+* WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+* A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License along with
+* this program. If not, see <http://www.gnu.org/licenses/>.
+*
+*******************************************************************************/
+
+package digest
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"mime"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"strings"
+	"time"
+
+	"github.com/majewsky/alltag/internal/auth"
+	"github.com/majewsky/alltag/internal/date"
+	"github.com/majewsky/alltag/internal/db"
+	"github.com/sapcc/go-bits/logg"
+)
+
+//Config contains the configuration for sending digest emails.
+type Config struct {
+	//SMTPServer is the address of the SMTP server in the form "host:port".
+	SMTPServer string
+	//If SMTPUserName is not empty, the SMTP server is authenticated against
+	//with these credentials. (net/smtp only allows this over TLS, or when the
+	//server is on localhost.)
+	SMTPUserName string
+	SMTPPassword string
+	//Sender is the address in the From header, e.g. "Alltag <alltag@example.org>".
+	Sender string
+}
+
+//checkInterval is how often the Scheduler checks whether digests need to be
+//sent. Digests are therefore sent up to this long after the configured hour.
+const checkInterval = 5 * time.Minute
+
+//Scheduler sends the digest emails.
+type Scheduler struct {
+	storage db.Storage
+	cfg     Config
+	sender  *mail.Address
+	//mailFinder is nil if the auth driver does not know any email addresses
+	mailFinder auth.MailAddressFinder
+}
+
+//NewScheduler prepares a Scheduler. If the auth driver implements
+//auth.MailAddressFinder, it is used to find the email addresses of users who
+//have not entered an address in their settings.
+func NewScheduler(storage db.Storage, cfg Config, driver auth.Driver) (*Scheduler, error) {
+	sender, err := mail.ParseAddress(cfg.Sender)
+	if err != nil {
+		return nil, fmt.Errorf("invalid sender address %q: %s", cfg.Sender, err.Error())
+	}
+	mailFinder, _ := driver.(auth.MailAddressFinder)
+	return &Scheduler{storage, cfg, sender, mailFinder}, nil
+}
+
+//Run calls SendDueDigests every checkInterval, forever.
+func (s *Scheduler) Run() {
+	for {
+		s.SendDueDigests(time.Now())
+		time.Sleep(checkInterval)
+	}
+}
+
+//SendDueDigests sends the digests of all users that are due at the given time.
+//Errors are logged. Digests that could not be sent are retried on the next
+//call.
+func (s *Scheduler) SendDueDigests(now time.Time) {
+	allSettings, err := s.storage.ListUserSettings()
+	if err != nil {
+		logg.Error("cannot list user settings: %s", err.Error())
+		return
+	}
+	for _, settings := range allSettings {
+		if !isDue(settings, now) {
+			continue
+		}
+		err := s.sendDigest(settings.UserName, now)
+		if err != nil {
+			logg.Error("cannot send digest to user %q: %s", settings.UserName, err.Error())
+		}
+	}
+}
+
+//isDue returns whether the digest for these settings needs to be sent at the
+//given time, i.e. once per day after the configured hour.
+func isDue(settings db.UserSettings, now time.Time) bool {
+	if !settings.DigestEnabled || now.Hour() < settings.DigestHour {
+		return false
+	}
+	if settings.DigestSentAt == nil {
+		return true
+	}
+	lastSent := date.FromTime(settings.DigestSentAt.In(now.Location()))
+	return lastSent.Before(date.FromTime(now))
+}
+
+var errNoMailAddress = errors.New("no email address known (please enter one in the settings)")
+
+func (s *Scheduler) sendDigest(userName string, now time.Time) error {
+	tasks, err := s.storage.ListOpenTasks(userName)
+	if err != nil {
+		return err
+	}
+	d := Build(tasks, date.FromTime(now))
+
+	if !d.IsEmpty() {
+		err = s.sendDigestMail(userName, d, now)
+		//when the address is missing, retrying is pointless until tomorrow
+		if err != nil && err != errNoMailAddress {
+			return err
+		}
+	}
+
+	//reload the settings to avoid overwriting changes that the user made in the
+	//meantime
+	return s.storage.Transaction(func(tx db.Storage) error {
+		settings, err := tx.GetUserSettings(userName)
+		if err != nil {
+			return err
+		}
+		sentAt := now.UTC()
+		settings.DigestSentAt = &sentAt
+		return tx.SaveUserSettings(settings)
+	})
+}
+
+func (s *Scheduler) sendDigestMail(userName string, d Digest, now time.Time) error {
+	settings, err := s.storage.GetUserSettings(userName)
+	if err != nil {
+		return err
+	}
+	address := settings.DigestMailAddress
+	if address == "" && s.mailFinder != nil {
+		address, err = s.mailFinder.FindMailAddress(userName)
+		if err != nil {
+			return err
+		}
+	}
+	if address == "" {
+		logg.Error("cannot send digest to user %q: %s", userName, errNoMailAddress.Error())
+		return errNoMailAddress
+	}
+	recipient, err := mail.ParseAddress(address)
+	if err != nil {
+		return fmt.Errorf("invalid email address %q: %s", address, err.Error())
+	}
+
+	body, err := d.Body()
+	if err != nil {
+		return err
+	}
+	return s.sendMail(recipient, d.Subject(), body, now)
+}
+
+func (s *Scheduler) sendMail(recipient *mail.Address, subject, body string, now time.Time) error {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "From: %s\r\n", s.sender.String())
+	fmt.Fprintf(&buf, "To: %s\r\n", recipient.String())
+	fmt.Fprintf(&buf, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(&buf, "Date: %s\r\n", now.Format(time.RFC1123Z))
+	buf.WriteString("MIME-Version: 1.0\r\n")
+	buf.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	buf.WriteString("Content-Transfer-Encoding: quoted-printable\r\n")
+	buf.WriteString("\r\n")
+	qp := quotedprintable.NewWriter(&buf)
+	_, err := qp.Write([]byte(strings.Replace(body, "\n", "\r\n", -1)))
+	if err != nil {
+		return err
+	}
+	err = qp.Close()
+	if err != nil {
+		return err
+	}
+
+	return s.sendSMTP(recipient.Address, buf.Bytes())
+}
+
+//smtpTimeout limits how long a single SMTP conversation may take, so that a
+//hung SMTP server does not block the Scheduler forever.
+var smtpTimeout = time.Minute
+
+//sendSMTP works like smtp.SendMail, but enforces smtpTimeout.
+func (s *Scheduler) sendSMTP(recipient string, msg []byte) error {
+	host, _, err := net.SplitHostPort(s.cfg.SMTPServer)
+	if err != nil {
+		return err
+	}
+	conn, err := net.DialTimeout("tcp", s.cfg.SMTPServer, smtpTimeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	err = conn.SetDeadline(time.Now().Add(smtpTimeout))
+	if err != nil {
+		return err
+	}
+
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		err = c.StartTLS(&tls.Config{ServerName: host})
+		if err != nil {
+			return err
+		}
+	}
+	if s.cfg.SMTPUserName != "" {
+		err = c.Auth(smtp.PlainAuth("", s.cfg.SMTPUserName, s.cfg.SMTPPassword, host))
+		if err != nil {
+			return err
+		}
+	}
+	err = c.Mail(s.sender.Address)
+	if err != nil {
+		return err
+	}
+	err = c.Rcpt(recipient)
+	if err != nil {
+		return err
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(msg)
+	if err != nil {
+		return err
+	}
+	err = w.Close()
+	if err != nil {
+		return err
+	}
+	return c.Quit()
+}
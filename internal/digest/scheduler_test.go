@@ -0,0 +1,244 @@
+/*******************************************************************************
+*
+* Copyright 2019 Stefan Majewsky <majewsky@gmx.net>
+*
+* This program is free software: you can redistribute it and/or modify it under
+* the terms of the GNU General Public License as published by the Free Software
+* Foundation, either version 3 of the License, or (at your option) any later
+* version.
+*
+* This program is distributed in the hope that it will be useful, but WITHOUT ANY
+* WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+* A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License along with
+* this program. If not, see <http://www.gnu.org/licenses/>.
+*
+*******************************************************************************/
+
+package digest
+
+import (
+	"net"
+	"net/textproto"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/majewsky/alltag/internal/date"
+	"github.com/majewsky/alltag/internal/db"
+)
+
+//smtpSink is a minimal SMTP server that records all messages it receives.
+type smtpSink struct {
+	listener net.Listener
+	mutex    sync.Mutex
+	messages []sinkMessage
+}
+
+type sinkMessage struct {
+	From string
+	To   []string
+	Data string
+}
+
+func newSMTPSink(t *testing.T) *smtpSink {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	s := &smtpSink{listener: listener}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go s.handle(textproto.NewConn(conn))
+		}
+	}()
+	return s
+}
+
+func (s *smtpSink) handle(conn *textproto.Conn) {
+	defer conn.Close()
+	var msg sinkMessage
+	conn.PrintfLine("220 localhost ESMTP sink")
+	for {
+		line, err := conn.ReadLine()
+		if err != nil {
+			return
+		}
+		fields := strings.SplitN(line, " ", 2)
+		verb, arg := strings.ToUpper(fields[0]), ""
+		if len(fields) > 1 {
+			arg = fields[1]
+		}
+		switch verb {
+		case "EHLO", "HELO", "NOOP", "RSET":
+			conn.PrintfLine("250 OK")
+		case "MAIL":
+			msg.From = strings.TrimPrefix(arg, "FROM:")
+			conn.PrintfLine("250 OK")
+		case "RCPT":
+			msg.To = append(msg.To, strings.TrimPrefix(arg, "TO:"))
+			conn.PrintfLine("250 OK")
+		case "DATA":
+			conn.PrintfLine("354 go ahead")
+			data, err := conn.ReadDotBytes()
+			if err != nil {
+				return
+			}
+			msg.Data = string(data)
+			s.mutex.Lock()
+			s.messages = append(s.messages, msg)
+			s.mutex.Unlock()
+			msg = sinkMessage{}
+			conn.PrintfLine("250 OK")
+		case "QUIT":
+			conn.PrintfLine("221 bye")
+			return
+		default:
+			conn.PrintfLine("502 not implemented")
+		}
+	}
+}
+
+func (s *smtpSink) Messages() []sinkMessage {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return append([]sinkMessage(nil), s.messages...)
+}
+
+func mustSaveSettings(t *testing.T, storage db.Storage, settings db.UserSettings) {
+	t.Helper()
+	err := storage.SaveUserSettings(&settings)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+}
+
+func TestSendDueDigests(t *testing.T) {
+	sink := newSMTPSink(t)
+	defer sink.listener.Close()
+
+	now := time.Date(2019, 11, 10, 8, 0, 0, 0, time.Local)
+	today := date.FromTime(now)
+	storage := db.NewMemoryStorage()
+	mental := db.TaskClassMental
+	for _, task := range []db.Task{
+		{Label: "water the plants", UserName: "alice", Class: &mental, StartsAt: today.AddDays(-5), DueAt: today.AddDays(-2)},
+		{Label: "file taxes", UserName: "carol", Class: &mental, StartsAt: today.AddDays(-5), DueAt: today.AddDays(-2)},
+		{Label: "call mom", UserName: "dave", Class: &mental, StartsAt: today.AddDays(-5), DueAt: today.AddDays(-2)},
+	} {
+		task := task
+		err := storage.SaveTask(&task)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	//alice gets a digest; bob does not since he has nothing to report; carol
+	//has disabled the digest; dave wants it later in the day
+	mustSaveSettings(t, storage, db.UserSettings{UserName: "alice", DigestEnabled: true, DigestHour: 7, DigestMailAddress: "alice@example.org"})
+	mustSaveSettings(t, storage, db.UserSettings{UserName: "bob", DigestEnabled: true, DigestHour: 7, DigestMailAddress: "bob@example.org"})
+	mustSaveSettings(t, storage, db.UserSettings{UserName: "carol", DigestEnabled: false, DigestHour: 7, DigestMailAddress: "carol@example.org"})
+	mustSaveSettings(t, storage, db.UserSettings{UserName: "dave", DigestEnabled: true, DigestHour: 12, DigestMailAddress: "dave@example.org"})
+
+	scheduler, err := NewScheduler(storage, Config{
+		SMTPServer: sink.listener.Addr().String(),
+		Sender:     "Alltag <alltag@example.org>",
+	}, nil)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	scheduler.SendDueDigests(now)
+
+	messages := sink.Messages()
+	if len(messages) != 1 {
+		t.Fatalf("expected 1 message, got %d: %#v", len(messages), messages)
+	}
+	msg := messages[0]
+	if msg.From != "<alltag@example.org>" || len(msg.To) != 1 || msg.To[0] != "<alice@example.org>" {
+		t.Errorf("expected message from alltag@ to alice@, got from %s to %v", msg.From, msg.To)
+	}
+	//(textproto has converted the line endings from CRLF to LF)
+	for _, expected := range []string{
+		"From: \"Alltag\" <alltag@example.org>\n",
+		"To: <alice@example.org>\n",
+		"Subject: Alltag: 1 overdue, 0 due soon\n",
+		"- water the plants (due 2019-11-08)\n",
+	} {
+		if !strings.Contains(msg.Data, expected) {
+			t.Errorf("expected message to contain %q, got:\n%s", expected, msg.Data)
+		}
+	}
+
+	//the digest is recorded as sent for alice and bob, so it is not sent again
+	//on the same day
+	for _, userName := range []string{"alice", "bob"} {
+		settings, err := storage.GetUserSettings(userName)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if settings.DigestSentAt == nil || !settings.DigestSentAt.Equal(now) {
+			t.Errorf("expected digest for %s to be recorded as sent at %s, got %v", userName, now, settings.DigestSentAt)
+		}
+	}
+	scheduler.SendDueDigests(now.Add(time.Hour))
+	if len(sink.Messages()) != 1 {
+		t.Errorf("expected no further digest for alice on the same day, got %d messages", len(sink.Messages()))
+	}
+
+	//on the next day, it is sent again
+	scheduler.SendDueDigests(now.Add(24 * time.Hour))
+	if len(sink.Messages()) != 2 {
+		t.Errorf("expected another digest for alice on the next day, got %d messages", len(sink.Messages()))
+	}
+}
+
+func TestSMTPTimeout(t *testing.T) {
+	//this server accepts connections, but never says anything
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer listener.Close()
+	go func() {
+		var conns []net.Conn
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				for _, conn := range conns {
+					conn.Close()
+				}
+				return
+			}
+			conns = append(conns, conn)
+		}
+	}()
+
+	defer func(timeout time.Duration) { smtpTimeout = timeout }(smtpTimeout)
+	smtpTimeout = 100 * time.Millisecond
+
+	scheduler, err := NewScheduler(db.NewMemoryStorage(), Config{
+		SMTPServer: listener.Addr().String(),
+		Sender:     "alltag@example.org",
+	}, nil)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- scheduler.sendSMTP("alice@example.org", []byte("Subject: test\r\n\r\ntest\r\n"))
+	}()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Error("expected sendSMTP to fail on a hung server, but it succeeded")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("sendSMTP did not time out")
+	}
+}
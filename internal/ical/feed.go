@@ -0,0 +1,59 @@
+/*******************************************************************************
+*
+* Copyright 2019 Stefan Majewsky <majewsky@gmx.net>
+*
+* This program is free software: you can redistribute it and/or modify it under
+* the terms of the GNU General Public License as published by the Free Software
+* Foundation, either version 3 of the License, or (at your option) any later
+* version.
+*
+* This program is distributed in the hope that it will be useful, but WITHOUT ANY
+* WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+* A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License along with
+* this program. If not, see <http://www.gnu.org/licenses/>.
+*
+*******************************************************************************/
+
+package ical
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/majewsky/alltag/internal/date"
+	"github.com/majewsky/alltag/internal/db"
+)
+
+//EncodeDueDate converts the due date of a classified task into an all-day
+//VEVENT, for calendar feeds that show upcoming deadlines next to other
+//appointments. Unlike the VTODO from EncodeTask, this is not meant to be
+//imported again, so it only contains what is useful to see in a calendar.
+func EncodeDueDate(task db.Task, locationLabels []string, now time.Time) Component {
+	return encodeDateEvent(task, "due", "Due: ", task.DueAt, locationLabels, now)
+}
+
+//EncodeStartDate is like EncodeDueDate, but for the start date of the task.
+func EncodeStartDate(task db.Task, locationLabels []string, now time.Time) Component {
+	return encodeDateEvent(task, "start", "Start: ", task.StartsAt, locationLabels, now)
+}
+
+func encodeDateEvent(task db.Task, kind, summaryPrefix string, day date.Date, locationLabels []string, now time.Time) Component {
+	event := Component{Name: "VEVENT"}
+	event.Add("UID", fmt.Sprintf("task-%d-%s@alltag", task.ID, kind))
+	event.Add("DTSTAMP", FormatDateTime(now))
+	event.Add("SUMMARY", EscapeText(summaryPrefix+task.Label))
+	event.Add("DTSTART", FormatDate(day), "VALUE", "DATE")
+	event.Add("DTEND", FormatDate(day.AddDays(1)), "VALUE", "DATE")
+	//deadlines should not show up as busy time
+	event.Add("TRANSP", "TRANSPARENT")
+	if task.Class != nil {
+		event.Add("CATEGORIES", EscapeText(string(*task.Class)))
+	}
+	if len(locationLabels) > 0 {
+		event.Add("LOCATION", EscapeText(strings.Join(locationLabels, ", ")))
+	}
+	return event
+}
@@ -0,0 +1,381 @@
+/*******************************************************************************
+*
+* Copyright 2019 Stefan Majewsky <majewsky@gmx.net>
+*
+* This program is free software: you can redistribute it and/or modify it under
+* the terms of the GNU General Public License as published by the Free Software
+* Foundation, either version 3 of the License, or (at your option) any later
+* version.
+*
+* This program is distributed in the hope that it will be useful, but WITHOUT ANY
+* WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+* A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License along with
+* this program. If not, see <http://www.gnu.org/licenses/>.
+*
+*******************************************************************************/
+
+//Package ical implements reading and writing of the iCalendar format from
+//RFC 5545, as far as Alltag needs it for exchanging tasks (VTODO components)
+//with other applications. The generic syntax (content lines, line folding,
+//parameters and text escaping) is handled in this file. The mapping between
+//tasks and VTODO components is in tasks.go.
+package ical
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/majewsky/alltag/internal/date"
+)
+
+//Property is a single content line within a Component, e.g.
+//"DTSTART;VALUE=DATE:20191120". Names of properties and parameters are always
+//in uppercase. The Value is stored as it appears in the content line, i.e.
+//TEXT values are still escaped (see EscapeText and UnescapeText).
+type Property struct {
+	Name   string
+	Params map[string]string
+	Value  string
+}
+
+//Component is a block delimited by "BEGIN:<Name>" and "END:<Name>", e.g. a
+//VCALENDAR or VTODO.
+type Component struct {
+	Name       string
+	Properties []Property
+	Components []Component
+}
+
+//Get returns the first property with the given name.
+func (c Component) Get(name string) (Property, bool) {
+	for _, prop := range c.Properties {
+		if prop.Name == name {
+			return prop, true
+		}
+	}
+	return Property{}, false
+}
+
+//GetAll returns all properties with the given name.
+func (c Component) GetAll(name string) []Property {
+	var result []Property
+	for _, prop := range c.Properties {
+		if prop.Name == name {
+			result = append(result, prop)
+		}
+	}
+	return result
+}
+
+//Add appends a property with the given name and (already escaped) value.
+//Parameters can be given as pairs of name and value.
+func (c *Component) Add(name, value string, params ...string) {
+	prop := Property{Name: name, Value: value}
+	if len(params) > 0 {
+		prop.Params = make(map[string]string, len(params)/2)
+		for idx := 0; idx+1 < len(params); idx += 2 {
+			prop.Params[params[idx]] = params[idx+1]
+		}
+	}
+	c.Properties = append(c.Properties, prop)
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// writing
+
+//maxLineLength is the maximum length of a content line in octets (excluding
+//the line break), after which it must be folded.
+const maxLineLength = 75
+
+//Encode writes this component (including all subcomponents) in the iCalendar
+//format.
+func (c Component) Encode(w io.Writer) error {
+	var buf bytes.Buffer
+	c.encodeInto(&buf)
+	_, err := buf.WriteTo(w)
+	return err
+}
+
+func (c Component) encodeInto(buf *bytes.Buffer) {
+	writeFolded(buf, "BEGIN:"+c.Name)
+	for _, prop := range c.Properties {
+		writeFolded(buf, prop.String())
+	}
+	for _, sub := range c.Components {
+		sub.encodeInto(buf)
+	}
+	writeFolded(buf, "END:"+c.Name)
+}
+
+//String returns the content line for this property (without folding).
+func (p Property) String() string {
+	names := make([]string, 0, len(p.Params))
+	for name := range p.Params {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var sb strings.Builder
+	sb.WriteString(p.Name)
+	for _, name := range names {
+		value := p.Params[name]
+		if strings.ContainsAny(value, ";:,") {
+			value = `"` + value + `"`
+		}
+		fmt.Fprintf(&sb, ";%s=%s", name, value)
+	}
+	sb.WriteString(":")
+	sb.WriteString(p.Value)
+	return sb.String()
+}
+
+//writeFolded writes a content line, folding it after maxLineLength octets as
+//described in RFC 5545, section 3.1. Folding never splits UTF-8 sequences.
+func writeFolded(buf *bytes.Buffer, line string) {
+	limit := maxLineLength
+	for len(line) > limit {
+		cut := limit
+		for cut > 0 && !utf8.RuneStart(line[cut]) {
+			cut--
+		}
+		buf.WriteString(line[:cut])
+		buf.WriteString("\r\n ")
+		line = line[cut:]
+		//continuation lines start with a space that counts towards the limit
+		limit = maxLineLength - 1
+	}
+	buf.WriteString(line)
+	buf.WriteString("\r\n")
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// reading
+
+//Parse reads a single top-level component (usually a VCALENDAR) from the
+//given input.
+func Parse(r io.Reader) (Component, error) {
+	lines, err := unfoldLines(r)
+	if err != nil {
+		return Component{}, err
+	}
+
+	//stack of components that have been opened, but not closed yet
+	var stack []Component
+	for idx, line := range lines {
+		if line.text == "" {
+			continue
+		}
+		prop, err := parseContentLine(line.text)
+		if err != nil {
+			return Component{}, fmt.Errorf("line %d: %s", line.number, err.Error())
+		}
+
+		switch prop.Name {
+		case "BEGIN":
+			stack = append(stack, Component{Name: strings.ToUpper(prop.Value)})
+		case "END":
+			name := strings.ToUpper(prop.Value)
+			if len(stack) == 0 || stack[len(stack)-1].Name != name {
+				return Component{}, fmt.Errorf("line %d: unexpected END:%s", line.number, name)
+			}
+			finished := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			if len(stack) == 0 {
+				for _, rest := range lines[idx+1:] {
+					if rest.text != "" {
+						return Component{}, fmt.Errorf("line %d: unexpected content after END:%s", rest.number, name)
+					}
+				}
+				return finished, nil
+			}
+			parent := &stack[len(stack)-1]
+			parent.Components = append(parent.Components, finished)
+		default:
+			if len(stack) == 0 {
+				return Component{}, fmt.Errorf("line %d: expected BEGIN, got %s", line.number, prop.Name)
+			}
+			current := &stack[len(stack)-1]
+			current.Properties = append(current.Properties, prop)
+		}
+	}
+
+	if len(stack) == 0 {
+		return Component{}, errors.New("input does not contain any iCalendar data")
+	}
+	return Component{}, fmt.Errorf("missing END:%s", stack[len(stack)-1].Name)
+}
+
+type unfoldedLine struct {
+	number int //of the first physical line, for error messages
+	text   string
+}
+
+//unfoldLines splits the input into content lines, reversing the line folding
+//from writeFolded.
+func unfoldLines(r io.Reader) ([]unfoldedLine, error) {
+	var result []unfoldedLine
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 4096), 1<<20)
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		text := strings.TrimSuffix(scanner.Text(), "\r")
+		if (strings.HasPrefix(text, " ") || strings.HasPrefix(text, "\t")) && len(result) > 0 {
+			result[len(result)-1].text += text[1:]
+			continue
+		}
+		result = append(result, unfoldedLine{lineNo, text})
+	}
+	return result, scanner.Err()
+}
+
+//parseContentLine parses a line of the form "NAME;PARAM=value:VALUE".
+func parseContentLine(line string) (Property, error) {
+	//the name extends until the first ";" or ":"
+	nameEnd := strings.IndexAny(line, ";:")
+	if nameEnd <= 0 {
+		return Property{}, fmt.Errorf("malformed content line: %q", line)
+	}
+	prop := Property{Name: strings.ToUpper(line[:nameEnd])}
+	rest := line[nameEnd:]
+
+	//parameters are separated by ";", and their values may be quoted (in which
+	//case they can contain ";" and ":")
+	for strings.HasPrefix(rest, ";") {
+		rest = rest[1:]
+		eq := strings.IndexByte(rest, '=')
+		if eq <= 0 {
+			return Property{}, fmt.Errorf("malformed parameter in content line: %q", line)
+		}
+		paramName := strings.ToUpper(rest[:eq])
+		rest = rest[eq+1:]
+
+		var paramValue string
+		if strings.HasPrefix(rest, `"`) {
+			closingQuote := strings.IndexByte(rest[1:], '"')
+			if closingQuote < 0 {
+				return Property{}, fmt.Errorf("unterminated quoted parameter value in content line: %q", line)
+			}
+			paramValue = rest[1 : closingQuote+1]
+			rest = rest[closingQuote+2:]
+		} else {
+			end := strings.IndexAny(rest, ";:")
+			if end < 0 {
+				return Property{}, fmt.Errorf("malformed content line: %q", line)
+			}
+			paramValue = rest[:end]
+			rest = rest[end:]
+		}
+
+		if prop.Params == nil {
+			prop.Params = make(map[string]string)
+		}
+		prop.Params[paramName] = paramValue
+	}
+
+	if !strings.HasPrefix(rest, ":") {
+		return Property{}, fmt.Errorf("malformed content line: %q", line)
+	}
+	prop.Value = rest[1:]
+	return prop, nil
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// value types
+
+var textEscaper = strings.NewReplacer(`\`, `\\`, `;`, `\;`, `,`, `\,`, "\r\n", `\n`, "\n", `\n`)
+
+//EscapeText escapes a string for use as a TEXT value.
+func EscapeText(text string) string {
+	return textEscaper.Replace(text)
+}
+
+//UnescapeText reverses EscapeText.
+func UnescapeText(value string) string {
+	return unescapeText(value, false)[0]
+}
+
+//SplitText splits a value with multiple TEXT entries (e.g. in CATEGORIES) at
+//the unescaped commas, and unescapes each entry.
+func SplitText(value string) []string {
+	return unescapeText(value, true)
+}
+
+func unescapeText(value string, split bool) []string {
+	var (
+		result  []string
+		current strings.Builder
+	)
+	for idx := 0; idx < len(value); idx++ {
+		ch := value[idx]
+		switch {
+		case ch == '\\' && idx+1 < len(value):
+			idx++
+			if value[idx] == 'n' || value[idx] == 'N' {
+				current.WriteByte('\n')
+			} else {
+				current.WriteByte(value[idx])
+			}
+		case ch == ',' && split:
+			result = append(result, current.String())
+			current.Reset()
+		default:
+			current.WriteByte(ch)
+		}
+	}
+	return append(result, current.String())
+}
+
+//FormatDate formats a date for use as a DATE value.
+func FormatDate(d date.Date) string {
+	return d.FirstSecondIn(time.UTC).Format("20060102")
+}
+
+//FormatDateTime formats a timestamp for use as a DATE-TIME value (in UTC).
+func FormatDateTime(t time.Time) string {
+	return t.UTC().Format("20060102T150405Z")
+}
+
+//ParseDate parses a property with a DATE or DATE-TIME value, and returns the
+//date part. DATE-TIME values are converted into the local timezone first.
+func ParseDate(prop Property) (date.Date, error) {
+	value := prop.Value
+	if len(value) == 8 {
+		t, err := time.Parse("20060102", value)
+		if err != nil {
+			return date.Epoch, fmt.Errorf("invalid %s value: %q", prop.Name, value)
+		}
+		return date.FromTime(t), nil
+	}
+
+	if strings.HasSuffix(value, "Z") {
+		t, err := time.Parse("20060102T150405Z", value)
+		if err != nil {
+			return date.Epoch, fmt.Errorf("invalid %s value: %q", prop.Name, value)
+		}
+		return date.FromTime(t.Local()), nil
+	}
+
+	//floating time, or time in the timezone given by TZID (when that timezone
+	//is unknown to us, treating it as floating time is the best we can do)
+	loc := time.Local
+	if tzid := prop.Params["TZID"]; tzid != "" {
+		if l, err := time.LoadLocation(strings.TrimPrefix(tzid, "/")); err == nil {
+			loc = l
+		}
+	}
+	t, err := time.ParseInLocation("20060102T150405", value, loc)
+	if err != nil {
+		return date.Epoch, fmt.Errorf("invalid %s value: %q", prop.Name, value)
+	}
+	return date.FromTime(t.Local()), nil
+}
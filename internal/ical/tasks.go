@@ -0,0 +1,375 @@
+/*******************************************************************************
+*
+* Copyright 2019 Stefan Majewsky <majewsky@gmx.net>
+*
+* This program is free software: you can redistribute it and/or modify it under
+* the terms of the GNU General Public License as published by the Free Software
+* Foundation, either version 3 of the License, or (at your option) any later
+* version.
+*
+* This program is distributed in the hope that it will be useful, but WITHOUT ANY
+* WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+* A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License along with
+* this program. If not, see <http://www.gnu.org/licenses/>.
+*
+*******************************************************************************/
+
+package ical
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/majewsky/alltag/internal/date"
+	"github.com/majewsky/alltag/internal/db"
+	"github.com/majewsky/alltag/internal/rrule"
+)
+
+//ProductID is the PRODID of all calendars generated by Alltag.
+const ProductID = "-//majewsky//Alltag//EN"
+
+//Nonstandard properties that are used to preserve those task attributes that
+//cannot be expressed exactly with the standard properties of VTODO.
+const (
+	propInitialPriority       = "X-ALLTAG-INITIAL-PRIORITY"
+	propFinalPriority         = "X-ALLTAG-FINAL-PRIORITY"
+	propRecurrenceDays        = "X-ALLTAG-RECURRENCE-DAYS"
+	propRecurrenceFromDueDate = "X-ALLTAG-RECURRENCE-FROM-DUE-DATE"
+	propClass                 = "X-ALLTAG-CLASS"
+	propLocations             = "X-ALLTAG-LOCATIONS"
+)
+
+//NewCalendar returns an empty VCALENDAR component.
+func NewCalendar() Component {
+	c := Component{Name: "VCALENDAR"}
+	c.Add("VERSION", "2.0")
+	c.Add("PRODID", ProductID)
+	return c
+}
+
+//TaskUID returns the UID of the VTODO representing the given task.
+func TaskUID(task db.Task) string {
+	if task.ICalUID != nil {
+		return *task.ICalUID
+	}
+	return fmt.Sprintf("task-%d@alltag", task.ID)
+}
+
+//EncodeTask converts a task into a VTODO component. The task class and the
+//labels of the task's locations are written into CATEGORIES, as well as into
+//the nonstandard properties X-ALLTAG-CLASS and X-ALLTAG-LOCATIONS. The latter
+//take precedence in DecodeTask, so that CATEGORIES can be edited freely in
+//other applications.
+//
+//PRIORITY is derived from the final priority, since that is what the task
+//will be judged by eventually. Both priorities are also stored in nonstandard
+//properties, so that they survive a roundtrip through EncodeTask and
+//DecodeTask unchanged. The same goes for recurrence intervals in days, which
+//are only approximated by the RRULE.
+func EncodeTask(task db.Task, locationLabels []string, now time.Time) Component {
+	todo := Component{Name: "VTODO"}
+	todo.Add("UID", TaskUID(task))
+	todo.Add("DTSTAMP", FormatDateTime(now))
+	todo.Add("SUMMARY", EscapeText(task.Label))
+	if task.IsClosed() {
+		todo.Add("STATUS", "COMPLETED")
+		todo.Add("COMPLETED", FormatDateTime(task.ClosedAt.FirstSecondIn(time.Local)))
+	} else {
+		todo.Add("STATUS", "NEEDS-ACTION")
+	}
+	if !task.IsClassified() {
+		return todo
+	}
+
+	todo.Add("DTSTART", FormatDate(task.StartsAt), "VALUE", "DATE")
+	todo.Add("DUE", FormatDate(task.DueAt), "VALUE", "DATE")
+	todo.Add("PRIORITY", strconv.Itoa(encodePriority(task.FinalPriority)))
+	todo.Add(propInitialPriority, strconv.Itoa(int(task.InitialPriority)))
+	todo.Add(propFinalPriority, strconv.Itoa(int(task.FinalPriority)))
+
+	categories := []string{EscapeText(string(*task.Class))}
+	for _, label := range locationLabels {
+		categories = append(categories, EscapeText(label))
+	}
+	todo.Add("CATEGORIES", strings.Join(categories, ","))
+	todo.Add(propClass, EscapeText(string(*task.Class)))
+	if len(locationLabels) > 0 {
+		todo.Add(propLocations, strings.Join(categories[1:], ","))
+	}
+
+	switch {
+	case task.RecurrenceRule != nil:
+		todo.Add("RRULE", task.RecurrenceRule.String())
+	case task.RecurrenceDays != 0:
+		todo.Add("RRULE", fmt.Sprintf("FREQ=DAILY;INTERVAL=%d", task.RecurrenceDays))
+		todo.Add(propRecurrenceDays, strconv.Itoa(int(task.RecurrenceDays)))
+		if task.RecurrenceFromDueDate {
+			todo.Add(propRecurrenceFromDueDate, "TRUE")
+		}
+	}
+	return todo
+}
+
+//encodePriority maps Alltag's priority scale (0 = Low to 3 = Critical) onto
+//the PRIORITY scale of iCalendar (1 = highest to 9 = lowest).
+func encodePriority(priority uint16) int {
+	switch priority {
+	case 3:
+		return 1
+	case 2:
+		return 3
+	case 1:
+		return 5
+	default:
+		return 9
+	}
+}
+
+//decodePriority is the reverse of encodePriority. It returns a final
+//priority, so Low is mapped to Normal since the final priority must be above
+//the initial priority (which is always Low when imported from PRIORITY).
+func decodePriority(value int) uint16 {
+	switch {
+	case value == 1:
+		return 3
+	case value >= 2 && value <= 4:
+		return 2
+	default:
+		return 1
+	}
+}
+
+//IsFinished returns whether the given VTODO has been completed or cancelled.
+func IsFinished(todo Component) bool {
+	if _, exists := todo.Get("COMPLETED"); exists {
+		return true
+	}
+	status, _ := todo.Get("STATUS")
+	switch strings.ToUpper(status.Value) {
+	case "COMPLETED", "CANCELLED":
+		return true
+	default:
+		return false
+	}
+}
+
+//DecodedTask is the result of DecodeTask.
+type DecodedTask struct {
+	//The Task has neither ID nor UserName filled.
+	Task db.Task
+	//All CATEGORIES that do not refer to a task class. When the task is
+	//imported, these are interpreted as location labels.
+	LocationLabels []string
+	//If the VTODO has an RRULE that Alltag does not support (e.g. one with
+	//COUNT or UNTIL), the Task is decoded without recurrence, and this explains
+	//why.
+	UnsupportedRecurrence error
+}
+
+//DecodeTask converts a VTODO component into a task. The task is only
+//classified if the VTODO has a DUE date and a task class (in X-ALLTAG-CLASS or
+//CATEGORIES), otherwise only the label is filled. When there is no DTSTART, the
+//task starts today. The result is not validated beyond the syntax of the
+//individual properties; use Task.CheckClassification for that. An unsupported
+//RRULE is not an error, cf. DecodedTask.UnsupportedRecurrence.
+func DecodeTask(todo Component, today date.Date) (DecodedTask, error) {
+	var result DecodedTask
+	summary, exists := todo.Get("SUMMARY")
+	if !exists || strings.TrimSpace(UnescapeText(summary.Value)) == "" {
+		return result, errors.New("found VTODO without SUMMARY")
+	}
+	task := db.Task{
+		Label:    strings.TrimSpace(UnescapeText(summary.Value)),
+		StartsAt: date.Epoch, //zero value
+		DueAt:    date.Epoch, //zero value
+	}
+
+	class, locationLabels := decodeClassAndLocations(todo)
+	result.LocationLabels = locationLabels
+	due, hasDue := todo.Get("DUE")
+	if class == nil || !hasDue {
+		result.Task = task
+		return result, nil
+	}
+	task.Class = class
+
+	err := decodeDates(todo, due, today, &task)
+	if err == nil {
+		err = decodePriorities(todo, &task)
+	}
+	if err == nil {
+		err = decodeRecurrence(todo, &task, &result)
+	}
+	if err != nil {
+		return result, fmt.Errorf("task %q: %s", task.Label, err.Error())
+	}
+	result.Task = task
+	return result, nil
+}
+
+//LocationResolver finds the locations that are named in the CATEGORIES of
+//decoded tasks.
+type LocationResolver struct {
+	storage       db.Storage
+	userName      string
+	createMissing bool
+	ids           map[string]int64 //key: lowercased label
+}
+
+//NewLocationResolver prepares a LocationResolver for the given user. If
+//createMissing is true, locations that do not exist yet are created on the
+//fly. Otherwise, labels of unknown locations are ignored.
+func NewLocationResolver(storage db.Storage, userName string, createMissing bool) (*LocationResolver, error) {
+	locations, err := storage.ListLocations(userName)
+	if err != nil {
+		return nil, err
+	}
+	ids := make(map[string]int64, len(locations))
+	for _, loc := range locations {
+		ids[strings.ToLower(loc.Label)] = loc.ID
+	}
+	return &LocationResolver{storage, userName, createMissing, ids}, nil
+}
+
+//Resolve returns the IDs of the locations with the given labels. Labels are
+//matched case-insensitively.
+func (r *LocationResolver) Resolve(labels []string) ([]int64, error) {
+	var result []int64
+	for _, label := range labels {
+		id, exists := r.ids[strings.ToLower(label)]
+		if !exists && r.createMissing {
+			loc := db.Location{Label: label, UserName: r.userName}
+			err := r.storage.SaveLocation(&loc)
+			if err != nil {
+				return nil, err
+			}
+			id, exists = loc.ID, true
+			r.ids[strings.ToLower(label)] = id
+		}
+		if exists {
+			result = append(result, id)
+		}
+	}
+	return result, nil
+}
+
+//CheckClassification is like Task.CheckClassification, but for tasks that
+//come from a VTODO. Overdue tasks are fine here, as long as they were valid
+//when they started: a task may well be overdue by the time it is imported or
+//synced.
+func CheckClassification(task db.Task) error {
+	return task.CheckClassification(task.StartsAt)
+}
+
+//decodeClassAndLocations reads the task class and location labels from either
+//X-ALLTAG-CLASS and X-ALLTAG-LOCATIONS, or from CATEGORIES.
+func decodeClassAndLocations(todo Component) (class *db.TaskClass, locationLabels []string) {
+	if prop, exists := todo.Get(propClass); exists {
+		c := db.TaskClass(strings.ToLower(strings.TrimSpace(UnescapeText(prop.Value))))
+		if db.IsTaskClass[c] {
+			class = &c
+		}
+		for _, prop := range todo.GetAll(propLocations) {
+			for _, label := range SplitText(prop.Value) {
+				if label = strings.TrimSpace(label); label != "" {
+					locationLabels = append(locationLabels, label)
+				}
+			}
+		}
+		return class, locationLabels
+	}
+
+	for _, prop := range todo.GetAll("CATEGORIES") {
+		for _, category := range SplitText(prop.Value) {
+			category = strings.TrimSpace(category)
+			c := db.TaskClass(strings.ToLower(category))
+			switch {
+			case category == "":
+				continue
+			case db.IsTaskClass[c]:
+				class = &c
+			default:
+				locationLabels = append(locationLabels, category)
+			}
+		}
+	}
+	return class, locationLabels
+}
+
+func decodeDates(todo Component, due Property, today date.Date, task *db.Task) (err error) {
+	task.DueAt, err = ParseDate(due)
+	if err != nil {
+		return err
+	}
+	if prop, exists := todo.Get("DTSTART"); exists {
+		task.StartsAt, err = ParseDate(prop)
+		return err
+	}
+	//without DTSTART, start today, or on the day before an overdue task was due
+	task.StartsAt = today
+	if !task.DueAt.After(today) {
+		task.StartsAt = task.DueAt.AddDays(-1)
+	}
+	return nil
+}
+
+func decodePriorities(todo Component, task *db.Task) error {
+	initial, hasInitial := todo.Get(propInitialPriority)
+	final, hasFinal := todo.Get(propFinalPriority)
+	if hasInitial && hasFinal {
+		var err error
+		task.InitialPriority, err = parsePriority(initial)
+		if err != nil {
+			return err
+		}
+		task.FinalPriority, err = parsePriority(final)
+		return err
+	}
+
+	task.InitialPriority = 0
+	task.FinalPriority = 1
+	if prop, exists := todo.Get("PRIORITY"); exists {
+		value, err := strconv.Atoi(prop.Value)
+		if err != nil {
+			return fmt.Errorf("invalid PRIORITY value: %q", prop.Value)
+		}
+		task.FinalPriority = decodePriority(value)
+	}
+	return nil
+}
+
+func parsePriority(prop Property) (uint16, error) {
+	value, err := strconv.ParseUint(prop.Value, 10, 16)
+	if err != nil || value > 3 {
+		return 0, fmt.Errorf("invalid %s value: %q", prop.Name, prop.Value)
+	}
+	return uint16(value), nil
+}
+
+func decodeRecurrence(todo Component, task *db.Task, result *DecodedTask) error {
+	if prop, exists := todo.Get(propRecurrenceDays); exists {
+		value, err := strconv.ParseUint(prop.Value, 10, 31)
+		if err != nil {
+			return fmt.Errorf("invalid %s value: %q", prop.Name, prop.Value)
+		}
+		task.RecurrenceDays = int32(value)
+		fromDueDate, _ := todo.Get(propRecurrenceFromDueDate)
+		task.RecurrenceFromDueDate = strings.EqualFold(fromDueDate.Value, "TRUE") && value != 0
+		return nil
+	}
+
+	if prop, exists := todo.Get("RRULE"); exists {
+		rule, err := rrule.Parse(prop.Value)
+		if err != nil {
+			result.UnsupportedRecurrence = fmt.Errorf("unsupported RRULE %q: %s", prop.Value, err.Error())
+			return nil
+		}
+		task.RecurrenceRule = &rule
+	}
+	return nil
+}
@@ -0,0 +1,122 @@
+/*******************************************************************************
+*
+* Copyright 2019 Stefan Majewsky <majewsky@gmx.net>
+*
+* This program is free software: you can redistribute it and/or modify it under
+* the terms of the GNU General Public License as published by the Free Software
+* Foundation, either version 3 of the License, or (at your option) any later
+* version.
+*
+* This program is distributed in the hope that it will be useful, but WITHOUT ANY
+* WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+* A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License along with
+* this program. If not, see <http://www.gnu.org/licenses/>.
+*
+*******************************************************************************/
+
+package ical
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/majewsky/alltag/internal/date"
+	"github.com/majewsky/alltag/internal/db"
+)
+
+func parseTodo(t *testing.T, lines ...string) Component {
+	t.Helper()
+	input := "BEGIN:VTODO\r\n" + strings.Join(lines, "\r\n") + "\r\nEND:VTODO\r\n"
+	todo, err := Parse(strings.NewReader(input))
+	if err != nil {
+		t.Fatalf("cannot parse VTODO: %s", err.Error())
+	}
+	return todo
+}
+
+func TestDecodeTaskRecurrence(t *testing.T) {
+	today, _ := date.Parse("2019-11-01")
+	testCases := []struct {
+		RRule       string
+		Expected    string //empty if the task shall not recur
+		Unsupported bool
+	}{
+		{"", "", false},
+		{"FREQ=WEEKLY;BYDAY=MO", "FREQ=WEEKLY;BYDAY=MO", false},
+		{"FREQ=DAILY;COUNT=5", "", true},
+		{"FREQ=MONTHLY;UNTIL=20201231", "", true},
+		{"FREQ=WEEKLY;WKST=SU;BYDAY=SU", "", true},
+	}
+
+	for _, tc := range testCases {
+		lines := []string{
+			"SUMMARY:Water the plants",
+			"CATEGORIES:physical,Home",
+			"DTSTART;VALUE=DATE:20191104",
+			"DUE;VALUE=DATE:20191105",
+		}
+		if tc.RRule != "" {
+			lines = append(lines, "RRULE:"+tc.RRule)
+		}
+		decoded, err := DecodeTask(parseTodo(t, lines...), today)
+		if err != nil {
+			t.Errorf("RRULE %q: unexpected error: %s", tc.RRule, err.Error())
+			continue
+		}
+
+		//the task is classified regardless of whether the RRULE is supported
+		task := decoded.Task
+		if !task.IsClassified() || task.StartsAt.String() != "2019-11-04" || task.DueAt.String() != "2019-11-05" {
+			t.Errorf("RRULE %q: expected classified task from 2019-11-04 to 2019-11-05, but got %#v", tc.RRule, task)
+		}
+		if (decoded.UnsupportedRecurrence != nil) != tc.Unsupported {
+			t.Errorf("RRULE %q: expected unsupported = %t, but got UnsupportedRecurrence = %v",
+				tc.RRule, tc.Unsupported, decoded.UnsupportedRecurrence)
+		}
+		actual := ""
+		if task.RecurrenceRule != nil {
+			actual = task.RecurrenceRule.String()
+		}
+		if actual != tc.Expected {
+			t.Errorf("RRULE %q: expected recurrence rule %q, but got %q", tc.RRule, tc.Expected, actual)
+		}
+	}
+}
+
+func TestDecodeTaskErrors(t *testing.T) {
+	today, _ := date.Parse("2019-11-01")
+	for _, lines := range [][]string{
+		{"DESCRIPTION:no summary"},
+		{"SUMMARY:Foo", "CATEGORIES:mental", "DUE;VALUE=DATE:2019-11-05"},
+		{"SUMMARY:Foo", "CATEGORIES:mental", "DUE;VALUE=DATE:20191105", "PRIORITY:high"},
+	} {
+		_, err := DecodeTask(parseTodo(t, lines...), today)
+		if err == nil {
+			t.Errorf("expected error when decoding %q, but got none", lines)
+		}
+	}
+}
+
+func TestEncodeClosedTask(t *testing.T) {
+	closedAt, _ := date.Parse("2019-11-03")
+	class := db.TaskClassMental
+	task := db.Task{
+		ID:       42,
+		Label:    "Call mom",
+		Class:    &class,
+		StartsAt: closedAt.AddDays(-2),
+		DueAt:    closedAt.AddDays(1),
+		ClosedAt: &closedAt,
+	}
+	todo := EncodeTask(task, []string{"Home"}, time.Now())
+	if !IsFinished(todo) {
+		t.Error("expected VTODO for closed task to be finished")
+	}
+	status, _ := todo.Get("STATUS")
+	if status.Value != "COMPLETED" {
+		t.Errorf("expected STATUS:COMPLETED, but got STATUS:%s", status.Value)
+	}
+}
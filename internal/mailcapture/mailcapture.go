@@ -0,0 +1,232 @@
+/*******************************************************************************
+*
+* Copyright 2019 Stefan Majewsky <majewsky@gmx.net>
+*
+* This program is free software: you can redistribute it and/or modify it under
+* the terms of the GNU General Public License as published by the Free Software
+* Foundation, either version 3 of the License, or (at your option) any later
+* version.
+*
+* This program is distributed in the hope that it will be useful, but WITHOUT ANY
+* WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+* A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License along with
+* this program. If not, see <http://www.gnu.org/licenses/>.
+*
+*******************************************************************************/
+
+//Package mailcapture creates tasks from emails. The emails are read from a
+//maildir that the MTA delivers into. Each user can create API tokens with the
+//scope "mail-capture", which are appended to the configured base address
+//(e.g. "tasks+alltag_...@example.org" for "tasks@example.org"), so that the
+//recipient address identifies the user.
+package mailcapture
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/majewsky/alltag/internal/date"
+	"github.com/majewsky/alltag/internal/db"
+	"github.com/sapcc/go-bits/logg"
+)
+
+//how often the maildir is checked for new messages
+const checkInterval = 30 * time.Second
+
+//Config contains the configuration for mail capture.
+type Config struct {
+	//Path to the maildir, which must contain the subdirectories "new" and
+	//"cur".
+	Maildir string
+	//The base address, e.g. "tasks@example.org". Mail capture tokens are
+	//appended to its local part to form the addresses of the users.
+	Address string
+}
+
+//AddressForToken returns the address that mails must be sent to in order to
+//create tasks with the given mail capture token.
+func AddressForToken(baseAddress, token string) string {
+	idx := strings.LastIndex(baseAddress, "@")
+	return baseAddress[:idx] + "+" + token + baseAddress[idx:]
+}
+
+//tokenFromAddress is the reverse of AddressForToken.
+func tokenFromAddress(baseAddress, address string) (string, bool) {
+	baseIdx := strings.LastIndex(baseAddress, "@")
+	idx := strings.LastIndex(address, "@")
+	if idx < 0 || !strings.EqualFold(address[idx:], baseAddress[baseIdx:]) {
+		return "", false
+	}
+	prefix := baseAddress[:baseIdx] + "+"
+	localPart := address[:idx]
+	if len(localPart) <= len(prefix) || !strings.EqualFold(localPart[:len(prefix)], prefix) {
+		return "", false
+	}
+	//mail capture tokens are always lowercase (see db.CreateAPIToken), but the
+	//mail might have been sent to an address with different case
+	return strings.ToLower(localPart[len(prefix):]), true
+}
+
+//Capturer creates tasks from the messages in a maildir.
+type Capturer struct {
+	storage db.Storage
+	cfg     Config
+}
+
+//NewCapturer prepares a Capturer.
+func NewCapturer(storage db.Storage, cfg Config) (*Capturer, error) {
+	addr, err := mail.ParseAddress(cfg.Address)
+	if err != nil || addr.Address != cfg.Address {
+		return nil, fmt.Errorf("invalid mail capture address: %q", cfg.Address)
+	}
+	for _, subdir := range []string{"new", "cur"} {
+		fi, err := os.Stat(filepath.Join(cfg.Maildir, subdir))
+		if err == nil && !fi.IsDir() {
+			err = errors.New("not a directory")
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid maildir %q: %s", cfg.Maildir, err.Error())
+		}
+	}
+	return &Capturer{storage, cfg}, nil
+}
+
+//Run polls the maildir for new messages (see ProcessNewMessages) every
+//checkInterval.
+func (c *Capturer) Run() {
+	for {
+		c.ProcessNewMessages()
+		time.Sleep(checkInterval)
+	}
+}
+
+//ProcessNewMessages creates tasks from all messages in the "new" subdirectory
+//of the maildir. Errors are logged.
+//
+//Each message is moved into "cur" and flagged as seen before the task is
+//created. Therefore no message is imported twice, at the risk of skipping a
+//message when Alltag crashes in the wrong moment. If the maildir is not
+//writable, messages cannot be claimed in this way, so they are not imported
+//at all. Messages that cannot be imported because of temporary problems (e.g.
+//database errors) are moved back into "new" to try again later.
+func (c *Capturer) ProcessNewMessages() {
+	entries, err := ioutil.ReadDir(filepath.Join(c.cfg.Maildir, "new"))
+	if err != nil {
+		logg.Error("cannot read maildir: %s", err.Error())
+		return
+	}
+
+	for _, entry := range entries {
+		if entry.IsDir() || strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+		newPath := filepath.Join(c.cfg.Maildir, "new", entry.Name())
+		curPath := filepath.Join(c.cfg.Maildir, "cur", entry.Name()+":2,S")
+		err := os.Rename(newPath, curPath)
+		if err != nil {
+			logg.Error("cannot claim message %s: %s", newPath, err.Error())
+			continue
+		}
+
+		err = c.processMessage(curPath)
+		if err != nil {
+			logg.Error("cannot process message %s (will retry): %s", curPath, err.Error())
+			err = os.Rename(curPath, newPath)
+			if err != nil {
+				logg.Error("cannot move message %s back into new/: %s", curPath, err.Error())
+			}
+		}
+	}
+}
+
+//processMessage creates a task from the message in the given file. Messages
+//that are not acceptable are logged and skipped. An error is only returned for
+//temporary problems.
+func (c *Capturer) processMessage(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	msg, err := parseMessage(file)
+	file.Close()
+	if err != nil {
+		logg.Info("skipping message %s: %s", path, err.Error())
+		return nil
+	}
+
+	apiToken, err := c.findAPIToken(msg.Recipients)
+	if err != nil {
+		return err
+	}
+	if apiToken == nil {
+		logg.Info("skipping message %s: not sent to a valid capture address", path)
+		return nil
+	}
+
+	task := db.Task{
+		Label:    taskLabel(msg),
+		Notes:    msg.Body,
+		UserName: apiToken.UserName,
+		StartsAt: date.Epoch, //zero value
+		DueAt:    date.Epoch, //zero value
+	}
+	if task.Label == "" {
+		logg.Info("skipping message %s: no subject and no body", path)
+		return nil
+	}
+	err = c.storage.Transaction(func(s db.Storage) error {
+		err := s.SaveTask(&task)
+		if err != nil {
+			return err
+		}
+		return s.EmitTaskEvent(db.WebhookEventTaskCreated, task)
+	})
+	if err != nil {
+		return err
+	}
+	logg.Info("created task %d for user %q from message %s", task.ID, task.UserName, path)
+	return nil
+}
+
+//findAPIToken returns the mail capture token from the first recipient that is
+//a valid capture address, or nil if there is none.
+func (c *Capturer) findAPIToken(recipients []string) (*db.APIToken, error) {
+	for _, recipient := range recipients {
+		token, ok := tokenFromAddress(c.cfg.Address, recipient)
+		if !ok {
+			continue
+		}
+		apiToken, err := c.storage.FindAPIToken(token)
+		if err != nil {
+			return nil, err
+		}
+		if apiToken != nil && apiToken.Scope == db.APITokenScopeMailCapture {
+			return apiToken, nil
+		}
+	}
+	return nil, nil
+}
+
+//forwardPrefixRx matches the prefixes that mail clients add to the subject
+//of forwarded messages.
+var forwardPrefixRx = regexp.MustCompile(`^(?i:(fwd?|wg|tr)\s*:\s*)+`)
+
+//taskLabel chooses the label for a task created from the given message: the
+//subject (without forwarding prefixes), or the first line of the body if there
+//is no subject.
+func taskLabel(msg message) string {
+	label := strings.TrimSpace(forwardPrefixRx.ReplaceAllString(msg.Subject, ""))
+	if label == "" {
+		label = strings.TrimSpace(strings.SplitN(msg.Body, "\n", 2)[0])
+	}
+	return label
+}
@@ -0,0 +1,215 @@
+/*******************************************************************************
+*
+* Copyright 2019 Stefan Majewsky <majewsky@gmx.net>
+*
+* This program is free software: you can redistribute it and/or modify it under
+* the terms of the GNU General Public License as published by the Free Software
+* Foundation, either version 3 of the License, or (at your option) any later
+* version.
+*
+* This program is distributed in the hope that it will be useful, but WITHOUT ANY
+* WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+* A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License along with
+* this program. If not, see <http://www.gnu.org/licenses/>.
+*
+*******************************************************************************/
+
+package mailcapture
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/majewsky/alltag/internal/db"
+)
+
+func TestTokenFromAddress(t *testing.T) {
+	base := "tasks@example.org"
+	testCases := []struct {
+		Address  string
+		Token    string
+		Expected bool
+	}{
+		{"tasks+alltag_abc@example.org", "alltag_abc", true},
+		{AddressForToken(base, "alltag_def"), "alltag_def", true},
+		//case is not reliably preserved in email addresses
+		{"Tasks+ALLTAG_ABC@EXAMPLE.org", "alltag_abc", true},
+		{"tasks@example.org", "", false},
+		{"tasks+@example.org", "", false},
+		{"tasks+alltag_abc@example.com", "", false},
+		{"other+alltag_abc@example.org", "", false},
+		{"tasks+alltag_abc", "", false},
+	}
+	for _, tc := range testCases {
+		token, ok := tokenFromAddress(base, tc.Address)
+		if token != tc.Token || ok != tc.Expected {
+			t.Errorf("%s: expected (%q, %t), but got (%q, %t)", tc.Address, tc.Token, tc.Expected, token, ok)
+		}
+	}
+}
+
+func TestTaskLabel(t *testing.T) {
+	testCases := []struct {
+		Subject  string
+		Body     string
+		Expected string
+	}{
+		{"Buy milk", "Two liters, please.", "Buy milk"},
+		{"Fwd: Buy milk", "", "Buy milk"},
+		{"WG: FW:Tr : Buy milk", "", "Buy milk"},
+		{"Forward the report", "", "Forward the report"},
+		{"", "Buy milk\nTwo liters, please.", "Buy milk"},
+		{"Fwd:", "  Buy milk  ", "Buy milk"},
+		{"", "", ""},
+	}
+	for _, tc := range testCases {
+		actual := taskLabel(message{Subject: tc.Subject, Body: tc.Body})
+		if actual != tc.Expected {
+			t.Errorf("subject %q, body %q: expected label %q, but got %q", tc.Subject, tc.Body, tc.Expected, actual)
+		}
+	}
+}
+
+//flakyStorage is a db.Storage whose API token lookups fail while Broken is
+//set, to simulate a database outage.
+type flakyStorage struct {
+	db.Storage
+	Broken bool
+}
+
+func (s *flakyStorage) FindAPIToken(token string) (*db.APIToken, error) {
+	if s.Broken {
+		return nil, errors.New("database is unavailable")
+	}
+	return s.Storage.FindAPIToken(token)
+}
+
+func listMaildir(t *testing.T, path string) []string {
+	t.Helper()
+	entries, err := ioutil.ReadDir(path)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	var result []string
+	for _, entry := range entries {
+		result = append(result, entry.Name())
+	}
+	sort.Strings(result)
+	return result
+}
+
+func expectMaildir(t *testing.T, maildir, subdir string, expected ...string) {
+	t.Helper()
+	actual := listMaildir(t, filepath.Join(maildir, subdir))
+	if len(actual) != len(expected) {
+		t.Errorf("expected %s/ to contain %v, but got %v", subdir, expected, actual)
+		return
+	}
+	for idx := range actual {
+		if actual[idx] != expected[idx] {
+			t.Errorf("expected %s/ to contain %v, but got %v", subdir, expected, actual)
+			return
+		}
+	}
+}
+
+func TestProcessNewMessages(t *testing.T) {
+	maildir, err := ioutil.TempDir("", "alltag-maildir")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(maildir)
+	for _, subdir := range []string{"new", "cur", "tmp"} {
+		err := os.Mkdir(filepath.Join(maildir, subdir), 0700)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+
+	storage := &flakyStorage{Storage: db.NewMemoryStorage()}
+	_, captureToken, err := storage.CreateAPIToken("alice", "mail", db.APITokenScopeMailCapture)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	_, readToken, err := storage.CreateAPIToken("alice", "read", db.APITokenScopeReadOnly)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	c, err := NewCapturer(storage, Config{Maildir: maildir, Address: "tasks@example.org"})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	messages := map[string]string{
+		"1.valid": makeMessage(
+			"To: "+AddressForToken("tasks@example.org", captureToken),
+			"Subject: Fwd: Buy milk",
+			"",
+			"Two liters, please.",
+		),
+		"2.wrongscope": makeMessage(
+			"To: "+AddressForToken("tasks@example.org", readToken),
+			"Subject: Buy bread",
+			"",
+		),
+		"3.garbage": "this is not a message",
+		//files starting with a dot are ignored, like in every maildir reader
+		".4.hidden": makeMessage(
+			"To: "+AddressForToken("tasks@example.org", captureToken),
+			"Subject: Hidden",
+			"",
+		),
+	}
+	for name, content := range messages {
+		err := ioutil.WriteFile(filepath.Join(maildir, "new", name), []byte(content), 0600)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+
+	//during a database outage, messages are claimed, but those that need the
+	//database are moved back into new/
+	storage.Broken = true
+	c.ProcessNewMessages()
+	expectMaildir(t, maildir, "new", ".4.hidden", "1.valid", "2.wrongscope")
+	expectMaildir(t, maildir, "cur", "3.garbage:2,S")
+	tasks, err := storage.ListTasks("alice")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(tasks) != 0 {
+		t.Errorf("expected no tasks during database outage, but got %#v", tasks)
+	}
+
+	//once the database is back, the remaining messages are processed
+	storage.Broken = false
+	c.ProcessNewMessages()
+	expectMaildir(t, maildir, "new", ".4.hidden")
+	expectMaildir(t, maildir, "cur", "1.valid:2,S", "2.wrongscope:2,S", "3.garbage:2,S")
+	tasks, err = storage.ListTasks("alice")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(tasks) != 1 {
+		t.Fatalf("expected exactly one task, but got %#v", tasks)
+	}
+	if tasks[0].Label != "Buy milk" || tasks[0].Notes != "Two liters, please." || tasks[0].IsClassified() {
+		t.Errorf("task was not created correctly: %#v", tasks[0])
+	}
+
+	//messages are not imported twice
+	c.ProcessNewMessages()
+	tasks, err = storage.ListTasks("alice")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(tasks) != 1 {
+		t.Errorf("expected exactly one task, but got %#v", tasks)
+	}
+}
@@ -0,0 +1,195 @@
+/*******************************************************************************
+*
+* Copyright 2019 Stefan Majewsky <majewsky@gmx.net>
+*
+* This program is free software: you can redistribute it and/or modify it under
+* the terms of the GNU General Public License as published by the Free Software
+* Foundation, either version 3 of the License, or (at your option) any later
+* version.
+*
+* This program is distributed in the hope that it will be useful, but WITHOUT ANY
+* WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+* A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License along with
+* this program. If not, see <http://www.gnu.org/licenses/>.
+*
+*******************************************************************************/
+
+package mailcapture
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"regexp"
+	"strings"
+)
+
+//message contains the parts of an email that are relevant for capturing a
+//task.
+type message struct {
+	Recipients []string
+	Subject    string
+	//Body is the first text/plain part of the message, if any.
+	Body string
+}
+
+//recipientHeaders are the headers that are searched for the capture address.
+//Delivered-To and X-Original-To are added by the MTA on delivery; they are
+//checked first since the capture address may also have been in Bcc.
+var recipientHeaders = []string{"Delivered-To", "X-Original-To", "To", "Cc"}
+
+//maxPartSize limits how much of a single message part is read, since the
+//body ends up in the notes of a task.
+const maxPartSize = 1 << 20
+
+var wordDecoder = &mime.WordDecoder{CharsetReader: charsetReader}
+
+func parseMessage(r io.Reader) (message, error) {
+	msg, err := mail.ReadMessage(r)
+	if err != nil {
+		return message{}, err
+	}
+
+	var result message
+	for _, header := range recipientHeaders {
+		for _, value := range msg.Header[header] {
+			addresses, err := mail.ParseAddressList(value)
+			if err != nil {
+				//Delivered-To and X-Original-To usually contain a bare address
+				addresses = []*mail.Address{{Address: strings.Trim(strings.TrimSpace(value), "<>")}}
+			}
+			for _, addr := range addresses {
+				result.Recipients = append(result.Recipients, addr.Address)
+			}
+		}
+	}
+
+	result.Subject, err = wordDecoder.DecodeHeader(msg.Header.Get("Subject"))
+	if err != nil {
+		result.Subject = msg.Header.Get("Subject")
+	}
+	result.Subject = strings.Join(strings.Fields(result.Subject), " ")
+
+	result.Body, err = findPlainText(msg.Header, msg.Body)
+	if err != nil {
+		return message{}, err
+	}
+	return result, nil
+}
+
+//header is the common interface of mail.Header and textproto.MIMEHeader.
+type header interface {
+	Get(key string) string
+}
+
+//findPlainText returns the decoded content of the first text/plain part
+//(which may be the message itself), or "" if there is none.
+func findPlainText(h header, body io.Reader) (string, error) {
+	contentType := h.Get("Content-Type")
+	if contentType == "" {
+		contentType = "text/plain"
+	}
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		//RFC 2045 says to treat malformed Content-Types like text/plain, but
+		//the body might as well be garbage
+		return "", nil
+	}
+
+	if strings.HasPrefix(mediaType, "multipart/") {
+		reader := multipart.NewReader(body, params["boundary"])
+		for {
+			part, err := reader.NextPart()
+			if err == io.EOF {
+				return "", nil
+			}
+			if err != nil {
+				return "", fmt.Errorf("malformed multipart body: %s", err.Error())
+			}
+			text, err := findPlainText(part.Header, part)
+			if err != nil || text != "" {
+				return text, err
+			}
+		}
+	}
+
+	isAttachment := strings.HasPrefix(strings.ToLower(h.Get("Content-Disposition")), "attachment")
+	if mediaType != "text/plain" || isAttachment {
+		return "", nil
+	}
+
+	switch strings.ToLower(h.Get("Content-Transfer-Encoding")) {
+	case "quoted-printable":
+		body = quotedprintable.NewReader(body)
+	case "base64":
+		body = base64.NewDecoder(base64.StdEncoding, newlineStripper{body})
+	}
+	buf, err := ioutil.ReadAll(io.LimitReader(body, maxPartSize))
+	if err != nil {
+		return "", fmt.Errorf("malformed message body: %s", err.Error())
+	}
+	return cleanupBody(decodeCharset(params["charset"], buf)), nil
+}
+
+//newlineStripper removes line breaks from base64-encoded content, which
+//base64.NewDecoder does not accept.
+type newlineStripper struct {
+	r io.Reader
+}
+
+func (n newlineStripper) Read(buf []byte) (int, error) {
+	count, err := n.r.Read(buf)
+	return copy(buf, bytes.Map(func(r rune) rune {
+		if r == '\r' || r == '\n' {
+			return -1
+		}
+		return r
+	}, buf[:count])), err
+}
+
+func charsetReader(charset string, input io.Reader) (io.Reader, error) {
+	buf, err := ioutil.ReadAll(input)
+	if err != nil {
+		return nil, err
+	}
+	return strings.NewReader(decodeCharset(charset, buf)), nil
+}
+
+//decodeCharset converts text into UTF-8. Only ISO-8859-1 is converted
+//explicitly, so that we do not need a dependency for this. For all other
+//charsets, the text is assumed to be UTF-8 (or ASCII), and invalid byte
+//sequences are replaced. A garbled character in the notes is still better
+//than losing the task.
+func decodeCharset(charset string, buf []byte) string {
+	switch strings.ToLower(charset) {
+	case "iso-8859-1", "latin1":
+		runes := make([]rune, len(buf))
+		for idx, b := range buf {
+			runes[idx] = rune(b)
+		}
+		return string(runes)
+	default:
+		return strings.ToValidUTF8(string(buf), "\uFFFD")
+	}
+}
+
+//signatureRx matches the signature delimiter ("-- " on a line of its own).
+var signatureRx = regexp.MustCompile(`(?m)^-- $`)
+
+//cleanupBody removes the signature and surrounding whitespace from a message
+//body.
+func cleanupBody(text string) string {
+	text = strings.Replace(text, "\r\n", "\n", -1)
+	if loc := signatureRx.FindStringIndex(text); loc != nil {
+		text = text[:loc[0]]
+	}
+	return strings.TrimSpace(text)
+}
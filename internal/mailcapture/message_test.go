@@ -0,0 +1,189 @@
+/*******************************************************************************
+*
+* Copyright 2019 Stefan Majewsky <majewsky@gmx.net>
+*
+* This program is free software: you can redistribute it and/or modify it under
+* the terms of the GNU General Public License as published by the Free Software
+* Foundation, either version 3 of the License, or (at your option) any later
+* version.
+*
+* This program is distributed in the hope that it will be useful, but WITHOUT ANY
+* WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+* A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License along with
+* this program. If not, see <http://www.gnu.org/licenses/>.
+*
+*******************************************************************************/
+
+package mailcapture
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func makeMessage(lines ...string) string {
+	return strings.Join(lines, "\r\n") + "\r\n"
+}
+
+func TestParseMessage(t *testing.T) {
+	testCases := []struct {
+		Description string
+		Input       string
+		Expected    message
+	}{
+		{
+			Description: "plain text with signature",
+			Input: makeMessage(
+				"From: Alice <alice@example.org>",
+				"To: Tasks <tasks+alltag_abc@example.org>",
+				"Cc: bob@example.org, Carol <carol@example.org>",
+				"Subject:   Buy",
+				"  milk  ",
+				"",
+				"Two liters, please.",
+				"",
+				"-- ",
+				"Alice",
+			),
+			Expected: message{
+				Recipients: []string{"tasks+alltag_abc@example.org", "bob@example.org", "carol@example.org"},
+				Subject:    "Buy milk",
+				Body:       "Two liters, please.",
+			},
+		},
+		{
+			Description: "recipients added by the MTA come first",
+			Input: makeMessage(
+				"To: alice@example.org",
+				"Delivered-To: tasks+alltag_abc@example.org",
+				"X-Original-To: <tasks+alltag_def@example.org>",
+				"Subject: Bcc",
+				"",
+				"",
+			),
+			Expected: message{
+				Recipients: []string{"tasks+alltag_abc@example.org", "tasks+alltag_def@example.org", "alice@example.org"},
+				Subject:    "Bcc",
+			},
+		},
+		{
+			Description: "ISO-8859-1 with quoted-printable",
+			Input: makeMessage(
+				"To: tasks+alltag_abc@example.org",
+				"Subject: =?ISO-8859-1?Q?Gr=FC=DFe?= aus =?UTF-8?B?S8O2bG4=?=",
+				"MIME-Version: 1.0",
+				"Content-Type: text/plain; charset=ISO-8859-1",
+				"Content-Transfer-Encoding: quoted-printable",
+				"",
+				"Sch=F6ne Gr=FC=DFe an alle, die diese sehr lange Zeile lesen, die umbrochen=",
+				" wurde.",
+			),
+			Expected: message{
+				Recipients: []string{"tasks+alltag_abc@example.org"},
+				Subject:    "Grüße aus Köln",
+				Body:       "Schöne Grüße an alle, die diese sehr lange Zeile lesen, die umbrochen wurde.",
+			},
+		},
+		{
+			Description: "invalid UTF-8 is replaced",
+			Input: makeMessage(
+				"To: tasks+alltag_abc@example.org",
+				"Content-Type: text/plain; charset=utf-8",
+				"",
+				"caf\xe9",
+			),
+			Expected: message{
+				Recipients: []string{"tasks+alltag_abc@example.org"},
+				Body:       "caf�",
+			},
+		},
+		{
+			Description: "nested multipart with HTML and attachment",
+			Input: makeMessage(
+				"To: tasks+alltag_abc@example.org",
+				"Subject: Fwd: Invoice",
+				"MIME-Version: 1.0",
+				`Content-Type: multipart/mixed; boundary="outer"`,
+				"",
+				"--outer",
+				"Content-Type: text/plain; charset=utf-8",
+				"Content-Disposition: attachment; filename=notes.txt",
+				"",
+				"this is an attachment",
+				"--outer",
+				`Content-Type: multipart/alternative; boundary="inner"`,
+				"",
+				"--inner",
+				"Content-Type: text/html; charset=utf-8",
+				"",
+				"<p>Please pay the invoice.</p>",
+				"--inner",
+				"Content-Type: text/plain; charset=utf-8",
+				"Content-Transfer-Encoding: base64",
+				"",
+				"UGxlYXNlIHBheSB0aGUg",
+				"aW52b2ljZS4=",
+				"--inner--",
+				"--outer--",
+			),
+			Expected: message{
+				Recipients: []string{"tasks+alltag_abc@example.org"},
+				Subject:    "Fwd: Invoice",
+				Body:       "Please pay the invoice.",
+			},
+		},
+		{
+			Description: "multipart without plain text",
+			Input: makeMessage(
+				"To: tasks+alltag_abc@example.org",
+				"Subject: HTML only",
+				`Content-Type: multipart/alternative; boundary="b"`,
+				"",
+				"--b",
+				"Content-Type: text/html",
+				"",
+				"<p>Hello</p>",
+				"--b--",
+			),
+			Expected: message{
+				Recipients: []string{"tasks+alltag_abc@example.org"},
+				Subject:    "HTML only",
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		actual, err := parseMessage(strings.NewReader(tc.Input))
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", tc.Description, err.Error())
+			continue
+		}
+		if !reflect.DeepEqual(actual, tc.Expected) {
+			t.Errorf("%s: expected %#v, but got %#v", tc.Description, tc.Expected, actual)
+		}
+	}
+}
+
+func TestParseMessageErrors(t *testing.T) {
+	for _, input := range []string{
+		"this is not a message",
+		makeMessage(
+			"Subject: Broken",
+			`Content-Type: multipart/mixed; boundary="b"`,
+			"",
+			"--b",
+			"Content-Type text/plain",
+			"",
+			"missing colon in the part header",
+			"--b--",
+		),
+	} {
+		_, err := parseMessage(strings.NewReader(input))
+		if err == nil {
+			t.Errorf("expected error when parsing %q, but got none", input)
+		}
+	}
+}
@@ -0,0 +1,115 @@
+/*******************************************************************************
+*
+* Copyright 2019 Stefan Majewsky <majewsky@gmx.net>
+*
+* This program is free software: you can redistribute it and/or modify it under
+* the terms of the GNU General Public License as published by the Free Software
+* Foundation, either version 3 of the License, or (at your option) any later
+* version.
+*
+* This program is distributed in the hope that it will be useful, but WITHOUT ANY
+* WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+* A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License along with
+* this program. If not, see <http://www.gnu.org/licenses/>.
+*
+*******************************************************************************/
+
+package metrics
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+var (
+	//HTTPRequests counts the HTTP requests handled by the routers for the UI,
+	//the API and CalDAV.
+	HTTPRequests = NewCounterVec("alltag_http_requests_total",
+		"Number of HTTP requests, by route, method and status code.",
+		"route", "method", "code")
+	//HTTPRequestDuration measures the time that those routers take to answer.
+	HTTPRequestDuration = NewHistogramVec("alltag_http_request_duration_seconds",
+		"Time taken to answer HTTP requests, by route and method.",
+		DurationBuckets, "route", "method")
+
+	//AuthAttempts counts logins (and other ways of authenticating) by the auth
+	//driver that checked them and by their result, which is one of "success",
+	//"failure", "forbidden", "throttled" or "error".
+	AuthAttempts = NewCounterVec("alltag_auth_attempts_total",
+		"Number of authentication attempts, by auth driver and result.",
+		"driver", "result")
+	//LDAPRequestDuration measures the round-trip times of requests to the LDAP
+	//server.
+	LDAPRequestDuration = NewHistogramVec("alltag_ldap_request_duration_seconds",
+		"Round-trip time of LDAP requests, by operation.",
+		DurationBuckets, "operation")
+
+	//DBQueryDuration measures the time taken by database queries. The
+	//operation is the first keyword of the SQL statement (e.g. "select").
+	DBQueryDuration = NewHistogramVec("alltag_db_query_duration_seconds",
+		"Time taken by database queries, by type of statement.",
+		DurationBuckets, "operation")
+
+	//OpenTasks, UnclassifiedTasks and OverdueTasks are computed from the
+	//database before each scrape.
+	OpenTasks = NewGaugeVec("alltag_open_tasks",
+		"Number of open tasks, by user.",
+		"user")
+	//UnclassifiedTasks is the part of OpenTasks that has not been classified yet.
+	UnclassifiedTasks = NewGaugeVec("alltag_unclassified_tasks",
+		"Number of open tasks that have not been classified yet, by user.",
+		"user")
+	//OverdueTasks is the part of OpenTasks whose due date has passed.
+	OverdueTasks = NewGaugeVec("alltag_overdue_tasks",
+		"Number of open tasks whose due date has passed, by user.",
+		"user")
+)
+
+//ObserveDuration adds the time elapsed since `start` (in seconds) to the
+//given histogram.
+func ObserveDuration(h *HistogramVec, start time.Time, labelValues ...string) {
+	h.Observe(time.Since(start).Seconds(), labelValues...)
+}
+
+//InstrumentRoutes is a mux.MiddlewareFunc that records HTTPRequests and
+//HTTPRequestDuration. Requests are identified by the path template of the
+//matching route (e.g. "/tasks/{id}") rather than the actual path, to keep the
+//number of label values bounded and to keep secrets in paths (like the token
+//of the calendar feed) out of the metrics.
+func InstrumentRoutes(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route := "unknown"
+		if current := mux.CurrentRoute(r); current != nil {
+			if tmpl, err := current.GetPathTemplate(); err == nil {
+				route = tmpl
+			}
+		}
+
+		start := time.Now()
+		sw := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(sw, r)
+		HTTPRequests.Inc(route, r.Method, strconv.Itoa(sw.status))
+		ObserveDuration(HTTPRequestDuration, start, route, r.Method)
+	})
+}
+
+//statusRecorder is a http.ResponseWriter that remembers the status code.
+type statusRecorder struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+}
+
+//WriteHeader implements the http.ResponseWriter interface.
+func (s *statusRecorder) WriteHeader(status int) {
+	if !s.wroteHeader {
+		s.status = status
+		s.wroteHeader = true
+	}
+	s.ResponseWriter.WriteHeader(status)
+}
@@ -0,0 +1,314 @@
+/*******************************************************************************
+*
+* Copyright 2019 Stefan Majewsky <majewsky@gmx.net>
+*
+* This program is free software: you can redistribute it and/or modify it under
+* the terms of the GNU General Public License as published by the Free Software
+* Foundation, either version 3 of the License, or (at your option) any later
+* version.
+*
+* This program is distributed in the hope that it will be useful, but WITHOUT ANY
+* WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+* A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License along with
+* this program. If not, see <http://www.gnu.org/licenses/>.
+*
+*******************************************************************************/
+
+//Package metrics contains a minimal implementation of Prometheus metrics
+//(counters, gauges and histograms with labels) and of the text exposition
+//format, as well as the definitions of all metrics exported by Alltag. The
+//metrics are defined in alltag.go.
+package metrics
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/sapcc/go-bits/logg"
+)
+
+//metric is implemented by CounterVec, GaugeVec and HistogramVec.
+type metric interface {
+	writeTo(buf *bytes.Buffer)
+}
+
+//registry contains all metrics in the order in which they were defined.
+var registry []metric
+
+//desc contains the parts that are common to all metric types.
+type desc struct {
+	name       string
+	help       string
+	typeName   string
+	labelNames []string
+}
+
+func (d desc) writeHeader(buf *bytes.Buffer) {
+	fmt.Fprintf(buf, "# HELP %s %s\n", d.name, strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(d.help))
+	fmt.Fprintf(buf, "# TYPE %s %s\n", d.name, d.typeName)
+}
+
+//seriesKey joins label values into a map key. The key must be reversible
+//since the label values are recovered from it when writing the exposition.
+func (d desc) seriesKey(labelValues []string) string {
+	if len(labelValues) != len(d.labelNames) {
+		panic(fmt.Sprintf("metric %s expects %d label values, got %d", d.name, len(d.labelNames), len(labelValues)))
+	}
+	return strings.Join(labelValues, "\x00")
+}
+
+//formatLabels renders the label set for the given series key, plus the given
+//extra label pairs (used for the "le" label of histogram buckets).
+func (d desc) formatLabels(key string, extra ...string) string {
+	var pairs []string
+	if len(d.labelNames) > 0 {
+		for idx, value := range strings.Split(key, "\x00") {
+			pairs = append(pairs, d.labelNames[idx]+`="`+escapeLabelValue(value)+`"`)
+		}
+	}
+	for idx := 0; idx+1 < len(extra); idx += 2 {
+		pairs = append(pairs, extra[idx]+`="`+escapeLabelValue(extra[idx+1])+`"`)
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabelValue(value string) string {
+	return labelValueEscaper.Replace(value)
+}
+
+func formatValue(value float64) string {
+	switch {
+	case math.IsInf(value, +1):
+		return "+Inf"
+	case math.IsInf(value, -1):
+		return "-Inf"
+	case math.IsNaN(value):
+		return "NaN"
+	default:
+		return strconv.FormatFloat(value, 'g', -1, 64)
+	}
+}
+
+func sortedKeys(values map[string]float64) []string {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// counters and gauges
+
+//CounterVec is a set of counters with the same name, which are distinguished
+//by their label values.
+type CounterVec struct {
+	desc
+	mutex  sync.Mutex
+	values map[string]float64
+}
+
+//NewCounterVec defines a new counter metric.
+func NewCounterVec(name, help string, labelNames ...string) *CounterVec {
+	c := &CounterVec{
+		desc:   desc{name, help, "counter", labelNames},
+		values: make(map[string]float64),
+	}
+	registry = append(registry, c)
+	return c
+}
+
+//Inc increments the counter with the given label values by one.
+func (c *CounterVec) Inc(labelValues ...string) {
+	key := c.seriesKey(labelValues)
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.values[key]++
+}
+
+func (c *CounterVec) writeTo(buf *bytes.Buffer) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.writeHeader(buf)
+	for _, key := range sortedKeys(c.values) {
+		fmt.Fprintf(buf, "%s%s %s\n", c.name, c.formatLabels(key), formatValue(c.values[key]))
+	}
+}
+
+//GaugeVec is a set of gauges with the same name, which are distinguished by
+//their label values.
+type GaugeVec struct {
+	desc
+	mutex  sync.Mutex
+	values map[string]float64
+}
+
+//NewGaugeVec defines a new gauge metric.
+func NewGaugeVec(name, help string, labelNames ...string) *GaugeVec {
+	g := &GaugeVec{
+		desc:   desc{name, help, "gauge", labelNames},
+		values: make(map[string]float64),
+	}
+	registry = append(registry, g)
+	return g
+}
+
+//Set sets the gauge with the given label values.
+func (g *GaugeVec) Set(value float64, labelValues ...string) {
+	key := g.seriesKey(labelValues)
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	g.values[key] = value
+}
+
+//Reset removes all label values from this gauge. This is used when the gauges
+//are computed from scratch, so that label values that disappeared (e.g. users
+//that do not have any tasks anymore) do not linger around.
+func (g *GaugeVec) Reset() {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	g.values = make(map[string]float64)
+}
+
+func (g *GaugeVec) writeTo(buf *bytes.Buffer) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	g.writeHeader(buf)
+	for _, key := range sortedKeys(g.values) {
+		fmt.Fprintf(buf, "%s%s %s\n", g.name, g.formatLabels(key), formatValue(g.values[key]))
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// histograms
+
+//HistogramVec is a set of histograms with the same name and buckets, which
+//are distinguished by their label values.
+type HistogramVec struct {
+	desc
+	buckets []float64 //upper bounds, in ascending order, without +Inf
+	mutex   sync.Mutex
+	series  map[string]*histogramSeries
+}
+
+type histogramSeries struct {
+	counts []uint64 //same length as HistogramVec.buckets, not cumulative
+	count  uint64
+	sum    float64
+}
+
+//DurationBuckets are the default buckets for histograms that measure
+//durations in seconds, like in the official Prometheus client libraries.
+var DurationBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+//NewHistogramVec defines a new histogram metric with the given bucket upper
+//bounds, which must be sorted in ascending order.
+func NewHistogramVec(name, help string, buckets []float64, labelNames ...string) *HistogramVec {
+	h := &HistogramVec{
+		desc:    desc{name, help, "histogram", labelNames},
+		buckets: buckets,
+		series:  make(map[string]*histogramSeries),
+	}
+	registry = append(registry, h)
+	return h
+}
+
+//Observe adds a value to the histogram with the given label values.
+func (h *HistogramVec) Observe(value float64, labelValues ...string) {
+	key := h.seriesKey(labelValues)
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	s, exists := h.series[key]
+	if !exists {
+		s = &histogramSeries{counts: make([]uint64, len(h.buckets))}
+		h.series[key] = s
+	}
+	idx := sort.SearchFloat64s(h.buckets, value)
+	if idx < len(h.buckets) {
+		s.counts[idx]++
+	}
+	s.count++
+	s.sum += value
+}
+
+func (h *HistogramVec) writeTo(buf *bytes.Buffer) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.writeHeader(buf)
+
+	keys := make([]string, 0, len(h.series))
+	for key := range h.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		s := h.series[key]
+		var cumulative uint64
+		for idx, bound := range h.buckets {
+			cumulative += s.counts[idx]
+			fmt.Fprintf(buf, "%s_bucket%s %d\n", h.name, h.formatLabels(key, "le", formatValue(bound)), cumulative)
+		}
+		fmt.Fprintf(buf, "%s_bucket%s %d\n", h.name, h.formatLabels(key, "le", "+Inf"), s.count)
+		fmt.Fprintf(buf, "%s_sum%s %s\n", h.name, h.formatLabels(key), formatValue(s.sum))
+		fmt.Fprintf(buf, "%s_count%s %d\n", h.name, h.formatLabels(key), s.count)
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// exposition
+
+//NewHandler returns a http.Handler that serves all metrics in the Prometheus
+//text exposition format. Requests must carry the given token as
+//"Authorization: Bearer <token>". Before each scrape, the refresh callback is
+//called to update metrics that are computed on demand (e.g. from the database).
+func NewHandler(token string, refresh func() error) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" && r.Method != "HEAD" {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		authHeader := r.Header.Get("Authorization")
+		givenToken := strings.TrimPrefix(authHeader, "Bearer ")
+		if givenToken == authHeader || subtle.ConstantTimeCompare([]byte(givenToken), []byte(token)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="Alltag metrics"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		//when the refresh fails, the other metrics are still useful, so we only
+		//log the error instead of failing the whole scrape
+		if refresh != nil {
+			err := refresh()
+			if err != nil {
+				logg.Error("cannot refresh metrics: %s", err.Error())
+			}
+		}
+
+		var buf bytes.Buffer
+		for _, m := range registry {
+			m.writeTo(&buf)
+		}
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		w.Header().Set("Content-Length", strconv.Itoa(buf.Len()))
+		w.WriteHeader(http.StatusOK)
+		if r.Method != "HEAD" {
+			w.Write(buf.Bytes())
+		}
+	})
+}
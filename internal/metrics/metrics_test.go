@@ -0,0 +1,163 @@
+/*******************************************************************************
+*
+* Copyright 2019 Stefan Majewsky <majewsky@gmx.net>
+*
+* This program is free software: you can redistribute it and/or modify it under
+* the terms of the GNU General Public License as published by the Free Software
+* Foundation, either version 3 of the License, or (at your option) any later
+* version.
+*
+* This program is distributed in the hope that it will be useful, but WITHOUT ANY
+* WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+* A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License along with
+* this program. If not, see <http://www.gnu.org/licenses/>.
+*
+*******************************************************************************/
+
+package metrics
+
+import (
+	"bytes"
+	"errors"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func expectExposition(t *testing.T, m metric, expected string) {
+	t.Helper()
+	var buf bytes.Buffer
+	m.writeTo(&buf)
+	if buf.String() != expected {
+		t.Errorf("expected exposition:\n%s\nactual exposition:\n%s", expected, buf.String())
+	}
+}
+
+func TestCounterVec(t *testing.T) {
+	c := NewCounterVec("test_counter_total", "Help with \\ and\nnewline.", "route", "code")
+	expectExposition(t, c, "# HELP test_counter_total Help with \\\\ and\\nnewline.\n# TYPE test_counter_total counter\n")
+
+	c.Inc("/tasks", "200")
+	c.Inc("/tasks", "200")
+	c.Inc(`/a "quoted\path"`+"\n", "404")
+	expectExposition(t, c, `# HELP test_counter_total Help with \\ and\nnewline.
+# TYPE test_counter_total counter
+test_counter_total{route="/a \"quoted\\path\"\n",code="404"} 1
+test_counter_total{route="/tasks",code="200"} 2
+`)
+}
+
+func TestGaugeVec(t *testing.T) {
+	g := NewGaugeVec("test_gauge", "Help.", "user")
+	g.Set(3, "bob")
+	g.Set(1.5, "alice")
+	g.Set(4, "bob")
+	expectExposition(t, g, `# HELP test_gauge Help.
+# TYPE test_gauge gauge
+test_gauge{user="alice"} 1.5
+test_gauge{user="bob"} 4
+`)
+
+	g.Reset()
+	g.Set(1, "carol")
+	expectExposition(t, g, `# HELP test_gauge Help.
+# TYPE test_gauge gauge
+test_gauge{user="carol"} 1
+`)
+
+	unlabeled := NewGaugeVec("test_unlabeled_gauge", "Help.")
+	unlabeled.Set(1e21)
+	expectExposition(t, unlabeled, `# HELP test_unlabeled_gauge Help.
+# TYPE test_unlabeled_gauge gauge
+test_unlabeled_gauge 1e+21
+`)
+}
+
+func TestHistogramVec(t *testing.T) {
+	h := NewHistogramVec("test_duration_seconds", "Help.", []float64{0.1, 1}, "operation")
+	h.Observe(0.05, "select")
+	h.Observe(0.1, "select") //bucket bounds are inclusive
+	h.Observe(0.5, "select")
+	h.Observe(7, "select")
+	h.Observe(0.5, "insert")
+	expectExposition(t, h, `# HELP test_duration_seconds Help.
+# TYPE test_duration_seconds histogram
+test_duration_seconds_bucket{operation="insert",le="0.1"} 0
+test_duration_seconds_bucket{operation="insert",le="1"} 1
+test_duration_seconds_bucket{operation="insert",le="+Inf"} 1
+test_duration_seconds_sum{operation="insert"} 0.5
+test_duration_seconds_count{operation="insert"} 1
+test_duration_seconds_bucket{operation="select",le="0.1"} 2
+test_duration_seconds_bucket{operation="select",le="1"} 3
+test_duration_seconds_bucket{operation="select",le="+Inf"} 4
+test_duration_seconds_sum{operation="select"} 7.65
+test_duration_seconds_count{operation="select"} 4
+`)
+}
+
+func TestWrongNumberOfLabelValues(t *testing.T) {
+	c := NewCounterVec("test_wrong_labels_total", "Help.", "route")
+	defer func() {
+		if recover() == nil {
+			t.Error("expected Inc() with wrong number of label values to panic")
+		}
+	}()
+	c.Inc("/tasks", "200")
+}
+
+func TestHandler(t *testing.T) {
+	NewGaugeVec("test_handler_gauge", "Help.").Set(42)
+	refreshCalls := 0
+	handler := NewHandler("secret", func() error {
+		refreshCalls++
+		return errors.New("refresh failed")
+	})
+
+	testCases := []struct {
+		Method         string
+		Authorization  string
+		ExpectedStatus int
+		ExpectedBody   string
+	}{
+		{"GET", "", 401, "Unauthorized\n"},
+		{"GET", "secret", 401, "Unauthorized\n"},
+		{"GET", "Bearer wrong", 401, "Unauthorized\n"},
+		{"GET", "Bearer secretsecret", 401, "Unauthorized\n"},
+		{"POST", "Bearer secret", 405, "Method not allowed\n"},
+		{"GET", "Bearer secret", 200, "test_handler_gauge 42\n"},
+		{"HEAD", "Bearer secret", 200, ""},
+	}
+	for _, tc := range testCases {
+		req := httptest.NewRequest(tc.Method, "/metrics", nil)
+		if tc.Authorization != "" {
+			req.Header.Set("Authorization", tc.Authorization)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+
+		if rec.Code != tc.ExpectedStatus {
+			t.Errorf("%s with %q: expected status %d, got %d", tc.Method, tc.Authorization, tc.ExpectedStatus, rec.Code)
+		}
+		body := rec.Body.String()
+		if tc.ExpectedBody == "" && body != "" {
+			t.Errorf("%s with %q: expected empty body, got %q", tc.Method, tc.Authorization, body)
+		}
+		if !strings.Contains(body, tc.ExpectedBody) {
+			t.Errorf("%s with %q: expected body to contain %q, got %q", tc.Method, tc.Authorization, tc.ExpectedBody, body)
+		}
+		if tc.ExpectedStatus == 200 {
+			contentType := rec.Header().Get("Content-Type")
+			if !strings.HasPrefix(contentType, "text/plain; version=0.0.4") {
+				t.Errorf("%s: unexpected Content-Type %q", tc.Method, contentType)
+			}
+		}
+	}
+
+	//a failing refresh does not fail the scrape (see above), but it only runs
+	//for authorized GET and HEAD requests
+	if refreshCalls != 2 {
+		t.Errorf("expected 2 calls to refresh, got %d", refreshCalls)
+	}
+}
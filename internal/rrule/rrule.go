@@ -0,0 +1,436 @@
+/*******************************************************************************
+*
+* Copyright 2019 Stefan Majewsky <majewsky@gmx.net>
+*
+* This program is free software: you can redistribute it and/or modify it under
+* the terms of the GNU General Public License as published by the Free Software
+* Foundation, either version 3 of the License, or (at your option) any later
+* version.
+*
+* This program is distributed in the hope that it will be useful, but WITHOUT ANY
+* WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+* A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License along with
+* this program. If not, see <http://www.gnu.org/licenses/>.
+*
+*******************************************************************************/
+
+//Package rrule implements the subset of recurrence rules (RRULE) from RFC 5545
+//that is useful for recurring tasks. Supported are the frequencies DAILY,
+//WEEKLY, MONTHLY and YEARLY, combined with INTERVAL, BYMONTH, BYMONTHDAY and
+//BYDAY. Ordinals in BYDAY (e.g. "1MO" for the first Monday) are only
+//supported for FREQ=MONTHLY. Weeks always start on Monday.
+package rrule
+
+import (
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/majewsky/alltag/internal/date"
+)
+
+//Frequency is an enum that appears in type Rule.
+type Frequency string
+
+const (
+	//Daily is the Frequency value "DAILY".
+	Daily Frequency = "DAILY"
+	//Weekly is the Frequency value "WEEKLY".
+	Weekly Frequency = "WEEKLY"
+	//Monthly is the Frequency value "MONTHLY".
+	Monthly Frequency = "MONTHLY"
+	//Yearly is the Frequency value "YEARLY".
+	Yearly Frequency = "YEARLY"
+)
+
+var isFrequency = map[Frequency]bool{
+	Daily:   true,
+	Weekly:  true,
+	Monthly: true,
+	Yearly:  true,
+}
+
+//WeekdayNum is an entry in the BYDAY part of a Rule. If Ordinal is not 0, it
+//refers to the n-th weekday of this kind in the month (counting from the end
+//of the month if negative), e.g. {Ordinal: -1, Weekday: time.Friday} is the
+//last Friday of the month.
+type WeekdayNum struct {
+	Ordinal int
+	Weekday time.Weekday
+}
+
+var weekdayNames = []string{"SU", "MO", "TU", "WE", "TH", "FR", "SA"}
+
+//String returns the RFC 5545 representation of this WeekdayNum, e.g. "-1FR".
+func (wn WeekdayNum) String() string {
+	if wn.Ordinal == 0 {
+		return weekdayNames[wn.Weekday]
+	}
+	return strconv.Itoa(wn.Ordinal) + weekdayNames[wn.Weekday]
+}
+
+//Rule is a parsed recurrence rule.
+type Rule struct {
+	Frequency  Frequency
+	Interval   int //always at least 1
+	ByMonth    []time.Month
+	ByMonthDay []int
+	ByDay      []WeekdayNum
+}
+
+//Parse parses a recurrence rule like "FREQ=WEEKLY;BYDAY=MO,TH". A leading
+//"RRULE:" is accepted and ignored.
+func Parse(input string) (Rule, error) {
+	input = strings.TrimPrefix(strings.ToUpper(strings.TrimSpace(input)), "RRULE:")
+	if input == "" {
+		return Rule{}, errors.New("empty recurrence rule")
+	}
+
+	r := Rule{Interval: 1}
+	seen := make(map[string]bool)
+	for _, part := range strings.Split(input, ";") {
+		fields := strings.SplitN(part, "=", 2)
+		if len(fields) != 2 || fields[1] == "" {
+			return Rule{}, fmt.Errorf("malformed recurrence rule part: %q", part)
+		}
+		key, value := fields[0], fields[1]
+		if seen[key] {
+			return Rule{}, fmt.Errorf("duplicate recurrence rule part: %s", key)
+		}
+		seen[key] = true
+
+		var err error
+		switch key {
+		case "FREQ":
+			r.Frequency = Frequency(value)
+			if !isFrequency[r.Frequency] {
+				err = errors.New("unsupported value")
+			}
+		case "INTERVAL":
+			r.Interval, err = parseInt(value, 1, 1000)
+		case "BYMONTH":
+			for _, v := range strings.Split(value, ",") {
+				month, err := parseInt(v, 1, 12)
+				if err != nil {
+					return Rule{}, fmt.Errorf("invalid value for %s: %q", key, value)
+				}
+				r.ByMonth = append(r.ByMonth, time.Month(month))
+			}
+		case "BYMONTHDAY":
+			for _, v := range strings.Split(value, ",") {
+				day, err := parseInt(v, -31, 31)
+				if err != nil || day == 0 {
+					return Rule{}, fmt.Errorf("invalid value for %s: %q", key, value)
+				}
+				r.ByMonthDay = append(r.ByMonthDay, day)
+			}
+		case "BYDAY":
+			for _, v := range strings.Split(value, ",") {
+				wn, err := parseWeekdayNum(v)
+				if err != nil {
+					return Rule{}, fmt.Errorf("invalid value for %s: %q", key, value)
+				}
+				r.ByDay = append(r.ByDay, wn)
+			}
+		default:
+			return Rule{}, fmt.Errorf("unsupported recurrence rule part: %s", key)
+		}
+		if err != nil {
+			return Rule{}, fmt.Errorf("invalid value for %s: %q", key, value)
+		}
+	}
+
+	if r.Frequency == "" {
+		return Rule{}, errors.New("recurrence rule is missing FREQ")
+	}
+	if r.Frequency == Weekly && len(r.ByMonthDay) > 0 {
+		return Rule{}, errors.New("BYMONTHDAY cannot be used with FREQ=WEEKLY")
+	}
+	if r.Frequency != Monthly {
+		for _, wn := range r.ByDay {
+			if wn.Ordinal != 0 {
+				return Rule{}, fmt.Errorf("BYDAY=%s is only supported with FREQ=MONTHLY", wn)
+			}
+		}
+	}
+	return r, nil
+}
+
+func parseInt(input string, min, max int) (int, error) {
+	val, err := strconv.Atoi(input)
+	if err == nil && (val < min || val > max) {
+		err = errors.New("out of range")
+	}
+	return val, err
+}
+
+func parseWeekdayNum(input string) (WeekdayNum, error) {
+	if len(input) < 2 {
+		return WeekdayNum{}, errors.New("too short")
+	}
+	name := input[len(input)-2:]
+	for idx, weekdayName := range weekdayNames {
+		if name != weekdayName {
+			continue
+		}
+		wn := WeekdayNum{Weekday: time.Weekday(idx)}
+		if len(input) > 2 {
+			var err error
+			wn.Ordinal, err = parseInt(strings.TrimPrefix(input[:len(input)-2], "+"), -5, 5)
+			if err != nil || wn.Ordinal == 0 {
+				return WeekdayNum{}, errors.New("invalid ordinal")
+			}
+		}
+		return wn, nil
+	}
+	return WeekdayNum{}, errors.New("unknown weekday")
+}
+
+//String returns the canonical representation of this Rule, which can be
+//given to Parse to obtain the same Rule again.
+func (r Rule) String() string {
+	parts := []string{"FREQ=" + string(r.Frequency)}
+	if r.Interval > 1 {
+		parts = append(parts, "INTERVAL="+strconv.Itoa(r.Interval))
+	}
+	if len(r.ByMonth) > 0 {
+		values := make([]string, len(r.ByMonth))
+		for idx, month := range r.ByMonth {
+			values[idx] = strconv.Itoa(int(month))
+		}
+		parts = append(parts, "BYMONTH="+strings.Join(values, ","))
+	}
+	if len(r.ByMonthDay) > 0 {
+		values := make([]string, len(r.ByMonthDay))
+		for idx, day := range r.ByMonthDay {
+			values[idx] = strconv.Itoa(day)
+		}
+		parts = append(parts, "BYMONTHDAY="+strings.Join(values, ","))
+	}
+	if len(r.ByDay) > 0 {
+		values := make([]string, len(r.ByDay))
+		for idx, wn := range r.ByDay {
+			values[idx] = wn.String()
+		}
+		parts = append(parts, "BYDAY="+strings.Join(values, ","))
+	}
+	return strings.Join(parts, ";")
+}
+
+//searchYears limits the search in Next. Even the sparsest rules that can be
+//satisfied at all (e.g. February 29 on a Monday) recur within this many years.
+const searchYears = 50
+
+//Next returns the first occurrence of this rule after the given date. The
+//series of occurrences is anchored at `start` (DTSTART in RFC 5545 terms),
+//which is relevant when the rule does not fully specify the occurrences (e.g.
+//FREQ=MONTHLY without BYMONTHDAY recurs on the same day of the month as the
+//start date), or when the interval is larger than 1. If the rule never
+//matches after the given date, false is returned.
+func (r Rule) Next(start, after date.Date) (date.Date, bool) {
+	interval := r.Interval
+	if interval < 1 {
+		interval = 1
+	}
+	startTime := start.FirstSecondIn(time.UTC)
+	afterTime := after.FirstSecondIn(time.UTC)
+
+	//skip the periods that end before `after`
+	var firstPeriod, periodsPerYear int
+	switch r.Frequency {
+	case Daily:
+		firstPeriod = after.Sub(start) / interval
+		periodsPerYear = 366
+	case Weekly:
+		weeks := daysBetween(startOfWeek(startTime), startOfWeek(afterTime)) / 7
+		firstPeriod = weeks / interval
+		periodsPerYear = 53
+	case Monthly:
+		months := (afterTime.Year()-startTime.Year())*12 + int(afterTime.Month()-startTime.Month())
+		firstPeriod = months / interval
+		periodsPerYear = 12
+	case Yearly:
+		firstPeriod = (afterTime.Year() - startTime.Year()) / interval
+		periodsPerYear = 1
+	default:
+		return date.Epoch, false
+	}
+	if firstPeriod < 0 {
+		firstPeriod = 0
+	}
+
+	maxPeriods := searchYears*periodsPerYear/interval + 1
+	for period := firstPeriod; period < firstPeriod+maxPeriods; period++ {
+		for _, candidate := range r.occurrencesInPeriod(startTime, period*interval) {
+			if candidate.After(afterTime) && !candidate.Before(startTime) {
+				return date.FromTime(candidate), true
+			}
+		}
+	}
+	return date.Epoch, false
+}
+
+//occurrencesInPeriod returns the occurrences in the period that is `offset`
+//days/weeks/months/years after the period containing the start time, in
+//chronological order.
+func (r Rule) occurrencesInPeriod(startTime time.Time, offset int) []time.Time {
+	var result []time.Time
+	switch r.Frequency {
+	case Daily:
+		day := startTime.AddDate(0, 0, offset)
+		if r.matchesMonth(day.Month()) && r.matchesMonthDay(day) && r.matchesWeekday(day) {
+			result = append(result, day)
+		}
+	case Weekly:
+		weekStart := startOfWeek(startTime).AddDate(0, 0, 7*offset)
+		weekdays := []time.Weekday{startTime.Weekday()}
+		if len(r.ByDay) > 0 {
+			weekdays = weekdays[:0]
+			for _, wn := range r.ByDay {
+				weekdays = append(weekdays, wn.Weekday)
+			}
+		}
+		for _, weekday := range weekdays {
+			day := weekStart.AddDate(0, 0, (int(weekday)+6)%7)
+			if r.matchesMonth(day.Month()) {
+				result = append(result, day)
+			}
+		}
+	case Monthly:
+		monthStart := time.Date(startTime.Year(), startTime.Month()+time.Month(offset), 1, 0, 0, 0, 0, time.UTC)
+		if r.matchesMonth(monthStart.Month()) {
+			result = r.occurrencesInMonth(startTime, monthStart)
+		}
+	case Yearly:
+		year := startTime.Year() + offset
+		months := r.ByMonth
+		if len(months) == 0 {
+			if len(r.ByMonthDay) > 0 || len(r.ByDay) > 0 {
+				months = []time.Month{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12}
+			} else {
+				months = []time.Month{startTime.Month()}
+			}
+		}
+		for _, month := range months {
+			monthStart := time.Date(year, month, 1, 0, 0, 0, 0, time.UTC)
+			result = append(result, r.occurrencesInMonth(startTime, monthStart)...)
+		}
+	}
+
+	sort.Slice(result, func(i, j int) bool { return result[i].Before(result[j]) })
+	return result
+}
+
+//occurrencesInMonth applies BYMONTHDAY and BYDAY to the given month.
+func (r Rule) occurrencesInMonth(startTime, monthStart time.Time) []time.Time {
+	var result []time.Time
+	lastDay := monthStart.AddDate(0, 1, -1).Day()
+	for day := 1; day <= lastDay; day++ {
+		t := monthStart.AddDate(0, 0, day-1)
+		matches := r.matchesMonthDay(t) && r.matchesWeekdayInMonth(t, lastDay)
+		if len(r.ByMonthDay) == 0 && len(r.ByDay) == 0 {
+			matches = day == startTime.Day()
+		}
+		if matches {
+			result = append(result, t)
+		}
+	}
+	return result
+}
+
+func (r Rule) matchesMonth(month time.Month) bool {
+	if len(r.ByMonth) == 0 {
+		return true
+	}
+	for _, m := range r.ByMonth {
+		if m == month {
+			return true
+		}
+	}
+	return false
+}
+
+func (r Rule) matchesMonthDay(t time.Time) bool {
+	if len(r.ByMonthDay) == 0 {
+		return true
+	}
+	lastDay := time.Date(t.Year(), t.Month()+1, 0, 0, 0, 0, 0, time.UTC).Day()
+	for _, day := range r.ByMonthDay {
+		if day == t.Day() || lastDay+1+day == t.Day() {
+			return true
+		}
+	}
+	return false
+}
+
+func (r Rule) matchesWeekday(t time.Time) bool {
+	return r.matchesWeekdayInMonth(t, 0)
+}
+
+//matchesWeekdayInMonth checks BYDAY. Ordinals are only evaluated when the
+//number of days in the month is given.
+func (r Rule) matchesWeekdayInMonth(t time.Time, lastDay int) bool {
+	if len(r.ByDay) == 0 {
+		return true
+	}
+	for _, wn := range r.ByDay {
+		if wn.Weekday != t.Weekday() {
+			continue
+		}
+		switch {
+		case wn.Ordinal == 0 || lastDay == 0:
+			return true
+		case wn.Ordinal > 0 && (t.Day()-1)/7+1 == wn.Ordinal:
+			return true
+		case wn.Ordinal < 0 && (lastDay-t.Day())/7+1 == -wn.Ordinal:
+			return true
+		}
+	}
+	return false
+}
+
+func startOfWeek(t time.Time) time.Time {
+	//weeks start on Monday
+	return t.AddDate(0, 0, -((int(t.Weekday()) + 6) % 7))
+}
+
+func daysBetween(from, to time.Time) int {
+	return int(to.Sub(from).Hours()) / 24
+}
+
+//MarshalText implements the encoding.TextMarshaler interface.
+func (r Rule) MarshalText() ([]byte, error) {
+	return []byte(r.String()), nil
+}
+
+//UnmarshalText implements the encoding.TextUnmarshaler interface.
+func (r *Rule) UnmarshalText(input []byte) error {
+	parsed, err := Parse(string(input))
+	if err == nil {
+		*r = parsed
+	}
+	return err
+}
+
+//Scan implements the database/sql.Scanner interface.
+func (r *Rule) Scan(src interface{}) error {
+	switch src := src.(type) {
+	case string:
+		return r.UnmarshalText([]byte(src))
+	case []byte:
+		return r.UnmarshalText(src)
+	default:
+		return fmt.Errorf("cannot scan %T into rrule.Rule", src)
+	}
+}
+
+//Value implements the database/sql/driver.Valuer interface.
+func (r Rule) Value() (driver.Value, error) {
+	return r.String(), nil
+}
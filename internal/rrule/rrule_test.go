@@ -0,0 +1,148 @@
+/*******************************************************************************
+*
+* Copyright 2019 Stefan Majewsky <majewsky@gmx.net>
+*
+* This program is free software: you can redistribute it and/or modify it under
+* the terms of the GNU General Public License as published by the Free Software
+* Foundation, either version 3 of the License, or (at your option) any later
+* version.
+*
+* This program is distributed in the hope that it will be useful, but WITHOUT ANY
+* WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+* A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License along with
+* this program. If not, see <http://www.gnu.org/licenses/>.
+*
+*******************************************************************************/
+
+package rrule
+
+import (
+	"testing"
+
+	"github.com/majewsky/alltag/internal/date"
+)
+
+func mustParseDate(t *testing.T, input string) date.Date {
+	t.Helper()
+	d, err := date.Parse(input)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	return d
+}
+
+func TestNext(t *testing.T) {
+	testCases := []struct {
+		Rule     string
+		Start    string
+		After    string
+		Expected string //empty if the rule never matches
+	}{
+		//without BY* parts, the start date determines the occurrences
+		{"FREQ=DAILY", "2019-11-01", "2019-11-20", "2019-11-21"},
+		{"FREQ=WEEKLY", "2019-11-04", "2019-11-04", "2019-11-11"},
+		{"FREQ=MONTHLY", "2019-01-15", "2019-03-20", "2019-04-15"},
+		//when `after` is before the start date, the start date is the first occurrence
+		{"FREQ=WEEKLY", "2019-11-04", "2019-11-01", "2019-11-04"},
+
+		//INTERVAL
+		{"FREQ=DAILY;INTERVAL=3", "2019-11-01", "2019-11-05", "2019-11-07"},
+		{"FREQ=DAILY;INTERVAL=3", "2019-11-01", "2019-11-07", "2019-11-10"},
+		{"FREQ=WEEKLY;INTERVAL=2;BYDAY=MO,TH", "2019-11-04", "2019-11-04", "2019-11-07"},
+		{"FREQ=WEEKLY;INTERVAL=2;BYDAY=MO,TH", "2019-11-04", "2019-11-08", "2019-11-18"},
+		{"FREQ=MONTHLY;INTERVAL=3", "2019-01-15", "2019-02-01", "2019-04-15"},
+		{"FREQ=MONTHLY;INTERVAL=3", "2019-11-15", "2019-11-15", "2020-02-15"},
+		{"FREQ=YEARLY;INTERVAL=2", "2019-06-01", "2019-06-01", "2021-06-01"},
+
+		//BYDAY with ordinals, counting from the start or from the end of the month
+		{"FREQ=MONTHLY;BYDAY=1MO", "2019-11-04", "2019-11-04", "2019-12-02"},
+		{"FREQ=MONTHLY;BYDAY=-1FR", "2019-11-01", "2019-11-01", "2019-11-29"},
+		{"FREQ=MONTHLY;BYDAY=-1FR", "2019-11-01", "2019-11-29", "2019-12-27"},
+		{"FREQ=MONTHLY;BYDAY=-2MO", "2019-11-01", "2019-11-01", "2019-11-18"},
+		{"FREQ=MONTHLY;BYDAY=-2MO", "2019-11-01", "2019-11-20", "2019-12-23"},
+		{"FREQ=MONTHLY;BYDAY=1MO,-1MO", "2019-11-01", "2019-11-04", "2019-11-25"},
+		{"FREQ=MONTHLY;BYDAY=5TH", "2019-10-01", "2019-10-31", "2020-01-30"},
+
+		//BYMONTHDAY=31 skips months that are too short, BYMONTHDAY=-1 does not
+		{"FREQ=MONTHLY;BYMONTHDAY=31", "2019-01-31", "2019-01-31", "2019-03-31"},
+		{"FREQ=MONTHLY;BYMONTHDAY=31", "2019-01-31", "2019-03-31", "2019-05-31"},
+		{"FREQ=MONTHLY;BYMONTHDAY=-1", "2019-01-31", "2019-01-31", "2019-02-28"},
+		{"FREQ=MONTHLY;BYMONTHDAY=-1", "2020-01-31", "2020-01-31", "2020-02-29"},
+		{"FREQ=MONTHLY;BYMONTHDAY=-1", "2019-01-31", "2019-04-01", "2019-04-30"},
+		{"FREQ=MONTHLY;BYMONTHDAY=1,-1", "2019-01-01", "2019-02-01", "2019-02-28"},
+
+		//February and leap years
+		{"FREQ=MONTHLY", "2019-01-30", "2019-01-30", "2019-03-30"},
+		{"FREQ=MONTHLY;BYMONTHDAY=29", "2019-01-29", "2019-01-29", "2019-03-29"},
+		{"FREQ=MONTHLY;BYMONTHDAY=29", "2020-01-29", "2020-01-29", "2020-02-29"},
+		{"FREQ=YEARLY", "2020-02-29", "2020-02-29", "2024-02-29"},
+		{"FREQ=YEARLY;BYMONTH=2;BYMONTHDAY=-1", "2019-02-28", "2019-02-28", "2020-02-29"},
+		{"FREQ=YEARLY;BYMONTH=2;BYMONTHDAY=-1", "2020-02-29", "2020-02-29", "2021-02-28"},
+		{"FREQ=DAILY;BYMONTH=2;BYMONTHDAY=29", "2019-01-01", "2019-01-01", "2020-02-29"},
+		{"FREQ=MONTHLY;BYMONTH=2;BYDAY=-1SA", "2020-01-01", "2020-01-01", "2020-02-29"},
+
+		//rules that cannot match
+		{"FREQ=MONTHLY;BYMONTH=2;BYMONTHDAY=30", "2019-01-01", "2019-01-01", ""},
+		{"FREQ=YEARLY;BYMONTH=4;BYMONTHDAY=31", "2019-01-01", "2019-01-01", ""},
+	}
+
+	for _, tc := range testCases {
+		rule, err := Parse(tc.Rule)
+		if err != nil {
+			t.Errorf("cannot parse %q: %s", tc.Rule, err.Error())
+			continue
+		}
+		actual, ok := rule.Next(mustParseDate(t, tc.Start), mustParseDate(t, tc.After))
+		switch {
+		case tc.Expected == "" && ok:
+			t.Errorf("%s starting at %s: expected no occurrence after %s, but got %s",
+				tc.Rule, tc.Start, tc.After, actual)
+		case tc.Expected != "" && !ok:
+			t.Errorf("%s starting at %s: expected %s as next occurrence after %s, but got none",
+				tc.Rule, tc.Start, tc.Expected, tc.After)
+		case tc.Expected != "" && actual.String() != tc.Expected:
+			t.Errorf("%s starting at %s: expected %s as next occurrence after %s, but got %s",
+				tc.Rule, tc.Start, tc.Expected, tc.After, actual)
+		}
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	for _, input := range []string{
+		"",
+		"INTERVAL=2",
+		"FREQ=HOURLY",
+		"FREQ=DAILY;INTERVAL=0",
+		"FREQ=DAILY;FREQ=WEEKLY",
+		"FREQ=MONTHLY;BYMONTHDAY=0",
+		"FREQ=MONTHLY;BYMONTHDAY=32",
+		"FREQ=WEEKLY;BYMONTHDAY=1",
+		"FREQ=WEEKLY;BYDAY=1MO",
+		"FREQ=DAILY;COUNT=5",
+	} {
+		_, err := Parse(input)
+		if err == nil {
+			t.Errorf("expected error when parsing %q, but got none", input)
+		}
+	}
+}
+
+func TestStringRoundtrip(t *testing.T) {
+	for _, input := range []string{
+		"FREQ=DAILY",
+		"FREQ=WEEKLY;INTERVAL=2;BYDAY=MO,TH",
+		"FREQ=MONTHLY;BYDAY=-1FR",
+		"FREQ=YEARLY;BYMONTH=2;BYMONTHDAY=-1",
+	} {
+		rule, err := Parse(input)
+		if err != nil {
+			t.Errorf("cannot parse %q: %s", input, err.Error())
+			continue
+		}
+		if rule.String() != input {
+			t.Errorf("expected %q to be serialized as itself, but got %q", input, rule.String())
+		}
+	}
+}
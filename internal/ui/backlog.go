@@ -0,0 +1,444 @@
+/*******************************************************************************
+*
+* Copyright 2019 Stefan Majewsky <majewsky@gmx.net>
+*
+* This program is free software: you can redistribute it and/or modify it under
+* the terms of the GNU General Public License as published by the Free Software
+* Foundation, either version 3 of the License, or (at your option) any later
+* version.
+*
+* This program is distributed in the hope that it will be useful, but WITHOUT ANY
+* WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+* A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License along with
+* this program. If not, see <http://www.gnu.org/licenses/>.
+*
+*******************************************************************************/
+
+package ui
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/majewsky/alltag/internal/date"
+	"github.com/majewsky/alltag/internal/db"
+	"github.com/sapcc/go-bits/respondwith"
+)
+
+//taskFilter contains the filter settings for the backlog view. Each field is
+//empty when the respective filter is not active.
+type taskFilter struct {
+	Class      string //"mental" or "physical"
+	LocationID string //a location ID, or "none" for tasks without locations
+	Classified string //"yes" or "no"
+	Starts     string //"now" (for tasks that have already started) or "future"
+}
+
+func parseTaskFilter(query url.Values) taskFilter {
+	return taskFilter{
+		Class:      query.Get("class"),
+		LocationID: query.Get("location"),
+		Classified: query.Get("classified"),
+		Starts:     query.Get("starts"),
+	}
+}
+
+//Query returns the URL query parameters that parseTaskFilter() will recognize as
+//this filter.
+func (f taskFilter) Query() url.Values {
+	query := make(url.Values)
+	for key, value := range map[string]string{
+		"class":      f.Class,
+		"location":   f.LocationID,
+		"classified": f.Classified,
+		"starts":     f.Starts,
+	} {
+		if value != "" {
+			query.Set(key, value)
+		}
+	}
+	return query
+}
+
+//URL returns the URL of the backlog view with this filter applied.
+func (f taskFilter) URL() string {
+	query := f.Query().Encode()
+	if query == "" {
+		return "/tasks"
+	}
+	return "/tasks?" + query
+}
+
+//Matches returns whether the given task (with the given location IDs) passes
+//this filter.
+func (f taskFilter) Matches(task db.Task, locationIDs []int64, today date.Date) bool {
+	if f.Class != "" && (task.Class == nil || string(*task.Class) != f.Class) {
+		return false
+	}
+
+	switch f.LocationID {
+	case "":
+		//no filter
+	case "none":
+		if len(locationIDs) > 0 {
+			return false
+		}
+	default:
+		found := false
+		for _, id := range locationIDs {
+			if strconv.FormatInt(id, 10) == f.LocationID {
+				found = true
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	switch f.Classified {
+	case "yes":
+		if !task.IsClassified() {
+			return false
+		}
+	case "no":
+		if task.IsClassified() {
+			return false
+		}
+	}
+
+	//unclassified tasks do not have a meaningful start date
+	isFuture := task.IsClassified() && task.StartsAt.After(today)
+	switch f.Starts {
+	case "now":
+		if isFuture {
+			return false
+		}
+	case "future":
+		if !isFuture {
+			return false
+		}
+	}
+
+	return true
+}
+
+//AllOpenTasks returns all tasks of the current user that have not been closed.
+func (h *handler) AllOpenTasks(r *http.Request) ([]db.Task, error) {
+	return h.storage.ListOpenTasks(currentUser(r))
+}
+
+//AllTaskLocations returns the location IDs for all tasks of the current user
+//(including closed ones), indexed by task ID.
+func (h *handler) AllTaskLocations(r *http.Request) (map[int64][]int64, error) {
+	return h.storage.ListTaskLocations(currentUser(r))
+}
+
+var tListTasks = tmpl("list-tasks.html", `
+	<form method="GET" action="/tasks">
+		<div class="side-by-side">
+			<div class="form-row">
+				<label for="filter-class">Class</label>
+				<select name="class" id="filter-class" data-initial-value="{{.Filter.Class}}">
+					<option value="">Any</option>
+					<option value="mental">Mental</option>
+					<option value="physical">Physical</option>
+				</select>
+			</div>
+			<div class="form-row">
+				<label for="filter-location">Location</label>
+				<select name="location" id="filter-location" data-initial-value="{{.Filter.LocationID}}">
+					<option value="">Any</option>
+					<option value="none">None</option>
+					{{- range .Locations }}
+						<option value="{{.ID}}">{{.Label}}</option>
+					{{- end }}
+				</select>
+			</div>
+			<div class="form-row">
+				<label for="filter-classified">Classified</label>
+				<select name="classified" id="filter-classified" data-initial-value="{{.Filter.Classified}}">
+					<option value="">Any</option>
+					<option value="yes">Yes</option>
+					<option value="no">No</option>
+				</select>
+			</div>
+			<div class="form-row">
+				<label for="filter-starts">Starts</label>
+				<select name="starts" id="filter-starts" data-initial-value="{{.Filter.Starts}}">
+					<option value="">Any time</option>
+					<option value="now">Already started</option>
+					<option value="future">In the future</option>
+				</select>
+			</div>
+		</div>
+		<div class="button-row">
+			<button type="submit">Filter</button>
+			<a class="button" href="/tasks">Reset filters</a>
+		</div>
+	</form>
+	<form method="POST" action="/tasks">
+		<input type="hidden" name="filter" value="{{.Filter.Query.Encode}}" />
+		<div class="table-container">
+			<table class="table responsive has-hover-highlight">
+				<thead>
+					<tr>
+						<th></th>
+						<th class="grow-column">Task</th>
+						<th>Class</th>
+						<th>Locations</th>
+						<th>Priority</th>
+						<th>Starts at</th>
+						<th>Due at</th>
+						<th class="actions"><a href="/tasks/new">New task</a></th>
+					</tr>
+				</thead>
+				<tbody>
+					{{- if .Tasks -}}
+						{{- range .Tasks -}}
+							<tr class="{{if and .IsClassified (dateGreaterThan .StartsAt $.DateNow)}}text-muted{{end}}">
+								<td><input type="checkbox" name="task_ids" id="task-{{.ID}}" value="{{.ID}}" /></td>
+								<td class="grow-column" data-label="Task"><label for="task-{{.ID}}">{{.Label}}</label></td>
+								{{- if .IsClassified }}
+									<td data-label="Class">{{.Class}}</td>
+									<td data-label="Locations">
+										{{- range $idx, $id := index $.LocationIDs .ID -}}
+											{{- if gt $idx 0 }}, {{ end -}}
+											{{- index $.LocationLabels $id -}}
+										{{- end -}}
+									</td>
+									<td class="nobr-column" data-label="Priority">{{.InitialPriority}} -> {{.FinalPriority}}</td>
+									<td class="nobr-column" data-label="Starts at">{{.StartsAt}}</td>
+									<td class="nobr-column" data-label="Due at">{{.DueAt}}</td>
+									<td class="actions"><a href="/tasks/{{.ID}}">Show</a> · <a href="/tasks/{{.ID}}/edit">Edit</a></td>
+								{{- else }}
+									<td colspan="5" class="text-muted" data-label="Class">not classified yet</td>
+									<td class="actions"><a href="/tasks/{{.ID}}/edit">Classify</a></td>
+								{{- end }}
+							</tr>
+						{{- end -}}
+					{{- else -}}
+						<tr>
+							<td colspan="8" class="text-muted text-center">No entries</td>
+						</tr>
+					{{- end -}}
+				</tbody>
+			</table>
+		</div>
+		{{- if .Tasks }}
+			<div class="form-row">
+				<label for="action">With selected tasks</label>
+				<select name="action" id="action" required>
+					<option value="">-- Select --</option>
+					<option value="set_locations">Reassign locations</option>
+					<option value="set_priorities">Change priorities</option>
+					<option value="delete">Delete permanently</option>
+				</select>
+			</div>
+			<div class="form-row">
+				<label>New locations (when reassigning locations)</label>
+				<div class="item-list">
+					{{- range .Locations -}}
+						<input type="checkbox" name="location_ids" id="location-{{ .ID }}" value="{{ .ID }}" />
+						<label for="location-{{ .ID }}">{{.Label}}</label>
+					{{- end -}}
+				</div>
+			</div>
+			<div class="side-by-side">
+				<div class="form-row">
+					<label for="initial_priority">New initial priority (when changing priorities)</label>
+					<select name="initial_priority" id="initial_priority">
+						<option value="">-- Select --</option>
+						<option value="0">Low</option>
+						<option value="1">Normal</option>
+						<option value="2">High</option>
+						<option value="3">Critical</option>
+					</select>
+				</div>
+				<div class="form-row">
+					<label for="final_priority">New final priority (when changing priorities)</label>
+					<select name="final_priority" id="final_priority">
+						<option value="">-- Select --</option>
+						<option value="0">Low</option>
+						<option value="1">Normal</option>
+						<option value="2">High</option>
+						<option value="3">Critical</option>
+					</select>
+				</div>
+			</div>
+			<div class="button-row">
+				<button type="submit">Apply</button>
+			</div>
+		{{- end }}
+	</form>
+`)
+
+func (h *handler) ListTasks(w http.ResponseWriter, r *http.Request) {
+	filter := parseTaskFilter(r.URL.Query())
+
+	locations, err := h.AllLocations(r)
+	if respondwith.ErrorText(w, err) {
+		return
+	}
+	locationLabels := db.NewLocationLabels(locations)
+
+	allTasks, err := h.AllOpenTasks(r)
+	if respondwith.ErrorText(w, err) {
+		return
+	}
+	locationIDs, err := h.AllTaskLocations(r)
+	if respondwith.ErrorText(w, err) {
+		return
+	}
+
+	today := date.Now()
+	var tasks []db.Task
+	for _, task := range allTasks {
+		if filter.Matches(task, locationIDs[task.ID], today) {
+			tasks = append(tasks, task)
+		}
+	}
+	now := time.Now()
+	sort.Slice(tasks, func(i, j int) bool {
+		//note the sign: this sorts into reverse order (i.e. highest current priority on top)
+		return tasks[i].SortOrder(now) > tasks[j].SortOrder(now)
+	})
+
+	Page{
+		Title: "Manage tasks",
+		Navigation: []BreadcrumbItem{
+			{URL: "/tasks", Label: "Tasks", Current: true},
+		},
+		Template: tListTasks,
+		Data: struct {
+			Filter         taskFilter
+			Tasks          []db.Task
+			Locations      []db.Location
+			LocationIDs    map[int64][]int64
+			LocationLabels db.LocationLabels
+			DateNow        date.Date
+		}{filter, tasks, locations, locationIDs, locationLabels, today},
+	}.WriteTo(w)
+}
+
+func (h *handler) UpdateTasksInBulk(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if respondwith.ErrorText(w, err) {
+		return
+	}
+	filterQuery, err := url.ParseQuery(r.PostForm.Get("filter"))
+	if err != nil {
+		http.Error(w, "malformed filter", http.StatusBadRequest)
+		return
+	}
+	filter := parseTaskFilter(filterQuery)
+
+	//collect selected tasks
+	allTasks, err := h.AllOpenTasks(r)
+	if respondwith.ErrorText(w, err) {
+		return
+	}
+	tasksByID := make(map[int64]db.Task, len(allTasks))
+	for _, task := range allTasks {
+		tasksByID[task.ID] = task
+	}
+	var tasks []db.Task
+	for _, idStr := range r.PostForm["task_ids"] {
+		id, err := strconv.ParseInt(idStr, 10, 64)
+		task, exists := tasksByID[id]
+		if err != nil || !exists {
+			msg := fmt.Sprintf("invalid task ID: %q", idStr)
+			http.Error(w, msg, http.StatusBadRequest)
+			return
+		}
+		tasks = append(tasks, task)
+	}
+	if len(tasks) == 0 {
+		http.Error(w, "need to select at least one task", http.StatusBadRequest)
+		return
+	}
+
+	//validate the action and prepare the respective changes
+	var apply func(s db.Storage, task db.Task) error
+	switch r.PostForm.Get("action") {
+	case "delete":
+		apply = func(s db.Storage, task db.Task) error {
+			return s.DeleteTask(&task)
+		}
+
+	case "set_locations":
+		locations, err := h.AllLocations(r)
+		if respondwith.ErrorText(w, err) {
+			return
+		}
+		isValidLocationID := make(map[int64]bool)
+		for _, loc := range locations {
+			isValidLocationID[loc.ID] = true
+		}
+		var newLocationIDs []int64
+		for _, idStr := range r.PostForm["location_ids"] {
+			id, err := strconv.ParseInt(idStr, 10, 64)
+			if err != nil || !isValidLocationID[id] {
+				msg := fmt.Sprintf("invalid location ID: %q", idStr)
+				http.Error(w, msg, http.StatusBadRequest)
+				return
+			}
+			newLocationIDs = append(newLocationIDs, id)
+		}
+		if len(newLocationIDs) == 0 {
+			http.Error(w, "need to specify at least one location", http.StatusBadRequest)
+			return
+		}
+
+		apply = func(s db.Storage, task db.Task) error {
+			return s.SetTaskLocations(task, newLocationIDs)
+		}
+
+	case "set_priorities":
+		initialPriority, err := parsePriority(r.PostForm.Get("initial_priority"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		finalPriority, err := parsePriority(r.PostForm.Get("final_priority"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if initialPriority >= finalPriority {
+			http.Error(w, "final priority must be higher than initial priority", http.StatusBadRequest)
+			return
+		}
+
+		apply = func(s db.Storage, task db.Task) error {
+			task.InitialPriority = initialPriority
+			task.FinalPriority = finalPriority
+			return s.SaveTask(&task)
+		}
+
+	default:
+		msg := fmt.Sprintf("invalid action: %q", r.PostForm.Get("action"))
+		http.Error(w, msg, http.StatusBadRequest)
+		return
+	}
+
+	//do everything in a transaction to enable easy rollback
+	err = h.storage.Transaction(func(s db.Storage) error {
+		for _, task := range tasks {
+			err := apply(s, task)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if respondwith.ErrorText(w, err) {
+		return
+	}
+	http.Redirect(w, r, filter.URL(), http.StatusSeeOther)
+}
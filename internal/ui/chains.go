@@ -0,0 +1,248 @@
+/*******************************************************************************
+*
+* Copyright 2019 Stefan Majewsky <majewsky@gmx.net>
+*
+* This program is free software: you can redistribute it and/or modify it under
+* the terms of the GNU General Public License as published by the Free Software
+* Foundation, either version 3 of the License, or (at your option) any later
+* version.
+*
+* This program is distributed in the hope that it will be useful, but WITHOUT ANY
+* WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+* A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License along with
+* this program. If not, see <http://www.gnu.org/licenses/>.
+*
+*******************************************************************************/
+
+package ui
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+
+	"github.com/majewsky/alltag/internal/date"
+	"github.com/majewsky/alltag/internal/db"
+	"github.com/sapcc/go-bits/respondwith"
+)
+
+//FindTaskAwaitingNextStep is like FindAnyTaskFromRequest, but only finds
+//closed tasks that do not have a next step yet. If the task already has a next
+//step, the user is redirected to the task chain instead.
+func (h *handler) FindTaskAwaitingNextStep(w http.ResponseWriter, r *http.Request) *db.Task {
+	task := h.FindAnyTaskFromRequest(w, r)
+	if task == nil {
+		return nil
+	}
+	if !task.IsClosed() {
+		http.Redirect(w, r, fmt.Sprintf("/tasks/%d/close", task.ID), http.StatusSeeOther)
+		return nil
+	}
+
+	_, err := h.storage.FindSuccessor(*task)
+	if err == nil {
+		http.Redirect(w, r, fmt.Sprintf("/tasks/%d/chain", task.ID), http.StatusSeeOther)
+		return nil
+	}
+	if err != sql.ErrNoRows && respondwith.ErrorText(w, err) {
+		return nil
+	}
+
+	return task
+}
+
+var tNextStep = tmpl("next-step.html", `
+	<form method="POST" action="/tasks/{{.ID}}/next">
+		<div class="flash flash-success">
+			Well done! You have finished: <strong>{{.Label}}</strong>
+		</div>
+		<div class="flash flash-primary">
+			<strong>What's the next step?</strong> Enter the smallest-possible step that follows from what you just did. It will have the same class, locations and priorities as the task you just finished.
+		</div>
+		<div class="form-row">
+			<label for="label">Label</label>
+			<input required type="text" name="label" id="label" />
+		</div>
+		<div class="button-row">
+			<button type="submit" name="next" value="home">Save</button>
+			<button type="submit" name="next" value="edit">Save and edit</button>
+			<a class="button" href="/">There is no next step</a>
+		</div>
+	</form>
+`)
+
+func (h *handler) AskNextStep(w http.ResponseWriter, r *http.Request) {
+	task := h.FindTaskAwaitingNextStep(w, r)
+	if task == nil {
+		return
+	}
+
+	Page{
+		Title: "Next step",
+		Navigation: []BreadcrumbItem{
+			{URL: "/tasks", Label: "Tasks"},
+			{URL: fmt.Sprintf("/tasks/%d/chain", task.ID), Label: fmt.Sprintf("#%d", task.ID)},
+			{URL: r.URL.Path, Label: "Next step", Current: true},
+		},
+		Template: tNextStep,
+		Data:     task,
+	}.WriteTo(w)
+}
+
+func (h *handler) CreateNextStep(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if respondwith.ErrorText(w, err) {
+		return
+	}
+	predecessor := h.FindTaskAwaitingNextStep(w, r)
+	if predecessor == nil {
+		return
+	}
+	isPredecessorLocation, err := h.FindTaskLocations(*predecessor)
+	if respondwith.ErrorText(w, err) {
+		return
+	}
+
+	//the next step inherits all attributes from its predecessor, except for the
+	//label (which is new) and the dates (which start over from today)
+	task := db.Task{
+		Label:           r.PostForm.Get("label"),
+		UserName:        currentUser(r),
+		Class:           predecessor.Class,
+		InitialPriority: predecessor.InitialPriority,
+		FinalPriority:   predecessor.FinalPriority,
+		StartsAt:        date.Now(),
+		PredecessorID:   &predecessor.ID,
+	}
+	if task.Label == "" {
+		http.Error(w, "label may not be empty", http.StatusBadRequest)
+		return
+	}
+	durationInDays := predecessor.DueAt.Sub(predecessor.StartsAt)
+	task.DueAt = task.StartsAt.AddDays(durationInDays)
+
+	err = h.storage.Transaction(func(s db.Storage) error {
+		err := s.SaveTask(&task)
+		if err != nil {
+			return err
+		}
+		var locationIDs []int64
+		for locationID := range isPredecessorLocation {
+			locationIDs = append(locationIDs, locationID)
+		}
+		err = s.SetTaskLocations(task, locationIDs)
+		if err != nil {
+			return err
+		}
+		err = s.EmitTaskEvent(db.WebhookEventTaskCreated, task)
+		if err != nil {
+			return err
+		}
+		return s.EmitTaskEvent(db.WebhookEventTaskClassified, task)
+	})
+	if respondwith.ErrorText(w, err) {
+		return
+	}
+
+	//if the predecessor's locations have all been deleted in the meantime, the
+	//next step needs to be edited before it can show up on the start page
+	nextURL := "/"
+	if r.PostForm.Get("next") == "edit" || len(isPredecessorLocation) == 0 {
+		nextURL = fmt.Sprintf("/tasks/%d/edit", task.ID)
+	}
+	http.Redirect(w, r, nextURL, http.StatusSeeOther)
+}
+
+//FindTaskChain returns all tasks in the same chain as the given task, ordered
+//from the first step to the last step.
+func (h *handler) FindTaskChain(task db.Task) ([]db.Task, error) {
+	chain := []db.Task{task}
+
+	//walk backwards to the first step
+	for chain[0].PredecessorID != nil {
+		predecessor, err := h.storage.FindTask(task.UserName, *chain[0].PredecessorID)
+		if err != nil {
+			return nil, err
+		}
+		chain = append([]db.Task{*predecessor}, chain...)
+	}
+
+	//walk forwards to the last step
+	for {
+		successor, err := h.storage.FindSuccessor(chain[len(chain)-1])
+		if err == sql.ErrNoRows {
+			return chain, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		chain = append(chain, *successor)
+	}
+}
+
+var tShowTaskChain = tmpl("show-task-chain.html", `
+	<div class="table-container">
+		<table class="table responsive has-hover-highlight">
+			<thead>
+				<tr>
+					<th>Step</th>
+					<th class="grow-column">Task</th>
+					<th>Status</th>
+					<th>Actions</th>
+				</tr>
+			</thead>
+			<tbody>
+				{{- range .Chain -}}
+					<tr class="{{if .IsClosed}}text-muted{{end}}">
+						<td class="nobr-column" data-label="Step">#{{.ID}}</td>
+						<td class="grow-column" data-label="Task">
+							{{- if eq .ID $.CurrentID -}}
+								<strong>{{.Label}}</strong>
+							{{- else -}}
+								{{.Label}}
+							{{- end -}}
+						</td>
+						<td class="nobr-column" data-label="Status">{{if .IsClosed}}done on {{.ClosedAt}}{{else}}open{{end}}</td>
+						<td class="actions">
+							{{- if not .IsClosed -}}
+								<a href="/tasks/{{.ID}}">Show</a>
+							{{- end -}}
+						</td>
+					</tr>
+				{{- end -}}
+			</tbody>
+		</table>
+	</div>
+	{{- if .LastStep.IsClosed -}}
+		<div class="button-row">
+			<a class="button" href="/tasks/{{.LastStep.ID}}/next">Enter next step</a>
+		</div>
+	{{- end -}}
+`)
+
+func (h *handler) ShowTaskChain(w http.ResponseWriter, r *http.Request) {
+	task := h.FindAnyTaskFromRequest(w, r)
+	if task == nil {
+		return
+	}
+	chain, err := h.FindTaskChain(*task)
+	if respondwith.ErrorText(w, err) {
+		return
+	}
+
+	Page{
+		Title: "Task chain",
+		Navigation: []BreadcrumbItem{
+			{URL: "/tasks", Label: "Tasks"},
+			{URL: r.URL.Path, Label: fmt.Sprintf("Chain of #%d", task.ID), Current: true},
+		},
+		Template: tShowTaskChain,
+		Data: struct {
+			Chain     []db.Task
+			LastStep  db.Task
+			CurrentID int64
+		}{chain, chain[len(chain)-1], task.ID},
+	}.WriteTo(w)
+}
@@ -0,0 +1,131 @@
+/*******************************************************************************
+*
+* Copyright 2019 Stefan Majewsky <majewsky@gmx.net>
+*
+* This program is free software: you can redistribute it and/or modify it under
+* the terms of the GNU General Public License as published by the Free Software
+* Foundation, either version 3 of the License, or (at your option) any later
+* version.
+*
+* This program is distributed in the hope that it will be useful, but WITHOUT ANY
+* WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+* A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License along with
+* this program. If not, see <http://www.gnu.org/licenses/>.
+*
+*******************************************************************************/
+
+package ui
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/majewsky/alltag/internal/date"
+	"github.com/majewsky/alltag/internal/db"
+	"github.com/sapcc/go-bits/respondwith"
+)
+
+//defaultDoneLogDays is how far back the done log goes when the "days" query
+//parameter is not given.
+const defaultDoneLogDays = 30
+
+var tShowDoneLog = tmpl("show-done-log.html", `
+	<div class="table-container">
+		<table class="table responsive">
+			<thead>
+				<tr>
+					<th>Time</th>
+					<th class="grow-column">Task</th>
+					<th>Class</th>
+					<th>Locations</th>
+				</tr>
+			</thead>
+			<tbody>
+				{{- range .Days -}}
+					<tr>
+						<th colspan="4">{{.Date}} ({{len .Completions}} done)</th>
+					</tr>
+					{{- range .Completions -}}
+						<tr>
+							<td class="nobr-column" data-label="Time">{{.CompletedAt.Local.Format "15:04"}}</td>
+							<td class="grow-column" data-label="Task">
+								{{- if .TaskID -}}
+									<a href="/tasks/{{.TaskID}}/chain">{{.Label}}</a>
+								{{- else -}}
+									{{.Label}}
+								{{- end -}}
+							</td>
+							<td data-label="Class">{{if .Class}}{{.Class}}{{end}}</td>
+							<td data-label="Locations">
+								{{- range $idx, $label := .Locations -}}
+									{{- if gt $idx 0 }}, {{ end -}}
+									{{- $label -}}
+								{{- end -}}
+							</td>
+						</tr>
+					{{- end -}}
+				{{- else -}}
+					<tr>
+						<td colspan="4" class="text-muted text-center">Nothing done in the last {{.DayCount}} days</td>
+					</tr>
+				{{- end -}}
+			</tbody>
+		</table>
+	</div>
+	<div class="button-row">
+		<a class="button" href="/done?days={{.MoreDayCount}}">Show older entries</a>
+	</div>
+`)
+
+//doneLogDay appears in the data for tShowDoneLog.
+type doneLogDay struct {
+	Date        date.Date
+	Completions []db.TaskCompletion
+}
+
+func (h *handler) ShowDoneLog(w http.ResponseWriter, r *http.Request) {
+	dayCount := defaultDoneLogDays
+	if daysStr := r.URL.Query().Get("days"); daysStr != "" {
+		val, err := strconv.ParseUint(daysStr, 10, 16)
+		if err != nil || val == 0 {
+			msg := fmt.Sprintf("invalid days value: %q", daysStr)
+			http.Error(w, msg, http.StatusBadRequest)
+			return
+		}
+		dayCount = int(val)
+	}
+
+	since := date.Now().AddDays(1 - dayCount).FirstSecondIn(time.Local)
+	completions, err := h.storage.ListTaskCompletions(currentUser(r), since)
+	if respondwith.ErrorText(w, err) {
+		return
+	}
+
+	//group completions by day (they are already sorted by time)
+	var days []doneLogDay
+	for _, completion := range completions {
+		day := date.FromTime(completion.CompletedAt.Local())
+		if len(days) == 0 || days[len(days)-1].Date != day {
+			days = append(days, doneLogDay{Date: day})
+		}
+		lastDay := &days[len(days)-1]
+		lastDay.Completions = append(lastDay.Completions, completion)
+	}
+
+	Page{
+		Title: "Done log",
+		Navigation: []BreadcrumbItem{
+			{URL: "/done", Label: "Done log", Current: true},
+		},
+		Template: tShowDoneLog,
+		Data: struct {
+			Days         []doneLogDay
+			DayCount     int
+			MoreDayCount int
+		}{days, dayCount, dayCount * 2},
+	}.WriteTo(w)
+}
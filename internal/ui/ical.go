@@ -0,0 +1,305 @@
+/*******************************************************************************
+*
+* Copyright 2019 Stefan Majewsky <majewsky@gmx.net>
+*
+* This program is free software: you can redistribute it and/or modify it under
+* the terms of the GNU General Public License as published by the Free Software
+* Foundation, either version 3 of the License, or (at your option) any later
+* version.
+*
+* This program is distributed in the hope that it will be useful, but WITHOUT ANY
+* WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+* A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License along with
+* this program. If not, see <http://www.gnu.org/licenses/>.
+*
+*******************************************************************************/
+
+package ui
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/majewsky/alltag/internal/date"
+	"github.com/majewsky/alltag/internal/db"
+	"github.com/majewsky/alltag/internal/ical"
+	"github.com/sapcc/go-bits/logg"
+	"github.com/sapcc/go-bits/respondwith"
+)
+
+//maxImportSize is the maximum size of an uploaded .ics file.
+const maxImportSize = 10 << 20
+
+//ExportTasks serves all tasks of the user as an .ics file. Closed tasks are
+//included as completed VTODOs, so that the export can serve as a backup.
+func (h *handler) ExportTasks(w http.ResponseWriter, r *http.Request) {
+	userName := currentUser(r)
+	tasks, err := h.storage.ListTasks(userName)
+	if respondwith.ErrorText(w, err) {
+		return
+	}
+	locationIDs, err := h.storage.ListTaskLocations(userName)
+	if respondwith.ErrorText(w, err) {
+		return
+	}
+	locations, err := h.AllLocations(r)
+	if respondwith.ErrorText(w, err) {
+		return
+	}
+	locationLabels := db.NewLocationLabels(locations)
+
+	now := time.Now()
+	cal := ical.NewCalendar()
+	for _, task := range tasks {
+		labels := locationLabels.Of(locationIDs[task.ID])
+		cal.Components = append(cal.Components, ical.EncodeTask(task, labels, now))
+	}
+
+	w.Header().Set("Content-Type", "text/calendar; charset=utf-8")
+	w.Header().Set("Content-Disposition", `attachment; filename="alltag-tasks.ics"`)
+	w.WriteHeader(http.StatusOK)
+	err = cal.Encode(w)
+	if err != nil {
+		logg.Error("cannot write tasks export for user %q: %s", userName, err.Error())
+	}
+}
+
+//ShowCalendarFeed serves the calendar feed with the due dates (and optionally
+//the start dates) of all classified open tasks. The authentication middleware
+//in main.go only lets requests through whose URL contains a calendar feed
+//token, so the token does not need to be checked here. The query parameters
+//of the backlog view can be used to restrict the feed to certain tasks.
+func (h *handler) ShowCalendarFeed(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	filter := parseTaskFilter(query)
+	//only classified tasks have due dates
+	filter.Classified = "yes"
+	withStartDates := query.Get("start_dates") == "true"
+
+	userName := currentUser(r)
+	tasks, err := h.storage.ListOpenTasks(userName)
+	if respondwith.ErrorText(w, err) {
+		return
+	}
+	locationIDs, err := h.storage.ListTaskLocations(userName)
+	if respondwith.ErrorText(w, err) {
+		return
+	}
+	locations, err := h.AllLocations(r)
+	if respondwith.ErrorText(w, err) {
+		return
+	}
+	locationLabels := db.NewLocationLabels(locations)
+
+	today := date.Now()
+	now := time.Now()
+	cal := ical.NewCalendar()
+	cal.Add("X-WR-CALNAME", "Alltag")
+	for _, task := range tasks {
+		if !filter.Matches(task, locationIDs[task.ID], today) {
+			continue
+		}
+		labels := locationLabels.Of(locationIDs[task.ID])
+		cal.Components = append(cal.Components, ical.EncodeDueDate(task, labels, now))
+		if withStartDates && task.StartsAt.Before(task.DueAt) {
+			cal.Components = append(cal.Components, ical.EncodeStartDate(task, labels, now))
+		}
+	}
+
+	//no Content-Disposition here since calendar apps load this directly
+	w.Header().Set("Content-Type", "text/calendar; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	err = cal.Encode(w)
+	if err != nil {
+		logg.Error("cannot write calendar feed for user %q: %s", userName, err.Error())
+	}
+}
+
+var tImportTasks = tmpl("import-tasks.html", `
+	<p class="flash flash-primary">
+		Tasks can be exported to and imported from iCalendar files (.ics) as VTODO entries, e.g. for migrating from or to
+		other task managers, or for making backups. Task classes and locations are stored in CATEGORIES.
+	</p>
+	<div class="button-row">
+		<a class="button" href="/tasks/export.ics">Export all tasks</a>
+	</div>
+	<form method="POST" action="/tasks/import" enctype="multipart/form-data">
+		<div class="form-row">
+			<label for="file">iCalendar file to import</label>
+			<input required type="file" name="file" id="file" accept=".ics,text/calendar" />
+		</div>
+		<div class="form-row">
+			<label>Options</label>
+			<div class="item-list">
+				<input type="checkbox" name="create_locations" id="create_locations" value="true" checked />
+				<label for="create_locations">Create locations for unknown categories</label>
+			</div>
+		</div>
+		<div class="flash flash-primary">
+			Imported tasks are always added as new tasks. Completed and cancelled entries are skipped. Entries that do not
+			have a due date, a task class ("mental" or "physical") and at least one location among their categories are
+			imported without classification. The same goes for entries whose dates or priorities are not valid in Alltag.
+			Recurrence rules that Alltag does not support (e.g. with COUNT or UNTIL) are dropped.
+		</div>
+		<div class="button-row">
+			<button type="submit">Import</button>
+		</div>
+	</form>
+`)
+
+func (h *handler) AskImportTasks(w http.ResponseWriter, r *http.Request) {
+	Page{
+		Title: "Import/export tasks",
+		Navigation: []BreadcrumbItem{
+			{URL: "/tasks", Label: "Tasks"},
+			{URL: r.URL.Path, Label: "Import/export", Current: true},
+		},
+		Template: tImportTasks,
+		Data:     nil,
+	}.WriteTo(w)
+}
+
+var tImportTasksResult = tmpl("import-tasks-result.html", `
+	<div class="flash flash-success">
+		Imported {{.Imported}} tasks.
+		{{- if .Unclassified }}
+			{{.Unclassified}} of them still need to be classified.
+		{{- end }}
+		{{- if .Skipped }}
+			Skipped {{.Skipped}} completed or cancelled entries.
+		{{- end }}
+	</div>
+	{{- if .Changes }}
+		<div class="flash flash-warning">
+			The following entries could not be imported as they were:
+			<ul>
+				{{- range .Changes }}
+					<li>{{.}}</li>
+				{{- end }}
+			</ul>
+		</div>
+	{{- end }}
+	<div class="button-row">
+		<a class="button" href="/tasks">Show tasks</a>
+	</div>
+`)
+
+func (h *handler) ImportTasks(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxImportSize)
+	file, _, err := r.FormFile("file")
+	if err != nil {
+		http.Error(w, "cannot read uploaded file: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer file.Close()
+	cal, err := ical.Parse(file)
+	if err == nil && cal.Name != "VCALENDAR" {
+		err = errors.New("expected a VCALENDAR")
+	}
+	if err != nil {
+		http.Error(w, "cannot parse uploaded file: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	userName := currentUser(r)
+	createLocations := r.PostForm.Get("create_locations") == "true"
+	today := date.Now()
+	var result struct {
+		Imported     int
+		Unclassified int
+		Skipped      int
+		//entries that were imported without recurrence or classification, or
+		//not at all
+		Changes []string
+	}
+
+	//do everything in a transaction, so that a failed import can be retried
+	//without creating duplicates
+	err = h.storage.Transaction(func(s db.Storage) error {
+		result.Changes = nil
+		resolver, err := ical.NewLocationResolver(s, userName, createLocations)
+		if err != nil {
+			return err
+		}
+
+		for _, todo := range cal.Components {
+			if todo.Name != "VTODO" {
+				continue
+			}
+			if ical.IsFinished(todo) {
+				result.Skipped++
+				continue
+			}
+			decoded, err := ical.DecodeTask(todo, today)
+			if err != nil {
+				result.Changes = append(result.Changes, "skipped: "+err.Error())
+				continue
+			}
+			task := decoded.Task
+			task.UserName = userName
+			if decoded.UnsupportedRecurrence != nil {
+				result.Changes = append(result.Changes, fmt.Sprintf(
+					"task %q: imported without recurrence: %s", task.Label, decoded.UnsupportedRecurrence.Error()))
+			}
+
+			var taskLocationIDs []int64
+			if task.IsClassified() {
+				err := ical.CheckClassification(task)
+				if err == nil {
+					taskLocationIDs, err = resolver.Resolve(decoded.LocationLabels)
+					if err != nil {
+						return err
+					}
+				} else {
+					result.Changes = append(result.Changes, fmt.Sprintf(
+						"task %q: imported without classification: %s", task.Label, err.Error()))
+				}
+			}
+
+			//a task without locations would never be suggested, so it needs to be
+			//classified again by the user
+			if len(taskLocationIDs) == 0 {
+				task = db.Task{
+					Label:    task.Label,
+					UserName: userName,
+					StartsAt: date.Epoch, //zero value
+					DueAt:    date.Epoch, //zero value
+				}
+				result.Unclassified++
+			}
+
+			err = s.SaveTask(&task)
+			if err == nil && len(taskLocationIDs) > 0 {
+				err = s.SetTaskLocations(task, taskLocationIDs)
+			}
+			if err == nil {
+				err = s.EmitTaskEvent(db.WebhookEventTaskCreated, task)
+			}
+			if err == nil && task.IsClassified() {
+				err = s.EmitTaskEvent(db.WebhookEventTaskClassified, task)
+			}
+			if err != nil {
+				return err
+			}
+			result.Imported++
+		}
+		return nil
+	})
+	if respondwith.ErrorText(w, err) {
+		return
+	}
+
+	Page{
+		Title: "Import/export tasks",
+		Navigation: []BreadcrumbItem{
+			{URL: "/tasks", Label: "Tasks"},
+			{URL: r.URL.Path, Label: "Import/export", Current: true},
+		},
+		Template: tImportTasksResult,
+		Data:     result,
+	}.WriteTo(w)
+}
@@ -83,11 +83,7 @@ func (h *handler) FindLocationFromRequest(w http.ResponseWriter, r *http.Request
 	if respondwith.ErrorText(w, err) {
 		return nil
 	}
-	var location db.Location
-	err = h.dbi.SelectOne(&location,
-		`SELECT * FROM locations WHERE id = $1 AND username = $2`,
-		id, currentUser(r),
-	)
+	location, err := h.storage.FindLocation(currentUser(r), id)
 	if err == sql.ErrNoRows {
 		http.Error(w, "Not found", http.StatusNotFound)
 		return nil
@@ -95,7 +91,7 @@ func (h *handler) FindLocationFromRequest(w http.ResponseWriter, r *http.Request
 	if respondwith.ErrorText(w, err) {
 		return nil
 	}
-	return &location
+	return location
 }
 
 var tShowLocation = tmpl("show-location.html", `
@@ -147,11 +143,7 @@ func (h *handler) ShowLocation(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	var tasks []db.Task
-	_, err := h.dbi.Select(&tasks,
-		`SELECT t.* FROM tasks t JOIN task_locations l ON t.id = l.task_id WHERE l.location_id = $1 AND t.username = $2`,
-		location.ID, currentUser(r),
-	)
+	tasks, err := h.storage.ListOpenTasksAtLocation(currentUser(r), location.ID)
 	if respondwith.ErrorText(w, err) {
 		return
 	}
@@ -249,11 +241,7 @@ func (h *handler) CreateOrUpdateLocation(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	if isUpdate {
-		_, err = h.dbi.Update(location)
-	} else {
-		err = h.dbi.Insert(location)
-	}
+	err = h.storage.SaveLocation(location)
 	if respondwith.ErrorText(w, err) {
 		return
 	}
@@ -293,7 +281,7 @@ func (h *handler) DeleteLocation(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	_, err := h.dbi.Delete(location)
+	err := h.storage.DeleteLocation(location)
 	if respondwith.ErrorText(w, err) {
 		return
 	}
@@ -0,0 +1,265 @@
+/*******************************************************************************
+*
+* Copyright 2019 Stefan Majewsky <majewsky@gmx.net>
+*
+* This program is free software: you can redistribute it and/or modify it under
+* the terms of the GNU General Public License as published by the Free Software
+* Foundation, either version 3 of the License, or (at your option) any later
+* version.
+*
+* This program is distributed in the hope that it will be useful, but WITHOUT ANY
+* WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+* A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License along with
+* this program. If not, see <http://www.gnu.org/licenses/>.
+*
+*******************************************************************************/
+
+package ui
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/majewsky/alltag/internal/auth"
+	"github.com/majewsky/alltag/internal/metrics"
+	"github.com/sapcc/go-bits/logg"
+	"github.com/sapcc/go-bits/respondwith"
+)
+
+type loginHandler struct {
+	driver    auth.Driver
+	throttler *auth.Throttler
+	sessions  *auth.Sessions
+}
+
+//NewLoginHandler returns a http.Handler serving the /login and /logout pages.
+//Unlike the handler returned by NewHandler, this handler must be reachable
+//without authentication.
+func NewLoginHandler(throttler *auth.Throttler, sessions *auth.Sessions) http.Handler {
+	h := loginHandler{throttler.Driver(), throttler, sessions}
+	r := mux.NewRouter()
+	r.Use(metrics.InstrumentRoutes)
+
+	r.Methods("GET").Path("/login").
+		HandlerFunc(h.AskLogin)
+	r.Methods("POST").Path("/login").
+		HandlerFunc(h.Login)
+	r.Methods("GET").Path("/login/start").
+		HandlerFunc(h.StartExternalLogin)
+	r.Methods("GET").Path("/login/callback").
+		HandlerFunc(h.CompleteExternalLogin)
+	//logging out changes state, so it must not be reachable with GET (e.g. from
+	//an <img> on another site)
+	r.Methods("POST").Path("/logout").
+		HandlerFunc(h.Logout)
+
+	return r
+}
+
+var tLogin = tmpl("login.html", `
+	{{- if .External }}
+	<form method="GET" action="/login/start">
+		{{- if .Failed }}
+			<div class="flash flash-danger">Login failed. Please try again.</div>
+		{{- end }}
+		<input type="hidden" name="next" value="{{.NextURL}}" />
+		<div class="button-row">
+			<button type="submit">Log in with single sign-on</button>
+		</div>
+	</form>
+	{{- else }}
+	<form method="POST" action="/login">
+		{{- if .Failed }}
+			<div class="flash flash-danger">Invalid username or password.</div>
+		{{- end }}
+		{{- if .Forbidden }}
+			<div class="flash flash-danger">Your account is not allowed to use Alltag.</div>
+		{{- end }}
+		{{- if .RetryAfter }}
+			<div class="flash flash-danger">Too many failed login attempts. Please try again in {{.RetryAfter}}.</div>
+		{{- end }}
+		{{- if .Unavailable }}
+			<div class="flash flash-warning">Cannot check your credentials right now. Please try again later.</div>
+		{{- end }}
+		<input type="hidden" name="next" value="{{.NextURL}}" />
+		<div class="form-row">
+			<label for="username">Username</label>
+			<input required type="text" name="username" id="username" value="{{.UserName}}" autocomplete="username" autofocus />
+		</div>
+		<div class="form-row">
+			<label for="password">Password</label>
+			<input required type="password" name="password" id="password" autocomplete="current-password" />
+		</div>
+		<div class="button-row">
+			<button type="submit">Log in</button>
+		</div>
+	</form>
+	{{- end }}
+`)
+
+type loginData struct {
+	NextURL     string
+	UserName    string
+	Failed      bool
+	Forbidden   bool
+	Unavailable bool
+	External    bool //if the driver is a RedirectAuthenticator
+	RetryAfter  time.Duration
+}
+
+func (h loginHandler) renderLoginPage(w http.ResponseWriter, status int, data loginData) {
+	_, data.External = h.driver.(auth.RedirectAuthenticator)
+	Page{
+		Status: status,
+		Title:  "Log in",
+		Navigation: []BreadcrumbItem{
+			{URL: "/login", Label: "Log in", Current: true},
+		},
+		HideFooter: true,
+		Template:   tLogin,
+		Data:       data,
+	}.WriteTo(w)
+}
+
+func (h loginHandler) AskLogin(w http.ResponseWriter, r *http.Request) {
+	h.renderLoginPage(w, http.StatusOK, loginData{
+		NextURL: sanitizeNextURL(r.URL.Query().Get("next")),
+	})
+}
+
+func (h loginHandler) Login(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if respondwith.ErrorText(w, err) {
+		return
+	}
+	userName := r.PostForm.Get("username")
+	nextURL := sanitizeNextURL(r.PostForm.Get("next"))
+
+	ok, err := h.throttler.CheckLogin(r, userName, r.PostForm.Get("password"))
+	var throttledErr auth.ThrottledError
+	if errors.As(err, &throttledErr) {
+		w.Header().Set("Retry-After", strconv.Itoa(int(throttledErr.RetryAfter.Seconds()+1)))
+		h.renderLoginPage(w, http.StatusTooManyRequests, loginData{
+			NextURL:    nextURL,
+			UserName:   userName,
+			RetryAfter: throttledErr.RetryAfter.Round(time.Second),
+		})
+		return
+	}
+	if err == auth.ErrForbidden {
+		h.renderLoginPage(w, http.StatusForbidden, loginData{
+			NextURL:   nextURL,
+			UserName:  userName,
+			Forbidden: true,
+		})
+		return
+	}
+	if err != nil {
+		logg.Error("cannot check credentials of user %q: %s", userName, err.Error())
+		h.renderLoginPage(w, http.StatusServiceUnavailable, loginData{
+			NextURL:     nextURL,
+			UserName:    userName,
+			Unavailable: true,
+		})
+		return
+	}
+	if !ok {
+		h.renderLoginPage(w, http.StatusUnauthorized, loginData{
+			NextURL:  nextURL,
+			UserName: userName,
+			Failed:   true,
+		})
+		return
+	}
+
+	h.sessions.Issue(w, r, userName)
+	http.Redirect(w, r, nextURL, http.StatusSeeOther)
+}
+
+func (h loginHandler) StartExternalLogin(w http.ResponseWriter, r *http.Request) {
+	ra, ok := h.driver.(auth.RedirectAuthenticator)
+	if !ok {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+
+	flow, err := h.sessions.StartLoginFlow(w, r, sanitizeNextURL(r.URL.Query().Get("next")))
+	if respondwith.ErrorText(w, err) {
+		return
+	}
+	loginURL, err := ra.LoginURL(flow)
+	if err != nil {
+		logg.Error("cannot start external login: %s", err.Error())
+		h.renderLoginPage(w, http.StatusServiceUnavailable, loginData{
+			NextURL:     flow.NextURL,
+			Unavailable: true,
+		})
+		return
+	}
+	http.Redirect(w, r, loginURL, http.StatusSeeOther)
+}
+
+func (h loginHandler) CompleteExternalLogin(w http.ResponseWriter, r *http.Request) {
+	ra, ok := h.driver.(auth.RedirectAuthenticator)
+	if !ok {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+
+	//the state parameter must match the one that we gave out in
+	//StartExternalLogin to prevent CSRF
+	flow, ok := h.sessions.FinishLoginFlow(w, r)
+	query := r.URL.Query()
+	if !ok || query.Get("state") != flow.State {
+		auth.RecordAuthAttempt(h.driver, false, nil)
+		h.renderLoginPage(w, http.StatusBadRequest, loginData{
+			NextURL: flow.NextURL,
+			Failed:  true,
+		})
+		return
+	}
+	if errCode := query.Get("error"); errCode != "" {
+		logg.Info("external login failed with error %q: %s", errCode, query.Get("error_description"))
+		auth.RecordAuthAttempt(h.driver, false, nil)
+		h.renderLoginPage(w, http.StatusUnauthorized, loginData{
+			NextURL: flow.NextURL,
+			Failed:  true,
+		})
+		return
+	}
+
+	userName, err := ra.CompleteLogin(query.Get("code"), flow)
+	if err != nil {
+		logg.Error("cannot complete external login: %s", err.Error())
+		auth.RecordAuthAttempt(h.driver, false, err)
+		h.renderLoginPage(w, http.StatusUnauthorized, loginData{
+			NextURL: flow.NextURL,
+			Failed:  true,
+		})
+		return
+	}
+
+	auth.RecordAuthAttempt(h.driver, true, nil)
+	h.sessions.Issue(w, r, userName)
+	http.Redirect(w, r, sanitizeNextURL(flow.NextURL), http.StatusSeeOther)
+}
+
+func (h loginHandler) Logout(w http.ResponseWriter, r *http.Request) {
+	h.sessions.Revoke(w, r)
+	http.Redirect(w, r, "/login", http.StatusSeeOther)
+}
+
+//sanitizeNextURL ensures that we only redirect to paths within Alltag after
+//login, to avoid becoming an open redirect.
+func sanitizeNextURL(nextURL string) string {
+	if !strings.HasPrefix(nextURL, "/") || strings.HasPrefix(nextURL, "//") || strings.HasPrefix(nextURL, "/\\") {
+		return "/"
+	}
+	return nextURL
+}
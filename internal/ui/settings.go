@@ -0,0 +1,126 @@
+/*******************************************************************************
+*
+* Copyright 2019 Stefan Majewsky <majewsky@gmx.net>
+*
+* This program is free software: you can redistribute it and/or modify it under
+* the terms of the GNU General Public License as published by the Free Software
+* Foundation, either version 3 of the License, or (at your option) any later
+* version.
+*
+* This program is distributed in the hope that it will be useful, but WITHOUT ANY
+* WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+* A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License along with
+* this program. If not, see <http://www.gnu.org/licenses/>.
+*
+*******************************************************************************/
+
+package ui
+
+import (
+	"fmt"
+	"net/http"
+	"net/mail"
+	"strconv"
+	"strings"
+
+	"github.com/sapcc/go-bits/respondwith"
+)
+
+var tEditDigestSettings = tmpl("edit-digest-settings.html", `
+	<form method="POST" action="/settings/digest">
+		<p class="flash flash-primary">
+			Alltag can send you a daily email with your overdue tasks, the tasks that are due today or tomorrow, and the
+			number of tasks that still need to be classified. Nothing is sent on days where there is nothing to report.
+			(This only works if the administrator of Alltag has configured an SMTP server.)
+		</p>
+		<div class="form-row">
+			<label>Options</label>
+			<div class="item-list">
+				<input type="checkbox" name="digest_enabled" id="digest_enabled" value="true" {{if .DigestEnabled}}checked{{end}} />
+				<label for="digest_enabled">Send me a daily digest</label>
+			</div>
+		</div>
+		<div class="form-row">
+			<label for="digest_hour">Send the digest at</label>
+			<select name="digest_hour" id="digest_hour">
+				{{- range $.Hours }}
+					<option value="{{.}}" {{if eq . $.DigestHour}}selected{{end}}>{{printf "%02d:00" .}}</option>
+				{{- end }}
+			</select>
+		</div>
+		<div class="form-row">
+			<label for="digest_mail_address">Email address</label>
+			<input type="email" name="digest_mail_address" id="digest_mail_address" value="{{.DigestMailAddress}}" placeholder="leave empty to use the address from your user account" />
+		</div>
+		<div class="button-row">
+			<button type="submit">Save</button>
+		</div>
+	</form>
+`)
+
+func (h *handler) EditDigestSettings(w http.ResponseWriter, r *http.Request) {
+	settings, err := h.storage.GetUserSettings(currentUser(r))
+	if respondwith.ErrorText(w, err) {
+		return
+	}
+
+	hours := make([]int, 24)
+	for idx := range hours {
+		hours[idx] = idx
+	}
+
+	Page{
+		Title: "Daily digest",
+		Navigation: []BreadcrumbItem{
+			{URL: "/settings/digest", Label: "Daily digest", Current: true},
+		},
+		Template: tEditDigestSettings,
+		Data: struct {
+			DigestEnabled     bool
+			DigestHour        int
+			DigestMailAddress string
+			Hours             []int
+		}{settings.DigestEnabled, settings.DigestHour, settings.DigestMailAddress, hours},
+	}.WriteTo(w)
+}
+
+func (h *handler) UpdateDigestSettings(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if respondwith.ErrorText(w, err) {
+		return
+	}
+	settings, err := h.storage.GetUserSettings(currentUser(r))
+	if respondwith.ErrorText(w, err) {
+		return
+	}
+
+	settings.DigestEnabled = r.PostForm.Get("digest_enabled") == "true"
+	hour, err := strconv.ParseUint(r.PostForm.Get("digest_hour"), 10, 8)
+	if err != nil || hour > 23 {
+		msg := fmt.Sprintf("invalid digest_hour value: %q", r.PostForm.Get("digest_hour"))
+		http.Error(w, msg, http.StatusBadRequest)
+		return
+	}
+	settings.DigestHour = int(hour)
+
+	//only accept plain addresses, since this ends up in the headers of the
+	//digest email
+	address := strings.TrimSpace(r.PostForm.Get("digest_mail_address"))
+	if address != "" {
+		parsed, err := mail.ParseAddress(address)
+		if err != nil || parsed.Address != address {
+			msg := fmt.Sprintf("invalid digest_mail_address value: %q", address)
+			http.Error(w, msg, http.StatusBadRequest)
+			return
+		}
+	}
+	settings.DigestMailAddress = address
+
+	err = h.storage.SaveUserSettings(settings)
+	if respondwith.ErrorText(w, err) {
+		return
+	}
+	http.Redirect(w, r, "/settings/digest", http.StatusSeeOther)
+}
@@ -0,0 +1,136 @@
+/*******************************************************************************
+*
+* Copyright 2019 Stefan Majewsky <majewsky@gmx.net>
+*
+* This program is free software: you can redistribute it and/or modify it under
+* the terms of the GNU General Public License as published by the Free Software
+* Foundation, either version 3 of the License, or (at your option) any later
+* version.
+*
+* This program is distributed in the hope that it will be useful, but WITHOUT ANY
+* WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+* A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License along with
+* this program. If not, see <http://www.gnu.org/licenses/>.
+*
+*******************************************************************************/
+
+package ui
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/majewsky/alltag/internal/date"
+	"github.com/majewsky/alltag/internal/db"
+	"github.com/sapcc/go-bits/respondwith"
+)
+
+//snoozeLaterToday is how long a task is snoozed when the user chooses "later
+//today".
+const snoozeLaterToday = 4 * time.Hour
+
+var tSnoozeTask = tmpl("snooze-task.html", `
+	<form method="POST" action="/tasks/{{.Task.ID}}/snooze">
+		<div class="form-row">
+			<label>Label</label>
+			<input required type="text" value="{{.Task.Label}}" readonly />
+		</div>
+		{{- if .Task.IsSnoozed .Now }}
+			<div class="flash flash-warning">
+				This task is already snoozed until {{.Task.SnoozedUntil.Local.Format "2006-01-02 15:04"}}.
+			</div>
+		{{- end }}
+		<div class="form-row">
+			<label for="snooze_for">Suggest this task again</label>
+			<select name="snooze_for" id="snooze_for">
+				<option value="later_today">Later today (in a few hours)</option>
+				<option value="tomorrow">Tomorrow</option>
+				<option value="days">In some days</option>
+				{{- if .Task.IsSnoozed .Now }}
+					<option value="now">Right now</option>
+				{{- end }}
+			</select>
+		</div>
+		<div class="form-row">
+			<label for="snooze_days">Number of days (when snoozing for some days)</label>
+			<input type="number" name="snooze_days" id="snooze_days" value="3" min="1" step="1" />
+		</div>
+		<div class="flash flash-primary">
+			While the task is snoozed, the start page suggests the next-best task instead.
+		</div>
+		<div class="button-row">
+			<button type="submit">Not now</button>
+		</div>
+	</form>
+`)
+
+func (h *handler) AskSnoozeTask(w http.ResponseWriter, r *http.Request) {
+	task := h.FindTaskFromRequest(w, r)
+	if task == nil {
+		return
+	}
+
+	Page{
+		Title: "Snooze task",
+		Navigation: []BreadcrumbItem{
+			{URL: "/tasks", Label: "Tasks"},
+			{URL: fmt.Sprintf("/tasks/%d", task.ID), Label: fmt.Sprintf("#%d", task.ID)},
+			{URL: r.URL.Path, Label: "Snooze", Current: true},
+		},
+		Template: tSnoozeTask,
+		Data: struct {
+			Task *db.Task
+			Now  time.Time
+		}{task, time.Now()},
+	}.WriteTo(w)
+}
+
+func (h *handler) SnoozeTask(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if respondwith.ErrorText(w, err) {
+		return
+	}
+	task := h.FindTaskFromRequest(w, r)
+	if task == nil {
+		return
+	}
+
+	now := time.Now()
+	var snoozedUntil time.Time
+	switch r.PostForm.Get("snooze_for") {
+	case "later_today":
+		snoozedUntil = now.Add(snoozeLaterToday)
+	case "tomorrow":
+		snoozedUntil = date.FromTime(now).AddDays(1).FirstSecondIn(time.Local)
+	case "days":
+		days, err := strconv.ParseUint(r.PostForm.Get("snooze_days"), 10, 16)
+		if err != nil || days == 0 {
+			msg := fmt.Sprintf("invalid snooze_days value: %q", r.PostForm.Get("snooze_days"))
+			http.Error(w, msg, http.StatusBadRequest)
+			return
+		}
+		snoozedUntil = date.FromTime(now).AddDays(int(days)).FirstSecondIn(time.Local)
+	case "now":
+		snoozedUntil = now
+	default:
+		msg := fmt.Sprintf("invalid snooze_for value: %q", r.PostForm.Get("snooze_for"))
+		http.Error(w, msg, http.StatusBadRequest)
+		return
+	}
+
+	if snoozedUntil.After(now) {
+		snoozedUntil = snoozedUntil.UTC()
+		task.SnoozedUntil = &snoozedUntil
+	} else {
+		task.SnoozedUntil = nil
+	}
+	err = h.storage.SaveTask(task)
+	if respondwith.ErrorText(w, err) {
+		return
+	}
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
@@ -21,10 +21,7 @@ package ui
 import (
 	"database/sql"
 	"net/http"
-	"sort"
-	"time"
 
-	"github.com/lib/pq"
 	"github.com/majewsky/alltag/internal/db"
 	"github.com/sapcc/go-bits/respondwith"
 )
@@ -74,19 +71,6 @@ var tStartPage = tmpl("startpage.html", `
 	</div>
 `)
 
-const sqlGetOpenTasks = `
-	SELECT t.*
-	FROM tasks t
-	WHERE class IS NOT NULL AND username = $1
-`
-
-const sqlGetOpenTasksByLocation = `
-	SELECT t.id, ARRAY_AGG(l.location_id)
-	FROM tasks t JOIN task_locations l ON l.task_id = t.id
-	WHERE class IS NOT NULL AND username = $1 AND starts_at <= NOW()
-	GROUP BY t.id
-`
-
 func (h *handler) StartPage(w http.ResponseWriter, r *http.Request) {
 	//can only show normal start page once locations are configured
 	locations, err := h.AllLocations(r)
@@ -98,66 +82,20 @@ func (h *handler) StartPage(w http.ResponseWriter, r *http.Request) {
 	}
 
 	//check for unclassified tasks
-	unclassifiedTaskID, err := h.dbi.SelectInt(
-		`SELECT id FROM tasks WHERE class IS NULL AND username = $1 ORDER BY id ASC LIMIT 1`,
-		currentUser(r),
-	)
-	if err == sql.ErrNoRows {
-		unclassifiedTaskID = 0
-	} else if respondwith.ErrorText(w, err) {
+	var unclassifiedTaskID int64
+	unclassifiedTask, err := h.storage.FindUnclassifiedTask(currentUser(r))
+	if err == nil {
+		unclassifiedTaskID = unclassifiedTask.ID
+	} else if err != sql.ErrNoRows && respondwith.ErrorText(w, err) {
 		return
 	}
 
-	//retrieve all open tasks incl. their location mappings
-	var openTasks []db.Task
-	_, err = h.dbi.Select(&openTasks, sqlGetOpenTasks, currentUser(r))
-	if respondwith.ErrorText(w, err) {
-		return
-	}
-	now := time.Now()
-	sort.Slice(openTasks, func(i, j int) bool {
-		return openTasks[i].CurrentPriority(now) < openTasks[j].CurrentPriority(now)
-	})
-
-	//retrieve location associations for those tasks
-	rows, err := h.dbi.Query(sqlGetOpenTasksByLocation, currentUser(r))
-	if respondwith.ErrorText(w, err) {
-		return
-	}
-	locationIDsForTask := make(map[int64][]int64)
-	for rows.Next() {
-		var (
-			taskID      int64
-			locationIDs []int64
-		)
-		err := rows.Scan(&taskID, pq.Array(&locationIDs))
-		if respondwith.ErrorText(w, err) {
-			return
-		}
-		locationIDsForTask[taskID] = locationIDs
-	}
-	err = rows.Close()
+	//select next task for all pairs of (location, taskClass)
+	nextTaskIDs, err := h.storage.NextTasks(currentUser(r))
 	if respondwith.ErrorText(w, err) {
 		return
 	}
 
-	//select next task for all pairs of (location, taskClass)
-	nextMentalTaskIDs := make(map[int64]int64)
-	nextPhysicalTaskIDs := make(map[int64]int64)
-	for _, task := range openTasks {
-		for _, locationID := range locationIDsForTask[task.ID] {
-			//because `openTasks` is sorted by current priority, the last task to
-			//write into this particular `nextTaskIDs[][]` slot is the one with the
-			//highest current priority
-			switch *task.Class {
-			case db.TaskClassMental:
-				nextMentalTaskIDs[locationID] = task.ID
-			case db.TaskClassPhysical:
-				nextPhysicalTaskIDs[locationID] = task.ID
-			}
-		}
-	}
-
 	Page{
 		Title:    "Alltag",
 		Template: tStartPage,
@@ -166,6 +104,6 @@ func (h *handler) StartPage(w http.ResponseWriter, r *http.Request) {
 			NextMentalTaskIDs   map[int64]int64
 			NextPhysicalTaskIDs map[int64]int64
 			UnclassifiedTaskID  int64
-		}{locations, nextMentalTaskIDs, nextPhysicalTaskIDs, unclassifiedTaskID},
+		}{locations, nextTaskIDs[db.TaskClassMental], nextTaskIDs[db.TaskClassPhysical], unclassifiedTaskID},
 	}.WriteTo(w)
 }
@@ -23,9 +23,11 @@ import (
 	"net/http"
 	"net/url"
 	"strconv"
+	"strings"
 
 	"github.com/majewsky/alltag/internal/date"
 	"github.com/majewsky/alltag/internal/db"
+	"github.com/majewsky/alltag/internal/rrule"
 	"github.com/sapcc/go-bits/respondwith"
 )
 
@@ -34,8 +36,19 @@ var tShowTask = tmpl("show-task.html", `
 		<p>Do this:</p>
 		<p class="task-description">{{.Label}}</p>
 	</div>
+	{{- if .Notes }}
+	<div class="contains-body-text">
+		{{- range paragraphs .Notes }}
+			<p>{{.}}</p>
+		{{- end }}
+	</div>
+	{{- end }}
 	<div class="button-row">
 		<a class="button" href="/tasks/{{.ID}}/close">Done!</a>
+		<a class="button" href="/tasks/{{.ID}}/snooze">Not now</a>
+		{{- if .PredecessorID }}
+			<a class="button" href="/tasks/{{.ID}}/chain">Show previous steps</a>
+		{{- end }}
 	</div>
 `)
 
@@ -101,7 +114,13 @@ func (h *handler) CreateTask(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "label may not be empty", http.StatusBadRequest)
 		return
 	}
-	err = h.dbi.Insert(&task)
+	err = h.storage.Transaction(func(s db.Storage) error {
+		err := s.SaveTask(&task)
+		if err != nil {
+			return err
+		}
+		return s.EmitTaskEvent(db.WebhookEventTaskCreated, task)
+	})
 	if respondwith.ErrorText(w, err) {
 		return
 	}
@@ -119,6 +138,10 @@ var tEditTask = tmpl("edit-task.html", `
 			<label for="label">Label</label>
 			<input required type="text" name="label" id="label" value="{{.Task.Label}}" />
 		</div>
+		<div class="form-row">
+			<label for="notes">Notes</label>
+			<textarea name="notes" id="notes" rows="4">{{.Task.Notes}}</textarea>
+		</div>
 		<div class="form-row">
 			<label for="task_class">Class</label>
 			<select name="task_class" id="task_class" required {{if .IsClassified}}data-initial-value="{{.Task.Class}}"{{end}}>
@@ -168,13 +191,25 @@ var tEditTask = tmpl("edit-task.html", `
 				<input required type="date" name="due_at" id="due_at" value="{{if .IsClassified}}{{.Task.DueAt}}{{end}}" />
 			</div>
 		</div>
-		{{if .Task.RecurrenceDays}}
-			<input type="checkbox" id="has_recurrence" name="has_recurrence" value="true" class="for-fieldset" {{if .Task.RecurrenceDays}}checked{{end}} />
+		{{if .Task.IsRecurring}}
+			<input type="checkbox" id="has_recurrence" name="has_recurrence" value="true" class="for-fieldset" checked />
 			<fieldset>
 				<label for="has_recurrence">Configure recurrence</label>
 				<div class="form-row">
-					<label for="recurrence_days">Recurrence interval (in days)</label>
-					<input type="number" name="recurrence_days" id="recurrence_days" value="{{.Task.RecurrenceDays}}" min="0" step="1" />
+					<label for="recurrence_mode">Respawn</label>
+					<select name="recurrence_mode" id="recurrence_mode">
+						<option value="days">Some days after closing</option>
+						<option value="days_from_due_date" {{if .Task.RecurrenceFromDueDate}}selected{{end}}>Some days after the previous due date</option>
+						<option value="rule" {{if .Task.RecurrenceRule}}selected{{end}}>On a calendar schedule</option>
+					</select>
+				</div>
+				<div class="form-row">
+					<label for="recurrence_days">Recurrence interval (in days, when not on a calendar schedule)</label>
+					<input type="number" name="recurrence_days" id="recurrence_days" value="{{if .Task.RecurrenceDays}}{{.Task.RecurrenceDays}}{{end}}" min="0" step="1" />
+				</div>
+				<div class="form-row">
+					<label for="recurrence_rule">Recurrence rule (when on a calendar schedule)</label>
+					<input type="text" name="recurrence_rule" id="recurrence_rule" value="{{if .Task.RecurrenceRule}}{{.Task.RecurrenceRule}}{{end}}" placeholder="e.g. FREQ=WEEKLY;BYDAY=MO,TH" />
 				</div>
 			</fieldset>
 		{{end}}
@@ -240,30 +275,12 @@ func (h *handler) UpdateTask(w http.ResponseWriter, r *http.Request) {
 	for _, loc := range locations {
 		isValidLocationID[loc.ID] = true
 	}
-	isTaskLocation, err := h.FindTaskLocations(*task)
-	if respondwith.ErrorText(w, err) {
-		return
-	}
-
-	//do everything in a transaction to enable easy rollback
-	tx, err := h.dbi.Begin()
-	if respondwith.ErrorText(w, err) {
-		return
-	}
 
 	//update task attributes
+	wasClassified := task.IsClassified()
 	task.Label = r.PostForm.Get("label")
-	if task.Label == "" {
-		http.Error(w, "label may not be empty", http.StatusBadRequest)
-		return
-	}
-
+	task.Notes = strings.TrimSpace(strings.Replace(r.PostForm.Get("notes"), "\r\n", "\n", -1))
 	class := db.TaskClass(r.PostForm.Get("task_class"))
-	if !db.IsTaskClass[class] {
-		msg := fmt.Sprintf("invalid task class: %q", class)
-		http.Error(w, msg, http.StatusBadRequest)
-		return
-	}
 	task.Class = &class
 
 	task.InitialPriority, err = parsePriority(r.PostForm.Get("initial_priority"))
@@ -276,15 +293,10 @@ func (h *handler) UpdateTask(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-	if task.InitialPriority >= task.FinalPriority {
-		http.Error(w, "final priority must be higher than initial priority", http.StatusBadRequest)
-		return
-	}
 
-	task.RecurrenceDays, err = parseRecurrenceDays(r.PostForm)
+	err = parseRecurrence(r.PostForm, task)
 	if err != nil {
-		msg := fmt.Sprintf("invalid recurrence_days value: %q", r.PostForm.Get("recurrence_days"))
-		http.Error(w, msg, http.StatusBadRequest)
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
@@ -297,22 +309,15 @@ func (h *handler) UpdateTask(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-	if task.DueAt.Before(date.Now()) {
-		http.Error(w, "due date cannot be in the past", http.StatusBadRequest)
-		return
-	}
-	if !task.DueAt.After(task.StartsAt) {
-		http.Error(w, "due date must occur after start date", http.StatusBadRequest)
-		return
-	}
 
-	_, err = tx.Update(task)
-	if respondwith.ErrorText(w, err) {
+	err = task.CheckClassification(date.Now())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	//update task locations
-	newLocationIDs := make(map[int64]bool)
+	//validate task locations
+	var newLocationIDs []int64
 	for _, idStr := range r.PostForm["location_ids"] {
 		id, err := strconv.ParseInt(idStr, 10, 64)
 		if err != nil || !isValidLocationID[id] {
@@ -320,30 +325,25 @@ func (h *handler) UpdateTask(w http.ResponseWriter, r *http.Request) {
 			http.Error(w, msg, http.StatusBadRequest)
 			return
 		}
-		newLocationIDs[id] = true
+		newLocationIDs = append(newLocationIDs, id)
 	}
 	if len(newLocationIDs) == 0 {
 		http.Error(w, "need to specify at least one location", http.StatusBadRequest)
 		return
 	}
-	for locationID := range newLocationIDs {
-		if !isTaskLocation[locationID] {
-			err := tx.Insert(&db.TaskLocation{TaskID: task.ID, LocationID: locationID})
-			if respondwith.ErrorText(w, err) {
-				return
-			}
+
+	//do everything in a transaction to enable easy rollback
+	err = h.storage.Transaction(func(s db.Storage) error {
+		err := s.SaveTask(task)
+		if err != nil {
+			return err
 		}
-	}
-	for locationID := range isTaskLocation {
-		if !newLocationIDs[locationID] {
-			_, err := tx.Delete(&db.TaskLocation{TaskID: task.ID, LocationID: locationID})
-			if respondwith.ErrorText(w, err) {
-				return
-			}
+		err = s.SetTaskLocations(*task, newLocationIDs)
+		if err != nil || wasClassified {
+			return err
 		}
-	}
-
-	err = tx.Commit()
+		return s.EmitTaskEvent(db.WebhookEventTaskClassified, *task)
+	})
 	if respondwith.ErrorText(w, err) {
 		return
 	}
@@ -356,17 +356,35 @@ var tCloseTask = tmpl("close-task.html", `
 			<label>Label</label>
 			<input required type="text" value="{{.Label}}" readonly />
 		</div>
-		<input type="checkbox" id="has_recurrence" name="has_recurrence" value="true" class="for-fieldset" {{if .RecurrenceDays}}checked{{end}} />
+		<input type="checkbox" id="has_recurrence" name="has_recurrence" value="true" class="for-fieldset" {{if .IsRecurring}}checked{{end}} />
 		<fieldset>
 			<label for="has_recurrence">Configure recurrence</label>
 			<div class="form-row">
-				<label for="recurrence_days">Recurrence interval (in days)</label>
+				<label for="recurrence_mode">Respawn</label>
+				<select name="recurrence_mode" id="recurrence_mode">
+					<option value="days">Some days after closing</option>
+					<option value="days_from_due_date" {{if .RecurrenceFromDueDate}}selected{{end}}>Some days after the previous due date</option>
+					<option value="rule" {{if .RecurrenceRule}}selected{{end}}>On a calendar schedule</option>
+				</select>
+			</div>
+			<div class="form-row">
+				<label for="recurrence_days">Recurrence interval (in days, when not on a calendar schedule)</label>
 				<input type="number" name="recurrence_days" id="recurrence_days" value="{{if .RecurrenceDays}}{{.RecurrenceDays}}{{end}}" min="0" step="1" />
 			</div>
+			<div class="form-row">
+				<label for="recurrence_rule">Recurrence rule (when on a calendar schedule)</label>
+				<input type="text" name="recurrence_rule" id="recurrence_rule" value="{{if .RecurrenceRule}}{{.RecurrenceRule}}{{end}}" placeholder="e.g. FREQ=WEEKLY;BYDAY=MO,TH" />
+			</div>
 			<div class="flash flash-primary">
-				Upon closing, the task will respawn with the start date set to that many days from now.
+				Upon closing, the task will respawn with the start date set to that many days from now, with the due date set
+				to that many days after the previous due date (skipping any missed periods), or with the start date set to
+				the next date matching the recurrence rule. Recurrence rules use the RRULE syntax from RFC 5545, e.g.
+				<code>FREQ=MONTHLY;BYMONTHDAY=1</code> for the first of every month.
 			</div>
 		</fieldset>
+		<div class="flash flash-primary">
+			Without recurrence, you will be asked for the next step after closing the task.
+		</div>
 		<div class="button-row">
 			<button type="submit">Close</button>
 		</div>
@@ -401,31 +419,31 @@ func (h *handler) CloseTask(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	task.RecurrenceDays, err = parseRecurrenceDays(r.PostForm)
+	err = parseRecurrence(r.PostForm, task)
 	if err != nil {
-		msg := fmt.Sprintf("invalid recurrence_days value: %q", r.PostForm.Get("recurrence_days"))
-		http.Error(w, msg, http.StatusBadRequest)
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-
-	if task.RecurrenceDays == 0 {
-		//without recurrence, closing a task just deletes it
-		_, err := h.dbi.Delete(task)
-		if respondwith.ErrorText(w, err) {
-			return
-		}
-	} else {
-		//with recurrence, closing a task shifts its start and due date into the future
-		durationInDays := task.DueAt.Sub(task.StartsAt)
-		task.StartsAt = date.Now().AddDays(int(task.RecurrenceDays))
-		task.DueAt = task.StartsAt.AddDays(durationInDays)
-		_, err := h.dbi.Update(task)
-		if respondwith.ErrorText(w, err) {
+	if task.RecurrenceRule != nil {
+		_, ok := task.NextOccurrence(date.Now())
+		if !ok {
+			msg := fmt.Sprintf("recurrence rule %q does not match any date", task.RecurrenceRule.String())
+			http.Error(w, msg, http.StatusBadRequest)
 			return
 		}
 	}
 
-	http.Redirect(w, r, "/", http.StatusSeeOther)
+	err = h.storage.CloseTask(task)
+	if respondwith.ErrorText(w, err) {
+		return
+	}
+
+	//when a non-recurring task was closed, offer to enter the next step
+	if task.IsClosed() {
+		http.Redirect(w, r, fmt.Sprintf("/tasks/%d/next", task.ID), http.StatusSeeOther)
+	} else {
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+	}
 }
 
 func parsePriority(input string) (uint16, error) {
@@ -436,10 +454,32 @@ func parsePriority(input string) (uint16, error) {
 	return uint16(val), nil
 }
 
-func parseRecurrenceDays(postForm url.Values) (int32, error) {
+//parseRecurrence parses the recurrence fields that appear in the task
+//classification form and the close form, and stores the result in the given
+//task's RecurrenceDays, RecurrenceFromDueDate and RecurrenceRule fields.
+func parseRecurrence(postForm url.Values, task *db.Task) error {
+	task.RecurrenceDays = 0
+	task.RecurrenceFromDueDate = false
+	task.RecurrenceRule = nil
 	if postForm.Get("has_recurrence") != "true" {
-		return 0, nil
+		return nil
+	}
+
+	mode := postForm.Get("recurrence_mode")
+	if mode == "rule" {
+		rule, err := rrule.Parse(postForm.Get("recurrence_rule"))
+		if err != nil {
+			return fmt.Errorf("invalid recurrence rule: %s", err.Error())
+		}
+		task.RecurrenceRule = &rule
+		return nil
 	}
+
 	val, err := strconv.ParseUint(postForm.Get("recurrence_days"), 0, 31)
-	return int32(val), err
+	if err != nil {
+		return fmt.Errorf("invalid recurrence_days value: %q", postForm.Get("recurrence_days"))
+	}
+	task.RecurrenceDays = int32(val)
+	task.RecurrenceFromDueDate = mode == "days_from_due_date" && val != 0
+	return nil
 }
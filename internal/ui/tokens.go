@@ -0,0 +1,268 @@
+/*******************************************************************************
+*
+* Copyright 2019 Stefan Majewsky <majewsky@gmx.net>
+*
+* This program is free software: you can redistribute it and/or modify it under
+* the terms of the GNU General Public License as published by the Free Software
+* Foundation, either version 3 of the License, or (at your option) any later
+* version.
+*
+* This program is distributed in the hope that it will be useful, but WITHOUT ANY
+* WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+* A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License along with
+* this program. If not, see <http://www.gnu.org/licenses/>.
+*
+*******************************************************************************/
+
+package ui
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+	"github.com/majewsky/alltag/internal/db"
+	"github.com/majewsky/alltag/internal/mailcapture"
+	"github.com/sapcc/go-bits/respondwith"
+)
+
+var tListAPITokens = tmpl("list-api-tokens.html", `
+	<p class="flash flash-primary">
+		API tokens can be used by scripts and other non-interactive clients to access the JSON API in your name,
+		without knowing your password. Read-only tokens can only be used to retrieve data. Calendar feed tokens can
+		only be used to subscribe to the due dates of your tasks in a calendar app.
+		{{- if .MailCaptureEnabled }} Mail capture tokens can only be used to create tasks by sending an email.{{ end }}
+	</p>
+	<div class="table-container">
+		<table class="table responsive has-hover-highlight">
+			<thead>
+				<tr>
+					<th class="grow-column">Label</th>
+					<th>Scope</th>
+					<th>Created at</th>
+					<th>Last used at</th>
+					<th class="actions">Actions</th>
+				</tr>
+			</thead>
+			<tbody>
+				{{- if .APITokens -}}
+					{{- range .APITokens -}}
+						<tr>
+							<td class="grow-column" data-label="Label">{{.Label}}</td>
+							<td class="nobr-column" data-label="Scope">{{.Scope}}</td>
+							<td class="nobr-column" data-label="Created at">{{.CreatedAt.Format "2006-01-02 15:04"}}</td>
+							<td class="nobr-column" data-label="Last used at">{{if .LastUsedAt}}{{.LastUsedAt.Format "2006-01-02 15:04"}}{{else}}<span class="text-muted">Never</span>{{end}}</td>
+							<td class="actions"><a href="/settings/tokens/{{ .ID }}/revoke">Revoke</a></td>
+						</tr>
+					{{- end -}}
+				{{- else -}}
+					<tr>
+						<td colspan="5" class="text-muted text-center">No entries</td>
+					</tr>
+				{{- end -}}
+			</tbody>
+		</table>
+	</div>
+	<form method="POST" action="/settings/tokens">
+		<div class="form-row">
+			<label for="label">Label</label>
+			<input required type="text" name="label" id="label" placeholder="e.g. phone automation" />
+		</div>
+		<div class="form-row">
+			<label for="scope">Scope</label>
+			<select name="scope" id="scope" required>
+				<option value="read-only">Read-only</option>
+				<option value="read-write">Read-write</option>
+				<option value="calendar-feed">Calendar feed</option>
+				{{- if .MailCaptureEnabled }}
+				<option value="mail-capture">Mail capture</option>
+				{{- end }}
+			</select>
+		</div>
+		<div class="button-row">
+			<button type="submit">Create token</button>
+		</div>
+	</form>
+`)
+
+func (h *handler) ListAPITokens(w http.ResponseWriter, r *http.Request) {
+	tokens, err := h.storage.ListAPITokens(currentUser(r))
+	if respondwith.ErrorText(w, err) {
+		return
+	}
+
+	Page{
+		Title: "Manage API tokens",
+		Navigation: []BreadcrumbItem{
+			{URL: "/settings/tokens", Label: "API tokens", Current: true},
+		},
+		Template: tListAPITokens,
+		Data: struct {
+			APITokens          []db.APIToken
+			MailCaptureEnabled bool
+		}{tokens, h.mailCaptureAddress != ""},
+	}.WriteTo(w)
+}
+
+var tShowNewAPIToken = tmpl("show-new-api-token.html", `
+	<p class="flash flash-success">Created API token <strong>{{.APIToken.Label}}</strong> ({{.APIToken.Scope}}).</p>
+	{{- if .FeedURL }}
+	<p>
+		This is the only time that this token will be shown. Copy the following URL now and subscribe to it in your
+		calendar app to see the due dates of all your tasks:
+	</p>
+	<pre>{{.FeedURL}}</pre>
+	{{- if .Locations }}
+	<p>To only see the tasks at one location, use one of the following URLs instead:</p>
+	<ul>
+		{{- range .Locations }}
+			<li>{{.Label}}: <code>{{$.FeedURL}}?location={{.ID}}</code></li>
+		{{- end }}
+	</ul>
+	{{- end }}
+	<p>
+		To also see the start dates of your tasks, append <code>start_dates=true</code> to the query string. The
+		other filters of the task list (e.g. <code>class=mental</code>) can be used in the same way.
+	</p>
+	{{- else if .MailCaptureAddress }}
+	<p>
+		This is the only time that this token will be shown. Save the following address in your address book. Every
+		email sent (or forwarded) to it becomes a new task, with the subject as label and the text as notes:
+	</p>
+	<pre>{{.MailCaptureAddress}}</pre>
+	{{- else }}
+	<p>
+		This is the only time that this token will be shown. Copy it now and pass it to your client in the
+		<code>Authorization: Bearer ...</code> header:
+	</p>
+	<pre>{{.Token}}</pre>
+	{{- end }}
+	<div class="button-row">
+		<a class="button" href="/settings/tokens">Back to API tokens</a>
+	</div>
+`)
+
+func (h *handler) CreateAPIToken(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if respondwith.ErrorText(w, err) {
+		return
+	}
+
+	label := r.PostForm.Get("label")
+	if label == "" {
+		http.Error(w, "label may not be empty", http.StatusBadRequest)
+		return
+	}
+	scope := db.APITokenScope(r.PostForm.Get("scope"))
+	if !db.IsAPITokenScope[scope] || (scope == db.APITokenScopeMailCapture && h.mailCaptureAddress == "") {
+		http.Error(w, fmt.Sprintf("invalid scope: %q", scope), http.StatusBadRequest)
+		return
+	}
+
+	apiToken, token, err := h.storage.CreateAPIToken(currentUser(r), label, scope)
+	if respondwith.ErrorText(w, err) {
+		return
+	}
+
+	var (
+		feedURL            string
+		locations          []db.Location
+		mailCaptureAddress string
+	)
+	switch scope {
+	case db.APITokenScopeCalendarFeed:
+		feedURL = calendarFeedURL(r, token)
+		locations, err = h.AllLocations(r)
+		if respondwith.ErrorText(w, err) {
+			return
+		}
+	case db.APITokenScopeMailCapture:
+		mailCaptureAddress = mailcapture.AddressForToken(h.mailCaptureAddress, token)
+	}
+
+	Page{
+		Title: "New API token",
+		Navigation: []BreadcrumbItem{
+			{URL: "/settings/tokens", Label: "API tokens"},
+			{URL: r.URL.Path, Label: "New", Current: true},
+		},
+		ContainsBodyText: true,
+		Template:         tShowNewAPIToken,
+		Data: struct {
+			APIToken           *db.APIToken
+			Token              string
+			FeedURL            string
+			Locations          []db.Location
+			MailCaptureAddress string
+		}{apiToken, token, feedURL, locations, mailCaptureAddress},
+	}.WriteTo(w)
+}
+
+//calendarFeedURL returns the URL of the calendar feed for the given token, as
+//seen from the user's browser.
+func calendarFeedURL(r *http.Request, token string) string {
+	scheme := "http"
+	if r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https" {
+		scheme = "https"
+	}
+	return fmt.Sprintf("%s://%s/feed/%s.ics", scheme, r.Host, token)
+}
+
+func (h *handler) FindAPITokenFromRequest(w http.ResponseWriter, r *http.Request) *db.APIToken {
+	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if respondwith.ErrorText(w, err) {
+		return nil
+	}
+	apiToken, err := h.storage.FindAPITokenByID(currentUser(r), id)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return nil
+	}
+	if respondwith.ErrorText(w, err) {
+		return nil
+	}
+	return apiToken
+}
+
+var tRevokeAPIToken = tmpl("revoke-api-token.html", `
+	<form class="contains-body-text" method="POST" action="/settings/tokens/{{.ID}}/revoke">
+		<p>Really revoke the API token <strong>{{.Label}}</strong>? Clients using this token will not be able to access Alltag anymore.</p>
+		<div class="button-row">
+			<button type="submit">Revoke permanently</button>
+		</div>
+	</form>
+`)
+
+func (h *handler) AskRevokeAPIToken(w http.ResponseWriter, r *http.Request) {
+	apiToken := h.FindAPITokenFromRequest(w, r)
+	if apiToken == nil {
+		return
+	}
+
+	Page{
+		Title: "Revoke API token",
+		Navigation: []BreadcrumbItem{
+			{URL: "/settings/tokens", Label: "API tokens"},
+			{URL: r.URL.Path, Label: "Revoke", Current: true},
+		},
+		Template: tRevokeAPIToken,
+		Data:     apiToken,
+	}.WriteTo(w)
+}
+
+func (h *handler) RevokeAPIToken(w http.ResponseWriter, r *http.Request) {
+	apiToken := h.FindAPITokenFromRequest(w, r)
+	if apiToken == nil {
+		return
+	}
+
+	err := h.storage.DeleteAPIToken(apiToken)
+	if respondwith.ErrorText(w, err) {
+		return
+	}
+	http.Redirect(w, r, "/settings/tokens", http.StatusSeeOther)
+}
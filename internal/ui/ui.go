@@ -26,18 +26,23 @@ import (
 
 	"github.com/gorilla/mux"
 	"github.com/majewsky/alltag/internal/db"
+	"github.com/majewsky/alltag/internal/metrics"
 	"github.com/sapcc/go-bits/respondwith"
-	"gopkg.in/gorp.v2"
 )
 
 type handler struct {
-	dbi *gorp.DbMap
+	storage db.Storage
+	//the base address for mail capture, or "" if mail capture is disabled
+	mailCaptureAddress string
 }
 
-//NewHandler returns a http.Handler serving Alltag's UI.
-func NewHandler(dbi *gorp.DbMap) http.Handler {
-	h := handler{dbi}
+//NewHandler returns a http.Handler serving Alltag's UI. If mail capture is
+//enabled, its base address must be given, so that the capture addresses can
+//be shown to the users.
+func NewHandler(storage db.Storage, mailCaptureAddress string) http.Handler {
+	h := handler{storage, mailCaptureAddress}
 	r := mux.NewRouter()
+	r.Use(metrics.InstrumentRoutes)
 
 	r.Methods("GET").Path("/").
 		HandlerFunc(h.StartPage)
@@ -59,10 +64,20 @@ func NewHandler(dbi *gorp.DbMap) http.Handler {
 	r.Methods("POST").Path("/locations/{id:[0-9]+}/delete").
 		HandlerFunc(h.DeleteLocation)
 
+	r.Methods("GET").Path("/tasks").
+		HandlerFunc(h.ListTasks)
+	r.Methods("POST").Path("/tasks").
+		HandlerFunc(h.UpdateTasksInBulk)
 	r.Methods("GET").Path("/tasks/new").
 		HandlerFunc(h.NewTask)
 	r.Methods("POST").Path("/tasks/new").
 		HandlerFunc(h.CreateTask)
+	r.Methods("GET").Path("/tasks/export.ics").
+		HandlerFunc(h.ExportTasks)
+	r.Methods("GET").Path("/tasks/import").
+		HandlerFunc(h.AskImportTasks)
+	r.Methods("POST").Path("/tasks/import").
+		HandlerFunc(h.ImportTasks)
 	r.Methods("GET").Path("/tasks/{id:[0-9]+}").
 		HandlerFunc(h.ShowTask)
 	r.Methods("GET").Path("/tasks/{id:[0-9]+}/edit").
@@ -73,37 +88,62 @@ func NewHandler(dbi *gorp.DbMap) http.Handler {
 		HandlerFunc(h.AskCloseTask)
 	r.Methods("POST").Path("/tasks/{id:[0-9]+}/close").
 		HandlerFunc(h.CloseTask)
+	r.Methods("GET").Path("/tasks/{id:[0-9]+}/snooze").
+		HandlerFunc(h.AskSnoozeTask)
+	r.Methods("POST").Path("/tasks/{id:[0-9]+}/snooze").
+		HandlerFunc(h.SnoozeTask)
+	r.Methods("GET").Path("/tasks/{id:[0-9]+}/next").
+		HandlerFunc(h.AskNextStep)
+	r.Methods("POST").Path("/tasks/{id:[0-9]+}/next").
+		HandlerFunc(h.CreateNextStep)
+	r.Methods("GET").Path("/tasks/{id:[0-9]+}/chain").
+		HandlerFunc(h.ShowTaskChain)
+
+	r.Methods("GET").Path("/done").
+		HandlerFunc(h.ShowDoneLog)
+
+	r.Methods("GET").Path("/feed/{token}.ics").
+		HandlerFunc(h.ShowCalendarFeed)
+
+	r.Methods("GET").Path("/settings/digest").
+		HandlerFunc(h.EditDigestSettings)
+	r.Methods("POST").Path("/settings/digest").
+		HandlerFunc(h.UpdateDigestSettings)
+	r.Methods("GET").Path("/settings/tokens").
+		HandlerFunc(h.ListAPITokens)
+	r.Methods("POST").Path("/settings/tokens").
+		HandlerFunc(h.CreateAPIToken)
+	r.Methods("GET").Path("/settings/tokens/{id:[0-9]+}/revoke").
+		HandlerFunc(h.AskRevokeAPIToken)
+	r.Methods("POST").Path("/settings/tokens/{id:[0-9]+}/revoke").
+		HandlerFunc(h.RevokeAPIToken)
+	r.Methods("GET").Path("/settings/webhooks").
+		HandlerFunc(h.ListWebhooks)
+	r.Methods("POST").Path("/settings/webhooks").
+		HandlerFunc(h.CreateWebhook)
+	r.Methods("GET").Path("/settings/webhooks/{id:[0-9]+}").
+		HandlerFunc(h.ShowWebhook)
+	r.Methods("GET").Path("/settings/webhooks/{id:[0-9]+}/delete").
+		HandlerFunc(h.AskDeleteWebhook)
+	r.Methods("POST").Path("/settings/webhooks/{id:[0-9]+}/delete").
+		HandlerFunc(h.DeleteWebhook)
 
 	return r
 }
 
 func (h *handler) AllLocations(r *http.Request) ([]db.Location, error) {
-	var locations []db.Location
-	_, err := h.dbi.Select(&locations,
-		`SELECT * FROM locations WHERE username = $1 ORDER BY label`,
-		currentUser(r),
-	)
-	return locations, err
+	return h.storage.ListLocations(currentUser(r))
 }
 
 func (h *handler) FindTaskFromRequest(w http.ResponseWriter, r *http.Request) *db.Task {
-	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
-	if respondwith.ErrorText(w, err) {
+	task := h.FindAnyTaskFromRequest(w, r)
+	if task == nil {
 		return nil
 	}
-
-	var task db.Task
-	err = h.dbi.SelectOne(&task,
-		`SELECT * FROM tasks WHERE id = $1 AND username = $2`,
-		id, currentUser(r),
-	)
-	if err == sql.ErrNoRows {
+	if task.IsClosed() {
 		http.Error(w, "Not found", http.StatusNotFound)
 		return nil
 	}
-	if respondwith.ErrorText(w, err) {
-		return nil
-	}
 
 	editTaskURL := fmt.Sprintf("/tasks/%d/edit", task.ID)
 	if !task.IsClassified() && r.URL.Path != editTaskURL {
@@ -111,24 +151,37 @@ func (h *handler) FindTaskFromRequest(w http.ResponseWriter, r *http.Request) *d
 		return nil
 	}
 
-	return &task
+	return task
+}
+
+//FindAnyTaskFromRequest is like FindTaskFromRequest, but also finds closed
+//tasks, and does not redirect to classification for unclassified tasks.
+func (h *handler) FindAnyTaskFromRequest(w http.ResponseWriter, r *http.Request) *db.Task {
+	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if respondwith.ErrorText(w, err) {
+		return nil
+	}
+
+	task, err := h.storage.FindTask(currentUser(r), id)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return nil
+	}
+	if respondwith.ErrorText(w, err) {
+		return nil
+	}
+	return task
 }
 
 func (h *handler) FindTaskLocations(task db.Task) (map[int64]bool, error) {
-	rows, err := h.dbi.Query(`SELECT location_id FROM task_locations WHERE task_id = $1`, task.ID)
+	locationIDs, err := h.storage.FindTaskLocations(task)
 	if err != nil {
 		return nil, err
 	}
 
-	result := make(map[int64]bool)
-	for rows.Next() {
-		var id int64
-		err := rows.Scan(&id)
-		if err != nil {
-			return nil, err
-		}
+	result := make(map[int64]bool, len(locationIDs))
+	for _, id := range locationIDs {
 		result[id] = true
 	}
-
-	return result, rows.Close()
+	return result, nil
 }
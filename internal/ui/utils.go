@@ -24,6 +24,7 @@ import (
 	"net/http"
 	"regexp"
 	"strconv"
+	"strings"
 
 	"github.com/majewsky/alltag/build/bindata"
 	"github.com/majewsky/alltag/internal/date"
@@ -42,8 +43,23 @@ func dateGreaterThan(lhs, rhs date.Date) bool {
 	return lhs.After(rhs)
 }
 
+//paragraphs splits multi-line text (e.g. task notes) at empty lines.
+func paragraphs(text string) []string {
+	var result []string
+	for _, paragraph := range paragraphRx.Split(text, -1) {
+		paragraph = strings.TrimSpace(paragraph)
+		if paragraph != "" {
+			result = append(result, paragraph)
+		}
+	}
+	return result
+}
+
+var paragraphRx = regexp.MustCompile(`\n\s*\n`)
+
 var tmplFuncMap = template.FuncMap{
 	"dateGreaterThan": dateGreaterThan,
+	"paragraphs":      paragraphs,
 }
 
 //ensure that goimports does not replace html/template with text/template
@@ -85,12 +101,28 @@ var tPage = tmpl("page.html", `<!DOCTYPE html>
 			</div>
 		</nav>
 		<main class="{{if .ContainsBodyText}}contains-body-text{{end}}">{{ .Content }}</main>
-		<footer>
-			<p>
-				Admin:
-				<a href="/locations">Manage locations</a>
-			</p>
-		</footer>
+		{{- if not .HideFooter }}
+			<footer>
+				<form method="POST" action="/logout"><p>
+					Admin:
+					<a href="/tasks">Manage tasks</a>
+					·
+					<a href="/tasks/import">Import/export</a>
+					·
+					<a href="/locations">Manage locations</a>
+					·
+					<a href="/done">Done log</a>
+					·
+					<a href="/settings/digest">Daily digest</a>
+					·
+					<a href="/settings/tokens">API tokens</a>
+					·
+					<a href="/settings/webhooks">Webhooks</a>
+					·
+					<button type="submit">Log out</button>
+				</p></form>
+			</footer>
+		{{- end }}
 		<script src="/static/{{ index .Assets "alltag.js" }}"></script>
 	</body>
 </html>`)
@@ -122,6 +154,7 @@ type Page struct {
 	Title            string
 	Navigation       []BreadcrumbItem
 	ContainsBodyText bool
+	HideFooter       bool //for pages that are shown without authentication
 	Template         *template.Template
 	Data             interface{}
 }
@@ -142,9 +175,10 @@ func (p Page) WriteTo(w http.ResponseWriter) {
 		Title            string
 		Navigation       []BreadcrumbItem
 		ContainsBodyText bool
+		HideFooter       bool
 		Content          template.HTML
 		Assets           map[string]string
-	}{p.Title, navWithInitial, p.ContainsBodyText, template.HTML(buf.String()), assetPaths}
+	}{p.Title, navWithInitial, p.ContainsBodyText, p.HideFooter, template.HTML(buf.String()), assetPaths}
 
 	buf.Reset()
 	err = tPage.Execute(&buf, pageData)
@@ -0,0 +1,274 @@
+/*******************************************************************************
+*
+* Copyright 2019 Stefan Majewsky <majewsky@gmx.net>
+*
+* This program is free software: you can redistribute it and/or modify it under
+* the terms of the GNU General Public License as published by the Free Software
+* Foundation, either version 3 of the License, or (at your option) any later
+* version.
+*
+* This program is distributed in the hope that it will be useful, but WITHOUT ANY
+* WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+* A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License along with
+* this program. If not, see <http://www.gnu.org/licenses/>.
+*
+*******************************************************************************/
+
+package ui
+
+import (
+	"database/sql"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/majewsky/alltag/internal/db"
+	"github.com/majewsky/alltag/internal/webhooks"
+	"github.com/sapcc/go-bits/respondwith"
+)
+
+//how many deliveries are shown on the page of a webhook
+const webhookDeliveryLogLength = 50
+
+var tListWebhooks = tmpl("list-webhooks.html", `
+	<p class="flash flash-primary">
+		Webhooks receive a POST request with a JSON payload whenever one of your tasks is created, classified, closed,
+		respawned or becomes overdue. Each request is signed with the secret of the webhook, so that the receiver can
+		verify that it comes from Alltag.
+	</p>
+	<div class="table-container">
+		<table class="table responsive has-hover-highlight">
+			<thead>
+				<tr>
+					<th class="grow-column">URL</th>
+					<th>Created at</th>
+					<th class="actions">Actions</th>
+				</tr>
+			</thead>
+			<tbody>
+				{{- if . -}}
+					{{- range . -}}
+						<tr>
+							<td class="grow-column" data-label="URL"><a href="/settings/webhooks/{{ .ID }}">{{.URL}}</a></td>
+							<td class="nobr-column" data-label="Created at">{{.CreatedAt.Format "2006-01-02 15:04"}}</td>
+							<td class="actions"><a href="/settings/webhooks/{{ .ID }}/delete">Delete</a></td>
+						</tr>
+					{{- end -}}
+				{{- else -}}
+					<tr>
+						<td colspan="3" class="text-muted text-center">No entries</td>
+					</tr>
+				{{- end -}}
+			</tbody>
+		</table>
+	</div>
+	<form method="POST" action="/settings/webhooks">
+		<div class="form-row">
+			<label for="url">URL</label>
+			<input required type="url" name="url" id="url" placeholder="https://example.com/alltag-hook" />
+		</div>
+		<div class="button-row">
+			<button type="submit">Add webhook</button>
+		</div>
+	</form>
+`)
+
+func (h *handler) ListWebhooks(w http.ResponseWriter, r *http.Request) {
+	webhooks, err := h.storage.ListWebhooks(currentUser(r))
+	if respondwith.ErrorText(w, err) {
+		return
+	}
+
+	Page{
+		Title: "Manage webhooks",
+		Navigation: []BreadcrumbItem{
+			{URL: "/settings/webhooks", Label: "Webhooks", Current: true},
+		},
+		Template: tListWebhooks,
+		Data:     webhooks,
+	}.WriteTo(w)
+}
+
+func (h *handler) CreateWebhook(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if respondwith.ErrorText(w, err) {
+		return
+	}
+
+	webhookURL := r.PostForm.Get("url")
+	parsed, err := url.Parse(webhookURL)
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+		msg := fmt.Sprintf("invalid URL: %q (only http and https are supported)", webhookURL)
+		http.Error(w, msg, http.StatusBadRequest)
+		return
+	}
+	//hostnames are checked again when connecting, since they could resolve to
+	//a different address by then
+	ip := net.ParseIP(parsed.Hostname())
+	if strings.EqualFold(parsed.Hostname(), "localhost") || (ip != nil && !webhooks.IsPublicAddress(ip)) {
+		msg := fmt.Sprintf("invalid URL: %q (webhooks can only be delivered to public addresses)", webhookURL)
+		http.Error(w, msg, http.StatusBadRequest)
+		return
+	}
+	secret, err := db.NewWebhookSecret()
+	if respondwith.ErrorText(w, err) {
+		return
+	}
+
+	webhook := db.Webhook{
+		UserName:  currentUser(r),
+		URL:       webhookURL,
+		Secret:    secret,
+		CreatedAt: time.Now().UTC(),
+	}
+	err = h.storage.SaveWebhook(&webhook)
+	if respondwith.ErrorText(w, err) {
+		return
+	}
+	http.Redirect(w, r, fmt.Sprintf("/settings/webhooks/%d", webhook.ID), http.StatusSeeOther)
+}
+
+func (h *handler) FindWebhookFromRequest(w http.ResponseWriter, r *http.Request) *db.Webhook {
+	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if respondwith.ErrorText(w, err) {
+		return nil
+	}
+	webhook, err := h.storage.FindWebhook(currentUser(r), id)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return nil
+	}
+	if respondwith.ErrorText(w, err) {
+		return nil
+	}
+	return webhook
+}
+
+var tShowWebhook = tmpl("show-webhook.html", `
+	<div class="form-row">
+		<label>URL</label>
+		<input type="text" value="{{.Webhook.URL}}" readonly />
+	</div>
+	<div class="form-row">
+		<label>Secret</label>
+		<input type="text" value="{{.Webhook.Secret}}" readonly />
+	</div>
+	<p>
+		Each request carries the headers <code>X-Alltag-Timestamp</code> (in Unix seconds) and
+		<code>X-Alltag-Signature: sha256=...</code> with the hex-encoded HMAC-SHA256 of the timestamp, a dot and the
+		request body, using the secret above as key. Failed deliveries are retried with increasing delays for about an
+		hour.
+	</p>
+	<p><strong>Recent deliveries</strong></p>
+	<div class="table-container">
+		<table class="table responsive has-hover-highlight">
+			<thead>
+				<tr>
+					<th>Created at</th>
+					<th>Event</th>
+					<th>Status</th>
+					<th>Attempts</th>
+					<th class="grow-column">Last response</th>
+				</tr>
+			</thead>
+			<tbody>
+				{{- if .Deliveries -}}
+					{{- range .Deliveries -}}
+						<tr>
+							<td class="nobr-column" data-label="Created at">{{.CreatedAt.Local.Format "2006-01-02 15:04"}}</td>
+							<td class="nobr-column" data-label="Event">{{.Event}}</td>
+							<td class="nobr-column" data-label="Status">
+								{{- .Status -}}
+								{{- if .NextAttemptAt }} <span class="text-muted">(next attempt at {{.NextAttemptAt.Local.Format "15:04"}})</span>{{ end -}}
+							</td>
+							<td class="nobr-column" data-label="Attempts">{{.Attempts}}</td>
+							<td class="grow-column" data-label="Last response">
+								{{- if .LastError }}{{.LastError}}
+								{{- else if .LastResponseStatus }}HTTP {{.LastResponseStatus}}
+								{{- else }}<span class="text-muted">None</span>{{ end -}}
+							</td>
+						</tr>
+					{{- end -}}
+				{{- else -}}
+					<tr>
+						<td colspan="5" class="text-muted text-center">No entries</td>
+					</tr>
+				{{- end -}}
+			</tbody>
+		</table>
+	</div>
+	<div class="button-row">
+		<a class="button" href="/settings/webhooks">Back to webhooks</a>
+	</div>
+`)
+
+func (h *handler) ShowWebhook(w http.ResponseWriter, r *http.Request) {
+	webhook := h.FindWebhookFromRequest(w, r)
+	if webhook == nil {
+		return
+	}
+	deliveries, err := h.storage.ListWebhookDeliveries(*webhook, webhookDeliveryLogLength)
+	if respondwith.ErrorText(w, err) {
+		return
+	}
+
+	Page{
+		Title: "Webhook",
+		Navigation: []BreadcrumbItem{
+			{URL: "/settings/webhooks", Label: "Webhooks"},
+			{URL: r.URL.Path, Label: fmt.Sprintf("#%d", webhook.ID), Current: true},
+		},
+		ContainsBodyText: true,
+		Template:         tShowWebhook,
+		Data: struct {
+			Webhook    *db.Webhook
+			Deliveries []db.WebhookDelivery
+		}{webhook, deliveries},
+	}.WriteTo(w)
+}
+
+var tDeleteWebhook = tmpl("delete-webhook.html", `
+	<form class="contains-body-text" method="POST" action="/settings/webhooks/{{.ID}}/delete">
+		<p>Really delete the webhook for <strong>{{.URL}}</strong>? Pending deliveries will be discarded.</p>
+		<div class="button-row">
+			<button type="submit">Delete permanently</button>
+		</div>
+	</form>
+`)
+
+func (h *handler) AskDeleteWebhook(w http.ResponseWriter, r *http.Request) {
+	webhook := h.FindWebhookFromRequest(w, r)
+	if webhook == nil {
+		return
+	}
+
+	Page{
+		Title: "Delete webhook",
+		Navigation: []BreadcrumbItem{
+			{URL: "/settings/webhooks", Label: "Webhooks"},
+			{URL: r.URL.Path, Label: "Delete", Current: true},
+		},
+		Template: tDeleteWebhook,
+		Data:     webhook,
+	}.WriteTo(w)
+}
+
+func (h *handler) DeleteWebhook(w http.ResponseWriter, r *http.Request) {
+	webhook := h.FindWebhookFromRequest(w, r)
+	if webhook == nil {
+		return
+	}
+
+	err := h.storage.DeleteWebhook(webhook)
+	if respondwith.ErrorText(w, err) {
+		return
+	}
+	http.Redirect(w, r, "/settings/webhooks", http.StatusSeeOther)
+}
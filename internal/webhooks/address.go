@@ -0,0 +1,96 @@
+/*******************************************************************************
+*
+* Copyright 2019 Stefan Majewsky <majewsky@gmx.net>
+*
+* This program is free software: you can redistribute it and/or modify it under
+* the terms of the GNU General Public License as published by the Free Software
+* Foundation, either version 3 of the License, or (at your option) any later
+* version.
+*
+* This program is distributed in the hope that it will be useful, but WITHOUT ANY
+* WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+* A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License along with
+* this program. If not, see <http://www.gnu.org/licenses/>.
+*
+*******************************************************************************/
+
+package webhooks
+
+import (
+	"fmt"
+	"net"
+	"syscall"
+)
+
+//nonPublicNetworks contains all address ranges that are not reachable on the
+//public internet (loopback, private networks, link-local addresses including
+//the cloud metadata endpoint at 169.254.169.254, etc.). Webhooks must not be
+//delivered into these, or else users could use the delivery log to probe the
+//network that Alltag runs in.
+var nonPublicNetworks = mustParseCIDRs(
+	"0.0.0.0/8",
+	"10.0.0.0/8",
+	"100.64.0.0/10",
+	"127.0.0.0/8",
+	"169.254.0.0/16",
+	"172.16.0.0/12",
+	"192.0.0.0/24",
+	"192.0.2.0/24",
+	"192.168.0.0/16",
+	"198.18.0.0/15",
+	"198.51.100.0/24",
+	"203.0.113.0/24",
+	"224.0.0.0/4",
+	"240.0.0.0/4",
+	"::/128",
+	"::1/128",
+	"64:ff9b::/96",
+	"100::/64",
+	"2001:db8::/32",
+	"fc00::/7",
+	"fe80::/10",
+	"ff00::/8",
+)
+
+func mustParseCIDRs(cidrs ...string) []*net.IPNet {
+	result := make([]*net.IPNet, len(cidrs))
+	for idx, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err.Error())
+		}
+		result[idx] = network
+	}
+	return result
+}
+
+//IsPublicAddress returns whether webhooks may be delivered to the given IP.
+func IsPublicAddress(ip net.IP) bool {
+	//IPv4-mapped IPv6 addresses are checked like the IPv4 addresses they contain
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	for _, network := range nonPublicNetworks {
+		if network.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+//refusePrivateAddresses is used as net.Dialer.Control for webhook deliveries.
+//It runs after name resolution, so it also catches hostnames that resolve to
+//private addresses (including DNS rebinding).
+func refusePrivateAddresses(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || !IsPublicAddress(ip) {
+		return fmt.Errorf("refusing to connect to %s: webhooks can only be delivered to public addresses", host)
+	}
+	return nil
+}
@@ -0,0 +1,244 @@
+/*******************************************************************************
+*
+* Copyright 2019 Stefan Majewsky <majewsky@gmx.net>
+*
+* This program is free software: you can redistribute it and/or modify it under
+* the terms of the GNU General Public License as published by the Free Software
+* Foundation, either version 3 of the License, or (at your option) any later
+* version.
+*
+* This program is distributed in the hope that it will be useful, but WITHOUT ANY
+* WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+* A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License along with
+* this program. If not, see <http://www.gnu.org/licenses/>.
+*
+*******************************************************************************/
+
+//Package webhooks delivers the webhook events that are queued by
+//db.EmitTaskEvent, and emits the "task.overdue" events that are not caused by
+//any user action.
+package webhooks
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/majewsky/alltag/internal/date"
+	"github.com/majewsky/alltag/internal/db"
+	"github.com/sapcc/go-bits/logg"
+)
+
+const (
+	//how often the Dispatcher looks for pending deliveries and overdue tasks
+	checkInterval = 30 * time.Second
+	//how long the receiver may take to respond
+	requestTimeout = 10 * time.Second
+	//how often a delivery is attempted before it is considered failed; with
+	//the exponential backoff from retryDelay, the last attempt happens about an
+	//hour after the first one
+	maxAttempts = 7
+	//how long finished deliveries are kept in the delivery log
+	deliveryLogRetention = 30 * 24 * time.Hour
+)
+
+//retryDelay returns how long to wait before the next attempt when the given
+//number of attempts has failed.
+func retryDelay(attempts int) time.Duration {
+	return time.Minute << uint(attempts-1)
+}
+
+//Dispatcher delivers webhook events in the background.
+type Dispatcher struct {
+	storage db.Storage
+	client  *http.Client
+}
+
+//NewDispatcher prepares a Dispatcher.
+func NewDispatcher(storage db.Storage) *Dispatcher {
+	dialer := &net.Dialer{
+		Timeout: requestTimeout,
+		Control: refusePrivateAddresses,
+	}
+	return &Dispatcher{
+		storage: storage,
+		client: &http.Client{
+			//no proxy is used, since the address check would only see the proxy
+			Transport: &http.Transport{
+				DialContext:         dialer.DialContext,
+				TLSHandshakeTimeout: requestTimeout,
+			},
+			//redirects are not followed (a redirect response counts as a failed
+			//delivery), so that receivers cannot bounce us to other targets
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+			Timeout: requestTimeout,
+		},
+	}
+}
+
+//Run is the main loop of the Dispatcher. Every checkInterval, it emits overdue
+//events, attempts all pending deliveries, and prunes old entries from the
+//delivery log.
+func (d *Dispatcher) Run() {
+	for {
+		now := time.Now()
+		d.EmitOverdueEvents(now)
+		d.DeliverPending(now)
+		err := d.storage.PruneWebhookDeliveries(now.Add(-deliveryLogRetention))
+		if err != nil {
+			logg.Error("cannot prune webhook delivery log: %s", err.Error())
+		}
+		time.Sleep(checkInterval)
+	}
+}
+
+//EmitOverdueEvents emits the "task.overdue" event for all tasks whose due
+//date has passed at the given time, unless the event has already been emitted
+//for the same due date. Only users with webhooks are considered. Errors are
+//logged.
+func (d *Dispatcher) EmitOverdueEvents(now time.Time) {
+	userNames, err := d.storage.ListWebhookUserNames()
+	if err != nil {
+		logg.Error("cannot list users with webhooks: %s", err.Error())
+		return
+	}
+
+	today := date.FromTime(now)
+	for _, userName := range userNames {
+		tasks, err := d.storage.ListOpenTasks(userName)
+		if err != nil {
+			logg.Error("cannot list tasks of user %q: %s", userName, err.Error())
+			continue
+		}
+		for _, task := range tasks {
+			if !task.IsClassified() || !task.DueAt.Before(today) {
+				continue
+			}
+			if task.OverdueEventFor != nil && *task.OverdueEventFor == task.DueAt {
+				continue
+			}
+			//only the marker is written, so that concurrent changes to the task
+			//(e.g. closing it) are not reverted; when such a change got in first,
+			//the event is skipped
+			task := task
+			err := d.storage.Transaction(func(tx db.Storage) error {
+				marked, err := tx.MarkOverdueEventEmitted(&task)
+				if err != nil || !marked {
+					return err
+				}
+				return tx.EmitTaskEvent(db.WebhookEventTaskOverdue, task)
+			})
+			if err != nil {
+				logg.Error("cannot emit overdue event for task %d: %s", task.ID, err.Error())
+			}
+		}
+	}
+}
+
+//DeliverPending attempts all deliveries that are due at the given time.
+//Errors are recorded in the delivery log.
+func (d *Dispatcher) DeliverPending(now time.Time) {
+	deliveries, err := d.storage.ListPendingWebhookDeliveries(now)
+	if err != nil {
+		logg.Error("cannot list pending webhook deliveries: %s", err.Error())
+		return
+	}
+
+	for _, delivery := range deliveries {
+		webhook, err := d.storage.FindWebhook(delivery.UserName, delivery.WebhookID)
+		if err != nil {
+			logg.Error("cannot find webhook %d: %s", delivery.WebhookID, err.Error())
+			continue
+		}
+
+		delivery := delivery
+		d.attempt(*webhook, &delivery, now)
+		err = d.storage.SaveWebhookDelivery(&delivery)
+		if err != nil {
+			logg.Error("cannot update webhook delivery %d: %s", delivery.ID, err.Error())
+		}
+	}
+}
+
+//attempt sends the given delivery to the given webhook, and records the
+//outcome in the delivery.
+func (d *Dispatcher) attempt(webhook db.Webhook, delivery *db.WebhookDelivery, now time.Time) {
+	attemptedAt := now.UTC()
+	delivery.Attempts++
+	delivery.LastAttemptAt = &attemptedAt
+	delivery.LastResponseStatus = nil
+	delivery.LastError = ""
+
+	status, err := d.send(webhook, *delivery)
+	if status != 0 {
+		delivery.LastResponseStatus = &status
+	}
+	if err == nil {
+		delivery.Status = db.WebhookDeliverySucceeded
+		delivery.NextAttemptAt = nil
+		return
+	}
+
+	delivery.LastError = err.Error()
+	if delivery.Attempts >= maxAttempts {
+		delivery.Status = db.WebhookDeliveryFailed
+		delivery.NextAttemptAt = nil
+	} else {
+		nextAttemptAt := attemptedAt.Add(retryDelay(delivery.Attempts))
+		delivery.NextAttemptAt = &nextAttemptAt
+	}
+}
+
+//send performs the HTTP request for a delivery. It returns the response status
+//(or 0 if there was no response), and an error unless the status was 2xx.
+func (d *Dispatcher) send(webhook db.Webhook, delivery db.WebhookDelivery) (int, error) {
+	body := []byte(delivery.Payload)
+	req, err := http.NewRequest("POST", webhook.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "Alltag-Webhook")
+	req.Header.Set("X-Alltag-Event", string(delivery.Event))
+	req.Header.Set("X-Alltag-Delivery", strconv.FormatInt(delivery.ID, 10))
+	timestamp := time.Now().Unix()
+	req.Header.Set("X-Alltag-Timestamp", strconv.FormatInt(timestamp, 10))
+	req.Header.Set("X-Alltag-Signature", Sign(webhook.Secret, timestamp, body))
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	//read (part of) the body to allow reusing the connection
+	io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 1<<16))
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("receiver responded with %s", resp.Status)
+	}
+	return resp.StatusCode, nil
+}
+
+//Sign computes the value of the X-Alltag-Signature header for the given
+//payload: the hex-encoded HMAC-SHA256 of the timestamp from the
+//X-Alltag-Timestamp header, a dot and the request body, keyed with the
+//webhook's secret, prefixed with "sha256=". Since the timestamp is signed,
+//receivers can reject old deliveries that are replayed by an attacker.
+func Sign(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%d.", timestamp)
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
@@ -20,6 +20,9 @@ package main
 
 import (
 	"bytes"
+	"crypto/rand"
+	"errors"
+	"net"
 	"net/http"
 	"net/url"
 	"os"
@@ -27,39 +30,122 @@ import (
 	"regexp"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/majewsky/alltag/build/bindata"
+	"github.com/majewsky/alltag/internal/api"
 	"github.com/majewsky/alltag/internal/auth"
+	"github.com/majewsky/alltag/internal/caldav"
+	"github.com/majewsky/alltag/internal/client"
+	"github.com/majewsky/alltag/internal/date"
 	"github.com/majewsky/alltag/internal/db"
+	"github.com/majewsky/alltag/internal/digest"
+	"github.com/majewsky/alltag/internal/mailcapture"
+	"github.com/majewsky/alltag/internal/metrics"
 	"github.com/majewsky/alltag/internal/ui"
+	"github.com/majewsky/alltag/internal/webhooks"
 	_ "github.com/majewsky/xyrillian.css"
 	"github.com/sapcc/go-bits/logg"
+	"github.com/sapcc/go-bits/respondwith"
+	"gopkg.in/gorp.v2"
 )
 
-type loggDebug struct{}
-
-func (loggDebug) Printf(format string, values ...interface{}) {
-	logg.Debug(format, values...)
+//updateTaskMetrics recomputes the task gauges in the metrics.
+func updateTaskMetrics(dbi *gorp.DbMap) error {
+	counts, err := db.CountOpenTasks(dbi, date.FromTime(time.Now()))
+	if err != nil {
+		return err
+	}
+	metrics.OpenTasks.Reset()
+	metrics.UnclassifiedTasks.Reset()
+	metrics.OverdueTasks.Reset()
+	for _, c := range counts {
+		metrics.OpenTasks.Set(float64(c.Open), c.UserName)
+		metrics.UnclassifiedTasks.Set(float64(c.Unclassified), c.UserName)
+		metrics.OverdueTasks.Set(float64(c.Overdue), c.UserName)
+	}
+	return nil
 }
 
 func main() {
+	//when called with arguments, act as a command-line client for the API
+	if len(os.Args) > 1 {
+		os.Exit(client.Run(os.Args[1:]))
+	}
+
 	dbi, err := db.Init(mustGetenv("ALLTAG_DB_URI"))
 	must(err)
 
 	logg.ShowDebug, _ = strconv.ParseBool(os.Getenv("ALLTAG_DEBUG"))
 	if logg.ShowDebug {
-		dbi.TraceOn("SQL: ", loggDebug{})
+		db.TraceQueries(dbi)
+	}
+
+	//mail capture is only available when a maildir is configured
+	var mailCaptureAddress string
+	if maildir := os.Getenv("ALLTAG_MAIL_CAPTURE_MAILDIR"); maildir != "" {
+		mailCaptureAddress = mustGetenv("ALLTAG_MAIL_CAPTURE_ADDRESS")
+		capturer, err := mailcapture.NewCapturer(db.NewStorage(dbi), mailcapture.Config{
+			Maildir: maildir,
+			Address: mailCaptureAddress,
+		})
+		must(err)
+		go capturer.Run()
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/", ui.NewHandler(db.NewStorage(dbi), mailCaptureAddress))
+	mux.Handle("/api/", api.NewHandler(db.NewStorage(dbi)))
+	mux.Handle("/dav/", caldav.NewHandler(db.NewStorage(dbi)))
+
+	trustedProxies := parseNetworks("ALLTAG_PROXY_TRUSTED_CIDRS")
+	driver := initAuthDriver(trustedProxies)
+	throttler := auth.NewThrottler(driver, auth.ThrottleConfig{
+		Allowlist:      parseNetworks("ALLTAG_LOGIN_THROTTLE_ALLOWLIST"),
+		TrustedProxies: trustedProxies,
+	})
+	sessions := initSessions(driver)
+
+	//the daily digest is only available when an SMTP server is configured
+	if smtpServer := os.Getenv("ALLTAG_SMTP_SERVER"); smtpServer != "" {
+		scheduler, err := digest.NewScheduler(db.NewStorage(dbi), digest.Config{
+			SMTPServer:   smtpServer,
+			SMTPUserName: os.Getenv("ALLTAG_SMTP_USERNAME"),
+			SMTPPassword: os.Getenv("ALLTAG_SMTP_PASSWORD"),
+			Sender:       mustGetenv("ALLTAG_SMTP_SENDER"),
+		}, driver)
+		must(err)
+		go scheduler.Run()
 	}
+	go webhooks.NewDispatcher(db.NewStorage(dbi)).Run()
 
-	handler := ui.NewHandler(dbi)
-	handler = authenticateUsers(handler)
+	var handler http.Handler = mux
+	handler = authenticateUsers(handler, dbi, throttler, sessions)
 	handler = addSecurityHeaders(handler)
 	http.Handle("/", handler)
 
+	//the login page is obviously not protected by authentication
+	loginHandler := addSecurityHeaders(ui.NewLoginHandler(throttler, sessions))
+	http.Handle("/login", loginHandler)
+	http.Handle("/login/", loginHandler)
+	http.Handle("/logout", loginHandler)
+
+	//the metrics endpoint is only available when a token for it is configured,
+	//and it is protected by that token instead of user authentication, so that
+	//Prometheus does not need an account in Alltag
+	if metricsToken := os.Getenv("ALLTAG_METRICS_TOKEN"); metricsToken != "" {
+		http.Handle("/metrics", metrics.NewHandler(metricsToken, func() error {
+			return updateTaskMetrics(dbi)
+		}))
+	}
+
 	//the static files are not protected by authentication - otherwise the
 	//browser cannot load the JS source maps
 	http.HandleFunc("/static/", serveStaticFiles)
 
+	//CalDAV clients look here to discover the CalDAV endpoint (RFC 6764)
+	http.Handle("/.well-known/caldav", http.RedirectHandler("/dav/", http.StatusMovedPermanently))
+
 	listenAddress := getenvOrDefault("ALLTAG_LISTEN_ADDRESS", "127.0.0.1:8080")
 	logg.Info("listening on %s...", listenAddress)
 	must(http.ListenAndServe(listenAddress, nil))
@@ -154,37 +240,224 @@ func serveStaticFiles(w http.ResponseWriter, r *http.Request) {
 ////////////////////////////////////////////////////////////////////////////////
 // HTTP middlewares
 
-func authenticateUsers(h http.Handler) http.Handler {
-	ldapServerURL, err := url.Parse(mustGetenv("ALLTAG_LDAP_URI"))
-	if err != nil {
-		logg.Fatal("cannot parse ALLTAG_LDAP_URI: %s", err.Error())
+//checkAPIToken looks up an API token that was given for an API or CalDAV
+//request. If the token exists, but cannot be used for this request, an error
+//response is written and false is returned. If the token does not exist, nil
+//is returned.
+func checkAPIToken(w http.ResponseWriter, r *http.Request, dbi gorp.SqlExecutor, token string) (*db.APIToken, bool) {
+	apiToken, err := db.FindAPIToken(dbi, token)
+	if respondwith.ErrorText(w, err) {
+		return nil, false
 	}
+	var forbiddenReason string
+	switch {
+	case apiToken == nil:
+		return nil, true
+	case apiToken.Scope == db.APITokenScopeCalendarFeed:
+		forbiddenReason = "this API token can only be used for the calendar feed"
+	case apiToken.Scope == db.APITokenScopeMailCapture:
+		forbiddenReason = "this API token can only be used for capturing tasks by email"
+	case !apiToken.Scope.Permits(r.Method):
+		forbiddenReason = "this API token is read-only"
+	default:
+		return apiToken, true
+	}
+	metrics.AuthAttempts.Inc("api-token", "forbidden")
+	http.Error(w, "Forbidden: "+forbiddenReason, http.StatusForbidden)
+	return nil, false
+}
 
-	driver, err := auth.NewLDAPDriver(auth.LDAPConfig{
-		ServerURL:    *ldapServerURL,
-		BindDN:       mustGetenv("ALLTAG_LDAP_BIND_DN"),
-		BindPassword: mustGetenv("ALLTAG_LDAP_BIND_PASSWORD"),
-		SearchBaseDN: mustGetenv("ALLTAG_LDAP_SEARCH_BASE_DN"),
-		SearchFilter: getenvOrDefault("ALLTAG_LDAP_SEARCH_FILTER", "(uid=%s)"),
-	})
-	must(err)
-
+func authenticateUsers(h http.Handler, dbi *gorp.DbMap, throttler *auth.Throttler, sessions *auth.Sessions) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		userName, password, ok := r.BasicAuth()
-		if ok {
-			ok = driver.CheckLogin(userName, password)
+		//calendar apps cannot authenticate at all, so calendar feeds carry an API
+		//token in the URL instead (and only that token is accepted for them)
+		if strings.HasPrefix(r.URL.Path, "/feed/") {
+			token := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/feed/"), ".ics")
+			apiToken, err := db.FindAPIToken(dbi, token)
+			if respondwith.ErrorText(w, err) {
+				return
+			}
+			if apiToken == nil || apiToken.Scope != db.APITokenScopeCalendarFeed {
+				http.Error(w, "Not found", http.StatusNotFound)
+				return
+			}
+			r.Header.Set("X-Alltag-Username", apiToken.UserName)
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		//CalDAV clients authenticate like API clients
+		isAPIRequest := strings.HasPrefix(r.URL.Path, "/api/") || strings.HasPrefix(r.URL.Path, "/dav/")
+
+		//some drivers (e.g. the proxy driver) identify the user from the request
+		//itself
+		var (
+			userName string
+			ok       bool
+		)
+		requestAuthenticator, isRequestAuthenticator := throttler.Driver().(auth.RequestAuthenticator)
+		if isRequestAuthenticator {
+			userName, ok = requestAuthenticator.AuthenticateRequest(r)
+			auth.RecordAuthAttempt(throttler.Driver(), ok, nil)
 		}
 
-		if ok {
+		//browsers get a session cookie from the login form, other clients use
+		//HTTP Basic auth or an API token on each request
+		if !ok {
+			userName, ok = sessions.Verify(w, r)
+		}
+		if !ok && isAPIRequest && strings.HasPrefix(r.Header.Get("Authorization"), "Bearer ") {
+			//API tokens are only accepted for the API (in particular, they cannot
+			//be used to create new API tokens in the UI)
+			apiToken, proceed := checkAPIToken(w, r, dbi, strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer "))
+			if !proceed {
+				return
+			}
+			if apiToken == nil {
+				metrics.AuthAttempts.Inc("api-token", "failure")
+			} else {
+				metrics.AuthAttempts.Inc("api-token", "success")
+				userName, ok = apiToken.UserName, true
+			}
+		}
+		if !ok {
+			var password string
+			userName, password, ok = r.BasicAuth()
+			isPassword := true
+			if ok && isAPIRequest && db.IsAPIToken(password) {
+				//many CalDAV clients only support Basic auth, so API tokens are also
+				//accepted in place of the password (this is the only way to use
+				//CalDAV with auth drivers that do not check passwords); when there
+				//is no such token, it might still be a password
+				apiToken, proceed := checkAPIToken(w, r, dbi, password)
+				if !proceed {
+					return
+				}
+				isPassword = apiToken == nil || apiToken.UserName != userName
+				if !isPassword {
+					metrics.AuthAttempts.Inc("api-token", "success")
+				}
+			}
+			if ok && isPassword {
+				var err error
+				ok, err = throttler.CheckLogin(r, userName, password)
+				var throttledErr auth.ThrottledError
+				switch {
+				case errors.As(err, &throttledErr):
+					w.Header().Set("Retry-After", strconv.Itoa(int(throttledErr.RetryAfter.Seconds()+1)))
+					http.Error(w, throttledErr.Error(), http.StatusTooManyRequests)
+					return
+				case err == auth.ErrForbidden:
+					http.Error(w, "Forbidden: you are not allowed to use Alltag", http.StatusForbidden)
+					return
+				case err != nil:
+					logg.Error("cannot check credentials of user %q: %s", userName, err.Error())
+					http.Error(w, "Login service unavailable", http.StatusServiceUnavailable)
+					return
+				}
+			}
+		}
+
+		switch {
+		case ok:
 			r.Header.Set("X-Alltag-Username", userName)
 			h.ServeHTTP(w, r)
-		} else {
+		case isAPIRequest:
 			w.Header().Set("Www-Authenticate", `Basic realm="Alltag", charset="UTF-8"`)
 			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		case isRequestAuthenticator:
+			//the login form is useless when the driver does not check passwords
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		default:
+			//we do not use the browser's Basic auth dialog for the UI since it does
+			//not allow logging out
+			http.Redirect(w, r, "/login?next="+url.QueryEscape(r.URL.RequestURI()), http.StatusSeeOther)
 		}
 	})
 }
 
+func initSessions(driver auth.Driver) *auth.Sessions {
+	secret := []byte(os.Getenv("ALLTAG_SESSION_SECRET"))
+	if len(secret) == 0 {
+		secret = make([]byte, 32)
+		_, err := rand.Read(secret)
+		must(err)
+		logg.Info("ALLTAG_SESSION_SECRET is not set: sessions will be invalidated when Alltag is restarted")
+	}
+
+	lifetime, err := time.ParseDuration(getenvOrDefault("ALLTAG_SESSION_LIFETIME", "168h"))
+	if err != nil {
+		logg.Fatal("cannot parse ALLTAG_SESSION_LIFETIME: %s", err.Error())
+	}
+	maxAge, err := time.ParseDuration(getenvOrDefault("ALLTAG_SESSION_MAX_AGE", "720h"))
+	if err != nil {
+		logg.Fatal("cannot parse ALLTAG_SESSION_MAX_AGE: %s", err.Error())
+	}
+	return auth.NewSessions(driver, auth.SessionConfig{
+		Secret:   secret,
+		Lifetime: lifetime,
+		MaxAge:   maxAge,
+	})
+}
+
+func initAuthDriver(trustedProxies []*net.IPNet) auth.Driver {
+	switch driverName := getenvOrDefault("ALLTAG_AUTH_DRIVER", "ldap"); driverName {
+	case "ldap":
+		ldapServerURL, err := url.Parse(mustGetenv("ALLTAG_LDAP_URI"))
+		if err != nil {
+			logg.Fatal("cannot parse ALLTAG_LDAP_URI: %s", err.Error())
+		}
+		poolSize, err := strconv.Atoi(getenvOrDefault("ALLTAG_LDAP_POOL_SIZE", "4"))
+		if err != nil || poolSize < 1 {
+			logg.Fatal("invalid value for ALLTAG_LDAP_POOL_SIZE: %q", os.Getenv("ALLTAG_LDAP_POOL_SIZE"))
+		}
+
+		driver, err := auth.NewLDAPDriver(auth.LDAPConfig{
+			ServerURL:    *ldapServerURL,
+			BindDN:       mustGetenv("ALLTAG_LDAP_BIND_DN"),
+			BindPassword: mustGetenv("ALLTAG_LDAP_BIND_PASSWORD"),
+			SearchBaseDN: mustGetenv("ALLTAG_LDAP_SEARCH_BASE_DN"),
+			SearchFilter: getenvOrDefault("ALLTAG_LDAP_SEARCH_FILTER", "(uid=%s)"),
+			PoolSize:     poolSize,
+			//optional group-based authorization
+			RequiredGroupDN:      os.Getenv("ALLTAG_LDAP_REQUIRED_GROUP_DN"),
+			GroupMemberAttribute: getenvOrDefault("ALLTAG_LDAP_GROUP_MEMBER_ATTRIBUTE", "memberOf"),
+		})
+		must(err)
+		return driver
+
+	case "htpasswd":
+		driver, err := auth.NewHtpasswdDriver(auth.HtpasswdConfig{
+			Path: mustGetenv("ALLTAG_HTPASSWD_PATH"),
+		})
+		must(err)
+		return driver
+
+	case "proxy":
+		driver, err := auth.NewProxyDriver(auth.ProxyConfig{
+			Header:          getenvOrDefault("ALLTAG_PROXY_USER_HEADER", "X-Forwarded-User"),
+			TrustedNetworks: trustedProxies,
+		})
+		must(err)
+		return driver
+
+	case "oidc":
+		driver, err := auth.NewOIDCDriver(auth.OIDCConfig{
+			IssuerURL:     mustGetenv("ALLTAG_OIDC_ISSUER_URL"),
+			ClientID:      mustGetenv("ALLTAG_OIDC_CLIENT_ID"),
+			ClientSecret:  os.Getenv("ALLTAG_OIDC_CLIENT_SECRET"),
+			RedirectURL:   mustGetenv("ALLTAG_OIDC_REDIRECT_URL"),
+			UserNameClaim: getenvOrDefault("ALLTAG_OIDC_USERNAME_CLAIM", "preferred_username"),
+		})
+		must(err)
+		return driver
+
+	default:
+		logg.Fatal("unknown value for ALLTAG_AUTH_DRIVER: %q", driverName)
+		return nil
+	}
+}
+
 func addSecurityHeaders(h http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		hdr := w.Header()
@@ -214,6 +487,14 @@ func mustGetenv(key string) string {
 	return val
 }
 
+func parseNetworks(key string) []*net.IPNet {
+	networks, err := auth.ParseNetworks(os.Getenv(key))
+	if err != nil {
+		logg.Fatal("cannot parse %s: %s", key, err.Error())
+	}
+	return networks
+}
+
 func getenvOrDefault(key, defaultValue string) string {
 	val := os.Getenv(key)
 	if val == "" {